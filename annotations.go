@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Annotations of a pipeline or a job tuning the launcher for its builds. An invalid one is
+// logged and the launcher settings are used instead.
+const (
+	// TimeoutAnnotation is the build timeout in minutes
+	TimeoutAnnotation = "screwdriver.cd/timeout"
+	// CacheAnnotation lists the cached directories instead of SD_CACHE_DIRS, or is false to
+	// use no cache
+	CacheAnnotation = "screwdriver.cd/cache"
+	// CloneDepthAnnotation is the depth of the clone, 0 for the whole history
+	CloneDepthAnnotation = "screwdriver.cd/cloneDepth"
+	// ShellAnnotation is the shell of the steps, a path or a name like bash
+	ShellAnnotation = "screwdriver.cd/shell"
+)
+
+// annotatedTimeout is the build timeout in seconds the annotations set, def otherwise
+func annotatedTimeout(annotations screwdriver.Annotations, def int) int {
+	if _, ok := annotations[TimeoutAnnotation]; !ok {
+		return def
+	}
+	minutes, err := annotations.Int(TimeoutAnnotation, 0)
+	if err != nil {
+		log.Printf("WARN: %v", err)
+		return def
+	}
+	if minutes <= 0 {
+		log.Printf("WARN: Annotation %s is %d, must be a positive number of minutes", TimeoutAnnotation, minutes)
+		return def
+	}
+	return minutes * 60
+}
+
+// annotatedCacheDirs are the cached directories the annotations set, def otherwise
+func annotatedCacheDirs(annotations screwdriver.Annotations, def []string) []string {
+	if _, ok := annotations[CacheAnnotation]; !ok {
+		return def
+	}
+	if enabled, err := annotations.Bool(CacheAnnotation, true); err == nil {
+		if !enabled {
+			return nil
+		}
+		return def
+	}
+	dirs, err := annotations.Strings(CacheAnnotation)
+	if err != nil {
+		log.Printf("WARN: Annotation %s is %v, must be a list of directories or false", CacheAnnotation, annotations[CacheAnnotation])
+		return def
+	}
+	return dirs
+}
+
+// annotatedCloneDepth is the clone depth the annotations set, the one of the environment
+// otherwise
+func annotatedCloneDepth(annotations screwdriver.Annotations) (int, error) {
+	if _, ok := annotations[CloneDepthAnnotation]; !ok {
+		return cloneDepth()
+	}
+	depth, err := annotations.Int(CloneDepthAnnotation, 0)
+	if err != nil {
+		log.Printf("WARN: %v", err)
+		return cloneDepth()
+	}
+	if depth < 0 {
+		log.Printf("WARN: Annotation %s is %d, must be a number of commits or 0", CloneDepthAnnotation, depth)
+		return cloneDepth()
+	}
+	return depth, nil
+}
+
+// annotatedShell is the shell of the steps the annotations set, def otherwise
+func annotatedShell(annotations screwdriver.Annotations, def string) string {
+	shell, err := annotations.String(ShellAnnotation, "")
+	if err != nil {
+		log.Printf("WARN: %v", err)
+		return def
+	}
+	if shell == "" {
+		return def
+	}
+	if _, err := resolveShell(shell); err != nil {
+		log.Printf("WARN: Annotation %s: %v", ShellAnnotation, err)
+		return def
+	}
+	return shell
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestAnnotatedTimeout(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  int
+	}{
+		{nil, 5400},
+		{30.0, 1800},
+		{"120", 7200},
+		{0.0, 5400},
+		{"-5", 5400},
+		{"soon", 5400},
+	} {
+		annotations := screwdriver.Annotations{}
+		if test.value != nil {
+			annotations[TimeoutAnnotation] = test.value
+		}
+		if got := annotatedTimeout(annotations, 5400); got != test.want {
+			t.Errorf("annotatedTimeout(%v) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAnnotatedCacheDirs(t *testing.T) {
+	def := []string{"node_modules"}
+	for _, test := range []struct {
+		value interface{}
+		want  []string
+	}{
+		{nil, def},
+		{true, def},
+		{false, nil},
+		{"false", nil},
+		{[]interface{}{"vendor", ".m2"}, []string{"vendor", ".m2"}},
+		{"vendor, .m2", []string{"vendor", ".m2"}},
+		{3.0, def},
+	} {
+		annotations := screwdriver.Annotations{}
+		if test.value != nil {
+			annotations[CacheAnnotation] = test.value
+		}
+		if got := annotatedCacheDirs(annotations, def); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("annotatedCacheDirs(%v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAnnotatedCloneDepth(t *testing.T) {
+	os.Setenv("GIT_SHALLOW_CLONE_DEPTH", "5")
+	defer os.Unsetenv("GIT_SHALLOW_CLONE_DEPTH")
+	for _, test := range []struct {
+		value interface{}
+		want  int
+	}{
+		{nil, 5},
+		{0.0, 0},
+		{"200", 200},
+		{-1.0, 5},
+		{"deep", 5},
+	} {
+		annotations := screwdriver.Annotations{}
+		if test.value != nil {
+			annotations[CloneDepthAnnotation] = test.value
+		}
+		if got, err := annotatedCloneDepth(annotations); err != nil || got != test.want {
+			t.Errorf("annotatedCloneDepth(%v) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestAnnotatedShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The shell is sh")
+	}
+	for _, test := range []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, "/bin/sh"},
+		{"sh", "sh"},
+		{"/usr/local/bin/zsh", "/usr/local/bin/zsh"},
+		{"nonexistent-shell", "/bin/sh"},
+		{true, "/bin/sh"},
+	} {
+		annotations := screwdriver.Annotations{}
+		if test.value != nil {
+			annotations[ShellAnnotation] = test.value
+		}
+		if got := annotatedShell(annotations, "/bin/sh"); got != test.want {
+			t.Errorf("annotatedShell(%v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestLaunchAnnotations(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The shell is sh")
+	}
+	oldExecutorRun := executorRun
+	defer func() { executorRun = oldExecutorRun }()
+	var gotShell string
+	var gotTimeout int
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		gotShell, gotTimeout = shellBin, timeout
+		return nil
+	}
+
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "RUNNING")
+	api.pipelineFromID = func(pipelineID int) (screwdriver.Pipeline, error) {
+		return screwdriver.Pipeline(FakePipeline{ID: pipelineID, ScmURI: TestScmURI, ScmRepo: TestScmRepo, Annotations: screwdriver.Annotations{TimeoutAnnotation: 30.0, ShellAnnotation: "/bin/bash"}}), nil
+	}
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) {
+		annotations := screwdriver.Annotations{TimeoutAnnotation: "45"}
+		return screwdriver.Job(FakeJob{ID: jobID, Name: "main", PipelineID: TestPipelineID, Permutations: []screwdriver.JobPermutation{{Annotations: annotations}}}), nil
+	}
+
+	if err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+	if gotTimeout != 45*60 || gotShell != "/bin/bash" {
+		t.Errorf("Ran with timeout %d and shell %q, want the 45 minutes of the job and the shell of the pipeline", gotTimeout, gotShell)
+	}
+}
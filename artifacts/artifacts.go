@@ -0,0 +1,275 @@
+// Package artifacts uploads the files a build leaves in its artifacts directory to the Screwdriver Store
+package artifacts
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/screwdriver-cd/launcher/store"
+)
+
+// ManifestFile lists the uploaded artifacts for the UI
+const ManifestFile = "manifest.txt"
+
+// DefaultParallel is how many files are uploaded at the same time unless Options.Parallel is set
+const DefaultParallel = 4
+
+// ProgressInterval is how often the progress of the uploads is logged
+var ProgressInterval = 10 * time.Second
+
+// Options controls which artifacts get uploaded, and how
+type Options struct {
+	// Include only uploads the files matching one of these patterns, all files when empty
+	Include []string
+	// Exclude skips the files matching one of these patterns
+	Exclude []string
+	// MaxFileSize skips files bigger than that many bytes, 0 for no limit
+	MaxFileSize int64
+	// MaxTotalSize stops uploading once that many bytes were sent, 0 for no limit
+	MaxTotalSize int64
+	// Parallel is how many files are uploaded at the same time
+	Parallel int
+	// PartSize sends the files bigger than that many bytes in parts of that size, one request
+	// each with a Content-Range header, 0 to always send files whole
+	PartSize int64
+	// RetryPolicy controls how failed uploads are retried
+	RetryPolicy screwdriver.RetryPolicy
+}
+
+// File is an artifact found in the artifacts directory
+type File struct {
+	// Path is relative to the artifacts directory, with forward slashes
+	Path string
+	Size int64
+}
+
+// Result describes what happened to the artifacts
+type Result struct {
+	Uploaded []File
+	Skipped  []File
+}
+
+// Uploader sends artifacts to the Screwdriver Store
+type Uploader struct {
+	store   store.Client
+	buildID int
+	options Options
+}
+
+// New returns an Uploader for the artifacts of a build
+func New(storeURL string, tokens screwdriver.TokenSource, buildID int, options Options) Uploader {
+	if options.Parallel <= 0 {
+		options.Parallel = DefaultParallel
+	}
+	if options.RetryPolicy.MaxAttempts <= 0 {
+		options.RetryPolicy = screwdriver.DefaultRetryPolicy
+	}
+
+	return Uploader{
+		store:   store.New(storeURL, tokens, store.Options{Timeout: 5 * time.Minute, RetryPolicy: options.RetryPolicy}),
+		buildID: buildID,
+		options: options,
+	}
+}
+
+// Match tells whether a slash separated path matches a pattern. Patterns without a slash match
+// the file name in any directory, and a trailing "/**" matches everything under a directory.
+func Match(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		return strings.HasPrefix(p, strings.TrimSuffix(pattern, "**"))
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// MatchAny tells whether a slash separated path matches one of the patterns
+func MatchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Collect lists the files of dir to upload and the ones skipped by the size limits, sorted by path
+func (u Uploader) Collect(dir string) (Result, error) {
+	var result Result
+	var total int64
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f := File{Path: filepath.ToSlash(rel), Size: info.Size()}
+
+		if f.Path == ManifestFile {
+			return nil
+		}
+		if len(u.options.Include) > 0 && !MatchAny(u.options.Include, f.Path) {
+			return nil
+		}
+		if MatchAny(u.options.Exclude, f.Path) {
+			return nil
+		}
+
+		if u.options.MaxFileSize > 0 && f.Size > u.options.MaxFileSize {
+			log.Printf("WARN: Skipping artifact %s: %d bytes is more than the %d bytes allowed", f.Path, f.Size, u.options.MaxFileSize)
+			result.Skipped = append(result.Skipped, f)
+			return nil
+		}
+		if u.options.MaxTotalSize > 0 && total+f.Size > u.options.MaxTotalSize {
+			log.Printf("WARN: Skipping artifact %s: artifacts would be more than the %d bytes allowed", f.Path, u.options.MaxTotalSize)
+			result.Skipped = append(result.Skipped, f)
+			return nil
+		}
+
+		total += f.Size
+		result.Uploaded = append(result.Uploaded, f)
+		return nil
+	})
+	if err != nil {
+		return Result{}, fmt.Errorf("Listing artifacts in %q: %v", dir, err)
+	}
+
+	return result, nil
+}
+
+// Upload sends the artifacts of dir to the store, then the manifest listing them
+func (u Uploader) Upload(dir string) (Result, error) {
+	result, err := u.Collect(dir)
+	if err != nil {
+		return result, err
+	}
+
+	p := &progress{totalFiles: len(result.Uploaded)}
+	for _, f := range result.Uploaded {
+		p.totalBytes += f.Size
+	}
+	stopProgress := p.logEvery(ProgressInterval)
+
+	files := make(chan File)
+	errs := make(chan error, len(result.Uploaded))
+	var wg sync.WaitGroup
+
+	for i := 0; i < u.options.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if err := u.uploadFile(dir, f, p); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, f := range result.Uploaded {
+		files <- f
+	}
+	close(files)
+	wg.Wait()
+	close(errs)
+	stopProgress()
+
+	var messages []string
+	for err := range errs {
+		messages = append(messages, err.Error())
+	}
+	if len(messages) > 0 {
+		sort.Strings(messages)
+		return result, fmt.Errorf("Uploading %d of %d artifacts failed: %s", len(messages), len(result.Uploaded), strings.Join(messages, "; "))
+	}
+
+	m := manifest(result.Uploaded)
+	if err := u.put(u.store, ManifestFile, "text/plain", strings.NewReader(m), int64(len(m))); err != nil {
+		return result, fmt.Errorf("Uploading artifact manifest: %v", err)
+	}
+	return result, nil
+}
+
+// manifest lists the artifacts the way the UI expects, one "./path" per line
+func manifest(files []File) string {
+	var b strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&b, "./%s\n", f.Path)
+	}
+	return b.String()
+}
+
+// progress counts what was sent, for the logs of long uploads
+type progress struct {
+	files      int64
+	bytes      int64
+	totalFiles int
+	totalBytes int64
+}
+
+func (p *progress) addBytes(n int64) { atomic.AddInt64(&p.bytes, n) }
+
+func (p *progress) addFile() { atomic.AddInt64(&p.files, 1) }
+
+func (p *progress) String() string {
+	return fmt.Sprintf("Uploaded %d of %d artifacts, %d of %d bytes",
+		atomic.LoadInt64(&p.files), p.totalFiles, atomic.LoadInt64(&p.bytes), p.totalBytes)
+}
+
+// logEvery logs the progress at each interval until the returned function is called
+func (p *progress) logEvery(interval time.Duration) func() {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.Print(p)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// uploadFile streams an artifact from disk, in parts when it is bigger than the part size
+func (u Uploader) uploadFile(dir string, f File, p *progress) error {
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(f.Path)))
+	if err != nil {
+		return fmt.Errorf("Reading artifact %s: %v", f.Path, err)
+	}
+	defer file.Close()
+
+	if err := u.put(u.store.WithPartSize(u.options.PartSize), f.Path, "application/octet-stream", file, f.Size); err != nil {
+		return fmt.Errorf("Uploading artifact %s: %v", f.Path, err)
+	}
+	p.addBytes(f.Size)
+	p.addFile()
+	return nil
+}
+
+// put stores the size bytes of body as the artifact at p through client
+func (u Uploader) put(client store.Client, p, contentType string, body io.ReadSeeker, size int64) error {
+	return client.Upload(fmt.Sprintf("v1/builds/%d/ARTIFACTS/%s", u.buildID, p), contentType, body, size)
+}
@@ -0,0 +1,255 @@
+package artifacts
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var testRetryPolicy = screwdriver.RetryPolicy{MaxAttempts: 3}
+
+// fakeStore records the artifacts PUT to it, failing the first failFirst requests of each path
+// and part with a 500. Parts are appended in the order they come.
+type fakeStore struct {
+	sync.Mutex
+	failFirst int
+	status    int
+	attempts  map[string]int
+	files     map[string]string
+	ranges    []string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{attempts: map[string]int{}, files: map[string]string{}}
+}
+
+func (s *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Method != "PUT" || r.Header.Get("Authorization") != "Bearer faketoken" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key := r.URL.Path
+	if rng := r.Header.Get("Content-Range"); rng != "" {
+		key += " " + rng
+	}
+	s.attempts[key]++
+	if s.attempts[key] <= s.failFirst {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if rng := r.Header.Get("Content-Range"); rng != "" {
+		s.ranges = append(s.ranges, rng)
+		s.files[r.URL.Path] += string(body)
+		return
+	}
+	s.files[r.URL.Path] = string(body)
+}
+
+func setupArtifacts(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0666); err != nil {
+			t.Fatalf("Writing %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func paths(files []File) []string {
+	var result []string
+	for _, f := range files {
+		result = append(result, f.Path)
+	}
+	return result
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"*.xml", "report.xml", true},
+		{"*.xml", "test/results/report.xml", true},
+		{"*.xml", "report.json", false},
+		{"test/*.xml", "test/report.xml", true},
+		{"test/*.xml", "test/results/report.xml", false},
+		{"coverage/**", "coverage/lcov/index.html", true},
+		{"coverage/**", "coverage.txt", false},
+	}
+
+	for _, test := range tests {
+		if got := Match(test.pattern, test.path); got != test.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dir := setupArtifacts(t, map[string]string{
+		"report.xml":          "<xml/>",
+		"coverage/index.html": "<html/>",
+		"coverage/big.json":   strings.Repeat("a", 100),
+		"build.log":           "log",
+		"tmp/scratch.xml":     "<xml/>",
+		ManifestFile:          "./old\n",
+	})
+	defer os.RemoveAll(dir)
+
+	u := New("http://fakestore", screwdriver.StaticToken("faketoken"), 1234, Options{
+		Include:     []string{"*.xml", "coverage/**"},
+		Exclude:     []string{"tmp/**"},
+		MaxFileSize: 10,
+	})
+	result, err := u.Collect(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error from Collect: %v", err)
+	}
+
+	wantUploaded := []string{"coverage/index.html", "report.xml"}
+	if !reflect.DeepEqual(paths(result.Uploaded), wantUploaded) {
+		t.Errorf("Uploaded = %v, want %v", paths(result.Uploaded), wantUploaded)
+	}
+	wantSkipped := []string{"coverage/big.json"}
+	if !reflect.DeepEqual(paths(result.Skipped), wantSkipped) {
+		t.Errorf("Skipped = %v, want %v", paths(result.Skipped), wantSkipped)
+	}
+}
+
+func TestCollectMaxTotalSize(t *testing.T) {
+	dir := setupArtifacts(t, map[string]string{
+		"a.txt": "12345",
+		"b.txt": "12345",
+		"c.txt": "1",
+	})
+	defer os.RemoveAll(dir)
+
+	u := New("http://fakestore", screwdriver.StaticToken("faketoken"), 1234, Options{MaxTotalSize: 7})
+	result, err := u.Collect(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error from Collect: %v", err)
+	}
+
+	if !reflect.DeepEqual(paths(result.Uploaded), []string{"a.txt", "c.txt"}) {
+		t.Errorf("Uploaded = %v, want [a.txt c.txt]", paths(result.Uploaded))
+	}
+	if !reflect.DeepEqual(paths(result.Skipped), []string{"b.txt"}) {
+		t.Errorf("Skipped = %v, want [b.txt]", paths(result.Skipped))
+	}
+}
+
+func TestUpload(t *testing.T) {
+	dir := setupArtifacts(t, map[string]string{
+		"report.xml":          "<xml/>",
+		"coverage/index.html": "<html/>",
+	})
+	defer os.RemoveAll(dir)
+
+	store := newFakeStore()
+	store.failFirst = 1
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	u := New(server.URL, screwdriver.StaticToken("faketoken"), 1234, Options{Parallel: 2, RetryPolicy: testRetryPolicy})
+	if _, err := u.Upload(dir); err != nil {
+		t.Fatalf("Unexpected error from Upload: %v", err)
+	}
+
+	want := map[string]string{
+		"/v1/builds/1234/ARTIFACTS/report.xml":          "<xml/>",
+		"/v1/builds/1234/ARTIFACTS/coverage/index.html": "<html/>",
+		"/v1/builds/1234/ARTIFACTS/manifest.txt":        "./coverage/index.html\n./report.xml\n",
+	}
+	if !reflect.DeepEqual(store.files, want) {
+		t.Errorf("Store files = %v, want %v", store.files, want)
+	}
+}
+
+func TestUploadError(t *testing.T) {
+	dir := setupArtifacts(t, map[string]string{"report.xml": "<xml/>"})
+	defer os.RemoveAll(dir)
+
+	store := newFakeStore()
+	store.status = http.StatusForbidden
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	u := New(server.URL, screwdriver.StaticToken("faketoken"), 1234, Options{RetryPolicy: testRetryPolicy})
+	_, err := u.Upload(dir)
+	if err == nil || !strings.Contains(err.Error(), "Uploading 1 of 1 artifacts failed") {
+		t.Fatalf("Upload error = %v, want the failed artifacts", err)
+	}
+	if store.attempts["/v1/builds/1234/ARTIFACTS/report.xml"] != 1 {
+		t.Errorf("Got %d attempts to upload, 4xx responses should not be retried", store.attempts["/v1/builds/1234/ARTIFACTS/report.xml"])
+	}
+	if _, ok := store.files["/v1/builds/1234/ARTIFACTS/manifest.txt"]; ok {
+		t.Errorf("Manifest was uploaded after a failed artifact")
+	}
+}
+
+func TestUploadParts(t *testing.T) {
+	dir := setupArtifacts(t, map[string]string{
+		"dist/app.tar": "0123456789abcdefghij-",
+		"empty.log":    "",
+	})
+	defer os.RemoveAll(dir)
+
+	store := newFakeStore()
+	store.failFirst = 1
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	u := New(server.URL, screwdriver.StaticToken("faketoken"), 1234, Options{PartSize: 8, RetryPolicy: testRetryPolicy})
+	if _, err := u.Upload(dir); err != nil {
+		t.Fatalf("Unexpected error from Upload: %v", err)
+	}
+
+	if got := store.files["/v1/builds/1234/ARTIFACTS/dist/app.tar"]; got != "0123456789abcdefghij-" {
+		t.Errorf("Uploaded %q, want the parts in order", got)
+	}
+	if got, ok := store.files["/v1/builds/1234/ARTIFACTS/empty.log"]; !ok || got != "" {
+		t.Errorf("Empty artifact = %q, %v, want it uploaded", got, ok)
+	}
+	if want := []string{"bytes 0-7/21", "bytes 8-15/21", "bytes 16-20/21"}; !reflect.DeepEqual(store.ranges, want) {
+		t.Errorf("Parts = %q, want %q", store.ranges, want)
+	}
+	// Each part failed once, none was sent again after it was stored
+	for _, rng := range store.ranges {
+		if n := store.attempts["/v1/builds/1234/ARTIFACTS/dist/app.tar "+rng]; n != 2 {
+			t.Errorf("Part %s took %d attempts, want 2", rng, n)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	p := &progress{totalFiles: 3, totalBytes: 300}
+	p.addBytes(100)
+	p.addFile()
+	p.addBytes(50)
+	if got, want := p.String(), "Uploaded 1 of 3 artifacts, 150 of 300 bytes"; got != want {
+		t.Errorf("progress = %q, want %q", got, want)
+	}
+}
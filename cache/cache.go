@@ -0,0 +1,334 @@
+// Package cache restores directories from a previous build before the steps run, and saves
+// them once the build succeeds
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/screwdriver-cd/launcher/store"
+)
+
+// ErrNotFound is returned by a Store without a cache of that name
+var ErrNotFound = errors.New("Cache not found")
+
+// Store keeps cache archives by name
+type Store interface {
+	// Get opens the archive called name
+	Get(name string) (io.ReadCloser, error)
+	// Put saves the archive read from r as name
+	Put(name string, r io.ReadSeeker) error
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Name returns the archive name of the cache identified by parts, such as the job,
+// the branch and a key chosen by the user
+func Name(parts ...string) string {
+	var clean []string
+	for _, p := range parts {
+		if p = strings.Trim(unsafeChars.ReplaceAllString(p, "_"), "_."); p != "" {
+			clean = append(clean, p)
+		}
+	}
+	return strings.Join(clean, "-") + ".tar.gz"
+}
+
+type diskStore struct {
+	dir string
+}
+
+// NewDiskStore returns a Store keeping archives in dir, usually a volume shared by the builds
+// of a pipeline
+func NewDiskStore(dir string) Store {
+	return diskStore{dir}
+}
+
+func (s diskStore) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s diskStore) Put(name string, r io.ReadSeeker) error {
+	if err := os.MkdirAll(s.dir, 0777); err != nil {
+		return err
+	}
+
+	// Builds restoring the cache at the same time never see a partial archive
+	tmp, err := ioutil.TempFile(s.dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+type httpStore struct {
+	client store.Client
+	prefix string
+}
+
+// NewStore returns a Store keeping the archives of a pipeline in the Screwdriver Store
+func NewStore(storeURL string, tokens screwdriver.TokenSource, pipelineID int) Store {
+	return NewStoreWithRetryPolicy(storeURL, tokens, pipelineID, screwdriver.DefaultRetryPolicy)
+}
+
+// NewStoreWithRetryPolicy returns a Store keeping the archives of a pipeline in the Screwdriver
+// Store, retrying failed requests according to policy
+func NewStoreWithRetryPolicy(storeURL string, tokens screwdriver.TokenSource, pipelineID int, policy screwdriver.RetryPolicy) Store {
+	return httpStore{
+		client: store.New(storeURL, tokens, store.Options{RetryPolicy: policy}),
+		prefix: fmt.Sprintf("v1/caches/pipelines/%d/", pipelineID),
+	}
+}
+
+// Get downloads the archive to a temporary file first, so a download cut short resumes where it
+// stopped instead of leaving a partial archive to extract
+func (s httpStore) Get(name string) (io.ReadCloser, error) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name)
+	if err := s.client.DownloadFile(s.prefix+name, path); err != nil {
+		os.RemoveAll(dir)
+		if err == store.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return tempArchive{f, dir}, nil
+}
+
+func (s httpStore) Put(name string, r io.ReadSeeker) error {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	return s.client.Upload(s.prefix+name, "application/gzip", r, size)
+}
+
+// tempArchive is a downloaded archive, removed once closed
+type tempArchive struct {
+	*os.File
+	dir string
+}
+
+func (a tempArchive) Close() error {
+	err := a.File.Close()
+	os.RemoveAll(a.dir)
+	return err
+}
+
+// Restore extracts the archive called name into root. It returns false when there is no
+// such cache yet.
+func Restore(store Store, name, root string) (bool, error) {
+	r, err := store.Get(name)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Fetching cache %s: %v", name, err)
+	}
+	defer r.Close()
+
+	if err := extract(r, root); err != nil {
+		return false, fmt.Errorf("Extracting cache %s: %v", name, err)
+	}
+	return true, nil
+}
+
+func extract(r io.Reader, root string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(root, filepath.FromSlash(header.Name))
+		if target != filepath.Clean(root) && !strings.HasPrefix(target, filepath.Clean(root)+string(filepath.Separator)) {
+			return fmt.Errorf("%q is outside of the cache", header.Name)
+		}
+		if err := checkParents(root, target); err != nil {
+			return fmt.Errorf("%q is outside of the cache: %v", header.Name, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode)|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			// A file replacing a symlink doesn't write to what it points to
+			if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				os.Remove(target)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkParents fails when a directory of target below root is a symlink. Archives never hold
+// files below their symlinks, one that does would write through a link it extracted, like
+// a -> /etc then a/passwd.
+func checkParents(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", dir)
+		}
+	}
+	return nil
+}
+
+// Save archives the dirs of root, relative to it, and stores them as name. Directories
+// that do not exist are left out.
+func Save(store Store, name, root string, dirs []string) error {
+	f, err := ioutil.TempFile("", "cache")
+	if err != nil {
+		return fmt.Errorf("Creating cache archive: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := archive(f, root, dirs); err != nil {
+		return fmt.Errorf("Creating cache archive: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Creating cache archive: %v", err)
+	}
+
+	if err := store.Put(name, f); err != nil {
+		return fmt.Errorf("Saving cache %s: %v", name, err)
+	}
+	return nil
+}
+
+func archive(w io.Writer, root string, dirs []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, dir := range dirs {
+		start := filepath.Join(root, dir)
+		if _, err := os.Lstat(start); os.IsNotExist(err) {
+			log.Printf("WARN: Not caching %s, it does not exist", dir)
+			continue
+		}
+
+		err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(rel, "..") {
+				return fmt.Errorf("%q is outside of %s", dir, root)
+			}
+
+			var link string
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(p); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	return dir
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Writing %s: %v", name, err)
+		}
+	}
+}
+
+func checkFiles(t *testing.T, root string, files map[string]string) {
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("Reading restored %s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("Restored %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	if got, want := Name("main", "feature/cache", "", "node 10"), "main-feature_cache-node_10.tar.gz"; got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+	if got, want := Name("../../etc", "master"), "etc-master.tar.gz"; got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+}
+
+func TestSaveRestoreDisk(t *testing.T) {
+	src, dst, cacheDir := tempDir(t), tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	defer os.RemoveAll(cacheDir)
+
+	files := map[string]string{
+		"node_modules/left-pad/index.js": "module.exports = pad",
+		"node_modules/.bin/pad":          "#!/bin/sh",
+		"vendor/lib.go":                  "package lib",
+	}
+	writeFiles(t, src, files)
+	writeFiles(t, src, map[string]string{"main.go": "package main"})
+	if err := os.Symlink("left-pad/index.js", filepath.Join(src, "node_modules", "pad.js")); err != nil {
+		t.Fatalf("Creating symlink: %v", err)
+	}
+
+	store := NewDiskStore(cacheDir)
+	if found, err := Restore(store, "main.tar.gz", dst); found || err != nil {
+		t.Errorf("Restore() = %v, %v before any save, want no cache", found, err)
+	}
+
+	if err := Save(store, "main.tar.gz", src, []string{"node_modules", "vendor", "missing"}); err != nil {
+		t.Fatalf("Unexpected error from Save: %v", err)
+	}
+	found, err := Restore(store, "main.tar.gz", dst)
+	if !found || err != nil {
+		t.Fatalf("Restore() = %v, %v, want the saved cache", found, err)
+	}
+
+	checkFiles(t, dst, files)
+	if link, err := os.Readlink(filepath.Join(dst, "node_modules", "pad.js")); err != nil || link != "left-pad/index.js" {
+		t.Errorf("Restored symlink = %q, %v, want left-pad/index.js", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "main.go")); !os.IsNotExist(err) {
+		t.Errorf("Restored main.go, which is not in the cached directories")
+	}
+}
+
+func TestRestoreOutsideRoot(t *testing.T) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	gz.Close()
+
+	cacheDir, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(dst)
+	ioutil.WriteFile(filepath.Join(cacheDir, "evil.tar.gz"), b.Bytes(), 0644)
+
+	_, err := Restore(NewDiskStore(cacheDir), "evil.tar.gz", dst)
+	if err == nil || !strings.Contains(err.Error(), "outside of the cache") {
+		t.Errorf("Restore() error = %v, want an error for a path outside of the cache", err)
+	}
+}
+
+func TestRestoreThroughSymlink(t *testing.T) {
+	outside := tempDir(t)
+	defer os.RemoveAll(outside)
+	writeFiles(t, outside, map[string]string{"passwd": "root"})
+
+	for _, entries := range [][]tar.Header{
+		{{Name: "a", Linkname: outside, Typeflag: tar.TypeSymlink}, {Name: "a/passwd", Mode: 0644, Size: 1, Typeflag: tar.TypeReg}},
+		{{Name: "a", Linkname: outside, Typeflag: tar.TypeSymlink}, {Name: "a/passwd", Linkname: "x", Typeflag: tar.TypeSymlink}},
+	} {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		tw := tar.NewWriter(gz)
+		for _, header := range entries {
+			tw.WriteHeader(&header)
+			tw.Write([]byte("x")[:header.Size])
+		}
+		tw.Close()
+		gz.Close()
+
+		cacheDir, dst := tempDir(t), tempDir(t)
+		defer os.RemoveAll(cacheDir)
+		defer os.RemoveAll(dst)
+		ioutil.WriteFile(filepath.Join(cacheDir, "evil.tar.gz"), b.Bytes(), 0644)
+
+		_, err := Restore(NewDiskStore(cacheDir), "evil.tar.gz", dst)
+		if err == nil || !strings.Contains(err.Error(), "outside of the cache") {
+			t.Errorf("Restore() error = %v, want an error for a path below a symlink", err)
+		}
+		checkFiles(t, outside, map[string]string{"passwd": "root"})
+	}
+
+	// Files replace the symlinks, rather than being written where they point to
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "passwd", Linkname: filepath.Join(outside, "passwd"), Typeflag: tar.TypeSymlink})
+	tw.WriteHeader(&tar.Header{Name: "passwd", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	gz.Close()
+	cacheDir, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(dst)
+	ioutil.WriteFile(filepath.Join(cacheDir, "replace.tar.gz"), b.Bytes(), 0644)
+	if _, err := Restore(NewDiskStore(cacheDir), "replace.tar.gz", dst); err != nil {
+		t.Fatalf("Unexpected error restoring the cache: %v", err)
+	}
+	checkFiles(t, outside, map[string]string{"passwd": "root"})
+	checkFiles(t, dst, map[string]string{"passwd": "x"})
+}
+
+type fakeStore struct {
+	sync.Mutex
+	archives map[string][]byte
+	fail     int
+}
+
+func (s *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer faketoken" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.fail > 0 {
+		s.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		s.archives[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	case "GET":
+		archive, ok := s.archives[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(archive)
+	}
+}
+
+func TestSaveRestoreStore(t *testing.T) {
+	oldPolicy := screwdriver.DefaultRetryPolicy
+	defer func() { screwdriver.DefaultRetryPolicy = oldPolicy }()
+	screwdriver.DefaultRetryPolicy = screwdriver.RetryPolicy{MaxAttempts: 3}
+
+	fake := &fakeStore{archives: map[string][]byte{}, fail: 1}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	src, dst := tempDir(t), tempDir(t)
+	defer os.RemoveAll(src)
+	defer os.RemoveAll(dst)
+	files := map[string]string{".m2/repository/junit.jar": "jar"}
+	writeFiles(t, src, files)
+
+	store := NewStore(server.URL, screwdriver.StaticToken("faketoken"), 42)
+	if found, err := Restore(store, "main.tar.gz", dst); found || err != nil {
+		t.Errorf("Restore() = %v, %v before any save, want no cache", found, err)
+	}
+	if err := Save(store, "main.tar.gz", src, []string{".m2"}); err != nil {
+		t.Fatalf("Unexpected error from Save: %v", err)
+	}
+	if _, ok := fake.archives["/v1/caches/pipelines/42/main.tar.gz"]; !ok {
+		t.Fatalf("Cache saved as %v, want it under the pipeline", fake.archives)
+	}
+
+	if found, err := Restore(store, "main.tar.gz", dst); !found || err != nil {
+		t.Fatalf("Restore() = %v, %v, want the saved cache", found, err)
+	}
+	checkFiles(t, dst, files)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/git"
+)
+
+// checkoutRetries is how many times a clone failing on the network is tried
+var checkoutRetries = 3
+
+// checkoutRetryDelay is the wait before the second try of a clone, doubled after each one
+var checkoutRetryDelay = 5 * time.Second
+
+// checkoutMirrors replace a prefix of the clone URLs, like
+// "https://github.com/=https://git-mirror.example.com/github/". The mirrors are tried once each,
+// in order, before the origin.
+var checkoutMirrors []string
+
+var removeAll = os.RemoveAll
+var rename = os.Rename
+
+// keepCheckouts is where the checkouts are kept between the builds of each job on persistent
+// build hosts, for the next build to only fetch the changes. Every build clones its
+// repository when empty.
+var keepCheckouts = ""
+
+// transientGitError matches what git prints when the SCM can't be reached, rather than when
+// the repository or the branch doesn't exist or the credentials are wrong
+var transientGitError = regexp.MustCompile(`(?i)could not resolve host|connection (timed out|refused|reset)|` +
+	`operation timed out|failed to connect|the remote end hung up unexpectedly|early eof|rpc failed|` +
+	`requested url returned error: 5\d\d|temporary failure in name resolution|network is unreachable|` +
+	`gnutls_handshake|ssl_read|unexpected disconnect`)
+
+// ErrSCMUnavailable means the source could not be checked out because the SCM could not be
+// reached, even after retrying
+type ErrSCMUnavailable struct {
+	Host string
+	Err  error
+}
+
+func (e ErrSCMUnavailable) Error() string {
+	return fmt.Sprintf("SCM unavailable: %s could not be reached: %v", e.Host, e.Err)
+}
+
+// mirrorURL is the URL of mirror for the repository at url, empty when the mirror doesn't
+// have it
+func mirrorURL(mirror, url string) string {
+	split := strings.SplitN(mirror, "=", 2)
+	if len(split) != 2 || !strings.HasPrefix(url, split[0]) {
+		return ""
+	}
+	return split[1] + strings.TrimPrefix(url, split[0])
+}
+
+// cloneWithRetry clones repo from the mirrors of publicURL first, then from its origin, trying
+// again with a backoff as long as the SCM can't be reached. The errors go through scrubber.
+func cloneWithRetry(repo git.Repo, publicURL, host, dir string, out io.Writer, scrubber *strings.Replacer) error {
+	// clone tells whether its error is the SCM being unreachable
+	clone := func(repo git.Repo) (bool, error) {
+		var output bytes.Buffer
+		err := gitClone(repo, dir, io.MultiWriter(out, &output))
+		if err == nil {
+			return false, nil
+		}
+		// The next clone needs an empty directory
+		if rmErr := removeAll(dir); rmErr != nil {
+			log.Printf("WARN: Removing the failed checkout: %v", rmErr)
+		}
+		return transientGitError.Match(output.Bytes()), fmt.Errorf("%s", scrubber.Replace(err.Error()))
+	}
+
+	for _, mirror := range checkoutMirrors {
+		url := mirrorURL(mirror, publicURL)
+		if url == "" {
+			continue
+		}
+		mirrored := repo
+		mirrored.Mirror = url
+		log.Printf("Cloning from mirror %v", url)
+		_, err := clone(mirrored)
+		if err == nil {
+			return nil
+		}
+		log.Printf("WARN: Cloning from mirror %v: %v", url, err)
+	}
+
+	delay := checkoutRetryDelay
+	for attempt := 1; ; attempt++ {
+		transient, err := clone(repo)
+		switch {
+		case err == nil:
+			return nil
+		case !transient:
+			return err
+		case attempt >= checkoutRetries:
+			return ErrSCMUnavailable{Host: host, Err: err}
+		}
+		log.Printf("WARN: Cloning %v failed, trying again in %v: %v", publicURL, delay, err)
+		sleep(delay)
+		delay *= 2
+	}
+}
+
+// borrowCheckout moves the checkout kept for the job into dir, the empty checkout directory of
+// its build, and returns the func putting the checkout back once the build is done. The job is
+// locked meanwhile: another of its builds on the host gets a checkout of its own, that isn't kept.
+func borrowCheckout(pipelineID, jobID int, dir string) func() {
+	kept := filepath.Join(keepCheckouts, strconv.Itoa(pipelineID), strconv.Itoa(jobID))
+	if err := mkdirAll(filepath.Dir(kept), 0777); err != nil {
+		log.Printf("WARN: Not keeping the checkout: %v", err)
+		return func() {}
+	}
+	lock, locked, err := tryLock(kept + ".lock")
+	if err != nil {
+		log.Printf("WARN: Not keeping the checkout: locking %s: %v", kept, err)
+		return func() {}
+	}
+	if !locked {
+		log.Printf("Checkout of job %d in use by another build, cloning a new one", jobID)
+		return func() {}
+	}
+
+	if _, err := stat(filepath.Join(kept, ".git")); err == nil {
+		err := removeFile(dir)
+		if err == nil {
+			err = rename(kept, dir)
+		}
+		if err != nil {
+			log.Printf("WARN: Not reusing the checkout kept in %s: %v", kept, err)
+			mkdirAll(dir, 0777)
+		} else {
+			log.Printf("Reusing the checkout kept in %s", kept)
+		}
+	}
+
+	return func() {
+		defer lock.Close()
+		// A kept checkout that couldn't be reused gets replaced
+		if err := removeAll(kept); err != nil {
+			log.Printf("WARN: Not keeping the checkout: %v", err)
+			return
+		}
+		if _, err := stat(filepath.Join(dir, ".git")); err != nil {
+			return
+		}
+		if err := rename(dir, kept); err != nil {
+			log.Printf("WARN: Not keeping the checkout: %v", err)
+		}
+	}
+}
+
+// updateKeptCheckout brings the checkout kept in dir to the commit of repo, once it is checked
+// to be one of repo that is whole. Its local changes are dropped, and its untracked files too
+// unless SD_CLEAN_UNTRACKED is false. The hooks and config the previous build may have left in
+// its .git are dropped first, so they don't run with the credentials of this one.
+func updateKeptCheckout(repo git.Repo, dir string, out io.Writer) error {
+	if err := gitVerify(repo, dir); err != nil {
+		return err
+	}
+	if err := gitScrub(repo, dir); err != nil {
+		return err
+	}
+	return gitUpdate(repo, dir, cleanUntracked(true), out)
+}
+
+// cleanUntracked tells whether a reused checkout gets its untracked and ignored files removed,
+// as set by SD_CLEAN_UNTRACKED, or def when it isn't set
+func cleanUntracked(def bool) bool {
+	clean, err := strconv.ParseBool(os.Getenv("SD_CLEAN_UNTRACKED"))
+	if err != nil {
+		return def
+	}
+	return clean
+}
+
+// commitEnvironment describes the commit checked out for the steps. Only the subject of its
+// message is kept, multiline variables break too many scripts.
+func commitEnvironment(commit git.Commit) map[string]string {
+	return map[string]string{
+		"SD_GIT_COMMIT_AUTHOR":  commit.Author,
+		"SD_GIT_COMMIT_EMAIL":   commit.Email,
+		"SD_GIT_COMMIT_MESSAGE": commit.Subject,
+	}
+}
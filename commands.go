@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/urfave/cli"
+)
+
+// httpOptions are the settings of the HTTP clients given by the flags of c
+func httpOptions(c *cli.Context) screwdriver.HTTPOptions {
+	return screwdriver.HTTPOptions{
+		ConnectTimeout:  c.Duration("http-connect-timeout"),
+		ReadTimeout:     c.Duration("http-read-timeout"),
+		KeepAlive:       c.Duration("http-keep-alive"),
+		IdleConnTimeout: c.Duration("http-idle-timeout"),
+		MaxIdleConns:    c.Int("http-max-idle-conns"),
+	}
+}
+
+// checkSettings returns what is wrong with the flags of c, any of which fails a build before
+// it starts
+func checkSettings(c *cli.Context) []string {
+	var problems []string
+	if format := c.String("log-format"); format != "text" && format != "json" {
+		problems = append(problems, fmt.Sprintf("unknown log format %q, must be text or json", format))
+	}
+	if clean := c.String("clean-workspace"); !validCleanWorkspace(clean) {
+		problems = append(problems, fmt.Sprintf("unknown clean-workspace %q, must be pre, post or both", clean))
+	}
+	if _, err := screwdriver.NewTransportWithOptions(c.String("ca-cert"), c.Bool("insecure-skip-tls-verify"), httpOptions(c)); err != nil {
+		problems = append(problems, fmt.Sprintf("configuring the HTTP client: %v", err))
+	}
+	if c.String("record-api") != "" && c.String("replay-api") != "" {
+		problems = append(problems, "can't record the API while replaying it")
+	}
+	// A call without a deadline can hang the build forever on a stalled connection
+	if timeout := c.Duration("api-timeout"); timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("the API timeout must be positive, got %v", timeout))
+	}
+	return problems
+}
+
+// validateSettings returns what would keep a build run with the flags of c from starting,
+// including what is wrong with the screwdriver.yaml args names, if any
+func validateSettings(c *cli.Context, args cli.Args) []string {
+	problems := checkSettings(c)
+
+	if !c.Bool("local") && c.String("token") == "" {
+		problems = append(problems, "token is not passed")
+	}
+	if shellBin, err := resolveShell(c.String("shell-bin")); err != nil {
+		problems = append(problems, err.Error())
+	} else if _, err := os.Stat(shellBin); err != nil {
+		problems = append(problems, fmt.Sprintf("Finding shell %q: %v", shellBin, err))
+	}
+
+	if len(args) > 0 {
+		config, err := readLocalConfig(args.Get(0))
+		if err != nil {
+			return append(problems, err.Error())
+		}
+		if len(config.Jobs) == 0 {
+			problems = append(problems, fmt.Sprintf("%v defines no jobs", args.Get(0)))
+		}
+		if job := c.String("local-job"); c.IsSet("local-job") {
+			if _, ok := config.Jobs[job]; !ok {
+				problems = append(problems, fmt.Sprintf("Job %q is not defined in %v", job, args.Get(0)))
+			}
+		}
+		names := make([]string, 0, len(config.Jobs))
+		for name := range config.Jobs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			job := config.Jobs[name]
+			if len(config.Shared.Steps)+len(job.Steps) == 0 {
+				problems = append(problems, fmt.Sprintf("Job %q has no steps", name))
+			}
+			if job.Shell != "" {
+				if _, err := resolveShell(job.Shell); err != nil {
+					problems = append(problems, fmt.Sprintf("Job %q: %v", name, err))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// validateCommand prints what would keep a build from starting, without running it
+func validateCommand(c *cli.Context) error {
+	problems := validateSettings(c, c.Args())
+	for _, problem := range problems {
+		fmt.Fprintf(c.App.Writer, "Error: %v\n", problem)
+	}
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d problem(s) found", len(problems)), 1)
+	}
+	fmt.Fprintln(c.App.Writer, "OK")
+	return nil
+}
+
+// versionCommand prints the version of the launcher and the platform it is built for
+func versionCommand(c *cli.Context) error {
+	fmt.Fprintf(c.App.Writer, "%v version %v\n%v %v/%v\n", c.App.Name, c.App.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// newContext parses args with the flags the settings are checked from
+func newContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range []cli.Flag{
+		cli.StringFlag{Name: "log-format", Value: "text"},
+		cli.StringFlag{Name: "clean-workspace"},
+		cli.StringFlag{Name: "ca-cert"},
+		cli.BoolFlag{Name: "insecure-skip-tls-verify"},
+		cli.DurationFlag{Name: "http-connect-timeout", Value: 30 * time.Second},
+		cli.DurationFlag{Name: "http-read-timeout", Value: time.Minute},
+		cli.DurationFlag{Name: "http-keep-alive", Value: 30 * time.Second},
+		cli.DurationFlag{Name: "http-idle-timeout", Value: 90 * time.Second},
+		cli.IntFlag{Name: "http-max-idle-conns", Value: 100},
+		cli.DurationFlag{Name: "api-timeout", Value: 20 * time.Second},
+		cli.StringFlag{Name: "record-api"},
+		cli.StringFlag{Name: "replay-api"},
+		cli.StringFlag{Name: "token"},
+		cli.StringFlag{Name: "shell-bin", Value: "/bin/sh"},
+		cli.BoolFlag{Name: "local"},
+		cli.StringFlag{Name: "local-job", Value: "main"},
+	} {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatalf("Couldn't parse %q: %v", args, err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestCheckSettings(t *testing.T) {
+	if problems := checkSettings(newContext(t)); len(problems) != 0 {
+		t.Errorf("checkSettings() = %q for the defaults", problems)
+	}
+
+	c := newContext(t, "--log-format", "xml", "--clean-workspace", "always", "--api-timeout", "0s", "--http-max-idle-conns", "-1")
+	problems := checkSettings(c)
+	want := []string{
+		`unknown log format "xml", must be text or json`,
+		`unknown clean-workspace "always", must be pre, post or both`,
+		"the API timeout must be positive, got 0s",
+	}
+	if len(problems) != 4 || !reflect.DeepEqual([]string{problems[0], problems[1], problems[3]}, want) ||
+		!strings.HasPrefix(problems[2], "configuring the HTTP client: ") {
+		t.Errorf("checkSettings() = %q, want %q and the HTTP client error", problems, want)
+	}
+
+	c = newContext(t, "--record-api", "api.jsonl", "--replay-api", "api.jsonl")
+	if problems := checkSettings(c); !reflect.DeepEqual(problems, []string{"can't record the API while replaying it"}) {
+		t.Errorf("checkSettings() = %q, want the record and replay conflict", problems)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The shell is /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldOpen := open
+	defer func() { open = oldOpen }()
+	open = os.Open
+
+	config := filepath.Join(dir, "screwdriver.yaml")
+	ioutil.WriteFile(config, []byte(`jobs:
+  main:
+    steps:
+      - test: make test
+  lint:
+    shell: nonexistent-shell
+`), 0644)
+
+	if problems := validateSettings(newContext(t, "--token", "jwt"), nil); len(problems) != 0 {
+		t.Errorf("validateSettings() = %q, want no problems", problems)
+	}
+
+	c := newContext(t, "--local", "--local-job", "deploy", config)
+	problems := validateSettings(c, c.Args())
+	want := []string{
+		`Job "deploy" is not defined in ` + config,
+		`Job "lint" has no steps`,
+		`Job "lint": Finding shell "nonexistent-shell": exec: "nonexistent-shell": executable file not found in $PATH`,
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("validateSettings() = %q, want %q", problems, want)
+	}
+
+	c = newContext(t, "--shell-bin", "/nonexistent/sh", filepath.Join(dir, "missing.yaml"))
+	problems = validateSettings(c, c.Args())
+	if len(problems) != 3 || problems[0] != "token is not passed" ||
+		!strings.HasPrefix(problems[1], `Finding shell "/nonexistent/sh"`) || !strings.HasPrefix(problems[2], "Opening ") {
+		t.Errorf("validateSettings() = %q, want the token, the shell and the missing file", problems)
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	app := cli.NewApp()
+	app.Name = "launcher"
+	app.Version = "1.2.3, commit abc, built at 2020-01-01"
+	out := new(bytes.Buffer)
+	app.Writer = out
+
+	versionCommand(cli.NewContext(app, flag.NewFlagSet("version", flag.ContinueOnError), nil))
+	want := "launcher version 1.2.3, commit abc, built at 2020-01-01\n" + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + "\n"
+	if out.String() != want {
+		t.Errorf("version printed %q, want %q", out, want)
+	}
+}
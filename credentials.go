@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// deployKeySecret is the secret holding the private SSH key allowed to clone the repository
+const deployKeySecret = "SD_SCM_DEPLOY_KEY"
+
+// checkoutCredentials authenticate the clone of a private repository
+type checkoutCredentials struct {
+	// Token is an SCM token for an HTTPS clone
+	Token string
+	// SSH is an ssh wrapper using the deploy key
+	SSH string
+	// files are the deploy key and its wrapper, removed right after the checkout
+	files []string
+}
+
+// resolveCheckoutCredentials gets the credentials the pipeline settings ask for. A deploy key is
+// written to dir with the ssh wrapper git runs, an OAuth token is fetched from the API.
+func resolveCheckoutCredentials(api screwdriver.API, buildID int, settings screwdriver.PipelineSettings, secrets screwdriver.Secrets, dir string) (checkoutCredentials, error) {
+	switch settings.CheckoutAuth {
+	case "":
+		return checkoutCredentials{}, nil
+	case screwdriver.CheckoutAuthOAuth:
+		token, err := api.GetCheckoutToken(buildID)
+		if err != nil {
+			return checkoutCredentials{}, fmt.Errorf("Fetching checkout token: %v", err)
+		}
+		if token == "" {
+			return checkoutCredentials{}, fmt.Errorf("Fetching checkout token: empty token for build %d", buildID)
+		}
+		return checkoutCredentials{Token: token}, nil
+	case screwdriver.CheckoutAuthDeployKey:
+		var key string
+		for _, s := range secrets {
+			if s.Name == deployKeySecret {
+				key = s.Value
+			}
+		}
+		if strings.TrimSpace(key) == "" {
+			return checkoutCredentials{}, fmt.Errorf("Checking out with a deploy key: secret %s is not set", deployKeySecret)
+		}
+		// ssh rejects keys without a final newline
+		if !strings.HasSuffix(key, "\n") {
+			key += "\n"
+		}
+
+		keyFile := filepath.Join(dir, fmt.Sprintf("sd-deploy-key-%d", buildID))
+		wrapper := keyFile + "-ssh"
+		creds := checkoutCredentials{SSH: wrapper, files: []string{keyFile, wrapper}}
+		if err := writeCredentialFile(keyFile, []byte(key)); err != nil {
+			return checkoutCredentials{}, err
+		}
+		script := fmt.Sprintf("#!/bin/sh\nexec ssh -i %q -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new \"$@\"\n", keyFile)
+		credentialFiles = append(credentialFiles, wrapper)
+		if err := writeFile(wrapper, []byte(script), 0700); err != nil {
+			creds.remove()
+			return checkoutCredentials{}, fmt.Errorf("Writing credential file %q: %v", wrapper, err)
+		}
+		return creds, nil
+	default:
+		return checkoutCredentials{}, fmt.Errorf("Unknown checkout authentication %q", settings.CheckoutAuth)
+	}
+}
+
+// remove deletes the deploy key and its wrapper, the steps never see them
+func (c checkoutCredentials) remove() {
+	if !cleanupCredentials {
+		return
+	}
+	for _, f := range c.files {
+		if err := removeFile(f); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: Unable to remove credential file %q: %v", f, err)
+		}
+	}
+}
+
+// tokenScrubber replaces a token, raw or escaped in a URL, by the secret mask
+func tokenScrubber(token string) *strings.Replacer {
+	if token == "" {
+		return strings.NewReplacer()
+	}
+	escaped := strings.TrimPrefix(url.UserPassword("", token).String(), ":")
+	return strings.NewReplacer(escaped, screwdriver.SecretMask, token, screwdriver.SecretMask)
+}
+
+// scrubWriter hides a token from the output of git. git writes its messages a line at a time,
+// so the token is never split across writes.
+type scrubWriter struct {
+	w        io.Writer
+	replacer *strings.Replacer
+}
+
+func (s scrubWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, s.replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/screwdriver-cd/launcher/store"
+)
+
+// diagnosticsLines is how many of the last lines of the log the diagnostics of a crash keep,
+// 0 for no diagnostics
+var diagnosticsLines = 100
+
+// diagnosticsMaxEntries is how many files of the workspace the diagnostics of a crash list
+var diagnosticsMaxEntries = 1000
+
+// diagnosticsMaxLog is how big the copy of the log kept for the diagnostics grows before it is
+// cut down to its last lines
+var diagnosticsMaxLog int64 = 1 << 20
+
+// diagnosticsMaxStack is how much of the end of the output of a supervised launcher is kept to
+// find its panic in
+const diagnosticsMaxStack = 64 * 1024
+
+// diagnosticsArtifact is the name of the diagnostics in the artifacts of the build
+const diagnosticsArtifact = "launcher-diagnostics.json"
+
+// supervise runs the build in a child launcher, so the build still fails with its diagnostics
+// when the launcher can't recover, killed for running out of memory for instance
+var supervise = false
+
+// supervisedEnv is set for the child launcher, which runs the build
+const supervisedEnv = "SD_LAUNCHER_SUPERVISED"
+
+// crashDiagnostics is where the report of a crash comes from and goes to. There are no
+// diagnostics without a dir.
+var crashDiagnostics struct {
+	dir         string
+	emitterPath string
+	workspace   string
+	storeURL    string
+}
+
+// secretEnvName matches the variables of the environment whose value is left out of the diagnostics
+var secretEnvName = regexp.MustCompile(`(?i)TOKEN|SECRET|PASSWORD|PASSWD|KEY|CREDENTIAL|AUTH`)
+
+var newSupervisedCommand = func() *exec.Cmd {
+	path, err := os.Executable()
+	if err != nil {
+		path = os.Args[0]
+	}
+	return exec.Command(path, os.Args[1:]...)
+}
+
+var uploadDiagnostics = func(storeURL string, tokens screwdriver.TokenSource, buildID int, data []byte) error {
+	client := store.New(storeURL, tokens, store.Options{RetryPolicy: storeRetryPolicy})
+	return client.Upload(fmt.Sprintf("v1/builds/%d/ARTIFACTS/%s", buildID, diagnosticsArtifact), "application/json", bytes.NewReader(data), int64(len(data)))
+}
+
+// diagnostics is what is known of the launcher when it crashed, uploaded with the artifacts
+// of the build
+type diagnostics struct {
+	BuildID   int       `json:"buildId"`
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	Stack     string    `json:"stack,omitempty"`
+	Step      string    `json:"step,omitempty"`
+	Env       []string  `json:"env"`
+	Workspace []string  `json:"workspace"`
+	Log       []string  `json:"log"`
+}
+
+// diagnosticsEmitter copies the lines of the log in dir, along with the name of the step
+// running, for the report of a crash that doesn't leave the launcher the time to send them
+type diagnosticsEmitter struct {
+	screwdriver.Emitter
+	dir  string
+	mu   sync.Mutex
+	log  *os.File
+	size int64
+}
+
+func newDiagnosticsEmitter(e screwdriver.Emitter, dir string) screwdriver.Emitter {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("WARN: No diagnostics in case of a crash: %v", err)
+		return e
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("WARN: No diagnostics in case of a crash: %v", err)
+		return e
+	}
+	d := &diagnosticsEmitter{Emitter: e, dir: dir, log: f}
+	// The launcher's own setup is the first step
+	d.setStep("sd-setup-launcher")
+	return d
+}
+
+func (d *diagnosticsEmitter) setStep(name string) {
+	path := filepath.Join(d.dir, "step")
+	if name == "" {
+		os.Remove(path)
+		return
+	}
+	ioutil.WriteFile(path, []byte(name), 0600)
+}
+
+// StartCmd records the step running
+func (d *diagnosticsEmitter) StartCmd(cmd screwdriver.CommandDef) {
+	d.setStep(cmd.Name)
+	d.Emitter.StartCmd(cmd)
+}
+
+// StopCmd records no step is running anymore
+func (d *diagnosticsEmitter) StopCmd(cmd screwdriver.CommandDef, exitCode int) {
+	d.setStep("")
+	d.Emitter.StopCmd(cmd, exitCode)
+}
+
+// Write copies p in the log of the diagnostics, cut down to its last lines when it gets too big
+func (d *diagnosticsEmitter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	if d.size+int64(len(p)) > diagnosticsMaxLog {
+		tail := tailLines(d.log.Name(), diagnosticsLines)
+		d.log.Truncate(0)
+		d.size = 0
+		if len(tail) > 0 {
+			n, _ := d.log.WriteString(strings.Join(tail, "\n") + "\n")
+			d.size += int64(n)
+		}
+	}
+	n, _ := d.log.Write(p)
+	d.size += int64(n)
+	d.mu.Unlock()
+	return d.Emitter.Write(p)
+}
+
+// Close closes the log of the diagnostics and the wrapped emitter
+func (d *diagnosticsEmitter) Close() error {
+	d.mu.Lock()
+	d.log.Close()
+	d.mu.Unlock()
+	return d.Emitter.Close()
+}
+
+// tailLines returns the last n lines of the file at path
+func tailLines(path string, n int) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// collectDiagnostics gathers the environment, the files of the workspace, the step running and
+// the last lines of its log
+func collectDiagnostics(buildID int, reason, stack string) diagnostics {
+	d := diagnostics{
+		BuildID:   buildID,
+		Time:      timeNow(),
+		Reason:    reason,
+		Stack:     stack,
+		Env:       redactedEnv(os.Environ()),
+		Workspace: listWorkspace(crashDiagnostics.workspace, diagnosticsMaxEntries),
+		Log:       tailLines(filepath.Join(crashDiagnostics.dir, "log"), diagnosticsLines),
+	}
+	if step, err := ioutil.ReadFile(filepath.Join(crashDiagnostics.dir, "step")); err == nil {
+		d.Step = string(step)
+	}
+	return d
+}
+
+// redactedEnv is env without the values of the variables looking like secrets
+func redactedEnv(env []string) []string {
+	var redacted []string
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 && secretEnvName.MatchString(parts[0]) {
+			e = parts[0] + "=" + screwdriver.Redacted
+		}
+		redacted = append(redacted, e)
+	}
+	sort.Strings(redacted)
+	return redacted
+}
+
+// listWorkspace lists the first max files of dir with their size, leaving out the git objects
+func listWorkspace(dir string, max int) []string {
+	var files []string
+	if dir == "" {
+		return files
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if len(files) == max {
+			files = append(files, "...")
+			return io.EOF
+		}
+		rel, _ := filepath.Rel(dir, path)
+		switch {
+		case path == dir:
+		case info.IsDir() && info.Name() == ".git":
+			files = append(files, filepath.ToSlash(rel)+"/")
+			return filepath.SkipDir
+		case info.IsDir():
+			files = append(files, filepath.ToSlash(rel)+"/")
+		default:
+			files = append(files, fmt.Sprintf("%s %d", filepath.ToSlash(rel), info.Size()))
+		}
+		return nil
+	})
+	return files
+}
+
+// reportCrash fails the build of a launcher that crashed: the step that was running stops, the
+// crash goes in its log and in the meta of the build as "launcher.crash", and the diagnostics
+// are uploaded with the artifacts of the build.
+func reportCrash(buildID int, api screwdriver.API, metaSpace, reason, stack string) {
+	if crashDiagnostics.dir == "" {
+		exit(screwdriver.Failure, buildID, api, metaSpace, reason)
+		return
+	}
+
+	d := collectDiagnostics(buildID, reason, stack)
+	if d.Step != "" {
+		if emitter, err := newEmitter(crashDiagnostics.emitterPath); err == nil {
+			cmd := screwdriver.CommandDef{Name: d.Step}
+			emitter.StartCmd(cmd)
+			fmt.Fprintf(emitter, "\n%s\n%s\n", reason, stack)
+			emitter.StopCmd(cmd, executor.ExitUnknown)
+			emitter.Close()
+		}
+		if api != nil {
+			if err := api.UpdateStepStop(buildID, d.Step, executor.ExitUnknown); err != nil {
+				log.Printf("Updating step stop %q: %v", d.Step, err)
+			}
+		}
+	}
+
+	crash := map[string]interface{}{"reason": reason, "stack": stack, "step": d.Step}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		log.Printf("ERROR: Marshalling the diagnostics: %v", err)
+	} else {
+		path := filepath.Join(crashDiagnostics.dir, diagnosticsArtifact)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			log.Printf("ERROR: Writing the diagnostics: %v", err)
+		} else {
+			log.Printf("Diagnostics of the crash written to %s", path)
+		}
+		if crashDiagnostics.storeURL != "" && buildTokens != nil {
+			if err := uploadDiagnostics(crashDiagnostics.storeURL, buildTokens, buildID, data); err != nil {
+				log.Printf("ERROR: Uploading the diagnostics: %v", err)
+			} else {
+				crash["diagnostics"] = diagnosticsArtifact
+			}
+		}
+	}
+	if value, err := json.Marshal(crash); err == nil && metaSpace != "" {
+		if err := metaSet(filepath.Join(metaSpace, "meta.json"), "launcher.crash", string(value), true); err != nil {
+			log.Printf("ERROR: Adding the crash to the meta: %v", err)
+		}
+	}
+
+	exit(screwdriver.Failure, buildID, api, metaSpace, reason)
+}
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	mu   sync.Mutex
+	max  int
+	data []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.data = append(w.data, p...)
+	if len(w.data) > w.max {
+		w.data = append(w.data[:0], w.data[len(w.data)-w.max:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.data)
+}
+
+// crashReason tells why a supervised launcher exited with err from the end of its output,
+// along with its stack when it panicked
+func crashReason(err error, output string) (string, string) {
+	reason := err.Error()
+	if reason == "signal: killed" {
+		reason = "killed, out of memory maybe"
+	}
+	start := -1
+	for _, marker := range []string{"panic: ", "fatal error: "} {
+		if i := strings.LastIndex(output, marker); i >= 0 && (i == 0 || output[i-1] == '\n') && i > start {
+			start = i
+		}
+	}
+	if start < 0 {
+		return reason, ""
+	}
+	stack := strings.TrimSpace(output[start:])
+	first := strings.SplitN(stack, "\n", 2)[0]
+	return fmt.Sprintf("%s (%s)", first, reason), stack
+}
+
+// superviseBuild runs the build in a child launcher with the same arguments and passes it the
+// signals to abort. The build is over when the child exits on its own, and reported as crashed
+// when it doesn't.
+func superviseBuild(buildID int, api screwdriver.API, metaSpace string) {
+	cmd := newSupervisedCommand()
+	cmd.Env = append(os.Environ(), supervisedEnv+"=1")
+	output := &tailWriter{max: diagnosticsMaxStack}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, io.MultiWriter(os.Stderr, output)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	log.Printf("Running build %d in a supervised launcher", buildID)
+	if err := cmd.Start(); err != nil {
+		reportCrash(buildID, api, metaSpace, fmt.Sprintf("Launcher crashed: starting the supervised launcher: %v", err), "")
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Passing %v to the supervised launcher", sig)
+			if err := cmd.Process.Signal(sig); err != nil {
+				log.Printf("WARN: Unable to pass %v to the supervised launcher: %v", sig, err)
+			}
+		case err := <-done:
+			if err == nil {
+				cleanExit()
+				return
+			}
+			reason, stack := crashReason(err, output.String())
+			log.Printf("ERROR: The supervised launcher crashed: %s", reason)
+			reportCrash(buildID, api, metaSpace, "Launcher crashed: "+reason, stack)
+			return
+		}
+	}
+}
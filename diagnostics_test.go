@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// withDiagnostics points the crash diagnostics to a temporary dir, until the returned func is called
+func withDiagnostics(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := crashDiagnostics
+	crashDiagnostics.dir = filepath.Join(dir, "diagnostics")
+	crashDiagnostics.workspace = filepath.Join(dir, "workspace")
+	crashDiagnostics.emitterPath = filepath.Join(dir, "emitter")
+	return dir, func() {
+		crashDiagnostics = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDiagnosticsEmitter(t *testing.T) {
+	_, cleanup := withDiagnostics(t)
+	defer cleanup()
+	oldMaxLog, oldLines := diagnosticsMaxLog, diagnosticsLines
+	defer func() { diagnosticsMaxLog, diagnosticsLines = oldMaxLog, oldLines }()
+	diagnosticsMaxLog, diagnosticsLines = 20, 2
+
+	var written string
+	emitter := newDiagnosticsEmitter(&MockEmitter{write: func(p []byte) (int, error) {
+		written += string(p)
+		return len(p), nil
+	}}, crashDiagnostics.dir)
+	step := func() string {
+		data, _ := ioutil.ReadFile(filepath.Join(crashDiagnostics.dir, "step"))
+		return string(data)
+	}
+	if got := step(); got != "sd-setup-launcher" {
+		t.Errorf("Step %q, want sd-setup-launcher", got)
+	}
+
+	cmd := screwdriver.CommandDef{Name: "test"}
+	emitter.StartCmd(cmd)
+	emitter.Write([]byte("one\ntwo\n"))
+	emitter.Write([]byte("three\nfour\n"))
+	emitter.Write([]byte("five\n"))
+	if got := step(); got != "test" {
+		t.Errorf("Step %q, want test", got)
+	}
+	emitter.StopCmd(cmd, 0)
+	emitter.Close()
+
+	if got := step(); got != "" {
+		t.Errorf("Step %q once stopped, want none", got)
+	}
+	if written != "one\ntwo\nthree\nfour\nfive\n" {
+		t.Errorf("Wrote %q to the wrapped emitter", written)
+	}
+	// The log got cut down to its last lines before the last write
+	want := []string{"three", "four", "five"}
+	if got := tailLines(filepath.Join(crashDiagnostics.dir, "log"), 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Kept %q, want %q", got, want)
+	}
+}
+
+func TestRedactedEnv(t *testing.T) {
+	got := redactedEnv([]string{"SD_TOKEN=abc", "PATH=/bin", "AWS_SECRET_ACCESS_KEY=xyz", "EMPTY="})
+	want := []string{"AWS_SECRET_ACCESS_KEY=" + screwdriver.Redacted, "EMPTY=", "PATH=/bin", "SD_TOKEN=" + screwdriver.Redacted}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("redactedEnv = %q, want %q", got, want)
+	}
+}
+
+func TestCrashReason(t *testing.T) {
+	output := "some log\npanic: boom\n\ngoroutine 7 [running]:\nmain.step()\n"
+	reason, stack := crashReason(errors.New("exit status 2"), output)
+	if reason != "panic: boom (exit status 2)" {
+		t.Errorf("Reason %q", reason)
+	}
+	if stack != "panic: boom\n\ngoroutine 7 [running]:\nmain.step()" {
+		t.Errorf("Stack %q", stack)
+	}
+
+	reason, stack = crashReason(errors.New("signal: killed"), "some log\n")
+	if reason != "killed, out of memory maybe" || stack != "" {
+		t.Errorf("Reason %q and stack %q of a killed launcher", reason, stack)
+	}
+}
+
+func TestReportCrash(t *testing.T) {
+	dir, cleanup := withDiagnostics(t)
+	defer cleanup()
+	crashDiagnostics.storeURL = TestStoreURL
+	oldNewEmitter, oldUpload, oldTokens, oldWriteFile := newEmitter, uploadDiagnostics, buildTokens, writeFile
+	defer func() {
+		newEmitter, uploadDiagnostics, buildTokens, writeFile = oldNewEmitter, oldUpload, oldTokens, oldWriteFile
+	}()
+	buildTokens = screwdriver.StaticToken(TestBuildToken)
+
+	os.MkdirAll(filepath.Join(crashDiagnostics.workspace, "src"), 0777)
+	ioutil.WriteFile(filepath.Join(crashDiagnostics.workspace, "src", "main.go"), []byte("package main"), 0666)
+	emitter := newDiagnosticsEmitter(&MockEmitter{}, crashDiagnostics.dir)
+	emitter.StartCmd(screwdriver.CommandDef{Name: "test"})
+	emitter.Write([]byte("running the tests\n"))
+
+	var crashLog string
+	var crashExit int
+	newEmitter = func(path string) (screwdriver.Emitter, error) {
+		if path != crashDiagnostics.emitterPath {
+			t.Errorf("Crash written to %q, want %q", path, crashDiagnostics.emitterPath)
+		}
+		return &MockEmitter{
+			write:   func(p []byte) (int, error) { crashLog += string(p); return len(p), nil },
+			stopCmd: func(cmd screwdriver.CommandDef, code int) { crashExit = code },
+		}, nil
+	}
+	var uploaded diagnostics
+	uploadDiagnostics = func(storeURL string, tokens screwdriver.TokenSource, buildID int, data []byte) error {
+		return json.Unmarshal(data, &uploaded)
+	}
+
+	var stopped string
+	var status screwdriver.BuildStatus
+	var message string
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, screwdriver.Running)
+	api.updateStepStop = func(buildID int, step string, code int) error {
+		stopped = step
+		return nil
+	}
+	api.updateBuildStatus = func(s screwdriver.BuildStatus, meta map[string]interface{}, buildID int, m string) error {
+		status, message = s, m
+		return nil
+	}
+
+	reportCrash(TestBuildID, api, dir, "Launcher crashed: panic: boom", "goroutine 1 [running]:")
+
+	if status != screwdriver.Failure || message != "Launcher crashed: panic: boom" {
+		t.Errorf("Build set to %s with %q", status, message)
+	}
+	if stopped != "test" || crashExit != executor.ExitUnknown {
+		t.Errorf("Stopped step %q with %d, want test with %d", stopped, crashExit, executor.ExitUnknown)
+	}
+	if !strings.Contains(crashLog, "goroutine 1 [running]:") {
+		t.Errorf("Stack missing from the log of the step: %q", crashLog)
+	}
+	if uploaded.Step != "test" || !reflect.DeepEqual(uploaded.Log, []string{"running the tests"}) {
+		t.Errorf("Uploaded step %q and log %q", uploaded.Step, uploaded.Log)
+	}
+	if want := []string{"src/", "src/main.go 12"}; !reflect.DeepEqual(uploaded.Workspace, want) {
+		t.Errorf("Uploaded workspace %q, want %q", uploaded.Workspace, want)
+	}
+	meta, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading the meta: %v", err)
+	}
+	if !strings.Contains(string(meta), `"stack":"goroutine 1 [running]:"`) || !strings.Contains(string(meta), diagnosticsArtifact) {
+		t.Errorf("Crash missing from the meta: %s", meta)
+	}
+	if _, err := os.Stat(filepath.Join(crashDiagnostics.dir, diagnosticsArtifact)); err != nil {
+		t.Errorf("Diagnostics not kept on the node: %v", err)
+	}
+}
+
+func TestSuperviseBuild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The supervised launcher is faked with sh")
+	}
+	oldCommand, oldCleanExit := newSupervisedCommand, cleanExit
+	defer func() { newSupervisedCommand, cleanExit = oldCommand, oldCleanExit }()
+	exited := false
+	cleanExit = func() { exited = true }
+
+	var message string
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, screwdriver.Running)
+	api.updateBuildStatus = func(s screwdriver.BuildStatus, meta map[string]interface{}, buildID int, m string) error {
+		message = m
+		return nil
+	}
+
+	for _, test := range []struct {
+		script  string
+		message string
+	}{
+		{"exit 0", ""},
+		{"echo 'panic: boom' >&2; echo 'goroutine 1 [running]:' >&2; exit 2", "Launcher crashed: panic: boom (exit status 2)"},
+		{"kill -9 $$", "Launcher crashed: killed, out of memory maybe"},
+	} {
+		exited, message = false, ""
+		script := test.script
+		newSupervisedCommand = func() *exec.Cmd {
+			return exec.Command("sh", "-c", script)
+		}
+		superviseBuild(TestBuildID, api, TestMetaSpace)
+		if !exited || message != test.message {
+			t.Errorf("%q: exited %v with %q, want %q", test.script, exited, message, test.message)
+		}
+	}
+}
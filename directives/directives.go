@@ -0,0 +1,88 @@
+// Package directives decides whether a build runs from what the message of its commit asks
+// for, like [skip ci], and from the freeze windows of its pipeline
+package directives
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var (
+	// skipPattern matches [skip ci], [ci skip], [no ci] and the same with sd instead of ci
+	skipPattern = regexp.MustCompile(`(?i)\[\s*(?:(?:skip|no)[\s-]+(?:ci|sd)|(?:ci|sd)[\s-]+skip)\s*\]`)
+	// forcePattern matches [force ci], [ci force] and the same with sd instead of ci
+	forcePattern = regexp.MustCompile(`(?i)\[\s*(?:force[\s-]+(?:ci|sd)|(?:ci|sd)[\s-]+force)\s*\]`)
+)
+
+// Directives are what a commit message asks of its builds
+type Directives struct {
+	// Skip doesn't run the build
+	Skip bool
+	// Force runs the build even when it is skipped or frozen
+	Force bool
+}
+
+// Parse finds the directives anywhere in a commit message
+func Parse(message string) Directives {
+	return Directives{
+		Skip:  skipPattern.MatchString(message),
+		Force: forcePattern.MatchString(message),
+	}
+}
+
+// Frozen returns the window of windows that freezes branch at t, if any
+func Frozen(windows []screwdriver.FreezeWindow, branch string, t time.Time) (screwdriver.FreezeWindow, bool) {
+	for _, w := range windows {
+		if t.Before(w.Start) || !t.Before(w.End) {
+			continue
+		}
+		if len(w.Branches) == 0 {
+			return w, true
+		}
+		for _, pattern := range w.Branches {
+			if matched, _ := path.Match(pattern, branch); matched {
+				return w, true
+			}
+		}
+	}
+	return screwdriver.FreezeWindow{}, false
+}
+
+// Touches tells whether one of the changed files is in one of the source paths, directories
+// of the repository like "services/api"
+func Touches(changed, sourcePaths []string) bool {
+	for _, file := range changed {
+		for _, dir := range sourcePaths {
+			dir = strings.Trim(dir, "/")
+			if dir == "" || file == dir || strings.HasPrefix(file, dir+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check tells whether a build of branch with the commit message must not run at t. It returns
+// the status to give the build instead and why, or an empty status when the build runs.
+func Check(message, branch string, windows []screwdriver.FreezeWindow, t time.Time) (screwdriver.BuildStatus, string) {
+	d := Parse(message)
+	if d.Force {
+		return "", ""
+	}
+	if d.Skip {
+		return screwdriver.Skipped, "Skipped by a directive in the commit message"
+	}
+	if w, ok := Frozen(windows, branch, t); ok {
+		reason := fmt.Sprintf("Branch %s is frozen until %s", branch, w.End.UTC().Format(time.RFC3339))
+		if w.Reason != "" {
+			reason += ": " + w.Reason
+		}
+		return screwdriver.Frozen, reason
+	}
+	return "", ""
+}
@@ -0,0 +1,85 @@
+package directives
+
+import (
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]Directives{
+		"Fix the launcher":                          {},
+		"Update the docs [skip ci]":                 {Skip: true},
+		"Update the docs\n\n[CI SKIP]":              {Skip: true},
+		"[no-ci] WIP":                               {Skip: true},
+		"Typo [ skip sd ]":                          {Skip: true},
+		"Hotfix [force ci]":                         {Force: true},
+		"Release [sd force] [skip ci]":              {Skip: true, Force: true},
+		"Explain skip ci without brackets":          {},
+		"Mention [skip] and [ci] in other brackets": {},
+	}
+	for message, want := range tests {
+		if got := Parse(message); got != want {
+			t.Errorf("Parse(%q) = %+v, want %+v", message, got, want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	start := time.Date(2020, 12, 20, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+	windows := []screwdriver.FreezeWindow{
+		{Branches: []string{"main", "release/*"}, Start: start, End: end, Reason: "Holidays"},
+	}
+	during := start.Add(time.Hour)
+
+	tests := []struct {
+		message string
+		branch  string
+		at      time.Time
+		status  screwdriver.BuildStatus
+		reason  string
+	}{
+		{"Fix the launcher", "main", start.Add(-time.Second), "", ""},
+		{"Fix the launcher", "main", during, screwdriver.Frozen, "Branch main is frozen until 2021-01-04T00:00:00Z: Holidays"},
+		{"Fix the launcher", "release/1.2", during, screwdriver.Frozen, "Branch release/1.2 is frozen until 2021-01-04T00:00:00Z: Holidays"},
+		{"Fix the launcher", "feature", during, "", ""},
+		{"Fix the launcher", "main", end, "", ""},
+		{"Hotfix [force ci]", "main", during, "", ""},
+		{"Docs [skip ci]", "feature", during, screwdriver.Skipped, "Skipped by a directive in the commit message"},
+		{"Docs [skip ci] [force ci]", "feature", during, "", ""},
+	}
+	for _, test := range tests {
+		status, reason := Check(test.message, test.branch, windows, test.at)
+		if status != test.status || reason != test.reason {
+			t.Errorf("Check(%q, %q, %v) = %v, %q, want %v, %q", test.message, test.branch, test.at, status, reason, test.status, test.reason)
+		}
+	}
+
+	if _, ok := Frozen([]screwdriver.FreezeWindow{{Start: start, End: end}}, "anything", during); !ok {
+		t.Errorf("A window without branches should freeze every branch")
+	}
+}
+
+func TestTouches(t *testing.T) {
+	paths := []string{"services/api/", "libs"}
+	tests := []struct {
+		changed []string
+		want    bool
+	}{
+		{[]string{"services/api/main.go"}, true},
+		{[]string{"README.md", "libs/log/log.go"}, true},
+		{[]string{"libs"}, true},
+		{[]string{"services/apidocs/index.md", "libsonnet/main.jsonnet"}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := Touches(test.changed, paths); got != test.want {
+			t.Errorf("Touches(%q) = %v, want %v", test.changed, got, test.want)
+		}
+	}
+	if !Touches([]string{"anything"}, []string{"/"}) {
+		t.Errorf("The root of the repository should hold every file")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// envBuilder makes the environment of the steps from layers of variables, each layer
+// overriding the variables of the ones before it
+type envBuilder struct {
+	vars map[string]string
+}
+
+// newEnvBuilder starts from environ, a list of "KEY=value" like os.Environ
+func newEnvBuilder(environ []string) *envBuilder {
+	b := &envBuilder{vars: map[string]string{}}
+	for _, e := range environ {
+		pieces := strings.SplitN(e, "=", 2)
+		if len(pieces) != 2 {
+			continue
+		}
+		b.vars[pieces[0]] = pieces[1]
+	}
+	return b
+}
+
+// add sets the variables of a layer. When expand is true, $VAR and ${VAR} in the values
+// are replaced with the variables of the layers before this one.
+func (b *envBuilder) add(layer map[string]string, expand bool) {
+	before := make(map[string]string, len(b.vars))
+	for k, v := range b.vars {
+		before[k] = v
+	}
+
+	for k, v := range layer {
+		if expand {
+			v = os.Expand(v, func(name string) string { return before[name] })
+		}
+		b.vars[k] = v
+	}
+}
+
+// environ returns the variables as "KEY=value", sorted by name
+func (b *envBuilder) environ() []string {
+	env := make([]string, 0, len(b.vars))
+	for k, v := range b.vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// createEnvironment returns the environment of the steps and the shell they asked for with
+// USER_SHELL_BIN, if any. From lowest to highest precedence, it is made of:
+//   - the environment of the launcher
+//   - base, the defaults describing the build like SD_BUILD_ID or SD_SOURCE_DIR
+//   - the secrets of the pipeline, used as is
+//   - the build environment, the job environment from the screwdriver.yaml coming
+//     before the variables the user set for this build
+//
+// The launcher's own environment is updated as well, as it reads some of its settings
+// from the build environment.
+func createEnvironment(base map[string]string, secrets screwdriver.Secrets, build screwdriver.Build) ([]string, string) {
+	var userShellBin string
+
+	b := newEnvBuilder(os.Environ())
+	b.add(base, true)
+
+	secretVars := map[string]string{}
+	for _, s := range secrets {
+		secretVars[s.Name] = s.Value
+	}
+	b.add(secretVars, false)
+
+	for _, env := range build.Environment {
+		b.add(env, true)
+		if v, ok := env["USER_SHELL_BIN"]; ok {
+			userShellBin = v
+		}
+	}
+
+	for k, v := range b.vars {
+		os.Setenv(k, v)
+	}
+
+	return b.environ(), userShellBin
+}
+
+// envLimit reads a size limit from the environment, falling back to def when unset
+func envLimit(envMap map[string]string, name string, def int) (int, error) {
+	v, ok := envMap[name]
+	if !ok || v == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q: must be a positive number of bytes", name, v)
+	}
+	return limit, nil
+}
+
+// validateEnvironment makes sure the step environment fits in the limits set by
+// SD_MAX_ENV_BYTES and SD_MAX_ENV_VAR_BYTES, so steps don't fail to start with E2BIG
+func validateEnvironment(env []string) error {
+	envMap := map[string]string{}
+	for _, e := range env {
+		pieces := strings.SplitN(e, "=", 2)
+		if len(pieces) == 2 {
+			envMap[pieces[0]] = pieces[1]
+		}
+	}
+
+	maxEnvBytes, err := envLimit(envMap, "SD_MAX_ENV_BYTES", DefaultMaxEnvBytes)
+	if err != nil {
+		return err
+	}
+	maxVarBytes, err := envLimit(envMap, "SD_MAX_ENV_VAR_BYTES", DefaultMaxEnvVarBytes)
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	largest := ""
+	largestSize := 0
+	for _, e := range env {
+		size := len(e) + 1 // Each variable is stored as a NUL terminated "KEY=value"
+		name := strings.SplitN(e, "=", 2)[0]
+		if size > maxVarBytes {
+			return fmt.Errorf("Environment variable %s is %d bytes, more than the %d bytes allowed by SD_MAX_ENV_VAR_BYTES", name, size, maxVarBytes)
+		}
+		if size > largestSize {
+			largest, largestSize = name, size
+		}
+		total += size
+	}
+
+	if total > maxEnvBytes {
+		return fmt.Errorf("Environment is %d bytes, more than the %d bytes allowed by SD_MAX_ENV_BYTES (largest variable is %s with %d bytes)", total, maxEnvBytes, largest, largestSize)
+	}
+	return nil
+}
+
+// prependPath puts dirs at the start of the PATH of env, keeping their order
+func prependPath(env []string, dirs []string) []string {
+	if len(dirs) == 0 {
+		return env
+	}
+	prefix := strings.Join(dirs, string(os.PathListSeparator))
+	for i, v := range env {
+		if strings.HasPrefix(v, "PATH=") {
+			env[i] = "PATH=" + prefix + string(os.PathListSeparator) + strings.TrimPrefix(v, "PATH=")
+			return env
+		}
+	}
+	return append(env, "PATH="+prefix)
+}
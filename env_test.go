@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestCreateEnvironment(t *testing.T) {
+	os.Setenv("OSENVWITHEQUALS", "foo=bar=")
+	base := map[string]string{
+		"SD_TOKEN":        "1234",
+		"FOO":             "bar",
+		"THINGWITHEQUALS": "abc=def",
+		"GETSOVERRIDDEN":  "goesaway",
+	}
+
+	secrets := screwdriver.Secrets{
+		{Name: "secret1", Value: "secret1value"},
+		{Name: "GETSOVERRIDDEN", Value: "override"},
+		{Name: "MYSECRETPATH", Value: "secretpath"},
+		{Name: "WITHDOLLAR", Value: "$FOO"},
+	}
+
+	var buildEnv []map[string]string
+	buildEnv = append(buildEnv, map[string]string{"GOPATH": "/go/path"})
+	buildEnv = append(buildEnv, map[string]string{"EXPANDENV": "${GOPATH}/expand"})
+	buildEnv = append(buildEnv, map[string]string{"EXPANDSECRET": "$MYSECRETPATH/home"})
+	buildEnv = append(buildEnv, map[string]string{"SD_CACHE_STRATEGY": "disk"})
+	buildEnv = append(buildEnv, map[string]string{"SD_PIPELINE_CACHE_DIR": "/opt/sd/cache/pipeline"})
+	buildEnv = append(buildEnv, map[string]string{"SD_JOB_CACHE_DIR": "/opt/sd/cache/job"})
+	buildEnv = append(buildEnv, map[string]string{"SD_EVENT_CACHE_DIR": "/opt/sd/cache/event"})
+
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Environment: buildEnv,
+	}
+	env, userShellBin := createEnvironment(base, secrets, testBuild)
+
+	if userShellBin != "" {
+		t.Errorf("Default userShellBin should be empty string")
+	}
+
+	foundEnv := map[string]bool{}
+	for _, i := range env {
+		foundEnv[i] = true
+	}
+
+	for _, want := range []string{
+		"SD_TOKEN=1234",
+		"FOO=bar",
+		"THINGWITHEQUALS=abc=def",
+		"secret1=secret1value",
+		"GETSOVERRIDDEN=override",
+		"OSENVWITHEQUALS=foo=bar=",
+		"GOPATH=/go/path",
+		"EXPANDENV=/go/path/expand",
+		"EXPANDSECRET=secretpath/home",
+		"WITHDOLLAR=$FOO",
+		"SD_PIPELINE_CACHE_DIR=/opt/sd/cache/pipeline",
+		"SD_JOB_CACHE_DIR=/opt/sd/cache/job",
+		"SD_EVENT_CACHE_DIR=/opt/sd/cache/event",
+	} {
+		if !foundEnv[want] {
+			t.Errorf("Did not receive expected environment setting %q", want)
+		}
+	}
+
+	if foundEnv["GETSOVERRIDDEN=goesaway"] {
+		t.Errorf("Failed to override the base environment with a secret")
+	}
+}
+
+func TestValidateEnvironment(t *testing.T) {
+	big := strings.Repeat("x", DefaultMaxEnvVarBytes)
+
+	tests := []struct {
+		name string
+		env  []string
+		err  string
+	}{
+		{"fits", []string{"FOO=bar", "SD_TOKEN=1234"}, ""},
+		{"oversized variable", []string{"FOO=bar", "HUGE=" + big}, "Environment variable HUGE is 131078 bytes, more than the 131072 bytes allowed by SD_MAX_ENV_VAR_BYTES"},
+		{"custom variable limit", []string{"FOO=barbarbar", "SD_MAX_ENV_VAR_BYTES=12"}, "Environment variable FOO is 14 bytes, more than the 12 bytes allowed by SD_MAX_ENV_VAR_BYTES"},
+		{"oversized environment", []string{"SD_MAX_ENV_BYTES=40", "FOO=bar", "LONGER=abcdefgh"}, "Environment is 44 bytes, more than the 40 bytes allowed by SD_MAX_ENV_BYTES (largest variable is SD_MAX_ENV_BYTES with 20 bytes)"},
+		{"bad limit", []string{"SD_MAX_ENV_BYTES=lots"}, `Invalid SD_MAX_ENV_BYTES "lots": must be a positive number of bytes`},
+	}
+
+	for _, test := range tests {
+		err := validateEnvironment(test.env)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: err = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestUserShellBin(t *testing.T) {
+	base := map[string]string{}
+	secrets := screwdriver.Secrets{}
+	var buildEnv []map[string]string
+	buildEnv = append(buildEnv, map[string]string{"USER_SHELL_BIN": "/bin/bash"})
+
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Environment: buildEnv,
+	}
+	_, userShellBin := createEnvironment(base, secrets, testBuild)
+
+	if userShellBin != "/bin/bash" {
+		t.Errorf("userShellBin %v, expect %v", userShellBin, "/bin/bash")
+	}
+}
+
+func TestEnvBuilderPrecedence(t *testing.T) {
+	b := newEnvBuilder([]string{"HOME=/root", "SD_BUILD_ID=launcher", "BROKEN"})
+	b.add(map[string]string{"SD_BUILD_ID": "1234", "SD_SOURCE_DIR": "/sd/workspace/src", "THEHOME": "$HOME"}, true)
+	b.add(map[string]string{"API_KEY": "$ecret", "SD_SOURCE_DIR": "/secret"}, false)
+	b.add(map[string]string{"SRC": "${SD_SOURCE_DIR}/lib", "A": "$B", "B": "b"}, true)
+	b.add(map[string]string{"SD_SOURCE_DIR": "/user"}, true)
+
+	want := []string{
+		"A=",
+		"API_KEY=$ecret",
+		"B=b",
+		"HOME=/root",
+		"SD_BUILD_ID=1234",
+		"SD_SOURCE_DIR=/user",
+		"SRC=/secret/lib",
+		"THEHOME=/root",
+	}
+	if got := b.environ(); !reflect.DeepEqual(got, want) {
+		t.Errorf("environ() = %q, want %q", got, want)
+	}
+}
+
+func TestCreateEnvironmentUserOverridesJob(t *testing.T) {
+	defer os.Unsetenv("SD_TEST_LEVEL")
+
+	base := map[string]string{"SD_TEST_LEVEL": "default"}
+	build := screwdriver.Build{Environment: []map[string]string{
+		{"SD_TEST_LEVEL": "job"},
+		{"SD_TEST_LEVEL": "user"},
+	}}
+
+	env, _ := createEnvironment(base, screwdriver.Secrets{}, build)
+	found := false
+	for _, e := range env {
+		if strings.HasPrefix(e, "SD_TEST_LEVEL=") {
+			found = true
+			if e != "SD_TEST_LEVEL=user" {
+				t.Errorf("Got %s, want the user value", e)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("SD_TEST_LEVEL missing from %q", env)
+	}
+	if got := os.Getenv("SD_TEST_LEVEL"); got != "user" {
+		t.Errorf("Launcher environment has SD_TEST_LEVEL=%q, want user", got)
+	}
+}
+
+func TestPrependPath(t *testing.T) {
+	env := []string{"FOO=bar", "PATH=/usr/bin:/bin"}
+	got := prependPath(env, []string{"/hab/pkgs/core/node/bin", "/hab/pkgs/core/git/bin"})
+	want := []string{"FOO=bar", "PATH=/hab/pkgs/core/node/bin:/hab/pkgs/core/git/bin:/usr/bin:/bin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("prependPath() = %q, want %q", got, want)
+	}
+
+	if got := prependPath([]string{"FOO=bar"}, []string{"/opt/bin"}); !reflect.DeepEqual(got, []string{"FOO=bar", "PATH=/opt/bin"}) {
+		t.Errorf("prependPath() = %q, want a PATH added", got)
+	}
+}
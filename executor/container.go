@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ContainerCLI is the docker compatible command starting the containers of the steps
+var ContainerCLI = "docker"
+
+// StepContainer is the container the steps run in, with `docker exec`, when the job has an
+// image. Its steps run in a process of their own, as without a persistent shell.
+var StepContainer *Container
+
+// containerEnvSkipped are the variables of the build the container keeps its own values of
+var containerEnvSkipped = map[string]bool{"PATH": true, "HOME": true, "HOSTNAME": true}
+
+// Container is a container of an image left running for the steps to be executed in it
+type Container struct {
+	ID    string
+	Image string
+	// scriptDir holds the scripts of the steps, it is mounted in the container at the same path
+	scriptDir string
+}
+
+// StartContainer starts a container of image with the mounts bind-mounted at the same paths,
+// writing the pull of the image to out
+func StartContainer(image string, mounts []string, out io.Writer) (*Container, error) {
+	dir, err := ioutil.TempDir("", "sd-container-steps")
+	if err != nil {
+		return nil, fmt.Errorf("Creating the step scripts dir: %v", err)
+	}
+
+	args := []string{"run", "--detach", "--init", "--entrypoint", "tail", "--volume", dir + ":" + dir}
+	for _, mount := range mounts {
+		args = append(args, "--volume", mount+":"+mount)
+	}
+	// tail keeps the container up whatever the entrypoint of the image
+	args = append(args, image, "-f", "/dev/null")
+	c := exec.Command(ContainerCLI, args...)
+	c.Stderr = out
+	id, err := c.Output()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Starting a container of %s: %v", image, err)
+	}
+	return &Container{ID: strings.TrimSpace(string(id)), Image: image, scriptDir: dir}, nil
+}
+
+// Remove stops and removes the container, with what the steps left running in it
+func (ct *Container) Remove() error {
+	defer os.RemoveAll(ct.scriptDir)
+	if out, err := exec.Command(ContainerCLI, "rm", "--force", ct.ID).CombinedOutput(); err != nil {
+		return fmt.Errorf("Removing container %s: %v: %s", ct.ID, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// command runs c in the container instead, in its dir and with its environment. The process of
+// the step writes its pid in the container to pidFile, for stop.
+func (ct *Container) command(c *exec.Cmd, pidFile string) *exec.Cmd {
+	args := []string{"exec", "--workdir", c.Dir}
+	// The values are taken from the environment of the CLI, they don't show in its arguments
+	for _, v := range c.Env {
+		name := strings.SplitN(v, "=", 2)[0]
+		if !containerEnvSkipped[name] {
+			args = append(args, "--env", name)
+		}
+	}
+	args = append(args, ct.ID, "sh", "-c", `echo $$ > "$0" && exec "$@"`, pidFile)
+	args = append(args, c.Args...)
+
+	e := exec.Command(ContainerCLI, args...)
+	e.Env = c.Env
+	return e
+}
+
+// stop terminates the step whose pid is in pidFile, stopping `docker exec` doesn't stop it
+func (ct *Container) stop(pidFile string, exited <-chan struct{}) {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		log.Printf("Step not started in container %s: %v", ct.ID, err)
+		return
+	}
+	pid := strings.TrimSpace(string(data))
+	log.Printf("Sending SIGTERM to process %s in container %s", pid, ct.ID)
+	exec.Command(ContainerCLI, "exec", ct.ID, "kill", "-s", "TERM", pid).Run()
+
+	select {
+	case <-exited:
+	case <-time.After(killGracePeriod):
+		log.Printf("Process %s still running after %v, sending SIGKILL", pid, killGracePeriod)
+		exec.Command(ContainerCLI, "exec", ct.ID, "kill", "-s", "KILL", pid).Run()
+	}
+}
@@ -0,0 +1,167 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// fakeCLI is a docker running the commands it is asked to exec on the host, and logging the
+// containers it is asked to run and remove to calls
+const fakeCLI = `#!/bin/sh
+action=$1
+shift
+case $action in
+run)
+	echo "run $*" >> "$CALLS"
+	echo "pulling image" >&2
+	echo c0ffee ;;
+rm)
+	echo "rm $*" >> "$CALLS" ;;
+exec)
+	while [ $# -gt 0 ]; do
+		case $1 in
+		--workdir) cd "$2"; shift 2 ;;
+		--env) shift 2 ;;
+		*) break ;;
+		esac
+	done
+	shift
+	exec "$@" ;;
+esac
+`
+
+// withFakeCLI points ContainerCLI to fakeCLI until the returned func is called
+func withFakeCLI(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "container")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	cli := filepath.Join(dir, "docker")
+	if err := ioutil.WriteFile(cli, []byte(fakeCLI), 0755); err != nil {
+		t.Fatalf("Couldn't write the fake CLI: %v", err)
+	}
+	oldCLI, oldCalls := ContainerCLI, os.Getenv("CALLS")
+	ContainerCLI = cli
+	os.Setenv("CALLS", filepath.Join(dir, "calls"))
+	return dir, func() {
+		ContainerCLI = oldCLI
+		os.Setenv("CALLS", oldCalls)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestContainerCommand(t *testing.T) {
+	ct := &Container{ID: "c0ffee", scriptDir: "/tmp/steps"}
+	c, _ := processCommand(screwdriver.CommandDef{Cmd: "make"}, "/bin/sh", "step")
+	c.Dir = "/sd/workspace/src"
+	c.Env = []string{"PATH=/usr/bin", "SD_TOKEN=secret", "FOO=bar"}
+
+	got := ct.command(c, "/tmp/steps/step.pid")
+	want := []string{
+		ContainerCLI, "exec", "--workdir", "/sd/workspace/src", "--env", "SD_TOKEN", "--env", "FOO",
+		"c0ffee", "sh", "-c", `echo $$ > "$0" && exec "$@"`, "/tmp/steps/step.pid",
+		"/bin/sh", "-e", filepath.Join(scriptDir, "step.sh"),
+	}
+	if !reflect.DeepEqual(got.Args, want) {
+		t.Errorf("command() args = %q, want %q", got.Args, want)
+	}
+	if !reflect.DeepEqual(got.Env, c.Env) {
+		t.Errorf("command() env = %q, want %q", got.Env, c.Env)
+	}
+}
+
+func TestRunInContainer(t *testing.T) {
+	dir, cleanup := withFakeCLI(t)
+	defer cleanup()
+
+	pull := new(strings.Builder)
+	ct, err := StartContainer("node:18", []string{dir}, pull)
+	if err != nil {
+		t.Fatalf("StartContainer() error: %v", err)
+	}
+	if ct.ID != "c0ffee" || !strings.Contains(pull.String(), "pulling image") {
+		t.Errorf("Started container %q writing %q", ct.ID, pull.String())
+	}
+	StepContainer = ct
+	defer func() { StepContainer = nil }()
+
+	build := screwdriver.Build{Commands: []screwdriver.CommandDef{
+		{Name: "one", Cmd: "export FOO=bar; echo $GREETING from $(basename $PWD)"},
+		{Name: "two", Cmd: "echo foo=$FOO"},
+		{Name: "fail", Cmd: "exit 7"},
+	}}
+	var stops []string
+	api := MockAPI{
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			stops = append(stops, stepName+"="+strconv.Itoa(exitCode))
+			return nil
+		},
+	}
+	emitter := &MockEmitter{}
+
+	err = Run(dir, []string{"GREETING=hello"}, emitter, build, api, 1, "/bin/sh", TestBuildTimeout, filepath.Join(dir, "env"), dir)
+	if err != (ErrStatus{7}) {
+		t.Errorf("Run() error = %v, want exit status 7", err)
+	}
+	if want := []string{"one=0", "two=0", "fail=7"}; !reflect.DeepEqual(stops, want) {
+		t.Errorf("Steps stopped = %v, want %v", stops, want)
+	}
+	output := string(emitter.found)
+	for _, want := range []string{"hello from " + filepath.Base(dir), "foo=\n"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q has no %q", output, want)
+		}
+	}
+
+	if err := ct.Remove(); err != nil {
+		t.Errorf("Remove() error: %v", err)
+	}
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	want := "run --detach --init --entrypoint tail --volume " + ct.scriptDir + ":" + ct.scriptDir +
+		" --volume " + dir + ":" + dir + " node:18 -f /dev/null\nrm --force c0ffee\n"
+	if string(calls) != want {
+		t.Errorf("Calls = %q, want %q", calls, want)
+	}
+	if _, err := os.Stat(ct.scriptDir); !os.IsNotExist(err) {
+		t.Errorf("Step scripts dir left behind: %v", err)
+	}
+}
+
+func TestRunInContainerTimeout(t *testing.T) {
+	_, cleanup := withFakeCLI(t)
+	defer cleanup()
+	oldKillGracePeriod := killGracePeriod
+	defer func() { killGracePeriod = oldKillGracePeriod }()
+	killGracePeriod = 100 * time.Millisecond
+
+	ct, err := StartContainer("node:18", nil, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("StartContainer() error: %v", err)
+	}
+	defer ct.Remove()
+	StepContainer = ct
+	defer func() { StepContainer = nil }()
+
+	cmd := screwdriver.CommandDef{Name: "slow", Cmd: "sleep 30", Timeout: 1}
+	start := time.Now()
+	ctx, cancel := stepContext(context.Background(), cmd)
+	defer cancel()
+	if _, err := runProcessStep(ctx, cmd, nil, "", &MockEmitter{}, "/bin/sh", os.TempDir(), "step", false); err != context.DeadlineExceeded {
+		t.Errorf("runProcessStep() error = %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("The step ran for %v after its timeout", elapsed)
+	}
+}
@@ -2,6 +2,7 @@ package executor
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,12 +10,11 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
-	"github.com/creack/pty"
 	"github.com/screwdriver-cd/launcher/screwdriver"
 	"gopkg.in/myesui/uuid.v1"
 )
@@ -39,9 +39,101 @@ func (e ErrStatus) Error() string {
 	return fmt.Sprintf("exit %d", e.Status)
 }
 
+// ErrTimeout is the error when the build or one of its steps runs for too long
+type ErrTimeout struct {
+	// Step is set when the step timeout was reached, empty for the build timeout
+	Step    string
+	Timeout time.Duration
+}
+
+func (e ErrTimeout) Error() string {
+	if e.Step != "" {
+		return fmt.Sprintf("Timeout of %v exceeded by step %s", e.Timeout, e.Step)
+	}
+	return fmt.Sprintf("Timeout of %v exceeded", e.Timeout)
+}
+
+// ErrAborted is the error when the build is stopped before its steps are done
+type ErrAborted struct {
+	Reason string
+}
+
+func (e ErrAborted) Error() string {
+	return "Build aborted: " + e.Reason
+}
+
+// aborts holds the reason the running build has to stop
+var aborts = make(chan ErrAborted, 1)
+
+// Abort stops the running build: the current step is killed, the remaining steps are skipped
+// and the teardown steps run. Run then returns an ErrAborted.
+func Abort(reason string) {
+	select {
+	case aborts <- ErrAborted{Reason: reason}:
+	default:
+		// The build is already being aborted
+	}
+}
+
+// PendingAbort returns the ErrAborted of an abort no step was left to handle, nil when the build
+// wasn't aborted
+func PendingAbort() error {
+	select {
+	case abortErr := <-aborts:
+		return abortErr
+	default:
+		return nil
+	}
+}
+
+// How long a timed out step gets to exit after SIGTERM before it is killed
+var killGracePeriod = 10 * time.Second
+
+// stepContext limits ctx to the timeout of the step, if it has one
+func stepContext(ctx context.Context, cmd screwdriver.CommandDef) (context.Context, context.CancelFunc) {
+	if cmd.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(cmd.Timeout)*time.Second)
+}
+
+var envNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// shellQuote quotes a value so the shell reads it literally
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// stepEnvironment returns the shell commands exporting the environment of a step,
+// and the ones putting back the previous values once the step is done
+func stepEnvironment(cmd screwdriver.CommandDef) (setup []string, restore []string, err error) {
+	names := make([]string, 0, len(cmd.Environment))
+	for name := range cmd.Environment {
+		if !envNameRegexp.MatchString(name) {
+			return nil, nil, fmt.Errorf("Invalid environment variable name %q for step %q", name, cmd.Name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// sd_saved_NAME is "x<value>" when NAME was set, and empty when it was not
+		saved := "sd_saved_" + name
+		setup = append(setup,
+			fmt.Sprintf(`%s=${%s+"x$%s"}`, saved, name, name),
+			fmt.Sprintf("export %s=%s", name, shellQuote(cmd.Environment[name])))
+		restore = append(restore,
+			fmt.Sprintf(`if [ -n "$%s" ]; then export %s="${%s#x}"; else unset %s; fi`, saved, name, saved, name),
+			"unset "+saved)
+	}
+	return setup, restore, nil
+}
+
 // Create a sh file
+// createShFile writes the script of cmd for a POSIX shell. Steps written on Windows would
+// end their lines with a \r the shell takes for part of the command.
 func createShFile(path string, cmd screwdriver.CommandDef, shellBin string) error {
-	return ioutil.WriteFile(path, []byte("#!"+shellBin+" -e\n"+cmd.Cmd), 0755)
+	return ioutil.WriteFile(path, []byte("#!"+shellBin+" -e\n"+toLF(cmd.Cmd)), 0755)
 }
 
 // Returns a single line (without the ending \n) from the input buffered reader
@@ -102,13 +194,19 @@ func copyLinesUntil(r io.Reader, w io.Writer, match string) (int, error) {
 	return ExitOk, nil
 }
 
-func doRunCommand(guid, path string, emitter screwdriver.Emitter, f *os.File, fReader io.Reader) (int, error) {
-	executionCommand := []string{
-		"export SD_STEP_ID=" + guid,
-		";. " + path,
-		";echo",
-		";echo " + guid + " $?\n",
+func doRunCommand(guid, run string, stepEnv, restoreEnv []string, emitter screwdriver.Emitter, f *os.File, fReader io.Reader) (int, error) {
+	executionCommand := []string{"export SD_STEP_ID=" + guid}
+	for _, c := range stepEnv {
+		executionCommand = append(executionCommand, ";"+c)
+	}
+	executionCommand = append(executionCommand, ";"+run)
+	for _, c := range restoreEnv {
+		executionCommand = append(executionCommand, ";"+c)
 	}
+	executionCommand = append(executionCommand,
+		";echo",
+		";echo "+guid+" $?\n",
+	)
 	shargs := strings.Join(executionCommand, " ")
 
 	f.Write([]byte(shargs))
@@ -116,17 +214,49 @@ func doRunCommand(guid, path string, emitter screwdriver.Emitter, f *os.File, fR
 	return copyLinesUntil(fReader, emitter, guid)
 }
 
+// exportShellEnv has the build shell running on f write the variables it exports to file, as a
+// script to source
+func exportShellEnv(f *os.File, file string) error {
+	guid := uuid.NewV4().String()
+	tmp := shellQuote(file + "_tmp")
+	fmt.Fprintf(f, "export -p | grep -vi \"PS1=\" > %s && mv %s %s ;echo ;echo %s $?\n", tmp, tmp, shellQuote(file), guid)
+	_, err := copyLinesUntil(f, ioutil.Discard, guid)
+	return err
+}
+
 // Executes teardown commands
 func doRunTeardownCommand(cmd screwdriver.CommandDef, emitter screwdriver.Emitter, path, shellBin, exportFile, sourceDir string) (int, error) {
+	// Teardowns run in their own shell, so the step environment doesn't need to be restored
+	stepEnv, _, err := stepEnvironment(cmd)
+	if err != nil {
+		return ExitLaunch, err
+	}
+	envCmd := ""
+	for _, c := range stepEnv {
+		envCmd += c + "; "
+	}
+
+	// PowerShell teardowns run from a POSIX shell setting up their environment
+	run := cmd.Cmd
+	if isPowerShell(shellBin) {
+		if run, err = writeStepScript(teardownScriptPath, cmd, shellBin); err != nil {
+			return ExitLaunch, fmt.Errorf("Writing to teardown script file: %v", err)
+		}
+	}
+	shell := buildShell(shellBin)
+	quotedExport := shellQuote(exportFile)
+
 	shargs := []string{"-e", "-c"}
-	cmdStr := "export PATH=$PATH:/opt/sd && " +
-		"START=$(date +'%s'); while ! [ -f " + exportFile + " ] && [ $(($(date +'%s')-$START)) -lt " + strconv.Itoa(WaitTimeout) + " ]; do sleep 1; done; " +
-		"if [ -f " + exportFile + " ]; then set +e; . " + exportFile + "; set -e; fi; " +
-		cmd.Cmd
+	cmdStr := strings.Join(shellOptions(shell), "; ") + "; " +
+		"export PATH=$PATH:/opt/sd && " +
+		"START=$(date +'%s'); while ! [ -f " + quotedExport + " ] && [ $(($(date +'%s')-$START)) -lt " + strconv.Itoa(WaitTimeout) + " ]; do sleep 1; done; " +
+		"if [ -f " + quotedExport + " ]; then set +e; . " + quotedExport + "; set -e; fi; " +
+		envCmd +
+		run
 
 	shargs = append(shargs, cmdStr)
 
-	c := exec.Command(shellBin, shargs...)
+	c := exec.Command(shell, shargs...)
 	emitter.StartCmd(cmd)
 	fmt.Fprintf(emitter, "$ %s\n", cmd.Cmd)
 	c.Stdout = emitter
@@ -139,9 +269,7 @@ func doRunTeardownCommand(cmd screwdriver.CommandDef, emitter screwdriver.Emitte
 
 	if err := c.Wait(); err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
-			waitStatus := exitError.Sys().(syscall.WaitStatus)
-
-			return waitStatus.ExitStatus(), ErrStatus{waitStatus.ExitStatus()}
+			return exitError.ExitCode(), ErrStatus{exitError.ExitCode()}
 		}
 
 		return ExitUnknown, fmt.Errorf("Running command %q: %v", cmd.Cmd, err)
@@ -150,14 +278,6 @@ func doRunTeardownCommand(cmd screwdriver.CommandDef, emitter screwdriver.Emitte
 	return ExitOk, nil
 }
 
-// Initiate the build timeout timer
-func initBuildTimeout(timeout time.Duration, ch chan<- error) {
-	log.Printf("Starting timer for timeout of %v seconds", timeout)
-	time.Sleep(timeout)
-	log.Printf("Timeout of %v seconds exceeded. Signal kill-build process", timeout)
-	ch <- fmt.Errorf("Timeout of %v seconds exceeded", timeout)
-}
-
 // print timeout message to build & kill shell
 func handleBuildTimeout(f *os.File, timeoutErr error) {
 	l := []string{
@@ -187,6 +307,8 @@ func handleBuildTimeout(f *os.File, timeoutErr error) {
 	f.Write([]byte{4})
 }
 
+// filterTeardowns splits the steps from the teardowns, named "sd-teardown-*" for the ones
+// of Screwdriver and "[pre|post]teardown-*" or flagged as teardown for the ones of the user
 func filterTeardowns(build screwdriver.Build) ([]screwdriver.CommandDef, []screwdriver.CommandDef, []screwdriver.CommandDef) {
 	userCommands := []screwdriver.CommandDef{}
 	sdTeardownCommands := []screwdriver.CommandDef{}
@@ -195,6 +317,7 @@ func filterTeardowns(build screwdriver.Build) ([]screwdriver.CommandDef, []screw
 	for _, cmd := range build.Commands {
 		isSdTeardown, _ := regexp.MatchString("^sd-teardown-.+", cmd.Name)
 		isUserTeardown, _ := regexp.MatchString("^(pre|post)?teardown-.+", cmd.Name)
+		isUserTeardown = isUserTeardown || cmd.Teardown
 
 		if isSdTeardown {
 			sdTeardownCommands = append(sdTeardownCommands, cmd)
@@ -210,35 +333,47 @@ func filterTeardowns(build screwdriver.Build) ([]screwdriver.CommandDef, []screw
 
 // Run executes a slice of CommandDefs
 func Run(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeoutSec int, envFilepath, sourceDir string) error {
+	if !persistentShell || StepContainer != nil {
+		return runStandalone(path, env, emitter, build, api, buildID, shellBin, timeoutSec, sourceDir)
+	}
+
 	tmpFile := envFilepath + "_tmp"
 	exportFile := envFilepath + "_export"
 
+	// Steps are run with shellBin, the build itself needs a POSIX shell
+	stepShell := shellBin
+	shellBin = buildShell(shellBin)
+
 	// Set up a single pseudo-terminal
 	c := exec.Command(shellBin)
 	c.Dir = path
 	c.Env = append(env, c.Env...)
 
-	f, err := pty.Start(c)
+	f, err := startShell(c)
 	if err != nil {
 		return fmt.Errorf("Cannot start shell: %v", err)
 	}
+	shellExited := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(shellExited)
+	}()
 
 	// Command to Export Env. Use tmpfile just in case export -p takes some time
 	exportEnvCmd :=
-		"tmpfile=" + tmpFile + "; exportfile=" + exportFile + "; " +
+		"tmpfile=" + shellQuote(tmpFile) + "; exportfile=" + shellQuote(exportFile) + "; " +
 			"export -p | grep -vi \"PS1=\" > $tmpfile && mv $tmpfile $exportfile; "
 
 	// Run setup commands
-	setupCommands := []string{
-		"set -e",
+	setupCommands := append(shellOptions(shellBin),
 		"export PATH=$PATH:/opt/sd",
 		// trap EXIT, echo the last step ID and write ENV to /tmp/buildEnv
-		"finish() { " +
-			"EXITCODE=$?; " +
-			exportEnvCmd +
+		"finish() { "+
+			"EXITCODE=$?; "+
+			exportEnvCmd+
 			"echo $SD_STEP_ID $EXITCODE; }", //mv newfile to file
 		"trap finish EXIT;\n",
-	}
+	)
 
 	shargs := strings.Join(setupCommands, " && ")
 
@@ -249,27 +384,70 @@ func Run(path string, env []string, emitter screwdriver.Emitter, build screwdriv
 	var cmdErr error
 
 	timeout := time.Duration(timeoutSec) * time.Second
-	invokeTimeout := make(chan error, 1)
-
-	// start build timeout timer
-	go initBuildTimeout(timeout, invokeTimeout)
+	log.Printf("Starting timer for timeout of %v seconds", timeout)
+	buildCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
 	userCommands, sdTeardownCommands, userTeardownCommands := filterTeardowns(build)
 
-	for _, cmd := range userCommands {
+	for i := 0; i < len(userCommands); i++ {
+		cmd := userCommands[i]
 		// Start set up & user steps if previous steps succeed
 		if firstError != nil {
 			break
 		}
 
+		// Don't start a step for an aborted build
+		select {
+		case abortErr := <-aborts:
+			log.Printf("%v before step %s", abortErr, cmd.Name)
+			fmt.Fprintf(emitter, "\n%v\n", abortErr)
+			stopShell(c.Process.Pid, shellExited)
+			firstError = abortErr
+		default:
+		}
+		if firstError != nil {
+			break
+		}
+
+		// The steps of a group can't share the shell, they run in processes of their own
+		// starting with the variables exported so far
+		if cmd.Group != "" {
+			group := groupAt(userCommands, i)
+			i += len(group) - 1
+			groupEnvFile := envFilepath + "_group"
+			if err := exportShellEnv(f, groupEnvFile); err != nil {
+				firstError = fmt.Errorf("Exporting the environment of step group %s: %v", cmd.Group, err)
+				break
+			}
+			firstError = runGroup(buildCtx, group, env, groupEnvFile, emitter, api, buildID, stepShell, path, timeout)
+			continue
+		}
+
+		// Errors of the launcher itself still leave the teardowns to run
 		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
-			return fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+			firstError = fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+			break
 		}
 
 		// Create step script file
-		stepFilePath := "/tmp/step.sh"
-		if err := createShFile(stepFilePath, cmd, shellBin); err != nil {
-			return fmt.Errorf("Writing to step script file: %v", err)
+		run, err := writeStepScript(stepScriptPath, cmd, stepShell)
+		if err != nil {
+			firstError = fmt.Errorf("Writing to step script file: %v", err)
+			break
+		}
+
+		stepEnv, restoreEnv, err := stepEnvironment(cmd)
+		if err != nil {
+			firstError = err
+			break
+		}
+
+		// The shell runs the step, the limits of the step are the ones of the shell meanwhile
+		releaseLimits, err := applyLimits(c.Process.Pid, cmd)
+		if err != nil {
+			firstError = err
+			break
 		}
 
 		// Generate guid for the step
@@ -285,48 +463,83 @@ func Run(path string, env []string, emitter screwdriver.Emitter, build screwdriv
 		fReader := bufio.NewReader(f)
 
 		go func() {
-			runCode, rcErr := doRunCommand(guid, stepFilePath, emitter, f, fReader)
+			runCode, rcErr := doRunCommand(guid, run, stepEnv, restoreEnv, emitter, f, fReader)
 			// exit code & errors from doRunCommand
 			eCode <- runCode
 			runErr <- rcErr
 		}()
 
+		stepCtx, stepCancel := stepContext(buildCtx, cmd)
+		stepFailed := false
 		select {
 		case cmdErr = <-runErr:
 			if firstError == nil {
 				firstError = cmdErr
 			}
 			code = <-eCode
-		case buildTimeout := <-invokeTimeout:
-			handleBuildTimeout(f, buildTimeout)
+			stepFailed = cmdErr != nil
+		case <-stepCtx.Done():
+			timeoutErr := ErrTimeout{Timeout: timeout}
+			if buildCtx.Err() == nil {
+				timeoutErr = ErrTimeout{Step: cmd.Name, Timeout: time.Duration(cmd.Timeout) * time.Second}
+			}
+			log.Printf("%v. Signal kill-build process", timeoutErr)
+			handleBuildTimeout(f, timeoutErr)
+			stopShell(c.Process.Pid, shellExited)
 
 			if firstError == nil {
-				firstError = buildTimeout
+				firstError = timeoutErr
 				code = 3
 			}
+		case abortErr := <-aborts:
+			log.Printf("%v. Signal kill-build process", abortErr)
+			fmt.Fprintf(emitter, "\n%v\n", abortErr)
+			stopShell(c.Process.Pid, shellExited)
+
+			if firstError == nil {
+				firstError = abortErr
+				code = 3
+			}
+		}
+		stepCancel()
+		// A step killed for going over its limits says so rather than only failing
+		if limitErr := releaseLimits(); limitErr != nil && stepFailed {
+			log.Println(limitErr)
+			fmt.Fprintf(emitter, "\n%v\n", limitErr)
+			firstError = limitErr
 		}
 
-		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil {
-			return fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+		emitter.StopCmd(cmd, code)
+		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil && firstError == nil {
+			firstError = fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
 		}
 	}
 
 	teardownCommands := append(userTeardownCommands, sdTeardownCommands...)
 
+	// Every teardown runs, their failures only fail a build whose steps succeeded
 	for index, cmd := range teardownCommands {
-		if index == 0 && firstError == nil {
-			// Exit shell only if previous user steps ran successfully
-			f.Write([]byte{4})
+		if index == 0 {
+			// Exit the shell if it is still running, its trap exports the environment
+			select {
+			case <-shellExited:
+			default:
+				f.Write([]byte{4})
+			}
 		}
 
 		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
-			return fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+			log.Printf("Updating step start %q: %v", cmd.Name, err)
 		}
 
-		code, cmdErr = doRunTeardownCommand(cmd, emitter, path, shellBin, exportFile, sourceDir)
+		code, cmdErr = doRunTeardownCommand(cmd, emitter, path, stepShell, exportFile, sourceDir)
+		emitter.StopCmd(cmd, code)
 
 		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil {
-			return fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+			log.Printf("Updating step stop %q: %v", cmd.Name, err)
+			if cmdErr == nil {
+				cmdErr = fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+			}
 		}
 
 		if firstError == nil {
@@ -334,5 +547,10 @@ func Run(path string, env []string, emitter screwdriver.Emitter, build screwdriv
 		}
 	}
 
+	// The teardowns aren't stopped, but a build aborted meanwhile still ends as aborted
+	if abortErr := PendingAbort(); abortErr != nil && firstError == nil {
+		firstError = abortErr
+	}
+
 	return firstError
 }
@@ -1,11 +1,16 @@
+//go:build !windows
+// +build !windows
+
 package executor
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"reflect"
 	"strconv"
 	"strings"
@@ -40,7 +45,7 @@ func (f MockAPI) PipelineFromID(pipelineID int) (screwdriver.Pipeline, error) {
 	return screwdriver.Pipeline{}, nil
 }
 
-func (f MockAPI) UpdateBuildStatus(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int) error {
+func (f MockAPI) UpdateBuildStatus(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
 	return nil
 }
 
@@ -74,8 +79,25 @@ func (f MockAPI) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, er
 	return "foobar", nil
 }
 
+func (f MockAPI) GetCheckoutToken(buildID int) (string, error) {
+	return "", nil
+}
+
+func (f MockAPI) ReportQueuePosition(buildID int, position int) error {
+	return nil
+}
+
+func (f MockAPI) LatestBuild(jobID int, status screwdriver.BuildStatus) (screwdriver.Build, error) {
+	return screwdriver.Build{}, nil
+}
+
+func (f MockAPI) StartNextJobs(eventID, jobID int, meta map[string]interface{}) ([]screwdriver.Build, error) {
+	return nil, nil
+}
+
 type MockEmitter struct {
 	startCmd func(screwdriver.CommandDef)
+	stopCmd  func(screwdriver.CommandDef, int)
 	write    func([]byte) (int, error)
 	close    func() error
 	found    []byte
@@ -92,6 +114,12 @@ func (e *MockEmitter) StartCmd(cmd screwdriver.CommandDef) {
 	return
 }
 
+func (e *MockEmitter) StopCmd(cmd screwdriver.CommandDef, exitCode int) {
+	if e.stopCmd != nil {
+		e.stopCmd(cmd, exitCode)
+	}
+}
+
 func (e *MockEmitter) Write(b []byte) (int, error) {
 	if e.write != nil {
 		return e.write(b)
@@ -222,6 +250,49 @@ func TestUnmocked(t *testing.T) {
 	}
 }
 
+func TestStepEnvironment(t *testing.T) {
+	cmd := screwdriver.CommandDef{
+		Name: "test",
+		Cmd:  "env",
+		Environment: map[string]string{
+			"FOO":   "it's a step",
+			"EMPTY": "",
+			"NEW":   "$FOO",
+		},
+	}
+
+	setup, restore, err := stepEnvironment(cmd)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	script := strings.Join([]string{
+		"export FOO=before",
+		"export EMPTY=",
+		strings.Join(setup, "; "),
+		`echo "step: FOO=$FOO EMPTY=$EMPTY NEW=$NEW"`,
+		strings.Join(restore, "; "),
+		`echo "after: FOO=$FOO EMPTY=${EMPTY-unset} NEW=${NEW-unset}"`,
+		`env | grep -c ^sd_saved_ || true`,
+	}, "; ")
+	out, err := exec.Command("/bin/sh", "-e", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Running %q: %v: %s", script, err, out)
+	}
+
+	want := "step: FOO=it's a step EMPTY= NEW=$FOO\n" +
+		"after: FOO=before EMPTY= NEW=unset\n" +
+		"0\n"
+	if string(out) != want {
+		t.Errorf("Output = %q, want %q", out, want)
+	}
+
+	cmd.Environment = map[string]string{"NOT-VALID": "foo"}
+	if _, _, err := stepEnvironment(cmd); err == nil {
+		t.Errorf("Expected an error for an invalid variable name")
+	}
+}
+
 func TestMulti(t *testing.T) {
 	envFilepath := "/tmp/testMulti"
 	setupTestCase(t, envFilepath)
@@ -388,6 +459,67 @@ func TestTeardownfail(t *testing.T) {
 	}
 }
 
+func TestFilterTeardowns(t *testing.T) {
+	build := screwdriver.Build{Commands: []screwdriver.CommandDef{
+		{Name: "sd-setup-scm"},
+		{Name: "sd-teardown-artifacts"},
+		{Name: "test"},
+		{Name: "teardown-report"},
+		{Name: "notify", Teardown: true},
+		{Name: "preteardown-logs"},
+	}}
+	names := func(cmds []screwdriver.CommandDef) (names []string) {
+		for _, cmd := range cmds {
+			names = append(names, cmd.Name)
+		}
+		return names
+	}
+
+	user, sdTeardowns, userTeardowns := filterTeardowns(build)
+	if want := []string{"sd-setup-scm", "test"}; !reflect.DeepEqual(names(user), want) {
+		t.Errorf("Steps = %q, want %q", names(user), want)
+	}
+	if want := []string{"sd-teardown-artifacts"}; !reflect.DeepEqual(names(sdTeardowns), want) {
+		t.Errorf("Screwdriver teardowns = %q, want %q", names(sdTeardowns), want)
+	}
+	if want := []string{"teardown-report", "notify", "preteardown-logs"}; !reflect.DeepEqual(names(userTeardowns), want) {
+		t.Errorf("User teardowns = %q, want %q", names(userTeardowns), want)
+	}
+}
+
+func TestTeardownAfterFailure(t *testing.T) {
+	envFilepath := "/tmp/testTeardownAfterFailure"
+	setupTestCase(t, envFilepath)
+	commands := []screwdriver.CommandDef{
+		{Cmd: "exit 2", Name: "test"},
+		{Cmd: "echo never", Name: "skipped"},
+		{Cmd: "exit 3", Name: "notify", Teardown: true},
+		{Cmd: "echo upload artifacts", Name: "sd-teardown-artifacts"},
+	}
+	testBuild := screwdriver.Build{
+		ID:          12345,
+		Commands:    commands,
+		Environment: []map[string]string{},
+	}
+	codes := map[string]int{}
+	testAPI := screwdriver.API(MockAPI{
+		updateStepStart: func(buildID int, stepName string) error {
+			return nil
+		},
+		updateStepStop: func(buildID int, stepName string, code int) error {
+			codes[stepName] = code
+			return nil
+		},
+	})
+	err := Run("", nil, &MockEmitter{}, testBuild, testAPI, testBuild.ID, "/bin/sh", TestBuildTimeout, envFilepath, "")
+	if err == nil || err.Error() != "Launching command exit with code: 2" {
+		t.Errorf("Unexpected error: %v - should be the one of the failed step", err)
+	}
+	if want := map[string]int{"test": 2, "notify": 3, "sd-teardown-artifacts": 0}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("Step exit codes = %v, want %v", codes, want)
+	}
+}
+
 func TestTimeout(t *testing.T) {
 	envFilepath := "/tmp/testTimeout"
 	setupTestCase(t, envFilepath)
@@ -424,7 +556,10 @@ func TestTimeout(t *testing.T) {
 	}
 	testTimeout := 3
 	err := Run("", nil, &emitter, testBuild, testAPI, testBuild.ID, "/bin/sh", testTimeout, envFilepath, "")
-	expectedErr := fmt.Errorf("Timeout of %vs seconds exceeded", testTimeout)
+	expectedErr := ErrTimeout{Timeout: time.Duration(testTimeout) * time.Second}
+	if err.Error() != fmt.Sprintf("Timeout of %vs exceeded", testTimeout) {
+		t.Errorf("Unexpected error message: %v", err)
+	}
 	if !reflect.DeepEqual(err, expectedErr) {
 		t.Fatalf("Unexpected error: %v - should be %v", err, expectedErr)
 	}
@@ -596,3 +731,116 @@ func TestUserShell(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestErrTimeout(t *testing.T) {
+	build := ErrTimeout{Timeout: 90 * time.Minute}
+	if got, want := build.Error(), "Timeout of 1h30m0s exceeded"; got != want {
+		t.Errorf("Build timeout error = %q, want %q", got, want)
+	}
+
+	step := ErrTimeout{Step: "test", Timeout: 30 * time.Second}
+	if got, want := step.Error(), "Timeout of 30s exceeded by step test"; got != want {
+		t.Errorf("Step timeout error = %q, want %q", got, want)
+	}
+}
+
+func TestStepContext(t *testing.T) {
+	ctx, cancel := stepContext(context.Background(), screwdriver.CommandDef{Name: "no timeout"})
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Step without a timeout should not have a deadline")
+	}
+	cancel()
+
+	start := time.Now()
+	ctx, cancel = stepContext(context.Background(), screwdriver.CommandDef{Name: "timeout", Timeout: 60})
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || deadline.Sub(start) > 61*time.Second || deadline.Sub(start) < 59*time.Second {
+		t.Errorf("Step deadline = %v, want a minute from now", deadline)
+	}
+
+	buildCtx, buildCancel := context.WithCancel(context.Background())
+	ctx, cancel = stepContext(buildCtx, screwdriver.CommandDef{Name: "timeout", Timeout: 60})
+	defer cancel()
+	buildCancel()
+	if ctx.Err() == nil {
+		t.Errorf("Step context should end with the build context")
+	}
+}
+
+func TestStopShell(t *testing.T) {
+	oldKillGracePeriod := killGracePeriod
+	defer func() { killGracePeriod = oldKillGracePeriod }()
+
+	tests := map[string]struct {
+		script      string
+		gracePeriod time.Duration
+	}{
+		"terminated": {"sleep 30 & wait", 10 * time.Second},
+		"killed":     {"trap '' TERM; sleep 30 & wait; sleep 30", 100 * time.Millisecond},
+	}
+
+	for name, test := range tests {
+		killGracePeriod = test.gracePeriod
+
+		c := exec.Command("/bin/sh", "-c", test.script)
+		newProcessGroup(c)
+		if err := c.Start(); err != nil {
+			t.Fatalf("Couldn't start shell: %v", err)
+		}
+		exited := make(chan struct{})
+		go func() {
+			c.Wait()
+			close(exited)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		stopShell(c.Process.Pid, exited)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: shell still running after stopShell", name)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: stopping the shell took %v", name, elapsed)
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	Abort("Received terminated")
+	Abort("Build was aborted from the UI")
+
+	select {
+	case err := <-aborts:
+		want := ErrAborted{Reason: "Received terminated"}
+		if err != want {
+			t.Errorf("Abort reason = %v, want %v", err, want)
+		}
+		if err.Error() != "Build aborted: Received terminated" {
+			t.Errorf("Unexpected error message %q", err.Error())
+		}
+	default:
+		t.Fatalf("Abort did not queue the abort")
+	}
+
+	select {
+	case err := <-aborts:
+		t.Errorf("Only the first abort should be kept, got %v", err)
+	default:
+	}
+}
+
+func TestPendingAbort(t *testing.T) {
+	if err := PendingAbort(); err != nil {
+		t.Errorf("PendingAbort() = %v without an abort", err)
+	}
+	Abort("Received terminated")
+	if err := PendingAbort(); err != (ErrAborted{Reason: "Received terminated"}) {
+		t.Errorf("PendingAbort() = %v, want the abort", err)
+	}
+	if err := PendingAbort(); err != nil {
+		t.Errorf("PendingAbort() = %v, want the abort handled once", err)
+	}
+}
@@ -0,0 +1,151 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// groupAt returns the steps of cmds from start on that belong to the group of the first one
+func groupAt(cmds []screwdriver.CommandDef, start int) []screwdriver.CommandDef {
+	end := start + 1
+	for end < len(cmds) && cmds[end].Group == cmds[start].Group {
+		end++
+	}
+	return cmds[start:end]
+}
+
+// taggedWriter writes the complete lines of a step of a group to out, starting with the name
+// of the step. The steps of the group share mu so their lines don't get mixed up.
+type taggedWriter struct {
+	out     io.Writer
+	mu      *sync.Mutex
+	tag     []byte
+	partial []byte
+}
+
+func (w *taggedWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	end := bytes.LastIndexByte(w.partial, '\n') + 1
+	if end == 0 {
+		return len(p), nil
+	}
+	var lines []byte
+	for _, line := range bytes.SplitAfter(w.partial[:end], []byte("\n")) {
+		if len(line) > 0 {
+			lines = append(append(lines, w.tag...), line...)
+		}
+	}
+	w.partial = append(w.partial[:0], w.partial[end:]...)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(lines)
+	return len(p), err
+}
+
+// flush writes what is left of the last line
+func (w *taggedWriter) flush() {
+	if len(w.partial) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
+
+// groupResult is how a step of a group ended
+type groupResult struct {
+	code     int
+	err      error
+	start    time.Time
+	duration time.Duration
+}
+
+// GroupStepTimes is told when each step of a group actually started and stopped. The emitter
+// only starts and stops them one after the other once the group is done, for their logs.
+var GroupStepTimes = func(cmd screwdriver.CommandDef, start, stop time.Time) {}
+
+// runGroup runs the steps of a group at once, each in a process of its own with env and the
+// variables exported by envFile when set, and waits for all of them. Their lines stream in the log of the first step, tagged with the name of
+// their step, and the report of the group lists them in order once they are all done. It
+// returns the error of the first step of the group that failed, the ErrTimeout when ctx is done
+// and the ErrAborted when the build is aborted meanwhile.
+func runGroup(ctx context.Context, group []screwdriver.CommandDef, env []string, envFile string, emitter screwdriver.Emitter, api screwdriver.API, buildID int, shellBin, dir string, timeout time.Duration) error {
+	var names []string
+	for _, cmd := range group {
+		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
+			return fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+		}
+		names = append(names, cmd.Name)
+	}
+	emitter.StartCmd(group[0])
+	fmt.Fprintf(emitter, "Running step group %s: %s\n", group[0].Group, strings.Join(names, ", "))
+
+	groupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	results := make([]groupResult, len(group))
+	var wg sync.WaitGroup
+	for i, cmd := range group {
+		wg.Add(1)
+		go func(i int, cmd screwdriver.CommandDef) {
+			defer wg.Done()
+			out := &taggedWriter{out: emitter, mu: &mu, tag: []byte("[" + cmd.Name + "] ")}
+			start := time.Now()
+			stepCtx, stepCancel := stepContext(groupCtx, cmd)
+			code, err := runProcessStep(stepCtx, cmd, env, envFile, out, shellBin, dir, fmt.Sprintf("step-%d", i), false)
+			stepCancel()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout{Timeout: timeout}
+				if ctx.Err() == nil {
+					err = ErrTimeout{Step: cmd.Name, Timeout: time.Duration(cmd.Timeout) * time.Second}
+				}
+				fmt.Fprintf(out, "%v\n", err)
+			}
+			out.flush()
+			results[i] = groupResult{code: code, err: err, start: start, duration: time.Since(start)}
+			if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil {
+				log.Printf("Updating step stop %q: %v", cmd.Name, err)
+			}
+		}(i, cmd)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var firstError error
+	select {
+	case <-done:
+	case abortErr := <-aborts:
+		log.Printf("%v. Signal kill-build process", abortErr)
+		mu.Lock()
+		fmt.Fprintf(emitter, "\n%v\n", abortErr)
+		mu.Unlock()
+		firstError = abortErr
+		cancel()
+		<-done
+	}
+
+	fmt.Fprintf(emitter, "Step group %s:\n", group[0].Group)
+	for i, cmd := range group {
+		fmt.Fprintf(emitter, "  %s exited with %d in %v\n", cmd.Name, results[i].code, results[i].duration.Round(time.Millisecond))
+		if firstError == nil {
+			firstError = results[i].err
+		}
+		GroupStepTimes(cmd, results[i].start, results[i].start.Add(results[i].duration))
+	}
+	emitter.StopCmd(group[0], results[0].code)
+	// The other steps of the group point to the log they share
+	for i, cmd := range group[1:] {
+		emitter.StartCmd(cmd)
+		fmt.Fprintf(emitter, "Ran in step group %s, see the log of %s\n", cmd.Group, group[0].Name)
+		emitter.StopCmd(cmd, results[i+1].code)
+	}
+	return firstError
+}
@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestGroupAt(t *testing.T) {
+	cmds := []screwdriver.CommandDef{
+		{Name: "install"},
+		{Name: "lint", Group: "check"},
+		{Name: "test", Group: "check"},
+		{Name: "build"},
+	}
+	if got := groupAt(cmds, 1); len(got) != 2 || got[0].Name != "lint" || got[1].Name != "test" {
+		t.Errorf("groupAt(1) = %v, want lint and test", got)
+	}
+	if got := groupAt(cmds, 3); len(got) != 1 {
+		t.Errorf("groupAt(3) = %v, want build alone", got)
+	}
+}
+
+func TestTaggedWriter(t *testing.T) {
+	var out strings.Builder
+	w := &taggedWriter{out: &out, mu: &sync.Mutex{}, tag: []byte("[lint] ")}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	w.flush()
+	if want := "[lint] one\n[lint] two\n[lint] three\n"; out.String() != want {
+		t.Errorf("Wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestRunGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "group")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each step waits for the other one, they only finish when they run at once
+	build := screwdriver.Build{Commands: []screwdriver.CommandDef{
+		{Name: "install", Cmd: "echo installed"},
+		{Name: "lint", Group: "check", Timeout: 10, Cmd: "touch lint; while [ ! -f test ]; do sleep 0.05; done; echo lint done; exit 3"},
+		{Name: "test", Group: "check", Timeout: 10, Cmd: "touch test; while [ ! -f lint ]; do sleep 0.05; done; echo test done; exit 5"},
+		{Name: "build", Cmd: "echo built"},
+	}}
+
+	var mu sync.Mutex
+	var stops, started []string
+	api := MockAPI{
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			stops = append(stops, stepName+"="+strconv.Itoa(exitCode))
+			return nil
+		},
+	}
+	emitter := &MockEmitter{startCmd: func(cmd screwdriver.CommandDef) { started = append(started, cmd.Name) }}
+	oldGroupStepTimes := GroupStepTimes
+	defer func() { GroupStepTimes = oldGroupStepTimes }()
+	type span struct{ start, stop time.Time }
+	ran := map[string]span{}
+	GroupStepTimes = func(cmd screwdriver.CommandDef, start, stop time.Time) {
+		ran[cmd.Name] = span{start, stop}
+	}
+
+	err = runStandalone(dir, nil, emitter, build, api, 1, "/bin/sh", TestBuildTimeout, dir)
+	if err != (ErrStatus{3}) {
+		t.Errorf("runStandalone() error = %v, want the exit status of lint, the first failing step", err)
+	}
+	sort.Strings(stops)
+	if want := []string{"install=0", "lint=3", "test=5"}; !reflect.DeepEqual(stops, want) {
+		t.Errorf("Steps stopped = %v, want %v", stops, want)
+	}
+	if want := []string{"install", "lint", "test"}; !reflect.DeepEqual(started, want) {
+		t.Errorf("Steps started in the emitter = %v, want %v", started, want)
+	}
+	// The steps of the group waited for each other, they ran at the same time
+	lint, test := ran["lint"], ran["test"]
+	if len(ran) != 2 || !lint.start.Before(test.stop) || !test.start.Before(lint.stop) {
+		t.Errorf("Steps of the group ran %+v, want lint and test at the same time", ran)
+	}
+
+	output := string(emitter.found)
+	for _, want := range []string{
+		"Running step group check: lint, test\n",
+		"[lint] lint done\n",
+		"[test] test done\n",
+		"Step group check:\n  lint exited with 3 in ",
+		"Ran in step group check, see the log of lint\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q has no %q", output, want)
+		}
+	}
+	if strings.Index(output, "  lint exited") > strings.Index(output, "  test exited") {
+		t.Errorf("The report of the group is not in the order of the steps: %q", output)
+	}
+	if strings.Contains(output, "built") {
+		t.Errorf("A step ran after a failed group")
+	}
+}
@@ -0,0 +1,29 @@
+package executor
+
+import "fmt"
+
+// StepCgroup is a cgroup v2 directory delegated to the launcher, with the memory, cpu and pids
+// controllers enabled for its children. The steps with limits run in a cgroup of their own
+// created in it. Without it, the memory and process limits are applied as rlimits, and the
+// CPU ones are not applied.
+var StepCgroup string
+
+// ErrLimitExceeded is the error when a step is stopped for using more of a resource than its
+// limits allow
+type ErrLimitExceeded struct {
+	Step     string
+	Resource string
+	Limit    int64
+}
+
+func (e ErrLimitExceeded) Error() string {
+	if e.Resource == "memory" {
+		return fmt.Sprintf("Step %s exceeded memory limit of %d bytes", e.Step, e.Limit)
+	}
+	return fmt.Sprintf("Step %s exceeded %s limit of %d", e.Step, e.Resource, e.Limit)
+}
+
+// noLimits is the release function of the steps without limits
+func noLimits() error {
+	return nil
+}
@@ -0,0 +1,208 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+// rlimitNproc is RLIMIT_NPROC, which the syscall package doesn't define, on the architectures
+// the launcher is built for
+const rlimitNproc = 6
+
+// applyLimits caps what the process pid, and the ones it starts, use until the returned
+// function is called. That function returns an ErrLimitExceeded when a limit stopped the step.
+func applyLimits(pid int, cmd screwdriver.CommandDef) (func() error, error) {
+	if cmd.Limits == nil || *cmd.Limits == (screwdriver.ResourceLimits{}) {
+		return noLimits, nil
+	}
+	if StepCgroup != "" {
+		return cgroupLimits(pid, cmd)
+	}
+	return rlimitLimits(pid, cmd)
+}
+
+// cgroupLimits moves pid to a cgroup of the step in StepCgroup. The kernel kills the step
+// there when it runs out of memory, not the launcher.
+func cgroupLimits(pid int, cmd screwdriver.CommandDef) (func() error, error) {
+	limits := *cmd.Limits
+	original, err := processCgroup(pid)
+	if err != nil {
+		return nil, fmt.Errorf("Limiting step %s: %v", cmd.Name, err)
+	}
+
+	dir := filepath.Join(StepCgroup, fmt.Sprintf("step-%d-%d", pid, time.Now().UnixNano()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Creating cgroup for step %s: %v", cmd.Name, err)
+	}
+
+	var settings, optional [][2]string
+	if limits.Memory > 0 {
+		settings = append(settings, [2]string{"memory.max", strconv.FormatInt(limits.Memory, 10)})
+		// Without swap accounting or groups for the OOM killer, only the limit itself applies
+		optional = append(optional, [2]string{"memory.swap.max", "0"}, [2]string{"memory.oom.group", "1"})
+	}
+	if limits.CPU > 0 {
+		settings = append(settings, [2]string{"cpu.max", cpuMax(limits.CPU)})
+	}
+	if limits.Procs > 0 {
+		settings = append(settings, [2]string{"pids.max", strconv.Itoa(limits.Procs)})
+	}
+	for _, setting := range settings {
+		if err := ioutil.WriteFile(filepath.Join(dir, setting[0]), []byte(setting[1]), 0644); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("Limiting step %s: %v", cmd.Name, err)
+		}
+	}
+	for _, setting := range optional {
+		ioutil.WriteFile(filepath.Join(dir, setting[0]), []byte(setting[1]), 0644)
+	}
+	if err := movePid(pid, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Limiting step %s: %v", cmd.Name, err)
+	}
+
+	return func() error {
+		// A persistent shell goes back where it was for the next steps
+		if syscall.Kill(pid, 0) == nil {
+			if err := movePid(pid, original); err != nil {
+				log.Printf("WARN: Moving process %d back to its cgroup: %v", pid, err)
+			}
+		}
+		exceeded := exceededLimit(dir, cmd)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("WARN: Keeping cgroup %s, processes of step %s still run in it", dir, cmd.Name)
+		}
+		return exceeded
+	}, nil
+}
+
+// processCgroup is the directory of the cgroup v2 of pid
+func processCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", fmt.Errorf("Reading the cgroup of process %d: %v", pid, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(cgroupRoot, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("Process %d is not in a cgroup v2", pid)
+}
+
+func movePid(pid int, dir string) error {
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// exceededLimit tells which limit of cmd the processes in the cgroup dir ran into
+func exceededLimit(dir string, cmd screwdriver.CommandDef) error {
+	limits := *cmd.Limits
+	if limits.Memory > 0 && eventCount(filepath.Join(dir, "memory.events"), "oom_kill") > 0 {
+		return ErrLimitExceeded{Step: cmd.Name, Resource: "memory", Limit: limits.Memory}
+	}
+	if limits.Procs > 0 && eventCount(filepath.Join(dir, "pids.events"), "max") > 0 {
+		return ErrLimitExceeded{Step: cmd.Name, Resource: "process", Limit: int64(limits.Procs)}
+	}
+	return nil
+}
+
+// eventCount reads the count of an event from a cgroup events file, like "oom_kill 1"
+func eventCount(path, event string) int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == event {
+			count, _ := strconv.ParseInt(fields[1], 10, 64)
+			return count
+		}
+	}
+	return 0
+}
+
+// cpuMax is the cpu.max of a cgroup getting cores CPUs, over the default period of 100ms
+func cpuMax(cores float64) string {
+	const period = 100000
+	quota := int64(cores * period)
+	if quota < 1000 {
+		// The kernel refuses quotas under 1ms
+		quota = 1000
+	}
+	return strconv.FormatInt(quota, 10) + " " + strconv.Itoa(period)
+}
+
+// rlimitLimits lowers the soft rlimits of pid for the memory and the processes. Programs
+// going over them fail to allocate or to fork rather than get killed, so they are not
+// reported as exceeded.
+func rlimitLimits(pid int, cmd screwdriver.CommandDef) (func() error, error) {
+	limits := *cmd.Limits
+	if limits.CPU > 0 {
+		log.Printf("WARN: Not limiting the CPU of step %s without a step cgroup", cmd.Name)
+	}
+
+	var restores []func()
+	restore := func() error {
+		for _, r := range restores {
+			r()
+		}
+		return nil
+	}
+	set := func(resource int, value uint64) error {
+		var old syscall.Rlimit
+		if err := prlimit(pid, resource, nil, &old); err != nil {
+			return err
+		}
+		limit := old
+		if value < limit.Max {
+			limit.Cur = value
+		}
+		if err := prlimit(pid, resource, &limit, nil); err != nil {
+			return err
+		}
+		// The process may be gone by then, nothing is left to restore
+		restores = append(restores, func() { prlimit(pid, resource, &old, nil) })
+		return nil
+	}
+
+	if limits.Memory > 0 {
+		if err := set(syscall.RLIMIT_AS, uint64(limits.Memory)); err != nil {
+			restore()
+			return nil, fmt.Errorf("Limiting the memory of step %s: %v", cmd.Name, err)
+		}
+	}
+	if limits.Procs > 0 {
+		if err := set(rlimitNproc, uint64(limits.Procs)); err != nil {
+			restore()
+			return nil, fmt.Errorf("Limiting the processes of step %s: %v", cmd.Name, err)
+		}
+	}
+	return restore, nil
+}
+
+// prlimit gets the rlimit of pid for resource into old and sets it to limit, when not nil
+func prlimit(pid, resource int, limit, old *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(limit)), uintptr(unsafe.Pointer(old)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// startSleep starts a process to apply limits to, killed at the end of the test
+func startSleep(t *testing.T) *exec.Cmd {
+	c := exec.Command("sleep", "30")
+	if err := c.Start(); err != nil {
+		t.Fatalf("Couldn't start sleep: %v", err)
+	}
+	return c
+}
+
+// softLimit reads the soft limit of a process from /proc/<pid>/limits, like "Max processes"
+func softLimit(t *testing.T, pid int, name string) string {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/limits")
+	if err != nil {
+		t.Fatalf("Couldn't read the limits of %d: %v", pid, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, name) {
+			return strings.Fields(strings.TrimPrefix(line, name))[0]
+		}
+	}
+	t.Fatalf("No %q limit for %d", name, pid)
+	return ""
+}
+
+func TestRlimitLimits(t *testing.T) {
+	c := startSleep(t)
+	defer c.Process.Kill()
+	pid := c.Process.Pid
+	oldMemory, oldProcs := softLimit(t, pid, "Max address space"), softLimit(t, pid, "Max processes")
+
+	cmd := screwdriver.CommandDef{Name: "test", Limits: &screwdriver.ResourceLimits{Memory: 1 << 30, Procs: 50}}
+	release, err := applyLimits(pid, cmd)
+	if err != nil {
+		t.Fatalf("Unexpected error applying limits: %v", err)
+	}
+	if got := softLimit(t, pid, "Max address space"); got != "1073741824" {
+		t.Errorf("Address space limit = %s, want 1073741824", got)
+	}
+	if got := softLimit(t, pid, "Max processes"); got != "50" {
+		t.Errorf("Process limit = %s, want 50", got)
+	}
+
+	if err := release(); err != nil {
+		t.Errorf("Unexpected error releasing limits: %v", err)
+	}
+	if got := softLimit(t, pid, "Max address space"); got != oldMemory {
+		t.Errorf("Address space limit = %s after the step, want %s back", got, oldMemory)
+	}
+	if got := softLimit(t, pid, "Max processes"); got != oldProcs {
+		t.Errorf("Process limit = %s after the step, want %s back", got, oldProcs)
+	}
+}
+
+func TestCgroupLimits(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	oldCgroupRoot, oldStepCgroup := cgroupRoot, StepCgroup
+	defer func() { cgroupRoot, StepCgroup = oldCgroupRoot, oldStepCgroup }()
+	cgroupRoot = root
+	StepCgroup = filepath.Join(root, "steps")
+	os.Mkdir(StepCgroup, 0755)
+
+	c := startSleep(t)
+	defer c.Process.Kill()
+	pid := c.Process.Pid
+	original, err := processCgroup(pid)
+	if err != nil {
+		t.Skipf("No cgroup v2 here: %v", err)
+	}
+	os.MkdirAll(original, 0755)
+
+	cmd := screwdriver.CommandDef{Name: "build", Limits: &screwdriver.ResourceLimits{Memory: 512 << 20, CPU: 0.5, Procs: 100}}
+	release, err := applyLimits(pid, cmd)
+	if err != nil {
+		t.Fatalf("Unexpected error applying limits: %v", err)
+	}
+
+	dirs, _ := filepath.Glob(filepath.Join(StepCgroup, "step-*"))
+	if len(dirs) != 1 {
+		t.Fatalf("Step cgroups = %q, want one", dirs)
+	}
+	for file, want := range map[string]string{
+		"memory.max":       "536870912",
+		"memory.oom.group": "1",
+		"cpu.max":          "50000 100000",
+		"pids.max":         "100",
+		"cgroup.procs":     strconv.Itoa(pid),
+	} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dirs[0], file)); string(data) != want {
+			t.Errorf("%s = %q, want %q", file, data, want)
+		}
+	}
+
+	// The kernel counts the processes it killed for going over memory.max
+	ioutil.WriteFile(filepath.Join(dirs[0], "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0644)
+	err = release()
+	if want := (ErrLimitExceeded{Step: "build", Resource: "memory", Limit: 512 << 20}); err != want {
+		t.Errorf("release() = %v, want %v", err, want)
+	}
+	if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+		t.Errorf("The cgroup of the step is still there")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(original, "cgroup.procs")); string(data) != strconv.Itoa(pid) {
+		t.Errorf("The process was not moved back to its cgroup")
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	for _, limits := range []*screwdriver.ResourceLimits{nil, {}} {
+		release, err := applyLimits(-1, screwdriver.CommandDef{Name: "test", Limits: limits})
+		if err != nil || release() != nil {
+			t.Errorf("applyLimits(%v) = %v, want nothing to apply", limits, err)
+		}
+	}
+}
+
+func TestLimitExceededError(t *testing.T) {
+	if got := (ErrLimitExceeded{Step: "test", Resource: "memory", Limit: 1024}).Error(); got != "Step test exceeded memory limit of 1024 bytes" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := (ErrLimitExceeded{Step: "test", Resource: "process", Limit: 10}).Error(); got != "Step test exceeded process limit of 10" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := cpuMax(0.001); got != "1000 100000" {
+		t.Errorf("cpuMax(0.001) = %q, want the 1ms minimum", got)
+	}
+}
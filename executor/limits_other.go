@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// applyLimits only tells the limits of cmd are not applied, there are no cgroups or process
+// rlimits to apply them with
+func applyLimits(pid int, cmd screwdriver.CommandDef) (func() error, error) {
+	if cmd.Limits != nil && *cmd.Limits != (screwdriver.ResourceLimits{}) {
+		log.Printf("WARN: Resource limits of step %s are not supported on %s", cmd.Name, runtime.GOOS)
+	}
+	return noLimits, nil
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// persistentShell runs all the steps in a single shell on a pseudo-terminal, so the variables
+// a step exports are seen by the next ones
+const persistentShell = true
+
+// DefaultShell runs the build when the shell of the steps can't, like PowerShell
+const DefaultShell = "/bin/sh"
+
+// scriptDir is where the scripts of the steps are written
+const scriptDir = "/tmp"
+
+func startShell(c *exec.Cmd) (*os.File, error) {
+	return pty.Start(c)
+}
+
+// stopShell terminates the shell and the step running in it, which share its process group
+func stopShell(pid int, exited <-chan struct{}) {
+	log.Printf("Sending SIGTERM to process group %d", pid)
+	syscall.Kill(-pid, syscall.SIGTERM)
+
+	select {
+	case <-exited:
+	case <-time.After(killGracePeriod):
+		log.Printf("Process group %d still running after %v, sending SIGKILL", pid, killGracePeriod)
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+}
+
+// newProcessGroup runs c in a process group of its own, for stopShell to stop its children too
+func newProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
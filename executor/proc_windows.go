@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package executor
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// persistentShell is off, Windows has no pseudo-terminal to keep a shell for all the steps
+const persistentShell = false
+
+// DefaultShell runs the steps unless the build asks for another shell
+const DefaultShell = "powershell.exe"
+
+// scriptDir is where the scripts of the steps are written
+var scriptDir = os.TempDir()
+
+func startShell(c *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("Pseudo-terminals are not supported on Windows")
+}
+
+// stopShell kills the step and the processes it started. Windows processes can't be asked
+// to stop, so the grace period only waits for the kill to complete.
+func stopShell(pid int, exited <-chan struct{}) {
+	log.Printf("Killing process tree %d", pid)
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run(); err != nil {
+		log.Printf("WARN: Killing process tree %d: %v", pid, err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(killGracePeriod):
+		log.Printf("Process %d still running after %v", pid, killGracePeriod)
+	}
+}
+
+// newProcessGroup does nothing, taskkill finds the children of a process by itself
+func newProcessGroup(c *exec.Cmd) {}
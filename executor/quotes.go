@@ -0,0 +1,226 @@
+package executor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// hereDoc is the body of a here-document, or of a PowerShell here-string, for QuoteIn
+const hereDoc = '<'
+
+var (
+	// psDoubleQuoted are the characters PowerShell expands or ends a double quoted string on
+	psDoubleQuoted = regexp.MustCompile("[`$\"\u201c\u201d\u201e]")
+	// shDoubleQuoted escapes the characters POSIX shells expand or end a double quoted string on
+	shDoubleQuoted = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+)
+
+// QuoteIn makes value stand as is in the quote a QuoteScanner found: between ' or ", and 0
+// outside of quotes, where Quote makes it a single word. In here-documents, where a line break
+// could end the document, only plain words are taken.
+func QuoteIn(shellBin, value string, quote byte) (string, error) {
+	switch {
+	case quote == 0:
+		return Quote(shellBin, value)
+	case quote == hereDoc:
+		if !plainWord.MatchString(value) {
+			return "", fmt.Errorf("Only letters, digits and _./:- can be put in a here-document, not %q", value)
+		}
+		return value, nil
+	case isPowerShell(shellBin) && quote == '\'':
+		return psQuotes.ReplaceAllString(value, "$0$0"), nil
+	case isPowerShell(shellBin):
+		return psDoubleQuoted.ReplaceAllString(value, "`$0"), nil
+	case isCmd(shellBin):
+		if strings.ContainsAny(value, "\r\n\"") {
+			return "", fmt.Errorf("Values with a line break or a double quote can't be put between double quotes for cmd")
+		}
+		return strings.Replace(value, "%", "%%", -1), nil
+	case quote == '\'':
+		return strings.Replace(value, "'", `'\''`, -1), nil
+	default:
+		return shDoubleQuoted.Replace(value), nil
+	}
+}
+
+// quoteContext is where a script is: between quotes ' or ", in a command substitution ( or `,
+// or in a here-document ending on the line end
+type quoteContext struct {
+	quote byte
+	end   string
+	// tabs lets the end line of a <<- here-document start with tabs
+	tabs bool
+}
+
+// QuoteScanner follows the quotes of a script, and the command substitutions and here-documents
+// that change them, to tell which ones an offset of the script is in
+type QuoteScanner struct {
+	script string
+	ps     bool
+	cmd    bool
+	pos    int
+	stack  []quoteContext
+	// pending are the here-documents starting on the next line
+	pending []quoteContext
+}
+
+// NewQuoteScanner follows the quotes of script, a step of shellBin
+func NewQuoteScanner(shellBin, script string) *QuoteScanner {
+	return &QuoteScanner{script: script, ps: isPowerShell(shellBin), cmd: isCmd(shellBin)}
+}
+
+// At returns the quote, ' or ", that offset is in, hereDoc in a here-document and 0 when in
+// none. Offsets are given in order.
+func (s *QuoteScanner) At(offset int) byte {
+	for s.pos < offset {
+		s.pos += s.step()
+	}
+	switch quote := s.top().quote; quote {
+	case '(', '`':
+		return 0
+	default:
+		return quote
+	}
+}
+
+func (s *QuoteScanner) top() quoteContext {
+	if len(s.stack) == 0 {
+		return quoteContext{}
+	}
+	return s.stack[len(s.stack)-1]
+}
+
+func (s *QuoteScanner) push(c quoteContext) {
+	s.stack = append(s.stack, c)
+}
+
+func (s *QuoteScanner) pop() {
+	s.stack = s.stack[:len(s.stack)-1]
+}
+
+// step follows the script at the current position, and returns how many bytes it went through
+func (s *QuoteScanner) step() int {
+	rest := s.script[s.pos:]
+	top := s.top()
+	escape := byte('\\')
+	if s.ps {
+		escape = '`'
+	}
+	switch {
+	case top.quote == hereDoc:
+		return s.hereDocLine(rest, top)
+	case s.cmd:
+		// cmd only has double quotes, and escapes outside of them
+		switch {
+		case top.quote == 0 && rest[0] == '^':
+			return 2
+		case rest[0] == '"' && top.quote == '"':
+			s.pop()
+		case rest[0] == '"':
+			s.push(quoteContext{quote: '"'})
+		}
+		return 1
+	case top.quote == '\'':
+		if rest[0] == '\'' {
+			s.pop()
+		}
+		return 1
+	case top.quote == '"':
+		switch {
+		case rest[0] == escape:
+			return 2
+		case rest[0] == '"':
+			s.pop()
+		case strings.HasPrefix(rest, "$("):
+			s.push(quoteContext{quote: '('})
+			return 2
+		case rest[0] == '`':
+			s.push(quoteContext{quote: '`'})
+		}
+		return 1
+	}
+
+	// Outside of quotes
+	switch c := rest[0]; {
+	case c == escape:
+		return 2
+	case s.ps && (strings.HasPrefix(rest, "@'") || strings.HasPrefix(rest, `@"`)):
+		// The here-strings of PowerShell start at the end of the line
+		if line := strings.IndexByte(rest, '\n'); line >= 0 && strings.TrimSpace(rest[2:line]) == "" {
+			s.push(quoteContext{quote: hereDoc, end: rest[1:2] + "@"})
+			return line + 1
+		}
+		return 1
+	case c == '\'' || c == '"':
+		s.push(quoteContext{quote: c})
+	case strings.HasPrefix(rest, "$(") || c == '(':
+		s.push(quoteContext{quote: '('})
+		if c == '$' {
+			return 2
+		}
+	case c == ')' && top.quote == '(':
+		s.pop()
+	case c == '`' && top.quote == '`':
+		s.pop()
+	case c == '`':
+		s.push(quoteContext{quote: '`'})
+	case s.ps && strings.HasPrefix(rest, "<#"):
+		if end := strings.Index(rest, "#>"); end >= 0 {
+			return end + 2
+		}
+		return len(rest)
+	case c == '#' && (s.pos == 0 || strings.IndexByte(" \t\n;&|(", s.script[s.pos-1]) >= 0):
+		if end := strings.IndexByte(rest, '\n'); end >= 0 {
+			return end
+		}
+		return len(rest)
+	case c == '\n':
+		for i := len(s.pending) - 1; i >= 0; i-- {
+			s.push(s.pending[i])
+		}
+		s.pending = nil
+	case !s.ps && strings.HasPrefix(rest, "<<") && !strings.HasPrefix(rest, "<<<"):
+		return s.hereDocStart(rest)
+	}
+	return 1
+}
+
+// hereDocStart reads the word of a here-document, whose lines start on the next line
+func (s *QuoteScanner) hereDocStart(rest string) int {
+	i := 2
+	tabs := strings.HasPrefix(rest[i:], "-")
+	if tabs {
+		i++
+	}
+	for i < len(rest) && (rest[i] == ' ' || rest[i] == '\t') {
+		i++
+	}
+	word := rest[i:]
+	if end := strings.IndexAny(word, " \t\r\n;&|<>()"); end >= 0 {
+		word = word[:end]
+	}
+	if end := strings.NewReplacer(`'`, "", `"`, "", `\`, "").Replace(word); end != "" {
+		s.pending = append(s.pending, quoteContext{quote: hereDoc, end: end, tabs: tabs})
+	}
+	return i + len(word)
+}
+
+// hereDocLine goes through a line of a here-document, the last one when it is its end
+func (s *QuoteScanner) hereDocLine(rest string, doc quoteContext) int {
+	line := rest
+	if end := strings.IndexByte(rest, '\n'); end >= 0 {
+		line = rest[:end]
+	}
+	trimmed := strings.TrimSuffix(line, "\r")
+	if doc.tabs {
+		trimmed = strings.TrimLeft(trimmed, "\t")
+	}
+	if trimmed == doc.end || s.ps && strings.HasPrefix(trimmed, doc.end) {
+		s.pop()
+	}
+	if len(line) < len(rest) {
+		return len(line) + 1
+	}
+	return len(line)
+}
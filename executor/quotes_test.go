@@ -0,0 +1,87 @@
+package executor
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestQuoteScanner(t *testing.T) {
+	tests := []struct {
+		shell  string
+		script string
+		want   string
+	}{
+		{"/bin/sh", `echo ~ "~" '~' "it's ~" 'say "~"'`, "0\"'\"'"},
+		{"/bin/sh", `echo "\"~" \'~ "$(echo ~ "~")" "~"`, "\"00\"\""},
+		{"/bin/sh", "# it's\necho ~ `echo ~` \"`echo ~`\"", "000"},
+		{"/bin/sh", "cat <<EOF; echo ~\nit's ~\nEOF\necho ~", "0<0"},
+		{"/bin/sh", "cat <<-\"END\" <<EOF\n\t~\n\tEND\n~\nEOF\n'~'", "<<'"},
+		{"/usr/bin/pwsh", "Write-Host '~''~' \"`\"~\" ~ # it's\n<# it's #> \"$(echo ~)\" ~", "''\"000"},
+		{"/usr/bin/pwsh", "$x = @'\nit's ~\n'@\n~", "<0"},
+		{"cmd", `echo "~" ^"~ it's ~`, "\"00"},
+	}
+	for _, test := range tests {
+		scanner := NewQuoteScanner(test.shell, test.script)
+		var got []byte
+		for i := range test.script {
+			if test.script[i] == '~' {
+				if quote := scanner.At(i); quote == 0 {
+					got = append(got, '0')
+				} else {
+					got = append(got, quote)
+				}
+			}
+		}
+		if string(got) != test.want {
+			t.Errorf("Quotes of %q = %s, want %s", test.script, got, test.want)
+		}
+	}
+}
+
+func TestQuoteIn(t *testing.T) {
+	value := "it's \"$HOME\" `id` \\"
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No shell to run the quoted values")
+	}
+	for _, script := range []string{`printf %s "@"`, `printf %s '@'`, `printf %s @`, `printf %s "$(printf %s @)"`} {
+		quote := NewQuoteScanner(sh, script).At(strings.Index(script, "@"))
+		quoted, err := QuoteIn(sh, value, quote)
+		if err != nil {
+			t.Errorf("QuoteIn(%q) unexpected error: %v", script, err)
+			continue
+		}
+		out, err := exec.Command(sh, "-c", strings.Replace(script, "@", quoted, 1)).Output()
+		if err != nil || string(out) != value {
+			t.Errorf("%s printed %q, %v, want %q", strings.Replace(script, "@", quoted, 1), out, err, value)
+		}
+	}
+
+	for _, test := range []struct {
+		shell string
+		value string
+		quote byte
+		want  string
+	}{
+		{"/usr/bin/pwsh", "it's $(id)", '\'', "it''s $(id)"},
+		{"/usr/bin/pwsh", "\"$(id)`”", '"', "`\"`$(id)```”"},
+		{"cmd", "50% off", '"', "50%% off"},
+	} {
+		if got, err := QuoteIn(test.shell, test.value, test.quote); err != nil || got != test.want {
+			t.Errorf("QuoteIn(%q, %q, %c) = %q, %v, want %q", test.shell, test.value, test.quote, got, err, test.want)
+		}
+	}
+	for _, test := range []struct {
+		shell string
+		value string
+		quote byte
+	}{
+		{"/bin/sh", "a\nEOF", hereDoc},
+		{"cmd", `say "hi"`, '"'},
+	} {
+		if _, err := QuoteIn(test.shell, test.value, test.quote); err == nil {
+			t.Errorf("QuoteIn(%q, %q, %c) took a value it can't escape", test.shell, test.value, test.quote)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Where the scripts of the steps and of the PowerShell teardowns are written
+var (
+	stepScriptPath     = filepath.Join(scriptDir, "step.sh")
+	teardownScriptPath = filepath.Join(scriptDir, "teardown.ps1")
+)
+
+// ResolveShell returns the path of a shell given by name, like "bash", or by path
+func ResolveShell(shell string) (string, error) {
+	if shell == "" || strings.ContainsAny(shell, `/\`) {
+		return shell, nil
+	}
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		return "", fmt.Errorf("Finding shell %q: %v", shell, err)
+	}
+	return path, nil
+}
+
+// shellName is the name of a shell binary, e.g. "bash" for /usr/local/bin/bash or "cmd" for
+// C:\Windows\System32\cmd.exe
+func shellName(shellBin string) string {
+	name := shellBin[strings.LastIndexAny(shellBin, `/\`)+1:]
+	return strings.TrimSuffix(name, ".exe")
+}
+
+// isCmd tells whether steps are batch files of the Windows command interpreter
+func isCmd(shellBin string) bool {
+	return strings.ToLower(shellName(shellBin)) == "cmd"
+}
+
+// toLF turns the Windows line endings of a script into the POSIX ones
+func toLF(script string) string {
+	return strings.Replace(script, "\r\n", "\n", -1)
+}
+
+// toCRLF ends every line of a script with \r\n, the batch files need it
+func toCRLF(script string) string {
+	return strings.Replace(toLF(script), "\n", "\r\n", -1)
+}
+
+// isPowerShell tells whether steps have to be run as PowerShell scripts rather than sourced
+func isPowerShell(shellBin string) bool {
+	name := shellName(shellBin)
+	return name == "pwsh" || name == "powershell"
+}
+
+var (
+	// psQuotes are the characters PowerShell takes for a single quote
+	psQuotes = regexp.MustCompile("['\u2018\u2019\u201a\u201b]")
+	// plainWord matches the values every shell takes as is, like IDs, SHAs and most branches
+	plainWord = regexp.MustCompile(`^[A-Za-z0-9_./:][A-Za-z0-9_./:-]*$`)
+)
+
+// Quote makes value a single word of the scripts of shellBin, whatever characters it holds,
+// so a value put in a step command can't change what the step runs. Plain words are left as is.
+func Quote(shellBin, value string) (string, error) {
+	switch {
+	case plainWord.MatchString(value):
+		return value, nil
+	case isPowerShell(shellBin):
+		return "'" + psQuotes.ReplaceAllString(value, "$0$0") + "'", nil
+	case isCmd(shellBin):
+		// A line break ends the command in a batch file, quoted or not
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("Values with a line break can't be quoted for cmd")
+		}
+		return `"` + strings.NewReplacer(`%`, `%%`, `"`, `""`).Replace(value) + `"`, nil
+	default:
+		return shellQuote(value), nil
+	}
+}
+
+// buildShell is the shell the build runs in. Steps are sourced into it so the variables they
+// export are seen by the next steps, which only works for POSIX shells.
+func buildShell(shellBin string) string {
+	if isPowerShell(shellBin) {
+		return DefaultShell
+	}
+	return shellBin
+}
+
+// shellOptions make a failing command fail its step, including in the middle of a
+// pipeline for the shells supporting it
+func shellOptions(shellBin string) []string {
+	switch shellName(shellBin) {
+	case "bash", "zsh", "ksh", "mksh":
+		return []string{"set -e", "set -o pipefail"}
+	default:
+		return []string{"set -e"}
+	}
+}
+
+// psScript makes a PowerShell script stop at the first error and exit with the code
+// of the last program it ran
+func psScript(cmd string) string {
+	return "$ErrorActionPreference = 'Stop'\n" + cmd + "\nexit $LASTEXITCODE\n"
+}
+
+// writeStepScript writes the script of cmd to path, with a .ps1 extension for PowerShell,
+// and returns the command running it in the build shell
+func writeStepScript(path string, cmd screwdriver.CommandDef, shellBin string) (string, error) {
+	if isPowerShell(shellBin) {
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + ".ps1"
+		if err := ioutil.WriteFile(path, []byte(psScript(cmd.Cmd)), 0755); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s -NoLogo -NoProfile -NonInteractive -File %s", shellQuote(shellBin), shellQuote(path)), nil
+	}
+
+	if err := createShFile(path, cmd, shellBin); err != nil {
+		return "", err
+	}
+	return ". " + shellQuote(path), nil
+}
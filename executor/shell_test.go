@@ -0,0 +1,121 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestResolveShell(t *testing.T) {
+	for _, shell := range []string{"", "/bin/bash", "./bin/sh"} {
+		if got, err := ResolveShell(shell); err != nil || got != shell {
+			t.Errorf("ResolveShell(%q) = %q, %v, want it unchanged", shell, got, err)
+		}
+	}
+
+	got, err := ResolveShell("sh")
+	if err != nil || !filepath.IsAbs(got) || filepath.Base(got) != "sh" {
+		t.Errorf("ResolveShell(sh) = %q, %v, want the path of sh", got, err)
+	}
+
+	if _, err := ResolveShell("no-such-shell"); err == nil || !strings.HasPrefix(err.Error(), `Finding shell "no-such-shell"`) {
+		t.Errorf("ResolveShell() error = %v, want a lookup error", err)
+	}
+}
+
+func TestShellOptions(t *testing.T) {
+	tests := map[string][]string{
+		"/bin/sh":            {"set -e"},
+		"/bin/dash":          {"set -e"},
+		"/bin/bash":          {"set -e", "set -o pipefail"},
+		"/usr/local/bin/zsh": {"set -e", "set -o pipefail"},
+	}
+	for shell, want := range tests {
+		if got := shellOptions(shell); !reflect.DeepEqual(got, want) {
+			t.Errorf("shellOptions(%q) = %q, want %q", shell, got, want)
+		}
+	}
+}
+
+func TestBuildShell(t *testing.T) {
+	tests := map[string]string{
+		"/bin/bash":                     "/bin/bash",
+		"/usr/bin/pwsh":                 DefaultShell,
+		"C:/Windows/powershell.exe":     DefaultShell,
+		"/opt/microsoft/powershell/zsh": "/opt/microsoft/powershell/zsh",
+	}
+	for shell, want := range tests {
+		if got := buildShell(shell); got != want {
+			t.Errorf("buildShell(%q) = %q, want %q", shell, got, want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		shell string
+		value string
+		want  string
+	}{
+		{"/bin/sh", "feature/login-v2", "feature/login-v2"},
+		{"/bin/sh", "", "''"},
+		{"/bin/bash", "a b;$(id)`id`", "'a b;$(id)`id`'"},
+		{"/bin/sh", "it's", `'it'\''s'`},
+		{"/bin/sh", "-n", "'-n'"},
+		{"/usr/bin/pwsh", "it's $(id)", "'it''s $(id)'"},
+		{"/usr/bin/pwsh", "it\u2019s", "'it\u2019\u2019s'"},
+		{`C:\Windows\System32\cmd.exe`, `50% "off" & more`, `"50%% ""off"" & more"`},
+	}
+	for _, test := range tests {
+		if got, err := Quote(test.shell, test.value); err != nil || got != test.want {
+			t.Errorf("Quote(%q, %q) = %q, %v, want %q", test.shell, test.value, got, err, test.want)
+		}
+	}
+
+	if _, err := Quote("cmd", "two\nlines"); err == nil {
+		t.Errorf("Expected an error quoting a line break for cmd")
+	}
+}
+
+func TestWriteStepScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "steps")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := screwdriver.CommandDef{Name: "test", Cmd: "echo \"it's\" | tee out"}
+	path := filepath.Join(dir, "it's a step.sh")
+
+	run, err := writeStepScript(path, cmd, "/bin/bash")
+	if err != nil {
+		t.Fatalf("Unexpected error writing the script: %v", err)
+	}
+	if want := `. '` + dir + `/it'\''s a step.sh'`; run != want {
+		t.Errorf("Run command = %q, want %q", run, want)
+	}
+	if got := ReadCommand(path); got[0] != "#!/bin/bash -e" || got[1] != cmd.Cmd {
+		t.Errorf("Script = %q, want the shebang and the command", got)
+	}
+
+	run, err = writeStepScript(path, cmd, "/usr/bin/pwsh")
+	if err != nil {
+		t.Fatalf("Unexpected error writing the script: %v", err)
+	}
+	ps1 := filepath.Join(dir, "it's a step.ps1")
+	if want := `'/usr/bin/pwsh' -NoLogo -NoProfile -NonInteractive -File '` + dir + `/it'\''s a step.ps1'`; run != want {
+		t.Errorf("Run command = %q, want %q", run, want)
+	}
+	script, _ := ioutil.ReadFile(ps1)
+	if want := "$ErrorActionPreference = 'Stop'\n" + cmd.Cmd + "\nexit $LASTEXITCODE\n"; string(script) != want {
+		t.Errorf("Script = %q, want %q", script, want)
+	}
+}
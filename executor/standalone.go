@@ -0,0 +1,231 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// processCommand writes the script of cmd, named script, and returns the process running it with
+// shellBin: a PowerShell script, a batch file for cmd.exe or a POSIX shell script
+func processCommand(cmd screwdriver.CommandDef, shellBin, script string) (*exec.Cmd, error) {
+	var path, body string
+	var args []string
+	dir := scriptDir
+	if StepContainer != nil {
+		dir = StepContainer.scriptDir
+	}
+	switch {
+	case isPowerShell(shellBin):
+		path = filepath.Join(dir, script+".ps1")
+		body = psScript(cmd.Cmd)
+		args = []string{"-NoLogo", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", path}
+	case isCmd(shellBin):
+		path = filepath.Join(dir, script+".cmd")
+		body = toCRLF("@echo off\n" + cmd.Cmd + "\nexit /b %ERRORLEVEL%\n")
+		args = []string{"/D", "/C", path}
+	default:
+		path = filepath.Join(dir, script+".sh")
+		body = toLF(cmd.Cmd)
+		args = []string{"-e", path}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(body), 0755); err != nil {
+		return nil, fmt.Errorf("Writing to step script file: %v", err)
+	}
+	return exec.Command(shellBin, args...), nil
+}
+
+// withExports returns c started from the POSIX shell of the build once it sourced envFile, for
+// c to get the variables it exports. The variables of the step still come first.
+func withExports(c *exec.Cmd, envFile, shellBin string, stepEnv map[string]string) *exec.Cmd {
+	quotedEnv := shellQuote(envFile)
+	script := "if [ -f " + quotedEnv + " ]; then . " + quotedEnv + "; fi; "
+	var names []string
+	for name := range stepEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		script += "export " + name + "=" + shellQuote(stepEnv[name]) + "; "
+	}
+	args := append([]string{"-c", script + `exec "$@"`, "sh"}, c.Args...)
+	return exec.Command(buildShell(shellBin), args...)
+}
+
+// runProcessStep runs cmd in a process of its own until it exits, ctx is done or, when
+// abortable, the build is aborted. The process gets env, then the variables exported by
+// envFile when set. It returns the exit code of the step and ctx.Err() or the ErrAborted that
+// stopped it.
+func runProcessStep(ctx context.Context, cmd screwdriver.CommandDef, env []string, envFile string, emitter io.Writer, shellBin, dir, script string, abortable bool) (int, error) {
+	for name := range cmd.Environment {
+		if !envNameRegexp.MatchString(name) {
+			return ExitLaunch, fmt.Errorf("Invalid environment variable name %q for step %q", name, cmd.Name)
+		}
+	}
+
+	c, err := processCommand(cmd, shellBin, script)
+	if err != nil {
+		return ExitLaunch, err
+	}
+	if envFile != "" {
+		c = withExports(c, envFile, shellBin, cmd.Environment)
+	}
+	c.Dir = dir
+	c.Env = append([]string{}, env...)
+	for name, value := range cmd.Environment {
+		c.Env = append(c.Env, name+"="+value)
+	}
+	container := StepContainer
+	var pidFile string
+	if container != nil {
+		pidFile = filepath.Join(container.scriptDir, script+".pid")
+		c = container.command(c, pidFile)
+	}
+	c.Stdout = emitter
+	c.Stderr = emitter
+	newProcessGroup(c)
+
+	fmt.Fprintf(emitter, "$ %s\n", cmd.Cmd)
+	if err := c.Start(); err != nil {
+		return ExitLaunch, fmt.Errorf("Launching command %q: %v", cmd.Cmd, err)
+	}
+	waitErr := make(chan error, 1)
+	exited := make(chan struct{})
+	go func() {
+		waitErr <- c.Wait()
+		close(exited)
+	}()
+	stop := func() { stopShell(c.Process.Pid, exited) }
+	// The limits would only apply to the CLI of the container, the step runs in the container
+	releaseLimits := noLimits
+	if container != nil {
+		stop = func() {
+			container.stop(pidFile, exited)
+			stopShell(c.Process.Pid, exited)
+		}
+	} else if releaseLimits, err = applyLimits(c.Process.Pid, cmd); err != nil {
+		stop()
+		return ExitLaunch, err
+	}
+
+	var abortCh <-chan ErrAborted
+	if abortable {
+		abortCh = aborts
+	}
+	select {
+	case err := <-waitErr:
+		limitErr := releaseLimits()
+		if err == nil {
+			return ExitOk, nil
+		}
+		if exitError, ok := err.(*exec.ExitError); ok {
+			// A step killed for going over its limits says so rather than only failing
+			if limitErr != nil {
+				fmt.Fprintf(emitter, "\n%v\n", limitErr)
+				return exitError.ExitCode(), limitErr
+			}
+			return exitError.ExitCode(), ErrStatus{exitError.ExitCode()}
+		}
+		return ExitUnknown, fmt.Errorf("Running command %q: %v", cmd.Cmd, err)
+	case <-ctx.Done():
+		stop()
+		releaseLimits()
+		return 3, ctx.Err()
+	case abortErr := <-abortCh:
+		log.Printf("%v. Signal kill-build process", abortErr)
+		fmt.Fprintf(emitter, "\n%v\n", abortErr)
+		stop()
+		releaseLimits()
+		return 3, abortErr
+	}
+}
+
+// runStandalone runs every step in a process of its own, for the platforms without
+// pseudo-terminals. Unlike with Run, the variables a step exports are not seen by the next ones.
+func runStandalone(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeoutSec int, sourceDir string) error {
+	var firstError error
+	timeout := time.Duration(timeoutSec) * time.Second
+	log.Printf("Starting timer for timeout of %v seconds", timeout)
+	buildCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	userCommands, sdTeardownCommands, userTeardownCommands := filterTeardowns(build)
+
+	for i := 0; i < len(userCommands); i++ {
+		cmd := userCommands[i]
+		select {
+		case abortErr := <-aborts:
+			log.Printf("%v before step %s", abortErr, cmd.Name)
+			fmt.Fprintf(emitter, "\n%v\n", abortErr)
+			firstError = abortErr
+		default:
+		}
+		if firstError != nil {
+			break
+		}
+
+		if cmd.Group != "" {
+			group := groupAt(userCommands, i)
+			i += len(group) - 1
+			firstError = runGroup(buildCtx, group, env, "", emitter, api, buildID, shellBin, path, timeout)
+			continue
+		}
+
+		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
+			firstError = fmt.Errorf("Updating step start %q: %v", cmd.Name, err)
+			break
+		}
+		emitter.StartCmd(cmd)
+
+		stepCtx, stepCancel := stepContext(buildCtx, cmd)
+		code, err := runProcessStep(stepCtx, cmd, env, "", emitter, shellBin, path, "step", true)
+		stepCancel()
+		if err == context.DeadlineExceeded {
+			timeoutErr := ErrTimeout{Timeout: timeout}
+			if buildCtx.Err() == nil {
+				timeoutErr = ErrTimeout{Step: cmd.Name, Timeout: time.Duration(cmd.Timeout) * time.Second}
+			}
+			log.Printf("%v. Signal kill-build process", timeoutErr)
+			fmt.Fprintf(emitter, "\n%v\n", timeoutErr)
+			err = timeoutErr
+		}
+		firstError = err
+
+		emitter.StopCmd(cmd, code)
+		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil && firstError == nil {
+			firstError = fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+		}
+	}
+
+	// Every teardown runs, their failures only fail a build whose steps succeeded
+	for _, cmd := range append(userTeardownCommands, sdTeardownCommands...) {
+		if err := api.UpdateStepStart(buildID, cmd.Name); err != nil {
+			log.Printf("Updating step start %q: %v", cmd.Name, err)
+		}
+		emitter.StartCmd(cmd)
+
+		code, cmdErr := runProcessStep(context.Background(), cmd, env, "", emitter, shellBin, sourceDir, "step", false)
+
+		emitter.StopCmd(cmd, code)
+		if err := api.UpdateStepStop(buildID, cmd.Name, code); err != nil {
+			log.Printf("Updating step stop %q: %v", cmd.Name, err)
+			if cmdErr == nil {
+				cmdErr = fmt.Errorf("Updating step stop %q: %v", cmd.Name, err)
+			}
+		}
+		if firstError == nil {
+			firstError = cmdErr
+		}
+	}
+
+	return firstError
+}
@@ -0,0 +1,151 @@
+//go:build !windows
+// +build !windows
+
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestProcessCommand(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Cmd: "echo one\r\necho two"}
+
+	tests := map[string]struct {
+		args   []string
+		script string
+	}{
+		"/bin/sh": {[]string{"/bin/sh", "-e", filepath.Join(scriptDir, "step.sh")}, "echo one\necho two"},
+		`C:\Windows\System32\cmd.exe`: {
+			[]string{`C:\Windows\System32\cmd.exe`, "/D", "/C", filepath.Join(scriptDir, "step.cmd")},
+			"@echo off\r\necho one\r\necho two\r\nexit /b %ERRORLEVEL%\r\n",
+		},
+		"pwsh": {
+			[]string{"pwsh", "-NoLogo", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", filepath.Join(scriptDir, "step.ps1")},
+			psScript(cmd.Cmd),
+		},
+	}
+	for shellBin, test := range tests {
+		c, err := processCommand(cmd, shellBin, "step")
+		if err != nil {
+			t.Fatalf("processCommand(%q) error: %v", shellBin, err)
+		}
+		if !reflect.DeepEqual(c.Args, test.args) {
+			t.Errorf("processCommand(%q) args = %q, want %q", shellBin, c.Args, test.args)
+		}
+		script, _ := ioutil.ReadFile(test.args[len(test.args)-1])
+		if string(script) != test.script {
+			t.Errorf("processCommand(%q) script = %q, want %q", shellBin, script, test.script)
+		}
+	}
+}
+
+func TestRunStandalone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "standalone")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	build := screwdriver.Build{Commands: []screwdriver.CommandDef{
+		{Name: "one", Cmd: "export FOO=bar; echo $GREETING from $(basename $PWD)"},
+		{Name: "two", Cmd: "echo foo=$FOO step=$STEP", Environment: map[string]string{"STEP": "two"}},
+		{Name: "fail", Cmd: "exit 7"},
+		{Name: "skipped", Cmd: "echo skipped"},
+		{Name: "sd-teardown-artifacts", Cmd: "echo teardown in $(basename $PWD)"},
+	}}
+
+	var stops []string
+	api := MockAPI{
+		updateStepStop: func(buildID int, stepName string, exitCode int) error {
+			stops = append(stops, stepName+"="+strconv.Itoa(exitCode))
+			return nil
+		},
+	}
+	emitter := &MockEmitter{}
+
+	err = runStandalone(dir, []string{"GREETING=hello"}, emitter, build, api, 1, "/bin/sh", TestBuildTimeout, os.TempDir())
+	if err != (ErrStatus{7}) {
+		t.Errorf("runStandalone() error = %v, want exit status 7", err)
+	}
+	if want := []string{"one=0", "two=0", "fail=7", "sd-teardown-artifacts=0"}; !reflect.DeepEqual(stops, want) {
+		t.Errorf("Steps stopped = %v, want %v", stops, want)
+	}
+
+	output := string(emitter.found)
+	for _, want := range []string{
+		"hello from " + filepath.Base(dir),
+		"foo= step=two",
+		"teardown in " + filepath.Base(os.TempDir()),
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output %q has no %q", output, want)
+		}
+	}
+	if strings.Contains(output, "$ echo skipped\nskipped") {
+		t.Errorf("A step ran after a failed one")
+	}
+}
+
+func TestRunStandaloneTimeout(t *testing.T) {
+	oldKillGracePeriod := killGracePeriod
+	defer func() { killGracePeriod = oldKillGracePeriod }()
+	killGracePeriod = 100 * time.Millisecond
+
+	build := screwdriver.Build{Commands: []screwdriver.CommandDef{
+		{Name: "slow", Cmd: "sleep 30", Timeout: 1},
+	}}
+	emitter := &MockEmitter{}
+
+	start := time.Now()
+	err := runStandalone(os.TempDir(), nil, emitter, build, MockAPI{}, 1, "/bin/sh", TestBuildTimeout, os.TempDir())
+	if want := (ErrTimeout{Step: "slow", Timeout: time.Second}); err != want {
+		t.Errorf("runStandalone() error = %v, want %v", err, want)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("The step ran for %v after its timeout", elapsed)
+	}
+}
+
+func TestRunProcessStepExports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exports")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The variables an earlier step exported in the build shell, as it writes them for a group
+	envFile := filepath.Join(dir, "env_group")
+	export := "export FOO='a b' BAR=shell; export -p > " + shellQuote(envFile)
+	if output, err := exec.Command("/bin/sh", "-c", export).CombinedOutput(); err != nil {
+		t.Fatalf("Exporting the environment: %v: %s", err, output)
+	}
+
+	cmd := screwdriver.CommandDef{Name: "lint", Cmd: `echo "$FOO|$BAR|$BASE"`, Environment: map[string]string{"BAR": "step"}}
+	emitter := &MockEmitter{}
+	if _, err := runProcessStep(context.Background(), cmd, []string{"BASE=build"}, envFile, emitter, "/bin/sh", dir, "step", false); err != nil {
+		t.Fatalf("Unexpected error running the step: %v", err)
+	}
+	if want := "a b|step|build\n"; !strings.HasSuffix(string(emitter.found), want) {
+		t.Errorf("Output %q, want it to end with %q", emitter.found, want)
+	}
+
+	// Without anything exported yet, the step still runs
+	emitter = &MockEmitter{}
+	if _, err := runProcessStep(context.Background(), cmd, []string{"BASE=build"}, filepath.Join(dir, "missing"), emitter, "/bin/sh", dir, "step", false); err != nil {
+		t.Fatalf("Unexpected error running the step: %v", err)
+	}
+	if want := "|step|build\n"; !strings.HasSuffix(string(emitter.found), want) {
+		t.Errorf("Output %q, want it to end with %q", emitter.found, want)
+	}
+}
@@ -0,0 +1,430 @@
+// Package git checks out the source code of a build
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var execCommand = exec.Command
+
+// lookPath finds git-lfs, which builds can run without
+var lookPath = exec.LookPath
+
+// Identity used for the merge commit of pull request builds
+const (
+	botName  = "sd-buildbot"
+	botEmail = "dev-null@screwdriver.cd"
+)
+
+// Repo describes what to check out of a repository
+type Repo struct {
+	// URL is the clone URL of the repository
+	URL string
+	// RemoteURL replaces URL as the origin of the checkout once cloned, so the credentials
+	// of an authenticated URL aren't left in it. The origin stays URL when empty.
+	RemoteURL string
+	// Mirror is cloned instead of URL when set, then the branch is brought up to date from URL,
+	// so only what the mirror is missing comes from the origin
+	Mirror string
+	// Branch is the branch to build, or the target branch of a pull request
+	Branch string
+	// PRRef is the ref of the pull request head, e.g. "pull/42/head", empty for branch builds
+	PRRef string
+	// SHA is the commit to build: the branch is reset to it, or for pull requests it is the head
+	// merged. The tip of the branch or of the pull request is built when empty.
+	SHA string
+	// BaseSHA is a commit ChangedFiles compares the checkout with, like the one of the previous
+	// build of the branch. It is fetched along with the checkout when missing.
+	BaseSHA string
+	// SSH is the program git runs instead of ssh, like a wrapper using a deploy key
+	SSH string
+	// Depth limits the cloned history to that many commits, 0 clones everything
+	Depth int
+	// Submodules initializes the submodules of the checkout, recursively
+	Submodules bool
+	// LFS fetches the Git LFS objects of the checkout, when its .gitattributes uses LFS
+	LFS bool
+	// SparsePaths are the only directories checked out, along with the files at the root of
+	// the repository. Everything is checked out when empty.
+	SparsePaths []string
+
+	// kept is set for the checkouts left by a previous build, whose steps could have changed
+	// what git runs in them
+	kept bool
+}
+
+// Commit describes a commit of the repository
+type Commit struct {
+	Author  string
+	Email   string
+	Subject string
+	// Message is the whole commit message, subject included
+	Message string
+}
+
+// run runs a git command for the repo in dir, sending its output to out
+func (repo Repo) run(dir string, out io.Writer, args ...string) error {
+	if repo.kept {
+		args = append([]string{"-c", "core.hooksPath=/dev/null", "-c", "core.fsmonitor="}, args...)
+	}
+	cmd := execCommand("git", args...)
+	cmd.Dir = dir
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// LFS objects are only downloaded by fetchExtras, when the build wants them
+	cmd.Env = append(cmd.Env, "GIT_LFS_SKIP_SMUDGE=1")
+	if repo.SSH != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH="+repo.SSH)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Running git %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func depthArgs(depth int) []string {
+	if depth <= 0 {
+		return nil
+	}
+	return []string{"--depth", strconv.Itoa(depth)}
+}
+
+// Clone clones repo into dir and checks out its branch, at its SHA when set.
+// For pull requests, the head of the pull request is merged into the target branch.
+func Clone(repo Repo, dir string, out io.Writer) error {
+	args := []string{"clone", "--quiet"}
+	args = append(args, depthArgs(repo.Depth)...)
+	if len(repo.SparsePaths) > 0 {
+		args = append(args, "--no-checkout")
+	}
+	cloneURL := repo.URL
+	if repo.Mirror != "" {
+		cloneURL = repo.Mirror
+	}
+	args = append(args, "--branch", repo.Branch, cloneURL, dir)
+	if err := repo.run("", out, args...); err != nil {
+		return err
+	}
+	if len(repo.SparsePaths) > 0 {
+		if err := sparseCheckout(repo, dir, out); err != nil {
+			return err
+		}
+		if err := repo.run(dir, out, "checkout", "--quiet", repo.Branch); err != nil {
+			return err
+		}
+	}
+	// The mirror can be behind the origin
+	if repo.Mirror != "" {
+		if err := repo.run(dir, out, "remote", "set-url", "origin", repo.URL); err != nil {
+			return err
+		}
+		fetch := []string{"fetch", "--quiet"}
+		fetch = append(fetch, depthArgs(repo.Depth)...)
+		fetch = append(fetch, "origin", repo.Branch)
+		if err := repo.run(dir, out, fetch...); err != nil {
+			return err
+		}
+		if err := repo.run(dir, out, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+			return err
+		}
+	}
+
+	if repo.PRRef != "" {
+		if err := mergePR(repo, dir, out); err != nil {
+			return err
+		}
+	} else if err := resetToCommit(repo, dir, out); err != nil {
+		return err
+	}
+	fetchBase(repo, dir, out)
+	// Relative submodule URLs are resolved against the origin, which still has the credentials
+	if err := fetchExtras(repo, dir, out); err != nil {
+		return err
+	}
+	if repo.RemoteURL != "" {
+		return repo.run(dir, out, "remote", "set-url", "origin", repo.RemoteURL)
+	}
+	return nil
+}
+
+// mergePR fetches the head of a pull request and merges it into the checked out branch
+func mergePR(repo Repo, dir string, out io.Writer) error {
+	args := []string{"fetch", "--quiet"}
+	args = append(args, depthArgs(repo.Depth)...)
+	args = append(args, "origin", repo.PRRef)
+	if err := repo.run(dir, out, args...); err != nil {
+		return err
+	}
+	head := "FETCH_HEAD"
+	if repo.SHA != "" {
+		if err := fetchCommit(repo, dir, repo.PRRef, out); err != nil {
+			return err
+		}
+		head = repo.SHA
+	}
+
+	return repo.run(dir, out, "-c", "user.name="+botName, "-c", "user.email="+botEmail,
+		"merge", "--quiet", "--no-edit", "--no-ff", head)
+}
+
+// resetToCommit resets the branch checked out in dir to the SHA of repo, when it has one
+func resetToCommit(repo Repo, dir string, out io.Writer) error {
+	if repo.SHA == "" {
+		return nil
+	}
+	if err := fetchCommit(repo, dir, repo.Branch, out); err != nil {
+		return err
+	}
+	return repo.run(dir, out, "reset", "--quiet", "--hard", repo.SHA)
+}
+
+// fetchCommit makes sure the checkout in dir has the SHA of repo, fetching it from the origin
+// when ref moved past it further than the depth of the clone
+func fetchCommit(repo Repo, dir, ref string, out io.Writer) error {
+	if repo.run(dir, ioutil.Discard, "cat-file", "-e", repo.SHA+"^{commit}") == nil {
+		return nil
+	}
+	args := []string{"fetch", "--quiet"}
+	args = append(args, depthArgs(repo.Depth)...)
+	args = append(args, "origin", repo.SHA)
+	if err := repo.run(dir, out, args...); err != nil {
+		return fmt.Errorf("Commit %s can't be reached from %s, it may have been force-pushed away: %v", repo.SHA, ref, err)
+	}
+	return nil
+}
+
+// Update brings an existing checkout of repo in dir to the head of its branch,
+// dropping any local change. Untracked and ignored files are removed when clean is set.
+// Neither its hooks nor its file system monitor are run.
+func Update(repo Repo, dir string, clean bool, out io.Writer) (err error) {
+	repo.kept = true
+	// The origin of the checkout is only URL, with its credentials, while it gets updated
+	if repo.RemoteURL != "" {
+		if err := repo.run(dir, out, "remote", "set-url", "origin", repo.URL); err != nil {
+			return err
+		}
+		defer func() {
+			if resetErr := repo.run(dir, out, "remote", "set-url", "origin", repo.RemoteURL); err == nil {
+				err = resetErr
+			}
+		}()
+	}
+
+	// The paths of the previous build may not be the ones of this one
+	if len(repo.SparsePaths) > 0 {
+		if err := sparseCheckout(repo, dir, out); err != nil {
+			return err
+		}
+	} else if exists(filepath.Join(dir, ".git", "info", "sparse-checkout")) {
+		if err := repo.run(dir, out, "sparse-checkout", "disable"); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"fetch", "--quiet"}
+	args = append(args, depthArgs(repo.Depth)...)
+	args = append(args, "origin", repo.Branch)
+	if err := repo.run(dir, out, args...); err != nil {
+		return err
+	}
+	if err := repo.run(dir, out, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+		return err
+	}
+	if repo.PRRef == "" {
+		if err := resetToCommit(repo, dir, out); err != nil {
+			return err
+		}
+	}
+	if clean {
+		if err := repo.run(dir, out, "clean", "-ffdx"); err != nil {
+			return err
+		}
+	}
+
+	if repo.PRRef != "" {
+		if err := mergePR(repo, dir, out); err != nil {
+			return err
+		}
+	}
+	fetchBase(repo, dir, out)
+	return fetchExtras(repo, dir, out)
+}
+
+// Verify checks that dir holds a checkout of repo that can be updated: its origin is the one
+// of repo, and everything its refs lead to is there
+func Verify(repo Repo, dir string) error {
+	repo.kept = true
+	origin := repo.origin()
+	var output bytes.Buffer
+	if err := repo.run(dir, &output, "config", "--get", "remote.origin.url"); err != nil {
+		return fmt.Errorf("Checkout in %s has no origin: %v", dir, err)
+	}
+	if got := strings.TrimSpace(output.String()); got != origin {
+		return fmt.Errorf("Checkout in %s is of %s, not %s", dir, got, origin)
+	}
+
+	output.Reset()
+	if err := repo.run(dir, &output, "fsck", "--connectivity-only", "--no-dangling", "--no-progress"); err != nil {
+		return fmt.Errorf("Checkout in %s is corrupted: %v: %s", dir, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// Scrub removes what the steps of a previous build could have left in the .git of the checkout
+// of repo in dir to run commands with the credentials of the next one: its hooks, the
+// repositories of its submodules, and its config but for the format of the repository and the
+// origin, which is set to the one of repo.
+func Scrub(repo Repo, dir string) error {
+	repo.kept = true
+	gitDir := filepath.Join(dir, ".git")
+	config := filepath.Join(gitDir, "config")
+	var kept bytes.Buffer
+	// Exits with 1 when none is set
+	repo.run(dir, &kept, "config", "--file", config, "--get-regexp", `^(core\.repositoryformatversion|extensions\..*|remote\.origin\.fetch)$`)
+
+	settings := [][]string{{"core.bare", "false"}, {"remote.origin.url", repo.origin()}}
+	for _, line := range strings.Split(strings.TrimSpace(kept.String()), "\n") {
+		if setting := strings.SplitN(line, " ", 2); len(setting) == 2 {
+			settings = append(settings, setting)
+		}
+	}
+	scrubbed := config + ".scrubbed"
+	if err := os.Remove(scrubbed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Scrubbing the config of %s: %v", dir, err)
+	}
+	for _, setting := range settings {
+		if err := repo.run(dir, ioutil.Discard, "config", "--file", scrubbed, "--add", setting[0], setting[1]); err != nil {
+			return fmt.Errorf("Scrubbing the config of %s: %v", dir, err)
+		}
+	}
+	if err := os.Rename(scrubbed, config); err != nil {
+		return fmt.Errorf("Scrubbing the config of %s: %v", dir, err)
+	}
+
+	for _, path := range []string{filepath.Join(gitDir, "hooks"), filepath.Join(gitDir, "modules")} {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("Scrubbing %s: %v", path, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(gitDir, "hooks"), 0777); err != nil {
+		return fmt.Errorf("Scrubbing the hooks of %s: %v", dir, err)
+	}
+	return nil
+}
+
+// origin is the URL left as the origin of the checkouts of repo
+func (repo Repo) origin() string {
+	if repo.RemoteURL != "" {
+		return repo.RemoteURL
+	}
+	return repo.URL
+}
+
+// fetchBase fetches the BaseSHA of repo when the checkout in dir doesn't have it. Not finding it
+// doesn't fail the checkout, ChangedFiles says it is missing instead.
+func fetchBase(repo Repo, dir string, out io.Writer) {
+	if repo.BaseSHA == "" || repo.run(dir, ioutil.Discard, "cat-file", "-e", repo.BaseSHA+"^{commit}") == nil {
+		return
+	}
+	args := []string{"fetch", "--quiet"}
+	args = append(args, depthArgs(repo.Depth)...)
+	args = append(args, "origin", repo.BaseSHA)
+	repo.run(dir, out, args...)
+}
+
+// sparseCheckout limits the checkout in dir to the SparsePaths of repo
+func sparseCheckout(repo Repo, dir string, out io.Writer) error {
+	args := append([]string{"sparse-checkout", "set", "--cone"}, repo.SparsePaths...)
+	return repo.run(dir, out, args...)
+}
+
+// fetchExtras initializes the submodules and fetches the LFS objects of the checkout in dir,
+// those of them the repo wants and the checkout has
+func fetchExtras(repo Repo, dir string, out io.Writer) error {
+	if repo.Submodules && exists(filepath.Join(dir, ".gitmodules")) {
+		args := []string{"submodule", "update", "--init", "--recursive", "--quiet"}
+		args = append(args, depthArgs(repo.Depth)...)
+		if err := repo.run(dir, out, args...); err != nil {
+			return err
+		}
+	}
+	if repo.LFS && usesLFS(dir) {
+		// Images without git-lfs still build the source, with the pointers of the LFS files
+		if _, err := lookPath("git-lfs"); err != nil {
+			fmt.Fprintln(out, "WARN: git lfs is not installed, the LFS files of the checkout are left as pointers")
+			return nil
+		}
+		if err := repo.run(dir, out, "lfs", "pull"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// usesLFS tells whether the .gitattributes of the checkout in dir has files filtered by LFS
+func usesLFS(dir string) bool {
+	attributes, err := ioutil.ReadFile(filepath.Join(dir, ".gitattributes"))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(attributes), "filter=lfs")
+}
+
+// HeadCommit describes the commit checked out in dir.
+// The subject is the one git gives, on a single line since multi-line values break shell
+// environments. Commits can have an empty message.
+func HeadCommit(dir string) (Commit, error) {
+	cmd := execCommand("git", "log", "-1", "--format=%an%x00%ae%x00%s%x00%B")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return Commit{}, fmt.Errorf("Running git log: %v", err)
+	}
+
+	fields := strings.SplitN(string(out), "\x00", 4)
+	if len(fields) < 4 {
+		return Commit{}, fmt.Errorf("Unexpected git log output %q", out)
+	}
+
+	return Commit{
+		Author:  fields[0],
+		Email:   fields[1],
+		Subject: strings.TrimSpace(fields[2]),
+		Message: strings.TrimSpace(fields[3]),
+	}, nil
+}
+
+// ChangedFiles lists the files that differ between the commit checked out in dir and base, like
+// the commit of the previous build of the branch. For a pull request merged into its target
+// branch, the first parent "HEAD^1" is the base of all the changes of the pull request.
+func ChangedFiles(dir, base string) ([]string, error) {
+	cmd := execCommand("git", "diff", "--name-only", "-z", base, "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Running git diff: %v", err)
+	}
+	var files []string
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,158 @@
+package git
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Provider knows how a source code manager names its clone URLs and pull request refs
+type Provider interface {
+	// Name is the name of the provider in a Screwdriver SCM context, e.g. "github"
+	Name() string
+	// CloneURL is the HTTPS clone URL of org/repo on host, authenticated with token unless it is empty
+	CloneURL(host, org, repo, token string) string
+	// SSHURL is the SSH clone URL of org/repo on host, for deploy keys
+	SSHURL(host, org, repo string) string
+	// PRRef is the ref of the head of a pull request, e.g. "pull/42/head" on GitHub
+	PRRef(pr string) string
+}
+
+// The supported providers
+var (
+	GitHub           Provider = gitHub{name: "github"}
+	GitHubEnterprise Provider = gitHub{name: "github-enterprise"}
+	GitLab           Provider = gitLab{}
+	Bitbucket        Provider = bitbucket{}
+)
+
+var providers = []Provider{GitHub, GitHubEnterprise, GitLab, Bitbucket}
+
+// ProviderByName returns the provider with a name, as found at the start of a Screwdriver
+// SCM context like "gitlab:gitlab.com"
+func ProviderByName(name string) (Provider, error) {
+	for _, p := range providers {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown SCM provider %q", name)
+}
+
+// DetectProvider guesses the provider of a host. Hosts that aren't known GitLab or Bitbucket
+// ones are taken for GitHub Enterprise.
+func DetectProvider(host string) Provider {
+	switch {
+	case host == "github.com":
+		return GitHub
+	case host == "gitlab.com" || strings.HasPrefix(host, "gitlab."):
+		return GitLab
+	case host == "bitbucket.org" || strings.HasPrefix(host, "bitbucket."):
+		return Bitbucket
+	default:
+		return GitHubEnterprise
+	}
+}
+
+// httpsURL is https://host/org/repo.git, with user and token as credentials when token is set
+func httpsURL(host, org, repo, user, token string) string {
+	u := url.URL{Scheme: "https", Host: host, Path: "/" + org + "/" + repo + ".git"}
+	if token != "" {
+		u.User = url.UserPassword(user, token)
+	}
+	return u.String()
+}
+
+// sshURL is git@host:org/repo.git, without the port of an HTTPS host
+func sshURL(host, org, repo string) string {
+	if u, err := url.Parse("https://" + host); err == nil {
+		host = u.Hostname()
+	}
+	return fmt.Sprintf("git@%s:%s/%s.git", host, org, repo)
+}
+
+// gitHub covers github.com and GitHub Enterprise, which only differ by their host
+type gitHub struct {
+	name string
+}
+
+func (p gitHub) Name() string { return p.name }
+
+func (p gitHub) CloneURL(host, org, repo, token string) string {
+	return httpsURL(host, org, repo, "x-access-token", token)
+}
+
+func (p gitHub) SSHURL(host, org, repo string) string { return sshURL(host, org, repo) }
+
+func (p gitHub) PRRef(pr string) string { return "pull/" + pr + "/head" }
+
+type gitLab struct{}
+
+func (gitLab) Name() string { return "gitlab" }
+
+func (gitLab) CloneURL(host, org, repo, token string) string {
+	return httpsURL(host, org, repo, "oauth2", token)
+}
+
+func (gitLab) SSHURL(host, org, repo string) string { return sshURL(host, org, repo) }
+
+func (gitLab) PRRef(pr string) string { return "merge-requests/" + pr + "/head" }
+
+type bitbucket struct{}
+
+func (bitbucket) Name() string { return "bitbucket" }
+
+func (bitbucket) CloneURL(host, org, repo, token string) string {
+	return httpsURL(host, org, repo, "x-token-auth", token)
+}
+
+func (bitbucket) SSHURL(host, org, repo string) string { return sshURL(host, org, repo) }
+
+// PRRef is the ref Bitbucket Server publishes, Bitbucket Cloud has none for pull requests
+func (bitbucket) PRRef(pr string) string { return "pull-requests/" + pr + "/from" }
+
+// Location is where a repository is hosted
+type Location struct {
+	Host string
+	// Org can have several levels, like the GitLab subgroups "group/subgroup"
+	Org  string
+	Repo string
+}
+
+// ParseURL reads the location of a repository from an SSH URL like
+// "git@github.com:screwdriver-cd/launcher.git", "ssh://git@host:7999/org/repo.git" or an
+// HTTPS one like "https://gitlab.com/group/subgroup/repo.git"
+func ParseURL(rawURL string) (Location, error) {
+	var host, p string
+	if strings.Contains(rawURL, "://") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return Location{}, fmt.Errorf("Unable to parse SCM URL %q: %v", rawURL, err)
+		}
+		// The port of an SSH URL is no use for HTTPS clones
+		host, p = u.Host, u.Path
+		if u.Scheme != "https" && u.Scheme != "http" {
+			host = u.Hostname()
+		}
+	} else {
+		// scp-like syntax, [user@]host:path
+		i := strings.Index(rawURL, ":")
+		if i == -1 {
+			return Location{}, fmt.Errorf("Unable to parse SCM URL %q", rawURL)
+		}
+		host, p = rawURL[:i], rawURL[i+1:]
+		if j := strings.LastIndex(host, "@"); j != -1 {
+			host = host[j+1:]
+		}
+	}
+
+	parts := strings.FieldsFunc(strings.TrimSuffix(p, ".git"), func(r rune) bool { return r == '/' })
+	if host == "" || len(parts) < 2 {
+		return Location{}, fmt.Errorf("Unable to parse SCM URL %q", rawURL)
+	}
+	return Location{
+		Host: host,
+		Org:  strings.Join(parts[:len(parts)-1], "/"),
+		Repo: parts[len(parts)-1],
+	}, nil
+}
@@ -11,4 +11,5 @@ require (
 	github.com/urfave/cli v1.20.0
 	gopkg.in/fatih/color.v1 v1.7.0
 	gopkg.in/myesui/uuid.v1 v1.0.0
+	gopkg.in/yaml.v2 v2.2.2
 )
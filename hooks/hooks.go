@@ -0,0 +1,167 @@
+// Package hooks tells the programs operators add to the launcher about the lifecycle of builds,
+// for audit logs, scanners or notifications that don't belong in the launcher itself
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// The events of a build, in the order hooks are told about them
+const (
+	BuildStart = "buildStart"
+	StepStart  = "stepStart"
+	StepEnd    = "stepEnd"
+	BuildEnd   = "buildEnd"
+)
+
+// DefaultTimeout is how long a hook runs before it gets killed
+const DefaultTimeout = 30 * time.Second
+
+// Build is what hooks know of the build they are told about
+type Build struct {
+	Build     screwdriver.Build    `json:"build"`
+	Job       screwdriver.Job      `json:"job"`
+	Pipeline  screwdriver.Pipeline `json:"pipeline"`
+	Workspace string               `json:"workspace"`
+}
+
+// Hook is told about each event of a build. Its errors are logged by the launcher, they
+// never fail the build.
+type Hook interface {
+	OnBuildStart(b Build) error
+	OnStepStart(b Build, step string) error
+	OnStepEnd(b Build, step string, exitCode int) error
+	OnBuildEnd(b Build, buildErr error) error
+}
+
+// Event is what a hook program reads on its stdin
+type Event struct {
+	Event string `json:"event"`
+	Build
+	Step     string `json:"step,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Dir runs the executables of the directory Path for every event, in the order of their
+// names. They get the name of the event as argument and the Event as JSON on stdin, and
+// their output goes to the launcher log. A Dir without a Path does nothing.
+type Dir struct {
+	Path string
+	// Timeout is how long each hook runs, DefaultTimeout when 0
+	Timeout time.Duration
+}
+
+// OnBuildStart runs the hooks once the workspace of the build is created
+func (d Dir) OnBuildStart(b Build) error {
+	return d.run(Event{Event: BuildStart, Build: b})
+}
+
+// OnStepStart runs the hooks before the step
+func (d Dir) OnStepStart(b Build, step string) error {
+	return d.run(Event{Event: StepStart, Build: b, Step: step})
+}
+
+// OnStepEnd runs the hooks after the step, with its exit code
+func (d Dir) OnStepEnd(b Build, step string, exitCode int) error {
+	return d.run(Event{Event: StepEnd, Build: b, Step: step, ExitCode: &exitCode})
+}
+
+// OnBuildEnd runs the hooks once the build is done, with the error that failed it
+func (d Dir) OnBuildEnd(b Build, buildErr error) error {
+	e := Event{Event: BuildEnd, Build: b}
+	if buildErr != nil {
+		e.Error = buildErr.Error()
+	}
+	return d.run(e)
+}
+
+// run runs every hook of the directory for the event, even after one of them failed,
+// and returns the failures of all of them
+func (d Dir) run(e Event) error {
+	if d.Path == "" {
+		return nil
+	}
+	hooks, err := d.hooks()
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("Marshaling %s event: %v", e.Event, err)
+	}
+
+	var failures []string
+	for _, hook := range hooks {
+		if err := d.runHook(hook, e.Event, data); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// hooks lists the executables of the directory, sorted by name
+func (d Dir) hooks() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading hooks directory %q: %v", d.Path, err)
+	}
+
+	var hooks []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// Windows has no executable bit, every file there is a hook
+		if runtime.GOOS != "windows" && entry.Mode()&0111 == 0 {
+			continue
+		}
+		hooks = append(hooks, filepath.Join(d.Path, entry.Name()))
+	}
+	return hooks, nil
+}
+
+func (d Dir) runHook(hook, event string, data []byte) error {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook, event)
+	cmd.Env = append(os.Environ(), "SD_HOOK_EVENT="+event)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Hook %s timed out on %s after %v", filepath.Base(hook), event, timeout)
+		}
+		return fmt.Errorf("Hook %s failed on %s: %v", filepath.Base(hook), event, err)
+	}
+	return nil
+}
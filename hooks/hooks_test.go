@@ -0,0 +1,112 @@
+package hooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// writeHook adds a hook script to dir
+func writeHook(t *testing.T, dir, name, script string, perm os.FileMode) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), perm); err != nil {
+		t.Fatalf("Couldn't write hook %s: %v", name, err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	// Each hook appends its name, its argument and what it read to out
+	writeHook(t, dir, "10-audit", `echo "audit $1 $SD_HOOK_EVENT $(cat)" >> `+out, 0755)
+	writeHook(t, dir, "20-scan", `echo "scan $1" >> `+out, 0755)
+	writeHook(t, dir, "notes.txt", `echo "not a hook" >> `+out, 0644)
+	os.Mkdir(filepath.Join(dir, "lib"), 0755)
+
+	d := Dir{Path: dir}
+	b := Build{
+		Build:     screwdriver.Build{ID: 42},
+		Job:       screwdriver.Job{Name: "main"},
+		Workspace: "/sd/workspace",
+	}
+	if err := d.OnStepEnd(b, "test", 2); err != nil {
+		t.Fatalf("Unexpected error running the hooks: %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(out)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "audit stepEnd stepEnd {") || lines[1] != "scan stepEnd" {
+		t.Fatalf("Hooks ran as %q, want 10-audit then 20-scan", lines)
+	}
+
+	var e Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "audit stepEnd stepEnd ")), &e); err != nil {
+		t.Fatalf("The hook read an invalid event: %v", err)
+	}
+	if e.Event != StepEnd || e.Build.Build.ID != 42 || e.Job.Name != "main" || e.Workspace != "/sd/workspace" ||
+		e.Step != "test" || e.ExitCode == nil || *e.ExitCode != 2 {
+		t.Errorf("The hook read %+v", e)
+	}
+}
+
+func TestDirBuildEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	writeHook(t, dir, "notify", "cat > "+out, 0755)
+
+	if err := (Dir{Path: dir}).OnBuildEnd(Build{}, errors.New("exit 1")); err != nil {
+		t.Fatalf("Unexpected error running the hooks: %v", err)
+	}
+	var e Event
+	data, _ := ioutil.ReadFile(out)
+	if err := json.Unmarshal(data, &e); err != nil || e.Event != BuildEnd || e.Error != "exit 1" || e.ExitCode != nil {
+		t.Errorf("The hook read %s, %v, want the build error", data, err)
+	}
+}
+
+func TestDirFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	writeHook(t, dir, "a-fail", "exit 3", 0755)
+	writeHook(t, dir, "b-slow", "exec sleep 5", 0755)
+	writeHook(t, dir, "c-ok", "echo ran > "+out, 0755)
+
+	err = (Dir{Path: dir, Timeout: 100 * time.Millisecond}).OnBuildStart(Build{})
+	want := "Hook a-fail failed on buildStart: exit status 3; Hook b-slow timed out on buildStart after 100ms"
+	if err == nil || err.Error() != want {
+		t.Errorf("OnBuildStart() error = %v, want %q", err, want)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("The hooks after a failed one should still run")
+	}
+}
+
+func TestDirNoHooks(t *testing.T) {
+	b := Build{}
+	for _, d := range []Dir{{}, {Path: "/nonexistent/hooks"}} {
+		if err := d.OnBuildStart(b); err != nil {
+			t.Errorf("%+v.OnBuildStart() = %v, want nothing to run", d, err)
+		}
+	}
+}
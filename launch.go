@@ -5,17 +5,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/peterbourgon/mergemap"
+	"github.com/screwdriver-cd/launcher/artifacts"
+	"github.com/screwdriver-cd/launcher/cache"
+	"github.com/screwdriver-cd/launcher/directives"
 	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/git"
+	"github.com/screwdriver-cd/launcher/hooks"
+	"github.com/screwdriver-cd/launcher/metrics"
+	"github.com/screwdriver-cd/launcher/notify"
+	"github.com/screwdriver-cd/launcher/packages"
+	"github.com/screwdriver-cd/launcher/reports"
 	"github.com/screwdriver-cd/launcher/screwdriver"
 	"github.com/urfave/cli"
 	"gopkg.in/fatih/color.v1"
@@ -34,22 +45,112 @@ var mkdirAll = os.MkdirAll
 var stat = os.Stat
 var open = os.Open
 var executorRun = executor.Run
+var executorAbort = executor.Abort
+var executorPendingAbort = executor.PendingAbort
+var resolveShell = executor.ResolveShell
+var gitClone = git.Clone
+var gitUpdate = git.Update
+var gitVerify = git.Verify
+var gitScrub = git.Scrub
+var gitHeadCommit = git.HeadCommit
+var gitChangedFiles = git.ChangedFiles
 var writeFile = ioutil.WriteFile
 var readFile = ioutil.ReadFile
+var removeFile = os.Remove
 var newEmitter = screwdriver.NewEmitter
+var newStoreEmitter = screwdriver.NewStoreEmitter
+var newMaskingEmitter = screwdriver.NewMaskingEmitter
+var newLimitingEmitter = screwdriver.NewLimitingEmitter
 var marshal = json.Marshal
 var unmarshal = json.Unmarshal
 var cyanFprintf = color.New(color.FgCyan).Add(color.Underline).FprintfFunc()
 var blackSprint = color.New(color.FgHiBlack).SprintFunc()
+var sleep = time.Sleep
+var timeNow = time.Now
+var cacheRestore = cache.Restore
+var cacheSave = cache.Save
+var installPackages = packages.Install
+var startContainer = executor.StartContainer
+var uploadArtifactsDir = func(storeURL string, tokens screwdriver.TokenSource, buildID int, dir string, options artifacts.Options) (artifacts.Result, error) {
+	return artifacts.New(storeURL, tokens, buildID, options).Upload(dir)
+}
 
 var cleanExit = func() {
 	os.Exit(0)
 }
 
+// failedExit ends a local build that did not succeed, so scripts and git hooks can tell
+var failedExit = func() {
+	os.Exit(1)
+}
+
+// localBuild is set by --local, the launcher then exits with the outcome of the build
+var localBuild = false
+
+// credentialFiles are the temporary SSH keys and credential files written during the build.
+// They are removed when launch returns, including when it panics.
+var credentialFiles []string
+
+// cleanupCredentials controls whether credential files get removed. It is only turned off
+// when debugging a launcher image.
+var cleanupCredentials = true
+
+// buildTokens renews the build token for the store calls, the build token is used as is when nil
+var buildTokens screwdriver.TokenSource
+
+// streamLogs sends the step logs to the store while the build runs
+var streamLogs = false
+
+// uploadArtifacts sends the files left in the artifacts directory to the store once the steps finish
+var uploadArtifacts = false
+
+// collectReports summarizes the test results and coverage reports once the steps finish
+var collectReports = false
+
+// startNextJobs has the launcher start the next jobs of the workflow once the build succeeds,
+// for the clusters without a queue worker doing it
+var startNextJobs = false
+
+// containerExec runs the steps of the jobs with an image in a container of it
+var containerExec = false
+
+// logLimits truncate the log of the steps going over them, when enabled
+var logLimits screwdriver.LogLimits
+
+// storeRetryPolicy controls how the requests of the caches and the artifacts to the store are retried
+var storeRetryPolicy = screwdriver.DefaultRetryPolicy
+
 const DefaultTimeout = 90 // 90 minutes
 
-// exit sets the build status and exits successfully
-func exit(status screwdriver.BuildStatus, buildID int, api screwdriver.API, metaSpace string) {
+// DefaultCloneDepth is the history kept by shallow clones unless GIT_SHALLOW_CLONE_DEPTH is set
+const DefaultCloneDepth = 50
+
+// Annotations skipping the submodules or the LFS objects of the checkout, to keep small builds fast.
+// They are fetched when the repository has some unless set to false.
+const (
+	SubmodulesAnnotation = "screwdriver.cd/gitSubmodules"
+	LFSAnnotation        = "screwdriver.cd/gitLFS"
+	// SourcePathsAnnotation lists the directories of a monorepo a job builds: only they are
+	// checked out, and the job is skipped for the commits that don't change them
+	SourcePathsAnnotation = "screwdriver.cd/sourcePaths"
+)
+
+const (
+	// DefaultMaxEnvBytes is the default size limit of a step environment, half of the usual ARG_MAX
+	DefaultMaxEnvBytes = 1024 * 1024
+	// DefaultMaxEnvVarBytes is the default size limit of a single variable, the kernel's MAX_ARG_STRLEN
+	DefaultMaxEnvVarBytes = 128 * 1024
+)
+
+// How often the queue position file is checked while the build waits
+var queuePollInterval = 5 * time.Second
+
+// How often the build status is checked for an abort from the UI
+var abortPollInterval = 10 * time.Second
+
+// exit sets the build status and exits successfully, or with an error for a local build
+// that did not succeed
+func exit(status screwdriver.BuildStatus, buildID int, api screwdriver.API, metaSpace, statusMessage string) {
 	if api != nil {
 		var metaInterface map[string]interface{}
 
@@ -66,36 +167,72 @@ func exit(status screwdriver.BuildStatus, buildID int, api screwdriver.API, meta
 			}
 		}
 		log.Printf("Setting build status to %s", status)
-		if err := api.UpdateBuildStatus(status, metaInterface, buildID); err != nil {
+		if err := api.UpdateBuildStatus(status, metaInterface, buildID, statusMessage); err != nil {
 			log.Printf("Failed updating the build status: %v", err)
+		} else if status == screwdriver.Success && startNextJobs {
+			triggerNextJobs(api, buildID, metaInterface)
 		}
 	}
+	writeBuildReport(status, statusMessage)
+	sendNotifications(status, statusMessage)
+	buildsCompleted.Inc(string(status))
+	pushMetrics(buildID)
+	if localBuild && status != screwdriver.Success {
+		failedExit()
+		return
+	}
 	cleanExit()
 }
 
+// triggerNextJobs starts the jobs following the one of the build in the workflow of its event,
+// passing them its meta
+func triggerNextJobs(api screwdriver.API, buildID int, meta map[string]interface{}) {
+	build, err := api.BuildFromID(buildID)
+	if err != nil {
+		log.Printf("Failed starting the next jobs: %v", err)
+		return
+	}
+	builds, err := api.StartNextJobs(build.EventID, build.JobID, meta)
+	if err != nil {
+		log.Printf("Failed starting the next jobs: %v", err)
+		return
+	}
+	for _, next := range builds {
+		log.Printf("Started build %d of job %d", next.ID, next.JobID)
+	}
+}
+
 type scmPath struct {
 	Host    string
 	Org     string
 	Repo    string
 	Branch  string
 	RootDir string
+	// SHA is the commit to check out, the tip of the branch when empty
+	SHA string
+	// BaseSHA is the commit the changes of a branch build are compared with, see git.Repo
+	BaseSHA string
+	// Provider knows the clone URLs and pull request refs of the host
+	Provider git.Provider
 }
 
-// e.g. scmUri: "github:123456:master", scmName: "screwdriver-cd/launcher"
+// e.g. scmUri: "github:123456:master", scmName: "screwdriver-cd/launcher".
+// GitLab names can have subgroups, like "group/subgroup/project".
 func parseScmURI(scmURI, scmName string) (scmPath, error) {
 	uri := strings.Split(scmURI, ":")
-	orgRepo := strings.Split(scmName, "/")
+	slash := strings.LastIndex(scmName, "/")
 
-	if (len(uri) != 3 && len(uri) != 4) || len(orgRepo) != 2 {
+	if (len(uri) != 3 && len(uri) != 4) || slash <= 0 || slash == len(scmName)-1 {
 		return scmPath{}, fmt.Errorf("Unable to parse scmUri %v and scmName %v", scmURI, scmName)
 	}
 
 	parsed := scmPath{
-		Host:    uri[0],
-		Org:     orgRepo[0],
-		Repo:    orgRepo[1],
-		Branch:  uri[2],
-		RootDir: "",
+		Host:     uri[0],
+		Org:      scmName[:slash],
+		Repo:     scmName[slash+1:],
+		Branch:   uri[2],
+		RootDir:  "",
+		Provider: git.DetectProvider(uri[0]),
 	}
 
 	if len(uri) > 3 {
@@ -118,10 +255,10 @@ type Workspace struct {
 //     /sd/workspace/artifacts
 func createWorkspace(rootDir string, srcPaths ...string) (Workspace, error) {
 	srcPaths = append([]string{"src"}, srcPaths...)
-	src := path.Join(srcPaths...)
+	src := filepath.Join(srcPaths...)
 
-	src = path.Join(rootDir, src)
-	artifacts := path.Join(rootDir, "artifacts")
+	src = filepath.Join(rootDir, src)
+	artifacts := filepath.Join(rootDir, "artifacts")
 
 	paths := []string{
 		src,
@@ -177,7 +314,7 @@ func writeArtifact(aDir string, fName string, artifact interface{}) error {
 		return fmt.Errorf("Marshaling artifact: %v ", err)
 	}
 
-	pathToCreate := path.Join(aDir, fName)
+	pathToCreate := filepath.Join(aDir, fName)
 	err = writeFile(pathToCreate, data, 0644)
 	if err != nil {
 		return fmt.Errorf("Creating file %q : %v", pathToCreate, err)
@@ -186,6 +323,56 @@ func writeArtifact(aDir string, fName string, artifact interface{}) error {
 	return nil
 }
 
+// Provenance records where the outputs of a build come from
+type Provenance struct {
+	BuildID         int       `json:"buildId"`
+	JobID           int       `json:"jobId"`
+	PipelineID      int       `json:"pipelineId"`
+	EventID         int       `json:"eventId"`
+	ParentEventID   int       `json:"parentEventId"`
+	ScmURI          string    `json:"scmUri"`
+	ScmRepo         string    `json:"scmRepo"`
+	SHA             string    `json:"sha"`
+	LauncherVersion string    `json:"launcherVersion"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// provenancePath returns where the provenance of the build goes, the artifacts unless the launcher
+// or the job set SD_PROVENANCE_FILE.
+// Relative paths are resolved from the workspace root.
+func provenancePath(w Workspace, provenanceFile string) string {
+	if provenanceFile == "" {
+		return filepath.Join(w.Artifacts, "provenance.json")
+	}
+	if !filepath.IsAbs(provenanceFile) {
+		return filepath.Join(w.Root, provenanceFile)
+	}
+	return provenanceFile
+}
+
+// resolveProvenanceFile gives the steps the absolute path of the SD_PROVENANCE_FILE the job set in env
+func resolveProvenanceFile(w Workspace, env []string) string {
+	for i, e := range env {
+		if strings.HasPrefix(e, "SD_PROVENANCE_FILE=") {
+			provenanceFile := provenancePath(w, strings.TrimPrefix(e, "SD_PROVENANCE_FILE="))
+			env[i] = "SD_PROVENANCE_FILE=" + provenanceFile
+			os.Setenv("SD_PROVENANCE_FILE", provenanceFile)
+			return provenanceFile
+		}
+	}
+	return provenancePath(w, "")
+}
+
+// writeProvenance writes the provenance of the build to provenanceFile
+func writeProvenance(provenanceFile string, p Provenance) error {
+	dir := filepath.Dir(provenanceFile)
+	if err := mkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("Cannot create provenance path %q: %v", dir, err)
+	}
+
+	return writeArtifact(dir, filepath.Base(provenanceFile), p)
+}
+
 // prNumber checks to see if the job name is a pull request and returns its number
 func prNumber(jobName string) string {
 	r := regexp.MustCompile("^PR-([0-9]+)(?::[\\w-]+)?$")
@@ -216,21 +403,47 @@ func convertToArray(i interface{}) (array []int) {
 	}
 }
 
-func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, storeURL, uiURL, shellBin string, buildTimeout int, buildToken, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir string) error {
+func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, storeURL, uiURL, shellBin string, buildTimeout int, buildToken, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir string) (buildErr error) {
 	emitter, err := newEmitter(emitterPath)
-	envFilepath := "/tmp/env"
+	envFilepath := defaultEnvFile
 	if err != nil {
 		return err
 	}
-	defer emitter.Close()
+	var tokens screwdriver.TokenSource = screwdriver.StaticToken(buildToken)
+	if buildTokens != nil {
+		tokens = buildTokens
+	}
+
+	if streamLogs {
+		emitter = newStoreEmitter(emitter, storeURL, tokens, buildID)
+	}
+	if crashDiagnostics.dir != "" {
+		emitter = newDiagnosticsEmitter(emitter, crashDiagnostics.dir)
+	}
+	startBuildReport(buildID, storeURL, tokens)
+	emitter = summaryEmitter{emitter}
+	executor.GroupStepTimes = timeGroupedStep
+	// The emitter gets wrapped once the secrets are known
+	defer func() { emitter.Close() }()
+	defer cleanupCredentialFiles()
 
 	if err = api.UpdateStepStart(buildID, "sd-setup-launcher"); err != nil {
 		return fmt.Errorf("Updating sd-setup-launcher start: %v", err)
 	}
+	// The setup step fails with the build when it doesn't get to the steps
+	setupDone := false
+	defer func() {
+		if !setupDone {
+			emitter.StopCmd(screwdriver.CommandDef{Name: "sd-setup-launcher"}, executor.ExitLaunch)
+			if err := api.UpdateStepStop(buildID, "sd-setup-launcher", executor.ExitLaunch); err != nil {
+				log.Printf("Updating sd-setup-launcher stop: %v", err)
+			}
+		}
+	}()
 
 	log.Print("Setting Build Status to RUNNING")
 	emptyMeta := make(map[string]interface{}) // {"meta":null} are not accepted. This will be {"meta":{}}
-	if err = api.UpdateBuildStatus(screwdriver.Running, emptyMeta, buildID); err != nil {
+	if err = api.UpdateBuildStatus(screwdriver.Running, emptyMeta, buildID, ""); err != nil {
 		return fmt.Errorf("Updating build status to RUNNING: %v", err)
 	}
 
@@ -245,12 +458,22 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 	if err != nil {
 		return fmt.Errorf("Fetching Job ID %d: %v", build.JobID, err)
 	}
+	if jsonLog != nil {
+		jsonLog.setJob(job.ID)
+		jsonLog.setStep("sd-setup-launcher")
+		emitter = stepLogEmitter{emitter, jsonLog}
+	}
 
 	log.Printf("Fetching Pipeline %d", job.PipelineID)
 	pipeline, err := api.PipelineFromID(job.PipelineID)
 	if err != nil {
 		return fmt.Errorf("Fetching Pipeline ID %d: %v", job.PipelineID, err)
 	}
+	setBuildNotice(pipeline, job, build, uiURL)
+	buildReport.JobID, buildReport.PipelineID = job.ID, job.PipelineID
+	if len(buildNotice.notifications) > 0 {
+		emitter = failedStepEmitter{emitter}
+	}
 
 	log.Printf("Fetching Event %d", build.EventID)
 	event, err := api.EventFromID(build.EventID)
@@ -348,6 +571,39 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		}
 	}
 
+	// Parameters the event was started with, checked against the ones the job declares
+	given, err := eventParameters(event.Meta)
+	if err != nil {
+		return err
+	}
+	params, err := resolveParameters(job.Name, job.Parameters(), given)
+	if err != nil {
+		return err
+	}
+	if len(params) > 0 {
+		mergedMeta = deepMergeJSON(mergedMeta, parameterMeta(params))
+	}
+
+	// The node is checked before anything gets checked out or run, the report goes in the meta
+	// even when the build can't go on
+	var preflightErr error
+	if runPreflight {
+		log.Print("Running preflight checks")
+		binaries := []string{"tar", shellBin}
+		if !hasStep(build, "sd-setup-scm") {
+			binaries = append([]string{"git"}, binaries...)
+		}
+		checkedURL, _ := api.GetAPIURL()
+		report := preflight(binaries, checkedURL, storeURL, rootDir)
+		for _, check := range report.Checks {
+			if !check.OK {
+				fmt.Fprintf(emitter, "Preflight %s: %s\n", check.Name, check.Message)
+			}
+		}
+		mergedMeta["preflight"] = report
+		preflightErr = report.Err()
+	}
+
 	log.Println("Marshalling Merged Meta JSON")
 	metaByte, err = marshal(mergedMeta)
 
@@ -359,11 +615,34 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 	if err != nil {
 		return fmt.Errorf("Writing Parent %v Meta JSON: %v", metaLog, err)
 	}
+	if preflightErr != nil {
+		return preflightErr
+	}
 
 	scm, err := parseScmURI(pipeline.ScmURI, pipeline.ScmRepo.Name)
 	if err != nil {
 		return err
 	}
+	if pipeline.ScmContext != "" {
+		scm.Provider = scmProvider(pipeline.ScmContext, scm.Provider)
+	}
+	// The commit of the build, the branch may have moved on since it was pushed
+	scm.SHA = build.SHA
+
+	if cleanWorkspace == "pre" || cleanWorkspace == "both" {
+		log.Printf("Cleaning Workspace in %v", rootDir)
+		if err := wipeWorkspace(rootDir); err != nil {
+			return err
+		}
+	}
+	if cleanWorkspace == "post" || cleanWorkspace == "both" {
+		defer func() {
+			log.Printf("Cleaning Workspace in %v", rootDir)
+			if err := wipeWorkspace(rootDir); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+		}()
+	}
 
 	log.Printf("Creating Workspace in %v", rootDir)
 	w, err := createWorkspace(rootDir, scm.Host, scm.Org, scm.Repo)
@@ -374,6 +653,18 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 	if scm.RootDir != "" {
 		sourceDir = sourceDir + "/" + scm.RootDir
 	}
+	buildReport.path = filepath.Join(w.Root, buildSummaryFile)
+
+	// Hooks see the build until it is done, before the workspace gets cleaned
+	hookBuild := hooks.Build{Build: build, Job: job, Pipeline: pipeline, Workspace: w.Root}
+	if err := buildHooks.OnBuildStart(hookBuild); err != nil {
+		log.Printf("WARN: %v", err)
+	}
+	defer func() {
+		if err := buildHooks.OnBuildEnd(hookBuild, buildErr); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}()
 
 	cyanFprintf(emitter, "Screwdriver Launcher information\n")
 	fmt.Fprintf(emitter, "%s%s\n", blackSprint("Version:        v"), version)
@@ -387,8 +678,11 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 
 	oldJobName := job.Name
 	pr := prNumber(job.Name)
+	prBaseBranch := ""
 	if pr != "" {
 		job.Name = "main"
+		// The pipeline branch is the one pull requests get merged into
+		prBaseBranch = scm.Branch
 	}
 
 	err = writeArtifact(w.Artifacts, "steps.json", build.Commands)
@@ -403,6 +697,12 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 
 	apiURL, _ := api.GetAPIURL()
 
+	// The branch built, like git names the remote branches
+	gitBranch := "origin/" + scm.Branch
+	if pr != "" {
+		gitBranch = "origin/" + scm.Provider.PRRef(pr)
+	}
+
 	defaultEnv := map[string]string{
 		"PS1":                    "",
 		"SCREWDRIVER":            "true",
@@ -425,7 +725,10 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		"SD_META_DIR":         	  metaSpace,
 		"SD_META_PATH":           metaSpace + "/meta.json",
 		"SD_BUILD_SHA":           build.SHA,
+		"SD_GIT_COMMIT":          build.SHA,
+		"GIT_BRANCH":             gitBranch,
 		"SD_PULL_REQUEST":        pr,
+		"PR_BASE_BRANCH_NAME":    prBaseBranch,
 		"SD_API_URL":             apiURL,
 		"SD_BUILD_URL":           apiURL + "builds/" + strconv.Itoa(buildID),
 		"SD_STORE_URL":           fmt.Sprintf("%s/%s/", storeURL, "v1"),
@@ -435,6 +738,7 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 		"SD_PIPELINE_CACHE_DIR":  pipelineCacheDir,
 		"SD_JOB_CACHE_DIR":       jobCacheDir,
 		"SD_EVENT_CACHE_DIR":     eventCacheDir,
+		"SD_PROVENANCE_FILE":     provenancePath(w, os.Getenv("SD_PROVENANCE_FILE")),
 	}
 
 	// Add coverage env vars
@@ -446,65 +750,552 @@ func launch(api screwdriver.API, buildID int, rootDir, emitterPath, metaSpace, s
 			defaultEnv[key] = value
 		}
 	}
+	for key, value := range parameterEnv(params) {
+		defaultEnv[key] = value
+	}
 
 	// Get secrets for build
 	secrets, err := api.SecretsForBuild(build)
 	if err != nil {
 		return fmt.Errorf("Fetching secrets for build %v", build.ID)
 	}
+	// The deploy key only serves the checkout, which pull requests need too
+	checkoutSecrets := secrets
+	if pr != "" {
+		secrets = secrets.AllowedInPR()
+	}
+	emitter = newMaskingEmitter(emitter, secrets.Values())
+	if logLimits.Enabled() {
+		emitter = newLimitingEmitter(emitter, logLimits)
+	}
+	// The deploy key stays masked, but only the checkout gets it, never the steps
+	if pipeline.Settings.CheckoutAuth == screwdriver.CheckoutAuthDeployKey {
+		secrets = secrets.Without(deployKeySecret)
+	}
+
+	annotations := pipeline.Annotations.Merge(job.Annotations())
+	buildTimeout = annotatedTimeout(annotations, buildTimeout)
 
 	env, userShellBin := createEnvironment(defaultEnv, secrets, build)
+	if err := validateEnvironment(env); err != nil {
+		return err
+	}
+	provenanceFile := resolveProvenanceFile(w, env)
+	shellBin = annotatedShell(annotations, shellBin)
 	if userShellBin != "" {
 		shellBin = userShellBin
 	}
+	// Shells can be given by name, like "bash" or "pwsh"
+	if shellBin, err = resolveShell(shellBin); err != nil {
+		return err
+	}
+
+	provenance := Provenance{
+		BuildID:         buildID,
+		JobID:           job.ID,
+		PipelineID:      job.PipelineID,
+		EventID:         build.EventID,
+		ParentEventID:   event.ParentEventID,
+		ScmURI:          pipeline.ScmURI,
+		ScmRepo:         pipeline.ScmRepo.Name,
+		SHA:             build.SHA,
+		LauncherVersion: version,
+		Timestamp:       timeNow().UTC(),
+	}
+	if err := writeProvenance(provenanceFile, provenance); err != nil {
+		return fmt.Errorf("Creating provenance file: %v", err)
+	}
+
+	if !hasStep(build, "sd-setup-scm") {
+		creds, err := resolveCheckoutCredentials(api, buildID, pipeline.Settings, checkoutSecrets, os.TempDir())
+		if err != nil {
+			return fmt.Errorf("Checking out source: %v", err)
+		}
+		if keepCheckouts != "" {
+			defer borrowCheckout(job.PipelineID, job.ID, w.Src)()
+		}
+		// Jobs of a monorepo compare the commit with the last one they built, fetched with the checkout
+		if paths, _ := annotations.Strings(SourcePathsAnnotation); len(paths) > 0 && pr == "" {
+			scm.BaseSHA = lastBuiltSHA(api, job.ID)
+		}
+		checkoutStart := time.Now()
+		if err := checkoutSource(scm, w.Src, pr, creds, annotations); err != nil {
+			if _, ok := err.(ErrSCMUnavailable); ok {
+				return err
+			}
+			return fmt.Errorf("Checking out source: %v", err)
+		}
+		checkoutDuration.Since(checkoutStart)
+		buildReport.CheckoutSeconds = time.Since(checkoutStart).Seconds()
+	}
 
-	return executorRun(w.Src, env, emitter, build, api, buildID, shellBin, buildTimeout, envFilepath, sourceDir)
+	// The commit message can ask not to build it, unless the build checks out the source in a
+	// step, the message of the event is all there is to go by
+	message := event.Commit.Message
+	if !hasStep(build, "sd-setup-scm") {
+		if commit, err := gitHeadCommit(w.Src); err != nil {
+			log.Printf("WARN: Reading the head commit: %v", err)
+		} else {
+			message = commit.Message
+			// The steps get the commit described like in local builds, below the job environment
+			for k, v := range commitEnvironment(commit) {
+				defaultEnv[k] = v
+			}
+			env, _ = createEnvironment(defaultEnv, secrets, build)
+			if err := validateEnvironment(env); err != nil {
+				return err
+			}
+			resolveProvenanceFile(w, env)
+		}
+	}
+	// Pull requests don't release anything, freeze windows don't stop them
+	freezeWindows := pipeline.Settings.FreezeWindows
+	if pr != "" {
+		freezeWindows = nil
+	}
+	if status, reason := directives.Check(message, scm.Branch, freezeWindows, timeNow()); status != "" {
+		fmt.Fprintf(emitter, "%s\n", reason)
+		return ErrSkipped{Status: status, Reason: reason}
+	}
+	// Jobs of a monorepo only build the commits changing their source paths since their last
+	// successful build, which needs the checkout of the launcher. The merge commit of a pull
+	// request has the target branch as first parent.
+	sourcePaths, err := annotations.Strings(SourcePathsAnnotation)
+	if err != nil {
+		return err
+	}
+	base := scm.BaseSHA
+	if pr != "" {
+		base = "HEAD^1"
+	}
+	if len(sourcePaths) > 0 && !hasStep(build, "sd-setup-scm") && !directives.Parse(message).Force {
+		if base == "" || base == build.SHA {
+			log.Printf("No previous build to compare with, not filtering on the source paths")
+		} else if changed, err := gitChangedFiles(w.Src, base); err != nil {
+			log.Printf("WARN: Not filtering on the source paths: %v", err)
+		} else if !directives.Touches(changed, sourcePaths) {
+			reason := "No changes in the source paths " + strings.Join(sourcePaths, ", ")
+			fmt.Fprintf(emitter, "%s\n", reason)
+			return ErrSkipped{Status: screwdriver.Skipped, Reason: reason}
+		}
+	}
+
+	// Toolchains listed in SD_PACKAGES come first in the PATH of the steps
+	if list := os.Getenv("SD_PACKAGES"); list != "" {
+		pkgs, err := packages.Parse(list)
+		if err != nil {
+			return err
+		}
+		binDirs, err := installPackages(pkgs, emitter)
+		if err != nil {
+			return err
+		}
+		env = prependPath(env, binDirs)
+	}
+
+	// The step commands get their ${{name}} values, and their ${VAR} when the job asks for it
+	interpolateEnv, err := annotations.Bool(InterpolateEnvAnnotation, false)
+	if err != nil {
+		return err
+	}
+	strictTemplates, err := annotations.Bool(StrictTemplatesAnnotation, false)
+	if err != nil {
+		return err
+	}
+	options := templateOptions{Env: interpolateEnv, Strict: strictTemplates, Shell: shellBin}
+	if err := expandCommands(&build, env, builtinValues(build, job, scm.Branch, pr), options); err != nil {
+		return err
+	}
+
+	// Cached directories are relative to the checkout directory. Pull requests restore the cache
+	// of the job they run for but never save it, so they can't change what other builds get.
+	cacheDirs := annotatedCacheDirs(annotations, splitList(os.Getenv("SD_CACHE_DIRS")))
+	cacheName := cache.Name(job.Name, scm.Branch, os.Getenv("SD_CACHE_KEY"))
+	var buildCache cache.Store
+	if len(cacheDirs) > 0 {
+		buildCache, err = cacheStore(cacheStrategy, pipelineCacheDir, storeURL, tokens, job.PipelineID)
+		if err != nil {
+			log.Printf("WARN: Not using the cache: %v", err)
+		} else if found, err := cacheRestore(buildCache, cacheName, w.Src); err != nil {
+			log.Printf("WARN: Restoring the cache: %v", err)
+			cacheRestores.Inc("error")
+			buildReport.Cache = "error"
+		} else if found {
+			log.Printf("Restored cache %s", cacheName)
+			cacheRestores.Inc("hit")
+			buildReport.Cache = "hit"
+		} else {
+			log.Printf("No cache %s to restore yet", cacheName)
+			cacheRestores.Inc("miss")
+			buildReport.Cache = "miss"
+		}
+	}
+
+	// The image is pulled as part of the setup, failing it when it can't be
+	if image := job.Image(); containerExec && image != "" {
+		fmt.Fprintf(emitter, "Starting a container of %s\n", image)
+		container, err := startContainer(image, []string{w.Root, metaSpace}, emitter)
+		if err != nil {
+			return err
+		}
+		executor.StepContainer = container
+		defer func() {
+			executor.StepContainer = nil
+			if err := container.Remove(); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+		}()
+	}
+
+	setupDone = true
+	emitter.StopCmd(screwdriver.CommandDef{Name: "sd-setup-launcher"}, executor.ExitOk)
+	if err := api.UpdateStepStop(buildID, "sd-setup-launcher", executor.ExitOk); err != nil {
+		return fmt.Errorf("Updating sd-setup-launcher stop: %v", err)
+	}
+
+	stopWatching := watchForAbort(api, buildID)
+	stopQuota := func() error { return nil }
+	if workspaceQuota > 0 {
+		stopQuota = watchWorkspaceQuota(rootDir, workspaceQuota)
+	}
+
+	runErr := executorRun(w.Src, env, &timedEmitter{Emitter: hookEmitter{emitter, buildHooks, hookBuild}}, build, api, buildID, shellBin, buildTimeout, envFilepath, sourceDir)
+	// Past the steps, the launcher stops like any process on a signal
+	stopWatching()
+	if abortErr := executorPendingAbort(); abortErr != nil && runErr == nil {
+		runErr = abortErr
+	}
+	// The build fails, rather than being aborted, when it filled its workspace
+	if err := stopQuota(); err != nil {
+		runErr = err
+	}
+	if jsonLog != nil {
+		jsonLog.setStep("")
+	}
+
+	// Reports are copied to the artifacts directory before it gets uploaded
+	if collectReports {
+		publishReports(w.Src, w.Artifacts, metaSpace)
+	}
+
+	if buildCache != nil && runErr == nil && pr == "" {
+		if err := cacheSave(buildCache, cacheName, w.Src, cacheDirs); err != nil {
+			log.Printf("WARN: Saving the cache: %v", err)
+		} else {
+			log.Printf("Saved cache %s", cacheName)
+		}
+	}
+
+	if uploadArtifacts {
+		options, err := artifactOptions()
+		if err != nil {
+			log.Printf("WARN: Not uploading artifacts: %v", err)
+		} else if result, err := uploadArtifactsDir(storeURL, tokens, buildID, w.Artifacts, options); err != nil {
+			log.Printf("WARN: Uploading artifacts: %v", err)
+		} else {
+			log.Printf("Uploaded %d artifacts, skipped %d", len(result.Uploaded), len(result.Skipped))
+			reportArtifacts(result)
+			for _, f := range result.Uploaded {
+				artifactBytes.Add(float64(f.Size))
+			}
+		}
+	}
+
+	return runErr
+}
+
+// cacheStore returns where caches are kept for the cache strategy: in the pipeline cache
+// directory for "disk", in the store otherwise
+func cacheStore(strategy, pipelineCacheDir, storeURL string, tokens screwdriver.TokenSource, pipelineID int) (cache.Store, error) {
+	if strategy == "disk" {
+		if pipelineCacheDir == "" {
+			return nil, fmt.Errorf("The disk cache strategy needs a pipeline cache directory")
+		}
+		return cache.NewDiskStore(pipelineCacheDir), nil
+	}
+	return cache.NewStoreWithRetryPolicy(storeURL, tokens, pipelineID, storeRetryPolicy), nil
+}
+
+// artifactOptions reads the artifact upload settings from the build environment
+func artifactOptions() (artifacts.Options, error) {
+	options := artifacts.Options{RetryPolicy: storeRetryPolicy}
+	var err error
+
+	options.Include = splitList(os.Getenv("SD_ARTIFACTS_INCLUDE"))
+	options.Exclude = splitList(os.Getenv("SD_ARTIFACTS_EXCLUDE"))
+	if options.MaxFileSize, err = parseSize("SD_ARTIFACTS_MAX_FILE_SIZE"); err != nil {
+		return options, err
+	}
+	if options.MaxTotalSize, err = parseSize("SD_ARTIFACTS_MAX_SIZE"); err != nil {
+		return options, err
+	}
+	if options.PartSize, err = parseSize("SD_ARTIFACTS_PART_SIZE"); err != nil {
+		return options, err
+	}
+	if v := os.Getenv("SD_ARTIFACTS_PARALLEL"); v != "" {
+		if options.Parallel, err = strconv.Atoi(v); err != nil || options.Parallel <= 0 {
+			return options, fmt.Errorf("Invalid SD_ARTIFACTS_PARALLEL %q: must be a positive number of uploads", v)
+		}
+	}
+
+	return options, nil
 }
 
-func createEnvironment(base map[string]string, secrets screwdriver.Secrets, build screwdriver.Build) ([]string, string) {
-	var userShellBin string
+// publishReports puts the summary of the test results and coverage reports of the checkout in
+// the build meta, for the build page, and copies them to the reports directory of the artifacts.
+// Missing or unreadable reports never fail the build.
+func publishReports(sourceDir, artifactsDir, metaSpace string) {
+	options := reports.Options{
+		TestResults: splitList(os.Getenv("SD_TEST_RESULTS")),
+		Coverage:    splitList(os.Getenv("SD_COVERAGE_REPORTS")),
+	}
+	summary, err := reports.Collect(sourceDir, options)
+	if err != nil {
+		log.Printf("WARN: Not publishing reports: %v", err)
+		return
+	}
+	if len(summary.Files) == 0 {
+		log.Printf("No test results or coverage reports found")
+		return
+	}
+	log.Printf("Found %d reports: %d tests, %d passed", len(summary.Files), summary.Tests, summary.Passed())
+
+	if err := reports.Copy(sourceDir, filepath.Join(artifactsDir, "reports"), summary.Files); err != nil {
+		log.Printf("WARN: %v", err)
+	}
 
-	// Add the default environment values
-	for k, v := range base {
-		os.Setenv(k, os.ExpandEnv(v))
+	// Values set by the steps themselves are kept
+	metaFile := metaSpace + "/meta.json"
+	meta := make(map[string]interface{})
+	if metaJSON, err := readFile(metaFile); err == nil {
+		if err := unmarshal(metaJSON, &meta); err != nil {
+			log.Printf("WARN: Not adding the reports to the meta, reading %v: %v", metaFile, err)
+			return
+		}
 	}
+	metaByte, err := marshal(deepMergeJSON(summary.Meta(), meta))
+	if err != nil {
+		log.Printf("WARN: Not adding the reports to the meta: %v", err)
+		return
+	}
+	if err := writeFile(metaFile, metaByte, 0666); err != nil {
+		log.Printf("WARN: Not adding the reports to the meta: %v", err)
+	}
+}
 
-	for _, s := range secrets {
-		os.Setenv(s.Name, s.Value)
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
+}
 
-	for _, env := range build.Environment {
-		for k, v := range env {
-			os.Setenv(k, os.ExpandEnv(v))
+// parseSize reads a size in bytes from the environment variable name, 0 when unset
+func parseSize(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid %s %q: must be a number of bytes", name, value)
+	}
+	return size, nil
+}
 
-			if k == "USER_SHELL_BIN" {
-				userShellBin = v
+// watchForAbort aborts the build when the launcher gets SIGTERM or SIGINT, or when the build
+// gets aborted from the UI. Calling the returned function stops watching, once an abort under
+// way is passed on to the executor.
+func watchForAbort(api screwdriver.API, buildID int) func() {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	ticker := time.NewTicker(abortPollInterval)
+
+	go func() {
+		defer close(finished)
+		defer ticker.Stop()
+		// Once the build is aborted, another signal stops the launcher itself
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				log.Printf("Received %v, aborting build %d", sig, buildID)
+				executorAbort(fmt.Sprintf("Received %v", sig))
+				return
+			case <-ticker.C:
+				build, err := api.BuildFromID(buildID)
+				if err != nil {
+					log.Printf("WARN: Unable to check whether build %d was aborted: %v", buildID, err)
+					continue
+				}
+				if build.Status == screwdriver.Aborted {
+					log.Printf("Build %d was aborted", buildID)
+					executorAbort("Stopped from the UI")
+					return
+				}
 			}
 		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// hasStep tells whether the build has a step with that name
+func hasStep(build screwdriver.Build, name string) bool {
+	for _, cmd := range build.Commands {
+		if cmd.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneDepth reads the shallow clone settings from the environment, 0 meaning a full clone
+func cloneDepth() (int, error) {
+	if shallow, err := strconv.ParseBool(os.Getenv("GIT_SHALLOW_CLONE")); err == nil && !shallow {
+		return 0, nil
+	}
+
+	v := os.Getenv("GIT_SHALLOW_CLONE_DEPTH")
+	if v == "" {
+		return DefaultCloneDepth, nil
+	}
+	depth, err := strconv.Atoi(v)
+	if err != nil || depth <= 0 {
+		return 0, fmt.Errorf("Invalid GIT_SHALLOW_CLONE_DEPTH %q: must be a positive number of commits", v)
 	}
+	return depth, nil
+}
 
-	envMap := map[string]string{}
+// scmProvider is the provider named by an SCM context like "gitlab:gitlab.com", detected
+// when the context names none the launcher knows
+func scmProvider(scmContext string, detected git.Provider) git.Provider {
+	name := strings.SplitN(scmContext, ":", 2)[0]
+	provider, err := git.ProviderByName(name)
+	if err != nil {
+		log.Printf("WARN: %v in SCM context %q, using %s", err, scmContext, detected.Name())
+		return detected
+	}
+	return provider
+}
 
-	// Go through environment and make an environment variables map
-	for _, e := range os.Environ() {
-		pieces := strings.SplitAfterN(e, "=", 2)
-		if len(pieces) != 2 {
-			log.Printf("WARN: bad environment value from base environment: %s", e)
-			continue
+// lastBuiltSHA is the commit of the last successful build of the job, empty when there is none
+func lastBuiltSHA(api screwdriver.API, jobID int) string {
+	build, err := api.LatestBuild(jobID, screwdriver.Success)
+	if err != nil {
+		if e, ok := err.(screwdriver.SDError); !ok || e.StatusCode != http.StatusNotFound {
+			log.Printf("WARN: Finding the last successful build of job %d: %v", jobID, err)
 		}
+		return ""
+	}
+	return build.SHA
+}
 
-		k := pieces[0][:len(pieces[0])-1] // Drop the "=" off the end
-		v := pieces[1]
+// checkoutSource clones the pipeline repository into checkoutDir for builds that don't
+// come with a sd-setup-scm step. Pull requests are merged into their target branch.
+// Private repositories are cloned with the SCM_ACCESS_TOKEN of the build environment.
+// The annotations of the job can skip its submodules and LFS objects.
+func checkoutSource(scm scmPath, checkoutDir, pr string, creds checkoutCredentials, annotations screwdriver.Annotations) error {
+	// The deploy key is gone before the steps start, whatever happens to the clone
+	defer creds.remove()
 
-		envMap[k] = v
+	depth, err := annotatedCloneDepth(annotations)
+	if err != nil {
+		return err
+	}
+	submodules, err := annotations.Bool(SubmodulesAnnotation, true)
+	if err != nil {
+		return err
+	}
+	lfs, err := annotations.Bool(LFSAnnotation, true)
+	if err != nil {
+		return err
+	}
+	sourcePaths, err := annotations.Strings(SourcePathsAnnotation)
+	if err != nil {
+		return err
 	}
 
-	env := []string{}
-	for k, v := range envMap {
-		env = append(env, strings.Join([]string{k, v}, "="))
+	provider := scm.Provider
+	if provider == nil {
+		provider = git.DetectProvider(scm.Host)
 	}
+	publicURL := provider.CloneURL(scm.Host, scm.Org, scm.Repo, "")
+	repo := git.Repo{
+		URL:        publicURL,
+		Branch:     scm.Branch,
+		SHA:        scm.SHA,
+		BaseSHA:    scm.BaseSHA,
+		Depth:      depth,
+		Submodules: submodules,
+		LFS:        lfs,
+	}
+	for _, dir := range sourcePaths {
+		if dir = strings.Trim(dir, "/"); dir != "" {
+			repo.SparsePaths = append(repo.SparsePaths, dir)
+		} else {
+			// The root of the repository holds everything
+			repo.SparsePaths = nil
+			break
+		}
+	}
+	token := creds.Token
+	if token == "" {
+		token = os.Getenv("SCM_ACCESS_TOKEN")
+	}
+	switch {
+	case creds.SSH != "":
+		repo.URL = provider.SSHURL(scm.Host, scm.Org, scm.Repo)
+		repo.RemoteURL = publicURL
+		repo.SSH = creds.SSH
+	case token != "":
+		repo.URL = provider.CloneURL(scm.Host, scm.Org, scm.Repo, token)
+		repo.RemoteURL = publicURL
+	}
+	if pr != "" {
+		repo.PRRef = provider.PRRef(pr)
+	}
+
+	scrubber := tokenScrubber(token)
+	out := scrubWriter{os.Stderr, scrubber}
+	// A checkout kept from a previous build of the job only needs to be brought up to date
+	if _, err := stat(filepath.Join(checkoutDir, ".git")); err == nil {
+		log.Printf("Updating the checkout of %v in %v", publicURL, checkoutDir)
+		err := updateKeptCheckout(repo, checkoutDir, out)
+		if err == nil {
+			return nil
+		}
+		log.Printf("WARN: Cloning a new checkout: %s", scrubber.Replace(err.Error()))
+		if err := removeAll(checkoutDir); err != nil {
+			return fmt.Errorf("Removing the kept checkout: %v", err)
+		}
+	}
+
+	log.Printf("Cloning %v into %v", publicURL, checkoutDir)
+	return cloneWithRetry(repo, publicURL, scm.Host, checkoutDir, out, scrubber)
+}
+
+// ErrSkipped means the build was not run, because of a directive in its commit message or a
+// freeze window
+type ErrSkipped struct {
+	Status screwdriver.BuildStatus
+	Reason string
+}
 
-	return env, userShellBin
+func (e ErrSkipped) Error() string {
+	return e.Reason
 }
 
 // Executes the command based on arguments from the CLI
@@ -513,20 +1304,98 @@ func launchAction(api screwdriver.API, buildID int, rootDir, emitterPath, metaSp
 	log.Printf("Cache strategy & directories (pipeline, job, event): %v, %v, %v, %v\n", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir)
 
 	if err := launch(api, buildID, rootDir, emitterPath, metaSpace, storeURI, uiURI, shellBin, buildTimeout, buildToken, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir); err != nil {
-		if _, ok := err.(executor.ErrStatus); ok {
-			log.Printf("Failure due to non-zero exit code: %v\n", err)
-		} else {
-			log.Printf("Error running launcher: %v\n", err)
+		var statusMessage string
+		status := screwdriver.BuildStatus(screwdriver.Failure)
+		switch e := err.(type) {
+		case ErrSkipped:
+			statusMessage = e.Reason
+			status = e.Status
+		case executor.ErrStatus:
+			statusMessage = fmt.Sprintf("Failure due to non-zero exit code: %v", err)
+		case executor.ErrTimeout:
+			statusMessage = fmt.Sprintf("Build timed out: %v", err)
+			status = screwdriver.Timedout
+		case executor.ErrAborted:
+			statusMessage = err.Error()
+			status = screwdriver.Aborted
+		case executor.ErrLimitExceeded, ErrSCMUnavailable, ErrPreflight:
+			statusMessage = err.Error()
+		default:
+			statusMessage = fmt.Sprintf("Error running launcher: %v", err)
 		}
+		log.Println(statusMessage)
 
-		exit(screwdriver.Failure, buildID, api, metaSpace)
+		exit(status, buildID, api, metaSpace, statusMessage)
 		return nil
 	}
 
-	exit(screwdriver.Success, buildID, api, metaSpace)
+	exit(screwdriver.Success, buildID, api, metaSpace, "")
+	return nil
+}
+
+// reportQueuePosition reports the position of the build in the queue every time the executor
+// changes it. It returns once the queue file is gone, which means the build is about to start.
+func reportQueuePosition(api screwdriver.API, buildID int, queueFile string) {
+	lastPosition := -1
+	for {
+		data, err := readFile(queueFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("WARN: Unable to read queue position from %q: %v", queueFile, err)
+			}
+			return
+		}
+
+		position, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			log.Printf("WARN: Bad queue position %q: %v", data, err)
+		} else if position != lastPosition {
+			log.Printf("Build is at position %d in the queue", position)
+			if err := api.ReportQueuePosition(buildID, position); err != nil {
+				log.Printf("Failed reporting the queue position: %v", err)
+			}
+			lastPosition = position
+		}
+
+		sleep(queuePollInterval)
+	}
+}
+
+// writeCredentialFile writes a sensitive file readable only by the launcher user and
+// registers it for removal once the build is done
+func writeCredentialFile(path string, data []byte) error {
+	credentialFiles = append(credentialFiles, path)
+	if err := writeFile(path, data, 0600); err != nil {
+		return fmt.Errorf("Writing credential file %q: %v", path, err)
+	}
 	return nil
 }
 
+// removeCredentialFiles deletes every registered credential file
+func removeCredentialFiles() {
+	if !cleanupCredentials {
+		log.Printf("WARN: Leaving %d credential file(s) on disk", len(credentialFiles))
+		return
+	}
+	for _, f := range credentialFiles {
+		if err := removeFile(f); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: Unable to remove credential file %q: %v", f, err)
+		}
+	}
+	credentialFiles = nil
+}
+
+// cleanupCredentialFiles removes the credential files and re-panics if it was called
+// while a panic was propagating, so recoverPanic still fails the build.
+// It must be called directly by defer.
+func cleanupCredentialFiles() {
+	p := recover()
+	removeCredentialFiles()
+	if p != nil {
+		panic(p)
+	}
+}
+
 func recoverPanic(buildID int, api screwdriver.API, metaSpace string) {
 	if p := recover(); p != nil {
 		filename := fmt.Sprintf("launcher-stacktrace-%s", time.Now().Format(time.RFC3339))
@@ -539,7 +1408,7 @@ func recoverPanic(buildID int, api screwdriver.API, metaSpace string) {
 			log.Printf("ERROR: Unable to write stacktrace to file: %v", err)
 		}
 
-		exit(screwdriver.Failure, buildID, api, metaSpace)
+		reportCrash(buildID, api, metaSpace, fmt.Sprintf("Internal Screwdriver error: %v", p), string(debug.Stack()))
 	}
 }
 
@@ -553,6 +1422,258 @@ func finalRecover() {
 	cleanExit()
 }
 
+// launchCommand runs the build args name, or the local one with --local, configured by the
+// flags of c
+func launchCommand(c *cli.Context, args cli.Args) error {
+	url := c.String("api-uri")
+	token := c.String("token")
+	workspace := c.String("workspace")
+	emitterPath := c.String("emitter")
+	metaSpace := c.String("meta-space")
+	storeURL := c.String("store-uri")
+	uiURL := c.String("ui-uri")
+	shellBin := c.String("shell-bin")
+	buildID, err := strconv.Atoi(args.Get(0))
+	buildTimeoutSeconds := c.Int("build-timeout") * 60
+	fetchFlag := c.Bool("only-fetch-token")
+	cacheStrategy := c.String("cache-strategy")
+	pipelineCacheDir := c.String("pipeline-cache-dir")
+	jobCacheDir := c.String("job-cache-dir")
+	eventCacheDir := c.String("event-cache-dir")
+	cleanupCredentials = c.BoolT("cleanup-credentials")
+	localBuild = c.Bool("local")
+	queueFile := c.String("queue-position-file")
+	streamLogs = c.Bool("stream-logs")
+	uploadArtifacts = c.Bool("upload-artifacts")
+	collectReports = c.Bool("collect-reports")
+	startNextJobs = c.Bool("start-next-jobs")
+	screwdriver.EmitStepEvents = c.Bool("emitter-events")
+	cleanWorkspace = c.String("clean-workspace")
+	workspaceQuota = c.Int64("workspace-quota")
+	checkoutRetries = c.Int("checkout-retries")
+	checkoutMirrors = splitList(c.String("scm-mirrors"))
+	keepCheckouts = c.String("keep-checkouts")
+	uploadBuildSummary = c.Bool("upload-build-summary")
+	runPreflight = c.Bool("preflight")
+	preflightMinDisk = c.Int64("preflight-min-disk")
+	preflightMaxClockSkew = c.Duration("preflight-max-clock-skew")
+	logLimits = screwdriver.LogLimits{
+		StepLines:   c.Int64("log-max-step-lines"),
+		StepBytes:   c.Int64("log-max-step-bytes"),
+		BuildLines:  c.Int64("log-max-build-lines"),
+		BuildBytes:  c.Int64("log-max-build-bytes"),
+		SampleEvery: c.Int64("log-sample-every"),
+		TailLines:   c.Int("log-tail-lines"),
+	}
+	executor.StepCgroup = c.String("step-cgroup")
+	containerExec = c.Bool("container-exec")
+	executor.ContainerCLI = c.String("container-cli")
+	buildHooks = hooks.Dir{Path: c.String("hooks-dir")}
+	notifier.Mail = notify.Mail{
+		Server:   c.String("smtp-server"),
+		From:     c.String("smtp-from"),
+		Username: c.String("smtp-username"),
+		Password: c.String("smtp-password"),
+	}
+	metricsPushgateway = c.String("metrics-pushgateway")
+	supervise = c.Bool("supervise") && os.Getenv(supervisedEnv) == ""
+	diagnosticsLines = c.Int("diagnostics-lines")
+	// The supervised launcher serves the metrics of the build
+	if addr := c.String("metrics-addr"); addr != "" && !supervise {
+		// The launcher exits with the build, which stops serving
+		if _, err := metrics.Default.Serve(addr); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+	retryPolicy := screwdriver.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = c.Int("api-max-attempts")
+	retryPolicy.MaxElapsed = c.Duration("api-max-elapsed")
+	storeRetryPolicy.MaxAttempts = c.Int("store-max-attempts")
+	storeRetryPolicy.MaxElapsed = c.Duration("store-max-elapsed")
+
+	if c.String("log-format") == "json" {
+		logBuildID := buildID
+		if c.Bool("local") {
+			logBuildID = LocalBuildID
+		}
+		jsonLog = newJSONLogger(os.Stderr, logBuildID)
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+	}
+
+	if problems := checkSettings(c); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Error: %v", problem)
+		}
+		exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+	}
+
+	if c.Bool("insecure-skip-tls-verify") {
+		log.Println("WARN: Not checking TLS certificates of the API and the store")
+	}
+	transport, transportErr := screwdriver.NewTransportWithOptions(c.String("ca-cert"), c.Bool("insecure-skip-tls-verify"), httpOptions(c))
+	if transportErr != nil {
+		log.Printf("Error configuring the HTTP client: %v", transportErr)
+		exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+	}
+	screwdriver.Transport = transport
+	screwdriver.APITimeout = c.Duration("api-timeout")
+	screwdriver.APIRateLimit = c.Float64("api-rate-limit")
+	screwdriver.APIMaxThrottled = c.Duration("api-max-throttled")
+	// A build can be recorded in production, then replayed anywhere without the API
+	if path := c.String("record-api"); path != "" {
+		recording, err := screwdriver.NewRecordingTransport(transport, path)
+		if err != nil {
+			log.Printf("Error recording the API: %v", err)
+			exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+		}
+		log.Printf("Recording the API responses in %s", path)
+		screwdriver.Transport = recording
+	}
+	if path := c.String("replay-api"); path != "" {
+		replay, err := screwdriver.NewReplayTransport(path)
+		if err != nil {
+			log.Printf("Error replaying the API: %v", err)
+			exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+		}
+		log.Printf("Replaying the API responses of %s", path)
+		screwdriver.Transport = replay
+		// The recorded responses don't check the token, and its value was redacted
+		if token == "" {
+			token = screwdriver.Redacted
+		}
+	}
+
+	if c.Bool("local") {
+		if !c.IsSet("emitter") {
+			emitterPath = "/dev/stdout"
+		}
+		// There is no store to send logs, artifacts or caches to
+		streamLogs = false
+		uploadArtifacts = false
+		cacheStrategy = "disk"
+
+		// A screwdriver.yaml given on the command line is run against the checkout it is in,
+		// unless a repository is given too
+		scmURL, configPath := c.String("local-scm-url"), ""
+		if len(args) > 0 {
+			absPath, err := filepath.Abs(args.Get(0))
+			if err != nil {
+				log.Printf("Error reading %v: %v", args.Get(0), err)
+				exit(screwdriver.Failure, LocalBuildID, nil, metaSpace, "")
+				return nil
+			}
+			configPath = absPath
+			if !c.IsSet("local-scm-url") {
+				scmURL = filepath.Dir(configPath)
+			}
+		}
+		if !c.IsSet("workspace") {
+			localRoot, localMeta, err := localWorkspace()
+			if err != nil {
+				log.Printf("Error preparing local build: %v", err)
+				exit(screwdriver.Failure, LocalBuildID, nil, metaSpace, "")
+				return nil
+			}
+			workspace = localRoot
+			if !c.IsSet("meta-space") {
+				metaSpace = localMeta
+			}
+			log.Printf("Running in temporary workspace %v", workspace)
+		}
+
+		api, err := newLocalAPI(scmURL, configPath, c.String("local-job"), os.Stdout)
+		if err != nil {
+			log.Printf("Error preparing local build: %v", err)
+			exit(screwdriver.Failure, LocalBuildID, nil, metaSpace, "")
+			return nil
+		}
+
+		defer recoverPanic(LocalBuildID, api, metaSpace)
+
+		launchAction(api, LocalBuildID, workspace, emitterPath, metaSpace, storeURL, uiURL, shellBin, buildTimeoutSeconds, "", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir)
+		return nil
+	}
+
+	if err != nil {
+		if c.Command.Name != "" {
+			return cli.ShowCommandHelp(c, c.Command.Name)
+		}
+		return cli.ShowAppHelp(c)
+	}
+
+	log.Printf("cache strategy n directories (pipeline, job, event): %v, %v, %v, %v \n", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir)
+
+	if len(token) == 0 {
+		log.Println("Error: token is not passed.")
+		cleanExit()
+	}
+
+	if fetchFlag {
+		temporalApi, err := screwdriver.NewWithRetryPolicy(url, token, retryPolicy)
+		if err != nil {
+			log.Printf("Error creating temporal Screwdriver API %v: %v", buildID, err)
+			exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+		}
+
+		buildToken, err := temporalApi.GetBuildToken(buildID, c.Int("build-timeout"))
+		if err != nil {
+			log.Printf("Error getting Build Token %v: %v", buildID, err)
+			exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+		}
+
+		log.Printf("Launcher process only fetch token.")
+		fmt.Printf("%s", buildToken)
+		cleanExit()
+	}
+
+	// Builds can outlive their token. It gets renewed before it expires with the refresh token,
+	// as a build token isn't allowed to get another one.
+	var tokens screwdriver.TokenSource = screwdriver.StaticToken(token)
+	if refreshToken := c.String("refresh-token"); refreshToken != "" {
+		minter, err := screwdriver.NewWithRetryPolicy(url, refreshToken, retryPolicy)
+		if err != nil {
+			log.Printf("Error creating Screwdriver API %v: %v", buildID, err)
+			exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+		}
+		refreshing := screwdriver.NewRefreshingToken(token, func() (string, error) {
+			return minter.GetBuildToken(buildID, c.Int("build-timeout"))
+		})
+		refreshing.Start()
+		tokens = refreshing
+	}
+	api, err := screwdriver.NewWithTokenSource(url, tokens, retryPolicy)
+	if err != nil {
+		log.Printf("Error creating Screwdriver API %v: %v", buildID, err)
+		exit(screwdriver.Failure, buildID, nil, metaSpace, "")
+	}
+	buildTokens = tokens
+
+	if diagnosticsLines > 0 {
+		crashDiagnostics.dir = filepath.Join(os.TempDir(), fmt.Sprintf("launcher-diagnostics-%d", buildID))
+		crashDiagnostics.emitterPath = emitterPath
+		crashDiagnostics.workspace = workspace
+		crashDiagnostics.storeURL = storeURL
+	}
+	if supervise {
+		superviseBuild(buildID, api, metaSpace)
+		return nil
+	}
+
+	defer recoverPanic(buildID, api, metaSpace)
+
+	if queueFile != "" {
+		reportQueuePosition(api, buildID, queueFile)
+	}
+
+	launchAction(api, buildID, workspace, emitterPath, metaSpace, storeURL, uiURL, shellBin, buildTimeoutSeconds, token, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir)
+
+	// This should never happen...
+	log.Println("Unexpected return in launcher. Failing the build.")
+	exit(screwdriver.Failure, buildID, api, metaSpace, "Unexpected return in launcher")
+	return nil
+}
+
 func main() {
 	defer finalRecover()
 	defer recoverPanic(0, nil, "")
@@ -560,7 +1681,7 @@ func main() {
 	app := cli.NewApp()
 	app.Name = "launcher"
 	app.Usage = "launch a Screwdriver build"
-	app.UsageText = "launch [options] build-id"
+	app.UsageText = "launcher run [options] build-id\n   launcher run --local [options] [path/to/screwdriver.yaml]\n   launcher validate [options] [path/to/screwdriver.yaml]\n   launcher version"
 	app.Version = fmt.Sprintf("%v, commit %v, built at %v", version, commit, date)
 
 	if date != "unknown" {
@@ -572,9 +1693,10 @@ func main() {
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "api-uri",
-			Usage: "API URI for Screwdriver",
-			Value: "http://localhost:8080",
+			Name:   "api-uri, api-url",
+			Usage:  "API URI for Screwdriver",
+			Value:  "http://localhost:8080",
+			EnvVar: "SD_API_URL",
 		},
 		cli.StringFlag{
 			Name:   "token",
@@ -582,19 +1704,101 @@ func main() {
 			EnvVar: "SD_TOKEN",
 		},
 		cli.StringFlag{
-			Name:  "workspace",
-			Usage: "Location for checking out and running code",
-			Value: "/sd/workspace",
+			Name:   "refresh-token",
+			Usage:  "JWT allowed to get build tokens, like the temporal token of the executor, renewing the build token of long builds",
+			EnvVar: "SD_REFRESH_TOKEN",
+		},
+		cli.IntFlag{
+			Name:   "api-max-attempts",
+			Usage:  "Number of times an API call is tried on network errors and 5xx responses",
+			Value:  screwdriver.DefaultRetryPolicy.MaxAttempts,
+			EnvVar: "SD_API_MAX_ATTEMPTS",
+		},
+		cli.DurationFlag{
+			Name:   "api-max-elapsed",
+			Usage:  "Maximum time spent retrying an API call, e.g. 2m (0 for no limit)",
+			EnvVar: "SD_API_MAX_ELAPSED",
+		},
+		cli.IntFlag{
+			Name:   "store-max-attempts",
+			Usage:  "Number of times a request of the caches or artifacts to the store is tried on network errors and 5xx responses",
+			Value:  screwdriver.DefaultRetryPolicy.MaxAttempts,
+			EnvVar: "SD_STORE_MAX_ATTEMPTS",
+		},
+		cli.DurationFlag{
+			Name:   "store-max-elapsed",
+			Usage:  "Maximum time spent retrying a request to the store, e.g. 5m (0 for no limit)",
+			EnvVar: "SD_STORE_MAX_ELAPSED",
+		},
+		cli.DurationFlag{
+			Name:   "api-timeout",
+			Usage:  "Deadline of each attempt of an API call, from sending the request to reading the response",
+			Value:  screwdriver.APITimeout,
+			EnvVar: "SD_API_TIMEOUT",
+		},
+		cli.Float64Flag{
+			Name:   "api-rate-limit",
+			Usage:  "Most API calls sent a second, 0 for no limit",
+			EnvVar: "SD_API_RATE_LIMIT",
+		},
+		cli.DurationFlag{
+			Name:   "api-max-throttled",
+			Usage:  "Longest an API call waits for the API to stop answering 429 Too Many Requests before it fails",
+			Value:  screwdriver.APIMaxThrottled,
+			EnvVar: "SD_API_MAX_THROTTLED",
+		},
+		cli.DurationFlag{
+			Name:   "http-connect-timeout",
+			Usage:  "Maximum time to open a connection to the API or the store",
+			Value:  screwdriver.DefaultHTTPOptions.ConnectTimeout,
+			EnvVar: "SD_HTTP_CONNECT_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "http-read-timeout",
+			Usage:  "Maximum wait for the response of the API or the store once a request is sent (0 for no limit)",
+			Value:  screwdriver.DefaultHTTPOptions.ReadTimeout,
+			EnvVar: "SD_HTTP_READ_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "http-keep-alive",
+			Usage:  "Period of the TCP keep-alives of the connections (negative to turn them off)",
+			Value:  screwdriver.DefaultHTTPOptions.KeepAlive,
+			EnvVar: "SD_HTTP_KEEP_ALIVE",
+		},
+		cli.DurationFlag{
+			Name:   "http-idle-timeout",
+			Usage:  "Time an unused connection is kept open for the next calls (0 for no limit)",
+			Value:  screwdriver.DefaultHTTPOptions.IdleConnTimeout,
+			EnvVar: "SD_HTTP_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "http-max-idle-conns",
+			Usage:  "Number of unused connections kept open to each of the API and the store",
+			Value:  screwdriver.DefaultHTTPOptions.MaxIdleConns,
+			EnvVar: "SD_HTTP_MAX_IDLE_CONNS",
+		},
+		cli.StringFlag{
+			Name:   "workspace, workspace-root",
+			Usage:  "Location for checking out and running code",
+			Value:  defaultWorkspace,
+			EnvVar: "SD_WORKSPACE",
 		},
 		cli.StringFlag{
-			Name:  "emitter",
-			Usage: "Location for writing log lines to",
-			Value: "/var/run/sd/emitter",
+			Name:   "emitter",
+			Usage:  "Location for writing log lines to",
+			Value:  defaultEmitter,
+			EnvVar: "SD_EMITTER",
+		},
+		cli.BoolFlag{
+			Name:   "emitter-events",
+			Usage:  "Write step start and stop events to the emitter along with the log lines",
+			EnvVar: "SD_EMITTER_EVENTS",
 		},
 		cli.StringFlag{
-			Name:  "meta-space",
-			Usage: "Location of meta temporarily",
-			Value: "/sd/meta",
+			Name:   "meta-space",
+			Usage:  "Location of meta temporarily",
+			Value:  defaultMetaSpace,
+			EnvVar: "SD_META_DIR",
 		},
 		cli.StringFlag{
 			Name:  "store-uri",
@@ -607,9 +1811,9 @@ func main() {
 			Value: "http://localhost:4200",
 		},
 		cli.StringFlag{
-			Name:   "shell-bin",
-			Usage:  "Shell to use when executing commands",
-			Value:  "/bin/sh",
+			Name:   "shell-bin, default-shell",
+			Usage:  "Shell to use when executing commands, unless the job sets USER_SHELL_BIN. Either a path or a name like bash, zsh or pwsh",
+			Value:  executor.DefaultShell,
 			EnvVar: "SD_SHELL_BIN",
 		},
 		cli.IntFlag{
@@ -622,6 +1826,219 @@ func main() {
 			Name:  "only-fetch-token",
 			Usage: "Only fetching build token",
 		},
+		cli.BoolFlag{
+			Name:  "local",
+			Usage: "Run a job from a screwdriver.yaml without a Screwdriver API",
+		},
+		cli.StringFlag{
+			Name:  "local-scm-url",
+			Usage: "Repository to build in local mode, e.g. git@github.com:screwdriver-cd/launcher.git#master or a local checkout",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "local-job",
+			Usage: "Job to run in local mode",
+			Value: "main",
+		},
+		cli.StringFlag{
+			Name:   "queue-position-file",
+			Usage:  "File the executor updates with the queue position while the build waits",
+			EnvVar: "SD_QUEUE_POSITION_FILE",
+		},
+		cli.BoolTFlag{
+			Name:   "cleanup-credentials",
+			Usage:  "Remove SSH keys and credential files when the build ends",
+			EnvVar: "SD_CLEANUP_CREDENTIALS",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "Format of the launcher's own logs, text or json",
+			Value:  "text",
+			EnvVar: "SD_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "ca-cert",
+			Usage:  "PEM file of additional CAs to trust for the API and the store",
+			EnvVar: "SD_CA_CERT",
+		},
+		cli.BoolFlag{
+			Name:   "insecure-skip-tls-verify",
+			Usage:  "Do not check the API and store certificates, only for lab environments",
+			EnvVar: "SD_INSECURE_SKIP_TLS_VERIFY",
+		},
+		cli.BoolFlag{
+			Name:   "stream-logs",
+			Usage:  "Send step logs to the store while the build runs",
+			EnvVar: "SD_STREAM_LOGS",
+		},
+		cli.BoolFlag{
+			Name:   "upload-artifacts",
+			Usage:  "Send the artifacts directory to the store when the steps finish",
+			EnvVar: "SD_UPLOAD_ARTIFACTS",
+		},
+		cli.StringFlag{
+			Name:   "clean-workspace",
+			Usage:  "Wipe the workspace before the build (pre), after it (post) or both",
+			EnvVar: "SD_CLEAN_WORKSPACE",
+		},
+		cli.Int64Flag{
+			Name:   "workspace-quota",
+			Usage:  "Fail the build when its workspace holds more bytes than that, 0 for no limit",
+			EnvVar: "SD_WORKSPACE_QUOTA",
+		},
+		cli.BoolFlag{
+			Name:   "preflight",
+			Usage:  "Check the binaries, network, clock, workspace and disk space before the steps run",
+			EnvVar: "SD_PREFLIGHT",
+		},
+		cli.Int64Flag{
+			Name:   "preflight-min-disk",
+			Usage:  "Fail the preflight checks when the workspace has fewer free bytes than that, 0 for no check",
+			Value:  preflightMinDisk,
+			EnvVar: "SD_PREFLIGHT_MIN_DISK",
+		},
+		cli.DurationFlag{
+			Name:   "preflight-max-clock-skew",
+			Usage:  "Fail the preflight checks when the clock is further than that from the one of the API",
+			Value:  preflightMaxClockSkew,
+			EnvVar: "SD_PREFLIGHT_MAX_CLOCK_SKEW",
+		},
+		cli.BoolFlag{
+			Name:   "supervise",
+			Usage:  "Run the build in a child launcher, so the build still fails with its diagnostics when the launcher is killed",
+			EnvVar: "SD_SUPERVISE",
+		},
+		cli.IntFlag{
+			Name:   "diagnostics-lines",
+			Usage:  "Number of the last log lines kept in the diagnostics uploaded when the launcher crashes, 0 for no diagnostics",
+			Value:  diagnosticsLines,
+			EnvVar: "SD_DIAGNOSTICS_LINES",
+		},
+		cli.Int64Flag{
+			Name:   "log-max-step-lines",
+			Usage:  "Truncate the log of a step past that many lines, 0 for no limit",
+			EnvVar: "SD_LOG_MAX_STEP_LINES",
+		},
+		cli.Int64Flag{
+			Name:   "log-max-step-bytes",
+			Usage:  "Truncate the log of a step past that many bytes, 0 for no limit",
+			EnvVar: "SD_LOG_MAX_STEP_BYTES",
+		},
+		cli.Int64Flag{
+			Name:   "log-max-build-lines",
+			Usage:  "Truncate the log of the build past that many lines, 0 for no limit",
+			EnvVar: "SD_LOG_MAX_BUILD_LINES",
+		},
+		cli.Int64Flag{
+			Name:   "log-max-build-bytes",
+			Usage:  "Truncate the log of the build past that many bytes, 0 for no limit",
+			EnvVar: "SD_LOG_MAX_BUILD_BYTES",
+		},
+		cli.Int64Flag{
+			Name:   "log-sample-every",
+			Usage:  "Once a log is truncated, still show 1 line in that many, 0 for none",
+			Value:  100,
+			EnvVar: "SD_LOG_SAMPLE_EVERY",
+		},
+		cli.IntFlag{
+			Name:   "log-tail-lines",
+			Usage:  "Once a log is truncated, show that many of its last lines when the step ends",
+			Value:  100,
+			EnvVar: "SD_LOG_TAIL_LINES",
+		},
+		cli.StringFlag{
+			Name:   "metrics-addr",
+			Usage:  "Address to serve the launcher metrics on /metrics while the build runs, like :9102",
+			EnvVar: "SD_METRICS_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "metrics-pushgateway",
+			Usage:  "URL of the Prometheus Pushgateway to push the launcher metrics to once the build is done",
+			EnvVar: "SD_METRICS_PUSHGATEWAY",
+		},
+		cli.IntFlag{
+			Name:   "checkout-retries",
+			Usage:  "Times to try the clone of the source when the SCM can't be reached",
+			Value:  3,
+			EnvVar: "SD_CHECKOUT_RETRIES",
+		},
+		cli.StringFlag{
+			Name:   "scm-mirrors",
+			Usage:  "Mirrors to clone from before the origin, as comma separated prefix=mirror-prefix rewrites of the clone URL",
+			EnvVar: "SD_SCM_MIRRORS",
+		},
+		cli.StringFlag{
+			Name:   "keep-checkouts",
+			Usage:  "Directory to keep the checkouts in between the builds of each job, on persistent build hosts",
+			EnvVar: "SD_KEEP_CHECKOUTS",
+		},
+		cli.StringFlag{
+			Name:   "record-api",
+			Usage:  "Record the responses of the API and the store in that file, to replay the build later",
+			EnvVar: "SD_RECORD_API",
+		},
+		cli.StringFlag{
+			Name:   "replay-api",
+			Usage:  "Answer the calls to the API and the store with the responses recorded in that file",
+			EnvVar: "SD_REPLAY_API",
+		},
+		cli.StringFlag{
+			Name:   "step-cgroup",
+			Usage:  "Delegated cgroup v2 directory the steps with resource limits run in, rlimits are used without it",
+			EnvVar: "SD_STEP_CGROUP",
+		},
+		cli.BoolFlag{
+			Name:   "container-exec",
+			Usage:  "Run the steps of the jobs with an image in a container of it, with the workspace mounted",
+			EnvVar: "SD_CONTAINER_EXEC",
+		},
+		cli.StringFlag{
+			Name:   "container-cli",
+			Usage:  "Docker compatible command starting the containers of the steps",
+			Value:  "docker",
+			EnvVar: "SD_CONTAINER_CLI",
+		},
+		cli.StringFlag{
+			Name:   "hooks-dir",
+			Usage:  "Directory of the programs to run when the build and each of its steps start and end",
+			EnvVar: "SD_HOOKS_DIR",
+		},
+		cli.StringFlag{
+			Name:   "smtp-server",
+			Usage:  "SMTP server host:port sending the email notifications of the pipelines",
+			EnvVar: "SD_SMTP_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "smtp-from",
+			Usage:  "Sender of the email notifications",
+			Value:  "screwdriver@localhost",
+			EnvVar: "SD_SMTP_FROM",
+		},
+		cli.StringFlag{
+			Name:   "smtp-username",
+			Usage:  "Username to authenticate to the SMTP server with, if it takes one",
+			EnvVar: "SD_SMTP_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "smtp-password",
+			Usage:  "Password to authenticate to the SMTP server with",
+			EnvVar: "SD_SMTP_PASSWORD",
+		},
+		cli.BoolFlag{
+			Name:   "collect-reports",
+			Usage:  "Summarize the JUnit and coverage reports in the build meta and add them to the artifacts",
+			EnvVar: "SD_COLLECT_REPORTS",
+		},
+		cli.BoolFlag{
+			Name:   "upload-build-summary",
+			Usage:  "Add the build-summary.json written at the root of the workspace to the artifacts of the build",
+			EnvVar: "SD_UPLOAD_BUILD_SUMMARY",
+		},
+		cli.BoolFlag{
+			Name:   "start-next-jobs",
+			Usage:  "Start the next jobs of the workflow once the build succeeds, when no queue worker does",
+			EnvVar: "SD_START_NEXT_JOBS",
+		},
 		cli.StringFlag{
 			Name:   "cache-strategy",
 			Usage:  "Cache strategy",
@@ -640,66 +2057,69 @@ func main() {
 		},
 	}
 
-	app.Action = func(c *cli.Context) error {
-		url := c.String("api-uri")
-		token := c.String("token")
-		workspace := c.String("workspace")
-		emitterPath := c.String("emitter")
-		metaSpace := c.String("meta-space")
-		storeURL := c.String("store-uri")
-		uiURL := c.String("ui-uri")
-		shellBin := c.String("shell-bin")
-		buildID, err := strconv.Atoi(c.Args().Get(0))
-		buildTimeoutSeconds := c.Int("build-timeout") * 60
-		fetchFlag := c.Bool("only-fetch-token")
-		cacheStrategy := c.String("cache-strategy")
-		pipelineCacheDir := c.String("pipeline-cache-dir")
-		jobCacheDir := c.String("job-cache-dir")
-		eventCacheDir := c.String("event-cache-dir")
-
-		if err != nil {
-			return cli.ShowAppHelp(c)
-		}
-
-		log.Printf("cache strategy n directories (pipeline, job, event): %v, %v, %v, %v \n", cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir)
-
-		if len(token) == 0 {
-			log.Println("Error: token is not passed.")
-			cleanExit()
-		}
-
-		if fetchFlag {
-			temporalApi, err := screwdriver.New(url, token)
-			if err != nil {
-				log.Printf("Error creating temporal Screwdriver API %v: %v", buildID, err)
-				exit(screwdriver.Failure, buildID, nil, metaSpace)
-			}
-
-			buildToken, err := temporalApi.GetBuildToken(buildID, c.Int("build-timeout"))
-			if err != nil {
-				log.Printf("Error getting Build Token %v: %v", buildID, err)
-				exit(screwdriver.Failure, buildID, nil, metaSpace)
-			}
-
-			log.Printf("Launcher process only fetch token.")
-			fmt.Printf("%s", buildToken)
-			cleanExit()
-		}
-
-		api, err := screwdriver.New(url, token)
-		if err != nil {
-			log.Printf("Error creating Screwdriver API %v: %v", buildID, err)
-			exit(screwdriver.Failure, buildID, nil, metaSpace)
-		}
-
-		defer recoverPanic(buildID, api, metaSpace)
-
-		launchAction(api, buildID, workspace, emitterPath, metaSpace, storeURL, uiURL, shellBin, buildTimeoutSeconds, token, cacheStrategy, pipelineCacheDir, jobCacheDir, eventCacheDir)
+	app.Commands = []cli.Command{
+		{
+			Name:      "run",
+			Usage:     "run a build",
+			ArgsUsage: "build-id",
+			Flags:     app.Flags,
+			Action: func(c *cli.Context) error {
+				return launchCommand(c, c.Args())
+			},
+		},
+		{
+			Name:      "validate",
+			Usage:     "check the settings, and the screwdriver.yaml if one is given, without running a build",
+			ArgsUsage: "[path/to/screwdriver.yaml]",
+			Flags:     app.Flags,
+			Action:    validateCommand,
+		},
+		{
+			Name:   "version",
+			Usage:  "print the version of the launcher",
+			Action: versionCommand,
+		},
+		{
+			Name:  "meta",
+			Usage: "Read or change the build meta from a step",
+			Subcommands: []cli.Command{
+				{
+					Name:      "get",
+					Usage:     "Print a meta value",
+					ArgsUsage: "key",
+					Action: func(c *cli.Context) error {
+						value, err := metaGet(filepath.Join(c.GlobalString("meta-space"), "meta.json"), c.Args().Get(0))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						fmt.Println(value)
+						return nil
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Change a meta value, passed on to the next jobs",
+					ArgsUsage: "key value",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "json-value",
+							Usage: "Parse the value as JSON instead of storing a string",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						metaFile := filepath.Join(c.GlobalString("meta-space"), "meta.json")
+						if err := metaSet(metaFile, c.Args().Get(0), c.Args().Get(1), c.Bool("json-value")); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
+	}
 
-		// This should never happen...
-		log.Println("Unexpected return in launcher. Failing the build.")
-		exit(screwdriver.Failure, buildID, api, metaSpace)
-		return nil
+	app.Action = func(c *cli.Context) error {
+		return launchCommand(c, c.Args())
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+
+	"github.com/screwdriver-cd/launcher/hooks"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// buildHooks are told about the start and end of the build and of its steps
+var buildHooks hooks.Hook = hooks.Dir{}
+
+// hookEmitter tells the hooks about each step as the executor starts and stops it
+type hookEmitter struct {
+	screwdriver.Emitter
+	hooks hooks.Hook
+	build hooks.Build
+}
+
+func (e hookEmitter) StartCmd(cmd screwdriver.CommandDef) {
+	if err := e.hooks.OnStepStart(e.build, cmd.Name); err != nil {
+		log.Printf("WARN: %v", err)
+	}
+	e.Emitter.StartCmd(cmd)
+}
+
+func (e hookEmitter) StopCmd(cmd screwdriver.CommandDef, exitCode int) {
+	e.Emitter.StopCmd(cmd, exitCode)
+	if err := e.hooks.OnStepEnd(e.build, cmd.Name, exitCode); err != nil {
+		log.Printf("WARN: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/hooks"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// recordingHook records the events it is told about
+type recordingHook struct {
+	events []string
+	builds []hooks.Build
+}
+
+func (h *recordingHook) OnBuildStart(b hooks.Build) error {
+	h.events = append(h.events, "buildStart")
+	h.builds = append(h.builds, b)
+	return nil
+}
+
+func (h *recordingHook) OnStepStart(b hooks.Build, step string) error {
+	h.events = append(h.events, "stepStart "+step)
+	return nil
+}
+
+func (h *recordingHook) OnStepEnd(b hooks.Build, step string, exitCode int) error {
+	h.events = append(h.events, fmt.Sprintf("stepEnd %s %d", step, exitCode))
+	return errors.New("Hooks failing should not fail the build")
+}
+
+func (h *recordingHook) OnBuildEnd(b hooks.Build, buildErr error) error {
+	h.events = append(h.events, fmt.Sprintf("buildEnd %v", buildErr))
+	return nil
+}
+
+func TestLaunchHooks(t *testing.T) {
+	oldExecutorRun, oldBuildHooks := executorRun, buildHooks
+	defer func() { executorRun, buildHooks = oldExecutorRun, oldBuildHooks }()
+
+	hook := &recordingHook{}
+	buildHooks = hook
+	runErr := errors.New("exit 1")
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		cmd := screwdriver.CommandDef{Name: "test"}
+		emitter.StartCmd(cmd)
+		emitter.StopCmd(cmd, 1)
+		return runErr
+	}
+
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "RUNNING")
+	err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "")
+	if err != runErr {
+		t.Errorf("launch() error = %v, want the error of the steps", err)
+	}
+
+	want := []string{"buildStart", "stepStart test", "stepEnd test 1", "buildEnd exit 1"}
+	if !reflect.DeepEqual(hook.events, want) {
+		t.Errorf("Hooks were told %q, want %q", hook.events, want)
+	}
+	if b := hook.builds[0]; b.Build.ID != TestBuildID || b.Job.ID != TestJobID || b.Pipeline.ScmRepo.Name != "screwdriver-cd/launcher" || b.Workspace != TestWorkspace {
+		t.Errorf("Hooks got %+v, want the build, its job, pipeline and workspace", b)
+	}
+}
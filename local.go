@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/git"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"gopkg.in/yaml.v2"
+)
+
+// LocalBuildID is the build ID used when running a build without a Screwdriver API
+const LocalBuildID = 0
+
+// localConfig is the subset of a screwdriver.yaml needed to run a job locally
+type localConfig struct {
+	Shared localJob            `yaml:"shared"`
+	Jobs   map[string]localJob `yaml:"jobs"`
+}
+
+// localJob is a job definition from a screwdriver.yaml
+type localJob struct {
+	Environment map[string]string `yaml:"environment"`
+	Steps       []localStep       `yaml:"steps"`
+	// Shell runs the steps, e.g. "bash" or "pwsh"
+	Shell string `yaml:"shell"`
+	// Packages are the Habitat packages installed for the steps, e.g. "core/node/10.16.0"
+	Packages []string `yaml:"packages"`
+}
+
+// localStep is a single step, either "- name: command" or a bare "- command"
+type localStep screwdriver.CommandDef
+
+func (s *localStep) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var named map[string]string
+	if err := unmarshal(&named); err == nil {
+		if len(named) != 1 {
+			return fmt.Errorf("Step %v must have exactly one name", named)
+		}
+		for name, cmd := range named {
+			s.Name = name
+			s.Cmd = cmd
+		}
+		return nil
+	}
+
+	return unmarshal(&s.Cmd)
+}
+
+// localRepo describes the repository a local build is run against
+type localRepo struct {
+	URL  string
+	Host string
+	Org  string
+	Repo string
+	// Branch is the branch built, or the target branch of a pull request
+	Branch string
+	// PR is the number of the pull request built, empty for branch builds
+	PR string
+}
+
+// localPRRef matches the pull request part of a checkout URL, e.g. "PR-123" or "PR-123:develop"
+var localPRRef = regexp.MustCompile(`^PR-([0-9]+)(?::(.+))?$`)
+
+// parseLocalScmURL parses a checkout URL like "git@github.com:screwdriver-cd/launcher.git#master",
+// "https://github.com/screwdriver-cd/launcher.git" or a local directory. Pull requests are
+// checked out with "#PR-123:targetBranch", the target branch defaulting to master.
+func parseLocalScmURL(scmURL string) (localRepo, error) {
+	repo := localRepo{URL: scmURL, Branch: "master"}
+	if i := strings.LastIndex(scmURL, "#"); i != -1 {
+		repo.URL = scmURL[:i]
+		repo.Branch = scmURL[i+1:]
+	}
+	if matched := localPRRef.FindStringSubmatch(repo.Branch); matched != nil {
+		repo.PR = matched[1]
+		repo.Branch = "master"
+		if matched[2] != "" {
+			repo.Branch = matched[2]
+		}
+	}
+
+	if info, err := stat(repo.URL); err == nil && info != nil && info.IsDir() {
+		if repo.PR != "" {
+			return localRepo{}, fmt.Errorf("Pull request %s can only be built from a remote repository", repo.PR)
+		}
+		abs, err := filepath.Abs(repo.URL)
+		if err != nil {
+			return localRepo{}, fmt.Errorf("Resolving local checkout %q: %v", repo.URL, err)
+		}
+		repo.URL = abs
+		repo.Host = "local"
+		repo.Org = filepath.Base(filepath.Dir(abs))
+		repo.Repo = filepath.Base(abs)
+		return repo, nil
+	}
+
+	location, err := git.ParseURL(repo.URL)
+	if err != nil {
+		return localRepo{}, err
+	}
+	repo.Host, repo.Org, repo.Repo = location.Host, location.Org, location.Repo
+	return repo, nil
+}
+
+// isLocalCheckout tells whether the repo is a directory on disk rather than a remote URL
+func (r localRepo) isLocalCheckout() bool {
+	return r.Host == "local"
+}
+
+// localCheckoutDir is where remote repositories are cloned for local builds,
+// so the following runs only fetch the changes
+func localCheckoutDir(repo localRepo) string {
+	return filepath.Join(os.TempDir(), "sd-local", repo.Host, repo.Org, repo.Repo)
+}
+
+// checkoutLocal returns a checkout of repo, cloning it the first time and
+// resetting it to the branch head when it was already cloned. Pull requests are
+// merged into their target branch.
+// Untracked files of a reused checkout are removed when SD_CLEAN_UNTRACKED is set.
+func checkoutLocal(repo localRepo) (string, error) {
+	if repo.isLocalCheckout() {
+		log.Printf("Using existing checkout %v", repo.URL)
+		return repo.URL, nil
+	}
+
+	dir := localCheckoutDir(repo)
+	gitRepo := git.Repo{URL: repo.URL, Branch: repo.Branch, Submodules: true, LFS: true}
+	if repo.PR != "" {
+		gitRepo.PRRef = git.DetectProvider(repo.Host).PRRef(repo.PR)
+	}
+	if _, err := stat(filepath.Join(dir, ".git")); err == nil {
+		log.Printf("Reusing checkout of %v in %v", repo.URL, dir)
+		// Files left over by the previous build would leak into this one
+		if err := gitUpdate(gitRepo, dir, cleanUntracked(false), os.Stderr); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+
+	log.Printf("Cloning %v into %v", repo.URL, dir)
+	if err := mkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return "", fmt.Errorf("Cannot create checkout path %q: %v", dir, err)
+	}
+	if err := gitClone(gitRepo, dir, os.Stderr); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// readLocalConfig parses a screwdriver.yaml
+func readLocalConfig(configPath string) (localConfig, error) {
+	var config localConfig
+
+	f, err := open(configPath)
+	if err != nil {
+		return config, fmt.Errorf("Opening %q: %v", configPath, err)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return config, fmt.Errorf("Reading %q: %v", configPath, err)
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("Parsing %q: %v", configPath, err)
+	}
+	return config, nil
+}
+
+// localWorkspace makes a temporary workspace and meta space, so each local build starts from
+// clean ones wherever it is run
+func localWorkspace() (workspace, metaSpace string, err error) {
+	dir, err := ioutil.TempDir("", "sd-local-build-")
+	if err != nil {
+		return "", "", fmt.Errorf("Creating a temporary workspace: %v", err)
+	}
+	return filepath.Join(dir, "workspace"), filepath.Join(dir, "meta"), nil
+}
+
+// localAPI is a screwdriver.API that never talks to a Screwdriver cluster.
+// It serves a build made from a screwdriver.yaml and prints status updates instead of reporting them.
+type localAPI struct {
+	build    screwdriver.Build
+	job      screwdriver.Job
+	pipeline screwdriver.Pipeline
+	out      io.Writer
+	// starts holds when each step started, to print how long it took
+	starts map[string]time.Time
+}
+
+// newLocalAPI checks out the repository at scmURL and builds the job named jobName from the
+// screwdriver.yaml at configPath, the one at the root of the checkout when configPath is empty
+func newLocalAPI(scmURL, configPath, jobName string, out io.Writer) (screwdriver.API, error) {
+	repo, err := parseLocalScmURL(scmURL)
+	if err != nil {
+		return nil, err
+	}
+
+	checkoutDir, err := checkoutLocal(repo)
+	if err != nil {
+		return nil, fmt.Errorf("Checking out %v: %v", scmURL, err)
+	}
+
+	if configPath == "" {
+		configPath = filepath.Join(checkoutDir, "screwdriver.yaml")
+	}
+	config, err := readLocalConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	commitEnv := map[string]string{}
+	if commit, err := gitHeadCommit(checkoutDir); err != nil {
+		log.Printf("WARN: Unable to read the head commit of %v: %v", checkoutDir, err)
+	} else {
+		commitEnv = commitEnvironment(commit)
+	}
+
+	job, ok := config.Jobs[jobName]
+	if !ok {
+		return nil, fmt.Errorf("Job %q is not defined in %v", jobName, configPath)
+	}
+
+	commands := []screwdriver.CommandDef{
+		{Name: "sd-setup-scm", Cmd: fmt.Sprintf("cp -R %q/. $SD_CHECKOUT_DIR", checkoutDir)},
+	}
+	for i, step := range append(config.Shared.Steps, job.Steps...) {
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		commands = append(commands, screwdriver.CommandDef(step))
+	}
+
+	environment := []map[string]string{commitEnv, config.Shared.Environment, job.Environment}
+	shell := job.Shell
+	if shell == "" {
+		shell = config.Shared.Shell
+	}
+	if shell != "" {
+		environment = append(environment, map[string]string{"USER_SHELL_BIN": shell})
+	}
+	if pkgs := append(config.Shared.Packages, job.Packages...); len(pkgs) > 0 {
+		environment = append(environment, map[string]string{"SD_PACKAGES": strings.Join(pkgs, ",")})
+	}
+
+	a := localAPI{
+		build: screwdriver.Build{
+			ID:          LocalBuildID,
+			Commands:    commands,
+			Environment: environment,
+		},
+		job: screwdriver.Job{
+			Name: localJobName(jobName, repo),
+		},
+		pipeline: screwdriver.Pipeline{
+			ScmURI:  fmt.Sprintf("%s:local:%s", repo.Host, repo.Branch),
+			ScmRepo: screwdriver.ScmRepo{Name: repo.Org + "/" + repo.Repo},
+		},
+		out:    out,
+		starts: map[string]time.Time{},
+	}
+	return screwdriver.API(a), nil
+}
+
+// localJobName is the name of the job in the build, "PR-123:main" for pull requests
+// like the jobs Screwdriver creates for them
+func localJobName(jobName string, repo localRepo) string {
+	if repo.PR == "" {
+		return jobName
+	}
+	return fmt.Sprintf("PR-%s:%s", repo.PR, jobName)
+}
+
+func (a localAPI) BuildFromID(buildID int) (screwdriver.Build, error) {
+	return a.build, nil
+}
+
+func (a localAPI) EventFromID(eventID int) (screwdriver.Event, error) {
+	return screwdriver.Event{ID: eventID}, nil
+}
+
+func (a localAPI) JobFromID(jobID int) (screwdriver.Job, error) {
+	return a.job, nil
+}
+
+func (a localAPI) PipelineFromID(pipelineID int) (screwdriver.Pipeline, error) {
+	return a.pipeline, nil
+}
+
+func (a localAPI) UpdateBuildStatus(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
+	if statusMessage != "" {
+		fmt.Fprintf(a.out, "Build status: %s (%s)\n", status, statusMessage)
+		return nil
+	}
+	fmt.Fprintf(a.out, "Build status: %s\n", status)
+	return nil
+}
+
+func (a localAPI) UpdateStepStart(buildID int, stepName string) error {
+	a.starts[stepName] = timeNow()
+	fmt.Fprintf(a.out, "Step %s: started\n", stepName)
+	return nil
+}
+
+func (a localAPI) UpdateStepStop(buildID int, stepName string, exitCode int) error {
+	start, ok := a.starts[stepName]
+	if !ok {
+		fmt.Fprintf(a.out, "Step %s: exited with code %d\n", stepName, exitCode)
+		return nil
+	}
+	fmt.Fprintf(a.out, "Step %s: exited with code %d after %v\n", stepName, exitCode, timeNow().Sub(start).Round(time.Millisecond))
+	return nil
+}
+
+func (a localAPI) SecretsForBuild(build screwdriver.Build) (screwdriver.Secrets, error) {
+	return screwdriver.Secrets{}, nil
+}
+
+func (a localAPI) GetAPIURL() (string, error) {
+	return "", nil
+}
+
+func (a localAPI) GetCoverageInfo() (screwdriver.Coverage, error) {
+	return screwdriver.Coverage{}, nil
+}
+
+func (a localAPI) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error) {
+	return "", nil
+}
+
+func (a localAPI) GetCheckoutToken(buildID int) (string, error) {
+	return "", nil
+}
+
+func (a localAPI) ReportQueuePosition(buildID int, position int) error {
+	return nil
+}
+
+func (a localAPI) LatestBuild(jobID int, status screwdriver.BuildStatus) (screwdriver.Build, error) {
+	return screwdriver.Build{}, screwdriver.SDError{StatusCode: 404, Reason: "Not Found", Message: "Local builds have no history"}
+}
+
+func (a localAPI) StartNextJobs(eventID, jobID int, meta map[string]interface{}) ([]screwdriver.Build, error) {
+	return nil, nil
+}
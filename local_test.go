@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/git"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+const TestLocalConfig = `
+shared:
+    environment:
+        FOO: shared
+        BAR: shared
+    steps:
+        - echo shared
+jobs:
+    main:
+        environment:
+            FOO: main
+        steps:
+            - install: npm install
+            - test: npm test
+    other:
+        steps:
+            - echo other
+`
+
+// TestCommit is the head commit of the test repositories
+var TestCommit = git.Commit{Author: "Jane Doe", Email: "jane@example.com", Subject: "Fix the launcher"}
+
+// fakeGit records the git operations and pretends to clone by creating the repository files
+func fakeGit(operations *[]string) {
+	gitClone = func(repo git.Repo, dir string, out io.Writer) error {
+		*operations = append(*operations, fmt.Sprintf("clone %s %s into %s", repo.URL, repo.Branch, dir))
+		os.MkdirAll(filepath.Join(dir, ".git"), 0777)
+		return ioutil.WriteFile(filepath.Join(dir, "screwdriver.yaml"), []byte(TestLocalConfig), 0644)
+	}
+	gitUpdate = func(repo git.Repo, dir string, clean bool, out io.Writer) error {
+		*operations = append(*operations, fmt.Sprintf("update %s %s clean=%v", repo.URL, repo.Branch, clean))
+		return nil
+	}
+	gitHeadCommit = func(dir string) (git.Commit, error) {
+		*operations = append(*operations, "head")
+		return TestCommit, nil
+	}
+}
+
+func setupLocalRepo(t *testing.T) (dir string, cleanup func()) {
+	tmp, err := ioutil.TempDir("", "LocalRepo")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(tmp, "screwdriver.yaml"), []byte(TestLocalConfig), 0644); err != nil {
+		t.Fatalf("Couldn't write screwdriver.yaml: %v", err)
+	}
+	return tmp, func() {
+		os.RemoveAll(tmp)
+	}
+}
+
+// restoreLocalHooks puts back the real filesystem functions stubbed out by TestMain
+func restoreLocalHooks() func() {
+	oldStat, oldOpen, oldMkdirAll := stat, open, mkdirAll
+	oldGitClone, oldGitUpdate, oldGitHeadCommit := gitClone, gitUpdate, gitHeadCommit
+	stat, open, mkdirAll = os.Stat, os.Open, os.MkdirAll
+	return func() {
+		stat, open, mkdirAll = oldStat, oldOpen, oldMkdirAll
+		gitClone, gitUpdate, gitHeadCommit = oldGitClone, oldGitUpdate, oldGitHeadCommit
+	}
+}
+
+func TestParseLocalScmURL(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	tests := []struct {
+		url  string
+		want localRepo
+	}{
+		{"git@github.com:screwdriver-cd/launcher.git#v4", localRepo{
+			URL: "git@github.com:screwdriver-cd/launcher.git", Host: "github.com", Org: "screwdriver-cd", Repo: "launcher", Branch: "v4"}},
+		{"https://github.com/screwdriver-cd/launcher.git", localRepo{
+			URL: "https://github.com/screwdriver-cd/launcher.git", Host: "github.com", Org: "screwdriver-cd", Repo: "launcher", Branch: "master"}},
+		{"git@github.com:screwdriver-cd/launcher.git#PR-12:v4", localRepo{
+			URL: "git@github.com:screwdriver-cd/launcher.git", Host: "github.com", Org: "screwdriver-cd", Repo: "launcher", Branch: "v4", PR: "12"}},
+		{"https://github.com/screwdriver-cd/launcher.git#PR-12", localRepo{
+			URL: "https://github.com/screwdriver-cd/launcher.git", Host: "github.com", Org: "screwdriver-cd", Repo: "launcher", Branch: "master", PR: "12"}},
+		{"git@gitlab.com:group/subgroup/project.git", localRepo{
+			URL: "git@gitlab.com:group/subgroup/project.git", Host: "gitlab.com", Org: "group/subgroup", Repo: "project", Branch: "master"}},
+		{"ssh://git@bitbucket.example.com:7999/proj/repo.git#develop", localRepo{
+			URL: "ssh://git@bitbucket.example.com:7999/proj/repo.git", Host: "bitbucket.example.com", Org: "proj", Repo: "repo", Branch: "develop"}},
+		{"launcher", localRepo{}},
+	}
+
+	for _, test := range tests {
+		repo, err := parseLocalScmURL(test.url)
+		if test.want.URL == "" {
+			if err == nil {
+				t.Errorf("parseLocalScmURL(%q) should have failed", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", test.url, err)
+		}
+		if !reflect.DeepEqual(repo, test.want) {
+			t.Errorf("parseLocalScmURL(%q) = %+v, want %+v", test.url, repo, test.want)
+		}
+	}
+}
+
+func TestLaunchLocal(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	repoDir, cleanup := setupLocalRepo(t)
+	defer cleanup()
+
+	var operations []string
+	fakeGit(&operations)
+
+	var executedAPI screwdriver.API
+	var executedBuild screwdriver.Build
+	oldExecutorRun := executorRun
+	defer func() { executorRun = oldExecutorRun }()
+	executorRun = func(path string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		executedAPI = api
+		executedBuild = build
+		return nil
+	}
+
+	out := new(bytes.Buffer)
+	api, err := newLocalAPI(repoDir, "", "main", out)
+	if err != nil {
+		t.Fatalf("Unexpected error creating local API: %v", err)
+	}
+
+	tmp, cleanupWorkspace := setupTempDirectoryAndSocket(t)
+	defer cleanupWorkspace()
+
+	if err := launchAction(api, LocalBuildID, tmp, path.Join(tmp, "socket"), TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, "", "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+
+	if !reflect.DeepEqual(operations, []string{"head"}) {
+		t.Errorf("Unexpected git operations for an existing checkout: %q", operations)
+	}
+
+	if _, ok := executedAPI.(localAPI); !ok {
+		t.Errorf("Steps were run with the API %T, want localAPI", executedAPI)
+	}
+
+	wantCommands := []screwdriver.CommandDef{
+		{Name: "sd-setup-scm", Cmd: fmt.Sprintf("cp -R %q/. $SD_CHECKOUT_DIR", repoDir)},
+		{Name: "step-1", Cmd: "echo shared"},
+		{Name: "install", Cmd: "npm install"},
+		{Name: "test", Cmd: "npm test"},
+	}
+	if !reflect.DeepEqual(executedBuild.Commands, wantCommands) {
+		t.Errorf("Commands = %+v, want %+v", executedBuild.Commands, wantCommands)
+	}
+
+	wantEnv := []map[string]string{
+		{
+			"SD_GIT_COMMIT_AUTHOR":  "Jane Doe",
+			"SD_GIT_COMMIT_EMAIL":   "jane@example.com",
+			"SD_GIT_COMMIT_MESSAGE": "Fix the launcher",
+		},
+		{"FOO": "shared", "BAR": "shared"},
+		{"FOO": "main"},
+	}
+	if !reflect.DeepEqual(executedBuild.Environment, wantEnv) {
+		t.Errorf("Environment = %v, want %v", executedBuild.Environment, wantEnv)
+	}
+
+	for _, want := range []string{"Build status: RUNNING", "Step sd-setup-launcher: started", "Step sd-setup-launcher: exited with code 0 after ", "Build status: SUCCESS"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output %q does not contain %q", out.String(), want)
+		}
+	}
+}
+
+func TestLocalShellAndPackages(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	repoDir, cleanup := setupLocalRepo(t)
+	defer cleanup()
+	config := "shared:\n    shell: bash\n    packages: [core/git]\njobs:\n    main:\n        steps:\n            - echo main\n    windows:\n        shell: pwsh\n        steps:\n            - Write-Output windows\n"
+	if err := ioutil.WriteFile(path.Join(repoDir, "screwdriver.yaml"), []byte(config), 0644); err != nil {
+		t.Fatalf("Couldn't write screwdriver.yaml: %v", err)
+	}
+	gitHeadCommit = func(dir string) (git.Commit, error) { return TestCommit, nil }
+
+	for job, want := range map[string]string{"main": "bash", "windows": "pwsh"} {
+		api, err := newLocalAPI(repoDir, "", job, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("Unexpected error creating local API: %v", err)
+		}
+		build, _ := api.BuildFromID(LocalBuildID)
+		env := build.Environment[len(build.Environment)-2]
+		if env["USER_SHELL_BIN"] != want {
+			t.Errorf("%s: USER_SHELL_BIN = %q, want %q", job, env["USER_SHELL_BIN"], want)
+		}
+		if last := build.Environment[len(build.Environment)-1]; last["SD_PACKAGES"] != "core/git" {
+			t.Errorf("%s: SD_PACKAGES = %q, want the shared packages", job, last["SD_PACKAGES"])
+		}
+	}
+}
+
+func TestLocalConfigPath(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	repoDir, cleanup := setupLocalRepo(t)
+	defer cleanup()
+	gitHeadCommit = func(dir string) (git.Commit, error) { return TestCommit, nil }
+
+	configPath := path.Join(repoDir, "ci", "screwdriver.experiment.yaml")
+	os.MkdirAll(path.Dir(configPath), 0777)
+	config := "jobs:\n    experiment:\n        steps:\n            - echo experiment\n"
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Couldn't write %v: %v", configPath, err)
+	}
+
+	api, err := newLocalAPI(repoDir, configPath, "experiment", ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Unexpected error creating local API: %v", err)
+	}
+	build, _ := api.BuildFromID(LocalBuildID)
+	if last := build.Commands[len(build.Commands)-1]; last.Cmd != "echo experiment" {
+		t.Errorf("Last step = %+v, want the one of the given screwdriver.yaml", last)
+	}
+	if sdSetup := build.Commands[0].Cmd; sdSetup != fmt.Sprintf("cp -R %q/. $SD_CHECKOUT_DIR", repoDir) {
+		t.Errorf("sd-setup-scm = %q, want the checkout copied", sdSetup)
+	}
+
+	_, err = newLocalAPI(repoDir, configPath, "main", ioutil.Discard)
+	if err == nil || err.Error() != fmt.Sprintf("Job %q is not defined in %v", "main", configPath) {
+		t.Errorf("newLocalAPI() error = %v, want the job missing from the given screwdriver.yaml", err)
+	}
+}
+
+func TestLocalWorkspace(t *testing.T) {
+	workspace, metaSpace, err := localWorkspace()
+	if err != nil {
+		t.Fatalf("Unexpected error from localWorkspace: %v", err)
+	}
+	root := filepath.Dir(workspace)
+	defer os.RemoveAll(root)
+
+	if !strings.HasPrefix(root, os.TempDir()) || filepath.Dir(metaSpace) != root {
+		t.Errorf("Workspace %v and meta space %v, want them in the same temporary directory", workspace, metaSpace)
+	}
+	other, _, _ := localWorkspace()
+	defer os.RemoveAll(filepath.Dir(other))
+	if other == workspace {
+		t.Errorf("Two local builds got the same workspace %v", workspace)
+	}
+}
+
+func TestLocalCheckout(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	repo, err := parseLocalScmURL("git@github.com:screwdriver-cd/launcher-local-test.git#master")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing SCM URL: %v", err)
+	}
+	dir := localCheckoutDir(repo)
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	var operations []string
+	fakeGit(&operations)
+
+	// First run clones, the second one reuses the checkout
+	for i := 0; i < 2; i++ {
+		if _, err := newLocalAPI(repo.URL+"#"+repo.Branch, "", "other", ioutil.Discard); err != nil {
+			t.Fatalf("Unexpected error creating local API: %v", err)
+		}
+	}
+
+	wantOperations := []string{
+		"clone git@github.com:screwdriver-cd/launcher-local-test.git master into " + dir,
+		"head",
+		"update git@github.com:screwdriver-cd/launcher-local-test.git master clean=false",
+		"head",
+	}
+	if !reflect.DeepEqual(operations, wantOperations) {
+		t.Errorf("Operations = %q, want %q", operations, wantOperations)
+	}
+
+	if _, err := newLocalAPI(repo.URL, "", "missing", ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for a job missing from screwdriver.yaml")
+	}
+}
+
+func TestLocalCheckoutPullRequest(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	scmURL := "git@github.com:screwdriver-cd/launcher-pr-test.git#PR-7:develop"
+	repo, err := parseLocalScmURL(scmURL)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing SCM URL: %v", err)
+	}
+	dir := localCheckoutDir(repo)
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	var refs []string
+	gitClone = func(repo git.Repo, dir string, out io.Writer) error {
+		refs = append(refs, repo.Branch+" "+repo.PRRef)
+		os.MkdirAll(filepath.Join(dir, ".git"), 0777)
+		return ioutil.WriteFile(filepath.Join(dir, "screwdriver.yaml"), []byte(TestLocalConfig), 0644)
+	}
+	gitHeadCommit = func(dir string) (git.Commit, error) { return TestCommit, nil }
+
+	api, err := newLocalAPI(scmURL, "", "main", ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Unexpected error creating local API: %v", err)
+	}
+	if want := []string{"develop pull/7/head"}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("Cloned %q, want %q", refs, want)
+	}
+
+	// The job is named like Screwdriver names pull request jobs, so launch sets SD_PULL_REQUEST
+	job, _ := api.JobFromID(0)
+	if job.Name != "PR-7:main" || prNumber(job.Name) != "7" {
+		t.Errorf("Job name = %q, want PR-7:main", job.Name)
+	}
+	pipeline, _ := api.PipelineFromID(0)
+	if scm, _ := parseScmURI(pipeline.ScmURI, pipeline.ScmRepo.Name); scm.Branch != "develop" {
+		t.Errorf("Pipeline branch = %q, want the target branch develop", scm.Branch)
+	}
+
+	repoDir, cleanup := setupLocalRepo(t)
+	defer cleanup()
+	if _, err := parseLocalScmURL(repoDir + "#PR-7"); err == nil {
+		t.Errorf("Expected an error for a pull request of a local checkout")
+	}
+}
+
+func TestLocalCheckoutCleanUntracked(t *testing.T) {
+	defer restoreLocalHooks()()
+
+	os.Setenv("SD_CLEAN_UNTRACKED", "true")
+	defer os.Unsetenv("SD_CLEAN_UNTRACKED")
+
+	repo, err := parseLocalScmURL("https://github.com/screwdriver-cd/launcher-clean-test.git")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing SCM URL: %v", err)
+	}
+	dir := localCheckoutDir(repo)
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	var operations []string
+	fakeGit(&operations)
+
+	if _, err := checkoutLocal(repo); err != nil {
+		t.Fatalf("Unexpected error checking out: %v", err)
+	}
+
+	operations = nil
+	if _, err := checkoutLocal(repo); err != nil {
+		t.Fatalf("Unexpected error checking out: %v", err)
+	}
+	want := []string{"update https://github.com/screwdriver-cd/launcher-clean-test.git master clean=true"}
+	if !reflect.DeepEqual(operations, want) {
+		t.Errorf("Operations = %q, want %q", operations, want)
+	}
+
+	// Without the flag a reused checkout keeps its untracked files
+	os.Unsetenv("SD_CLEAN_UNTRACKED")
+	operations = nil
+	if _, err := checkoutLocal(repo); err != nil {
+		t.Fatalf("Unexpected error checking out: %v", err)
+	}
+	want = []string{"update https://github.com/screwdriver-cd/launcher-clean-test.git master clean=false"}
+	if !reflect.DeepEqual(operations, want) {
+		t.Errorf("Operations = %q, want %q", operations, want)
+	}
+
+	// An existing local checkout is never touched
+	repoDir, cleanup := setupLocalRepo(t)
+	defer cleanup()
+	os.Setenv("SD_CLEAN_UNTRACKED", "true")
+	operations = nil
+	local, _ := parseLocalScmURL(repoDir)
+	if _, err := checkoutLocal(local); err != nil {
+		t.Fatalf("Unexpected error checking out: %v", err)
+	}
+	if len(operations) != 0 {
+		t.Errorf("Unexpected git operations for an existing checkout: %q", operations)
+	}
+}
+
+func TestCommitEnvironment(t *testing.T) {
+	env := commitEnvironment(git.Commit{
+		Author:  "Jane Doe",
+		Email:   "jane@example.com",
+		Subject: "Fix the launcher",
+		Message: "Fix the launcher\n\nThe body is left out",
+	})
+
+	want := map[string]string{
+		"SD_GIT_COMMIT_AUTHOR":  "Jane Doe",
+		"SD_GIT_COMMIT_EMAIL":   "jane@example.com",
+		"SD_GIT_COMMIT_MESSAGE": "Fix the launcher",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// jsonLog formats the launcher's own log lines when --log-format=json is set, nil otherwise
+var jsonLog *jsonLogger
+
+// jsonLogger is a log output writing each line as a JSON object tagged with the build,
+// the job and the step running, for log aggregation tools
+type jsonLogger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	partial []byte
+	buildID int
+	jobID   int
+	step    string
+}
+
+type jsonLogEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+	BuildID int    `json:"buildId"`
+	JobID   int    `json:"jobId,omitempty"`
+	Step    string `json:"step,omitempty"`
+}
+
+// Messages starting with these prefixes get the matching level, their prefix removed
+var logLevelPrefixes = []struct {
+	prefix string
+	level  string
+}{
+	{"WARNING: ", "warn"},
+	{"WARN: ", "warn"},
+	{"Error: ", "error"},
+	{"Error ", "error"},
+	{"Failed ", "error"},
+	{"Failure ", "error"},
+}
+
+func newJSONLogger(out io.Writer, buildID int) *jsonLogger {
+	return &jsonLogger{out: out, buildID: buildID}
+}
+
+// setJob tags the following lines with the job of the build
+func (l *jsonLogger) setJob(jobID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.jobID = jobID
+}
+
+// setStep tags the following lines with the step running, none when step is empty
+func (l *jsonLogger) setStep(step string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.step = step
+}
+
+// Write outputs a JSON object for each complete line of p. The log package writes whole
+// lines, an incomplete one waits for the next write anyway.
+func (l *jsonLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i == -1 {
+			break
+		}
+		line := string(l.partial[:i])
+		l.partial = l.partial[i+1:]
+
+		if err := l.writeEntry(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (l *jsonLogger) writeEntry(line string) error {
+	entry := jsonLogEntry{
+		Time:    timeNow().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Level:   "info",
+		Message: strings.TrimSpace(line),
+		BuildID: l.buildID,
+		JobID:   l.jobID,
+		Step:    l.step,
+	}
+	for _, p := range logLevelPrefixes {
+		if strings.HasPrefix(entry.Message, p.prefix) {
+			entry.Level = p.level
+			if strings.HasSuffix(p.prefix, ": ") {
+				entry.Message = strings.TrimPrefix(entry.Message, p.prefix)
+			}
+			break
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = l.out.Write(append(data, '\n'))
+	return err
+}
+
+// stepLogEmitter tags the launcher's log lines with each step as the executor starts it
+type stepLogEmitter struct {
+	screwdriver.Emitter
+	log *jsonLogger
+}
+
+func (e stepLogEmitter) StartCmd(cmd screwdriver.CommandDef) {
+	e.log.setStep(cmd.Name)
+	e.Emitter.StartCmd(cmd)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func decodeLogEntries(t *testing.T, out string) []jsonLogEntry {
+	var entries []jsonLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var entry jsonLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line %q is not JSON: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJSONLogger(t *testing.T) {
+	oldTimeNow := timeNow
+	defer func() { timeNow = oldTimeNow }()
+	timeNow = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	out := new(bytes.Buffer)
+	logger := newJSONLogger(out, 1234)
+	l := log.New(logger, "", 0)
+
+	l.Print("Fetching Build 1234")
+	logger.setJob(2345)
+	logger.setStep("install")
+	l.Printf("WARN: Not caching %s, it does not exist", "vendor")
+	l.Printf("Error creating Screwdriver API 1234: boom")
+
+	want := []jsonLogEntry{
+		{Time: "2020-01-02T03:04:05.000Z", Level: "info", Message: "Fetching Build 1234", BuildID: 1234},
+		{Time: "2020-01-02T03:04:05.000Z", Level: "warn", Message: "Not caching vendor, it does not exist", BuildID: 1234, JobID: 2345, Step: "install"},
+		{Time: "2020-01-02T03:04:05.000Z", Level: "error", Message: "Error creating Screwdriver API 1234: boom", BuildID: 1234, JobID: 2345, Step: "install"},
+	}
+	if got := decodeLogEntries(t, out.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Log entries = %+v, want %+v", got, want)
+	}
+}
+
+func TestStepLogEmitter(t *testing.T) {
+	logger := newJSONLogger(new(bytes.Buffer), 1234)
+	started := ""
+	e := stepLogEmitter{&MockEmitter{startCmd: func(cmd screwdriver.CommandDef) { started = cmd.Name }}, logger}
+
+	e.StartCmd(screwdriver.CommandDef{Name: "test"})
+	if logger.step != "test" || started != "test" {
+		t.Errorf("Step = %q, started %q, want test for both", logger.step, started)
+	}
+}
+
+func TestLaunchJSONLog(t *testing.T) {
+	oldOutput, oldFlags := log.Writer(), log.Flags()
+	defer func() {
+		log.SetOutput(oldOutput)
+		log.SetFlags(oldFlags)
+		jsonLog = nil
+	}()
+
+	out := new(bytes.Buffer)
+	jsonLog = newJSONLogger(out, TestBuildID)
+	log.SetFlags(0)
+	log.SetOutput(jsonLog)
+
+	api := mockAPI(t, TestBuildID, TestJobID, 0, "RUNNING")
+	if err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+
+	entries := decodeLogEntries(t, out.String())
+	if entries[0].Message != "Setting Build Status to RUNNING" || entries[0].JobID != 0 {
+		t.Errorf("First entry = %+v, want the status update before the job is known", entries[0])
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Message, "Fetching Pipeline") {
+			if entry.BuildID != TestBuildID || entry.JobID != TestJobID || entry.Step != "sd-setup-launcher" {
+				t.Errorf("Entry = %+v, want it tagged with the build, the job and the launcher step", entry)
+			}
+			return
+		}
+	}
+	t.Errorf("No entry for fetching the pipeline in %q", out.String())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readMeta loads the meta file, an empty meta when it doesn't exist yet
+func readMeta(metaFile string) (map[string]interface{}, error) {
+	meta := map[string]interface{}{}
+
+	data, err := readFile(metaFile)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading meta file %q: %v", metaFile, err)
+	}
+	if len(data) == 0 {
+		return meta, nil
+	}
+	if err := unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("Parsing meta file %q: %v", metaFile, err)
+	}
+	return meta, nil
+}
+
+// metaGet returns the value at key, a dotted path like "foo.bar", from the meta file.
+// Strings are returned as is, anything else as JSON.
+func metaGet(metaFile, key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("Meta key must not be empty")
+	}
+
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return "", err
+	}
+
+	var value interface{} = meta
+	for _, k := range strings.Split(key, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			value = nil
+			break
+		}
+		value = m[k]
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	out, err := marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("Marshalling meta value of %q: %v", key, err)
+	}
+	return string(out), nil
+}
+
+// metaSet stores value at key, a dotted path like "foo.bar", in the meta file.
+// The value is parsed as JSON when jsonValue is set, and stored as a string otherwise.
+func metaSet(metaFile, key, value string, jsonValue bool) error {
+	if key == "" {
+		return fmt.Errorf("Meta key must not be empty")
+	}
+
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		return err
+	}
+
+	var v interface{} = value
+	if jsonValue {
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return fmt.Errorf("Parsing JSON value %q: %v", value, err)
+		}
+	}
+
+	keys := strings.Split(key, ".")
+	m := meta
+	for _, k := range keys[:len(keys)-1] {
+		child, ok := m[k].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			m[k] = child
+		}
+		m = child
+	}
+	m[keys[len(keys)-1]] = v
+
+	data, err := marshal(meta)
+	if err != nil {
+		return fmt.Errorf("Marshalling meta: %v", err)
+	}
+	if err := writeMeta(metaFile, data); err != nil {
+		return fmt.Errorf("Writing meta file %q: %v", metaFile, err)
+	}
+	return nil
+}
+
+// writeMeta replaces the meta file with data. The data goes to a file next to it first, so a
+// launcher dying meanwhile leaves the previous meta whole.
+func writeMeta(metaFile string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(metaFile); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(metaFile), filepath.Base(metaFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), metaFile)
+}
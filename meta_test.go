@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+// restoreMetaHooks puts back the real file and JSON functions stubbed out by TestMain
+func restoreMetaHooks() func() {
+	oldReadFile, oldWriteFile, oldMarshal, oldUnmarshal := readFile, writeFile, marshal, unmarshal
+	readFile, writeFile, marshal, unmarshal = ioutil.ReadFile, ioutil.WriteFile, json.Marshal, json.Unmarshal
+	return func() {
+		readFile, writeFile, marshal, unmarshal = oldReadFile, oldWriteFile, oldMarshal, oldUnmarshal
+	}
+}
+
+func TestMetaSetGet(t *testing.T) {
+	defer restoreMetaHooks()()
+
+	tmp, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	metaFile := path.Join(tmp, "meta.json")
+
+	if err := ioutil.WriteFile(metaFile, []byte(`{"build":{"jobName":"main"},"foo":"string"}`), 0666); err != nil {
+		t.Fatalf("Couldn't write meta file: %v", err)
+	}
+
+	sets := []struct {
+		key       string
+		value     string
+		jsonValue bool
+	}{
+		{"version", "1.2.3", false},
+		{"foo.bar", "replaces the string", false},
+		{"count", "42", false},
+		{"coverage", `{"lines": 87.5}`, true},
+	}
+	for _, s := range sets {
+		if err := metaSet(metaFile, s.key, s.value, s.jsonValue); err != nil {
+			t.Fatalf("Unexpected error setting %q: %v", s.key, err)
+		}
+	}
+
+	gets := map[string]string{
+		"build.jobName":  "main",
+		"version":        "1.2.3",
+		"foo.bar":        "replaces the string",
+		"count":          "42",
+		"coverage":       `{"lines":87.5}`,
+		"coverage.lines": "87.5",
+		"missing":        "null",
+		"version.nested": "null",
+	}
+	for key, want := range gets {
+		got, err := metaGet(metaFile, key)
+		if err != nil {
+			t.Errorf("Unexpected error getting %q: %v", key, err)
+		}
+		if got != want {
+			t.Errorf("meta get %q = %q, want %q", key, got, want)
+		}
+	}
+
+	if err := metaSet(metaFile, "bad", "{not json", true); err == nil {
+		t.Errorf("Expected an error for an invalid JSON value")
+	}
+	if err := metaSet(metaFile, "", "value", false); err == nil {
+		t.Errorf("Expected an error for an empty key")
+	}
+}
+
+func TestMetaGetMissingFile(t *testing.T) {
+	defer restoreMetaHooks()()
+
+	got, err := metaGet("/does/not/exist/meta.json", "foo")
+	if err != nil {
+		t.Fatalf("Unexpected error reading a missing meta file: %v", err)
+	}
+	if got != "null" {
+		t.Errorf("meta get foo = %q, want %q", got, "null")
+	}
+}
+
+func TestMetaSetUnreadableFile(t *testing.T) {
+	defer restoreMetaHooks()()
+
+	tmp, err := ioutil.TempDir("", "meta")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	metaFile := path.Join(tmp, "meta.json")
+	if err := ioutil.WriteFile(metaFile, []byte(`{"version":"1.2.3"}`), 0666); err != nil {
+		t.Fatalf("Couldn't write meta file: %v", err)
+	}
+
+	// A meta file that can't be read is not replaced by a new one
+	readFile = func(filename string) ([]byte, error) {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: syscall.EIO}
+	}
+	if err := metaSet(metaFile, "foo", "bar", false); err == nil {
+		t.Errorf("Expected an error setting the meta of an unreadable file")
+	}
+	readFile = ioutil.ReadFile
+	if got, _ := metaGet(metaFile, "version"); got != "1.2.3" {
+		t.Errorf("meta get version = %q after the failed set, want %q", got, "1.2.3")
+	}
+
+	if err := metaSet(metaFile, "foo", "bar", false); err != nil {
+		t.Fatalf("Unexpected error setting foo: %v", err)
+	}
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("Couldn't list the meta space: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != "meta.json" {
+		t.Errorf("Meta space holds %d files, want only meta.json", len(files))
+	}
+}
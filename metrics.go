@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/metrics"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var (
+	stepDuration = metrics.NewHistogram("sd_launcher_step_duration_seconds",
+		"Time the steps of the builds ran for, by step", metrics.TaskBuckets, "step")
+	checkoutDuration = metrics.NewHistogram("sd_launcher_checkout_duration_seconds",
+		"Time spent checking out the source of the builds", metrics.TaskBuckets)
+	artifactBytes = metrics.NewCounter("sd_launcher_artifact_upload_bytes_total",
+		"Bytes of artifacts uploaded to the store")
+	cacheRestores = metrics.NewCounter("sd_launcher_cache_restores_total",
+		"Cache restores by result: hit, miss or error", "result")
+	buildsCompleted = metrics.NewCounter("sd_launcher_builds_total",
+		"Builds run to completion, by status", "status")
+)
+
+// metricsPushgateway is where the metrics get pushed once the build is done, never when empty
+var metricsPushgateway = ""
+
+var metricsClient = &http.Client{Timeout: 10 * time.Second}
+
+// pushMetrics sends the metrics of the build to the Pushgateway, grouped by build
+func pushMetrics(buildID int) {
+	if metricsPushgateway == "" {
+		return
+	}
+	grouping := map[string]string{"build_id": strconv.Itoa(buildID)}
+	if err := metrics.Default.Push(metricsClient, metricsPushgateway, "sd-launcher", grouping); err != nil {
+		log.Printf("WARN: %v", err)
+	}
+}
+
+// timedEmitter measures how long each step runs, from the executor starting it until it stops it
+type timedEmitter struct {
+	screwdriver.Emitter
+	started time.Time
+}
+
+func (e *timedEmitter) StartCmd(cmd screwdriver.CommandDef) {
+	e.started = time.Now()
+	e.Emitter.StartCmd(cmd)
+}
+
+func (e *timedEmitter) StopCmd(cmd screwdriver.CommandDef, exitCode int) {
+	stepDuration.Since(e.started, cmd.Name)
+	e.Emitter.StopCmd(cmd, exitCode)
+}
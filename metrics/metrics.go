@@ -0,0 +1,274 @@
+// Package metrics keeps the counters and histograms of the launcher and exposes them in the
+// Prometheus text format, served on /metrics or pushed to a Pushgateway
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the histograms, in seconds
+var (
+	// RequestBuckets suit HTTP calls
+	RequestBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// TaskBuckets suit steps and other parts of a build that take minutes
+	TaskBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+)
+
+// Registry holds metrics, in the order they were created
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry the metrics of the launcher are created in
+var Default = &Registry{}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all the metrics of r in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics of r, for Prometheus to scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// Serve serves the metrics of r on /metrics at addr, like ":9102", until the returned function
+// is called
+func (r *Registry) Serve(addr string) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Listening for metrics on %s: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+	return func() { server.Close() }, nil
+}
+
+// Push replaces the metrics of the group of job in the Pushgateway at gatewayURL with those
+// of r. The group is named by the grouping labels, e.g. {"build_id": "42"}.
+func (r *Registry) Push(client *http.Client, gatewayURL, job string, grouping map[string]string) error {
+	path := "/metrics/job/" + url.PathEscape(job)
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += "/" + url.PathEscape(name) + "/" + url.PathEscape(grouping[name])
+	}
+
+	body := new(bytes.Buffer)
+	r.WriteTo(body)
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(gatewayURL, "/")+path, body)
+	if err != nil {
+		return fmt.Errorf("Pushing metrics: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Pushing metrics: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Pushing metrics: %d returned from %s", res.StatusCode, gatewayURL)
+	}
+	return nil
+}
+
+// series are the values of a metric for each set of label values
+type series struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func newSeries(name, help string, labels []string) *series {
+	return &series{name: name, help: help, labels: labels, values: map[string]interface{}{}}
+}
+
+// key joins label values, which can't hold a NUL
+func key(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// labelPairs formats the labels of a series, with the extra pairs after them
+func (s *series) labelPairs(k string, extra ...string) string {
+	var pairs []string
+	if len(s.labels) > 0 {
+		for i, v := range strings.Split(k, "\x00") {
+			pairs = append(pairs, s.labels[i]+"="+strconv.Quote(v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sortedKeys are the label values of the series, sorted for a stable output
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *series) checkLabels(values []string) {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", s.name, s.labels, values))
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a metric that only goes up, like a number of bytes sent
+type Counter struct {
+	s *series
+}
+
+// NewCounter creates a counter in the Default registry, with the names of its labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter creates a counter in r, with the names of its labels
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newSeries(name, help, labels)}
+	r.add(c)
+	return c
+}
+
+// Add adds v to the counter of the label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.s.checkLabels(labelValues)
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	k := key(labelValues)
+	total, _ := c.s.values[k].(float64)
+	c.s.values[k] = total + v
+}
+
+// Inc adds 1 to the counter of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.s.name, c.s.help, c.s.name)
+	for _, k := range c.s.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.s.name, c.s.labelPairs(k), formatFloat(c.s.values[k].(float64)))
+	}
+}
+
+// Histogram counts observations, like durations, in buckets
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram in the Default registry with the upper bounds of its buckets,
+// sorted, and the names of its labels
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram creates a histogram in r with the upper bounds of its buckets, sorted, and the
+// names of its labels
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newSeries(name, help, labels), buckets}
+	r.add(h)
+	return h
+}
+
+// Observe adds v to the histogram of the label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.s.checkLabels(labelValues)
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	k := key(labelValues)
+	hv, ok := h.s.values[k].(*histogramValue)
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.s.values[k] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// Since observes the time elapsed since start, in seconds
+func (h *Histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.s.name, h.s.help, h.s.name)
+	for _, k := range h.s.sortedKeys() {
+		hv := h.s.values[k].(*histogramValue)
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.s.name, h.s.labelPairs(k, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.s.name, h.s.labelPairs(k, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.s.name, h.s.labelPairs(k), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.s.name, h.s.labelPairs(k), hv.count)
+	}
+}
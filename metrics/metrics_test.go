@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := &Registry{}
+	calls := r.NewHistogram("sd_api_seconds", "Latency of the API calls", []float64{0.1, 1}, "method")
+	bytesSent := r.NewCounter("sd_bytes_total", "Bytes sent")
+	restores := r.NewCounter("sd_restores_total", "Cache restores", "result")
+
+	calls.Observe(0.05, "GET")
+	calls.Observe(0.5, "GET")
+	calls.Observe(3, "PUT")
+	bytesSent.Add(1024)
+	bytesSent.Add(512)
+	restores.Inc("hit")
+	restores.Inc(`"odd"`)
+
+	buf := new(bytes.Buffer)
+	r.WriteTo(buf)
+	want := `# HELP sd_api_seconds Latency of the API calls
+# TYPE sd_api_seconds histogram
+sd_api_seconds_bucket{method="GET",le="0.1"} 1
+sd_api_seconds_bucket{method="GET",le="1"} 2
+sd_api_seconds_bucket{method="GET",le="+Inf"} 2
+sd_api_seconds_sum{method="GET"} 0.55
+sd_api_seconds_count{method="GET"} 2
+sd_api_seconds_bucket{method="PUT",le="0.1"} 0
+sd_api_seconds_bucket{method="PUT",le="1"} 0
+sd_api_seconds_bucket{method="PUT",le="+Inf"} 1
+sd_api_seconds_sum{method="PUT"} 3
+sd_api_seconds_count{method="PUT"} 1
+# HELP sd_bytes_total Bytes sent
+# TYPE sd_bytes_total counter
+sd_bytes_total 1536
+# HELP sd_restores_total Cache restores
+# TYPE sd_restores_total counter
+sd_restores_total{result="\"odd\""} 1
+sd_restores_total{result="hit"} 1
+`
+	if buf.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", buf, want)
+	}
+}
+
+func TestLabelValuesMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for missing label values")
+		}
+	}()
+	(&Registry{}).NewCounter("sd_total", "Things", "kind").Inc()
+}
+
+func TestPush(t *testing.T) {
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(data)
+	}))
+	defer server.Close()
+
+	r := &Registry{}
+	r.NewCounter("sd_builds_total", "Builds").Inc()
+	grouping := map[string]string{"build_id": "42", "instance": "node-1"}
+	if err := r.Push(server.Client(), server.URL+"/", "sd-launcher", grouping); err != nil {
+		t.Fatalf("Unexpected error pushing: %v", err)
+	}
+	if method != "PUT" || path != "/metrics/job/sd-launcher/build_id/42/instance/node-1" {
+		t.Errorf("Pushed with %s %s", method, path)
+	}
+	if !strings.Contains(body, "sd_builds_total 1\n") {
+		t.Errorf("Pushed %q, want the metrics", body)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	if err := r.Push(failing.Client(), failing.URL, "sd-launcher", nil); err == nil {
+		t.Errorf("Expected an error when the Pushgateway rejects the metrics")
+	}
+}
+
+func TestServe(t *testing.T) {
+	r := &Registry{}
+	r.NewCounter("sd_builds_total", "Builds").Inc()
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := res.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+	if !strings.Contains(res.Body.String(), "sd_builds_total 1\n") {
+		t.Errorf("Served %q, want the metrics", res.Body.String())
+	}
+
+	stop, err := r.Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error serving: %v", err)
+	}
+	stop()
+	if _, err := r.Serve("256.0.0.1:1"); err == nil {
+		t.Errorf("Expected an error for an invalid address")
+	}
+}
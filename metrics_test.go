@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/metrics"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(data)
+	}))
+	defer server.Close()
+
+	oldPushgateway := metricsPushgateway
+	defer func() { metricsPushgateway = oldPushgateway }()
+
+	// Nothing is pushed without a Pushgateway
+	pushMetrics(TestBuildID)
+	if path != "" {
+		t.Fatalf("Metrics pushed to %s without a Pushgateway", path)
+	}
+
+	metricsPushgateway = server.URL
+	buildsCompleted.Inc("SUCCESS")
+	pushMetrics(TestBuildID)
+	if path != "/metrics/job/sd-launcher/build_id/1234" {
+		t.Errorf("Metrics pushed to %s, want the group of the build", path)
+	}
+	if !strings.Contains(body, `sd_launcher_builds_total{status="SUCCESS"}`) {
+		t.Errorf("Pushed %q, want the launcher metrics", body)
+	}
+}
+
+func TestTimedEmitter(t *testing.T) {
+	emitter := &timedEmitter{Emitter: &MockEmitter{}}
+	cmd := screwdriver.CommandDef{Name: "timed-step"}
+	emitter.StartCmd(cmd)
+	emitter.StopCmd(cmd, 0)
+
+	buf := new(bytes.Buffer)
+	metrics.Default.WriteTo(buf)
+	if !strings.Contains(buf.String(), `sd_launcher_step_duration_seconds_count{step="timed-step"} 1`) {
+		t.Errorf("The step duration was not recorded:\n%s", buf)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/notify"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// notifier sends the notifications of the pipeline settings once the build is done
+var notifier notify.Notifier
+
+// buildNotice is what the notifications know of the build, set once its pipeline is fetched
+var buildNotice struct {
+	notifications []screwdriver.Notification
+	summary       notify.Summary
+	started       time.Time
+}
+
+// setBuildNotice gets the notifications of pipeline ready for the build
+func setBuildNotice(pipeline screwdriver.Pipeline, job screwdriver.Job, build screwdriver.Build, uiURL string) {
+	buildNotice.notifications = pipeline.Settings.Notifications
+	buildNotice.started = timeNow()
+	buildNotice.summary = notify.Summary{
+		Pipeline:   pipeline.ScmRepo.Name,
+		PipelineID: pipeline.ID,
+		Job:        job.Name,
+		BuildID:    build.ID,
+		SHA:        build.SHA,
+		URL:        fmt.Sprintf("%s/pipelines/%d/builds/%d", uiURL, pipeline.ID, build.ID),
+	}
+}
+
+// failedStepEmitter records the first step exiting with a non-zero code, for the notifications
+type failedStepEmitter struct {
+	screwdriver.Emitter
+}
+
+func (e failedStepEmitter) StopCmd(cmd screwdriver.CommandDef, exitCode int) {
+	if exitCode != 0 && buildNotice.summary.FailedStep == "" {
+		buildNotice.summary.FailedStep = cmd.Name
+	}
+	e.Emitter.StopCmd(cmd, exitCode)
+}
+
+// sendNotifications sends the notifications enabled for the status the build ended with. Their
+// failures are logged, they never change the status.
+func sendNotifications(status screwdriver.BuildStatus, statusMessage string) {
+	summary := buildNotice.summary
+	summary.Status = status
+	summary.Message = statusMessage
+	summary.Duration = timeNow().Sub(buildNotice.started)
+	for _, n := range buildNotice.notifications {
+		if !notify.Enabled(n, status) {
+			continue
+		}
+		log.Printf("Sending the %s notification of the build", n.Type)
+		if err := notifier.Send(n, summary); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+}
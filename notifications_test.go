@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestLaunchNotifications(t *testing.T) {
+	var posted []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		json.Unmarshal(data, &body)
+		posted = append(posted, body)
+	}))
+	defer server.Close()
+
+	oldRun := executorRun
+	defer func() { executorRun, buildNotice.notifications = oldRun, nil }()
+	executorRun = func(path string, env []string, out screwdriver.Emitter, build screwdriver.Build, a screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		out.StopCmd(screwdriver.CommandDef{Name: "install"}, 0)
+		out.StopCmd(screwdriver.CommandDef{Name: "test"}, 2)
+		out.StopCmd(screwdriver.CommandDef{Name: "teardown-report"}, 1)
+		return executor.ErrStatus{Status: 2}
+	}
+
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "")
+	api.updateBuildStatus = func(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
+		return nil
+	}
+	api.pipelineFromID = func(pipelineID int) (screwdriver.Pipeline, error) {
+		return screwdriver.Pipeline(FakePipeline{ID: pipelineID, ScmURI: TestScmURI, ScmRepo: TestScmRepo, Settings: screwdriver.PipelineSettings{
+			Notifications: []screwdriver.Notification{
+				{Type: screwdriver.NotifyWebhook, URL: server.URL, Template: "{{.Status}} in {{.FailedStep}}"},
+				// Only sent for the successes
+				{Type: screwdriver.NotifySlack, URL: server.URL, Statuses: []screwdriver.BuildStatus{screwdriver.Success}},
+			},
+		}}), nil
+	}
+
+	if err := launchAction(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+	if len(posted) != 1 {
+		t.Fatalf("Posted %d notifications, want the failure one", len(posted))
+	}
+	build, _ := posted[0]["build"].(map[string]interface{})
+	if posted[0]["text"] != "FAILURE in test" {
+		t.Errorf("Notified %q, want the failed step", posted[0]["text"])
+	}
+	if want := fmt.Sprintf("%s/pipelines/%d/builds/%d", TestUiURL, TestPipelineID, TestBuildID); build["url"] != want {
+		t.Errorf("Linked %v, want %s", build["url"], want)
+	}
+	if build["message"] != "Failure due to non-zero exit code: exit 2" {
+		t.Errorf("Notified the message %v", build["message"])
+	}
+}
@@ -0,0 +1,218 @@
+// Package notify tells Slack, webhooks and email addresses about the builds once they are done,
+// as their pipeline settings ask
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// DefaultTemplate is the message of the notifications without a template of their own
+const DefaultTemplate = `{{.Pipeline}} {{.Job}} #{{.BuildID}} {{.Status}}` +
+	`{{if .FailedStep}} in step {{.FailedStep}}{{end}} after {{.Duration}}` +
+	`{{if .Message}}: {{.Message}}{{end}}{{if .URL}}
+{{.URL}}{{end}}`
+
+// DefaultTimeout is how long a notification gets to be sent
+const DefaultTimeout = 10 * time.Second
+
+var (
+	sendMail    = sendMailTimeout
+	mailTimeout = DefaultTimeout
+)
+
+// Summary is what a notification tells about the build, and what its template is given
+type Summary struct {
+	Status     screwdriver.BuildStatus `json:"status"`
+	Message    string                  `json:"message,omitempty"`
+	Pipeline   string                  `json:"pipeline"`
+	PipelineID int                     `json:"pipelineId"`
+	Job        string                  `json:"job"`
+	BuildID    int                     `json:"buildId"`
+	SHA        string                  `json:"sha,omitempty"`
+	// FailedStep is the first step that exited with a non-zero code
+	FailedStep string        `json:"failedStep,omitempty"`
+	Duration   time.Duration `json:"-"`
+	// URL is the page of the build
+	URL string `json:"url,omitempty"`
+}
+
+// Mail is the SMTP server sending the emails, with the credentials it takes if any
+type Mail struct {
+	// Server is a host:port
+	Server   string
+	From     string
+	Username string
+	Password string
+}
+
+// Notifier sends the notifications
+type Notifier struct {
+	Mail   Mail
+	Client *http.Client
+}
+
+// Enabled tells whether n is sent for the builds ending with status
+func Enabled(n screwdriver.Notification, status screwdriver.BuildStatus) bool {
+	if len(n.Statuses) == 0 {
+		return status == screwdriver.Failure
+	}
+	for _, s := range n.Statuses {
+		if strings.EqualFold(string(s), string(status)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is the text of n about the build of s
+func Message(n screwdriver.Notification, s Summary) (string, error) {
+	text := n.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	t, err := template.New(n.Type).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Parsing the template of the %s notification: %v", n.Type, err)
+	}
+	s.Duration = s.Duration.Round(time.Second)
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, s); err != nil {
+		return "", fmt.Errorf("Executing the template of the %s notification: %v", n.Type, err)
+	}
+	return buf.String(), nil
+}
+
+// Send sends n about the build of s
+func (nt Notifier) Send(n screwdriver.Notification, s Summary) error {
+	message, err := Message(n, s)
+	if err != nil {
+		return err
+	}
+	switch n.Type {
+	case screwdriver.NotifySlack:
+		return nt.post(n.URL, map[string]interface{}{"text": message})
+	case screwdriver.NotifyWebhook:
+		return nt.post(n.URL, map[string]interface{}{"text": message, "build": s, "durationSeconds": int(s.Duration.Seconds())})
+	case screwdriver.NotifyEmail:
+		return nt.email(n.To, s, message)
+	}
+	return fmt.Errorf("Unknown notification type %q", n.Type)
+}
+
+func (nt Notifier) post(url string, body interface{}) error {
+	if url == "" {
+		return errors.New("Notification without a URL")
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("Marshaling the notification: %v", err)
+	}
+	client := nt.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout, Transport: screwdriver.Transport}
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Posting the notification: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Posting the notification: %d returned from %s", res.StatusCode, res.Request.URL.Host)
+	}
+	return nil
+}
+
+func (nt Notifier) email(to []string, s Summary, message string) error {
+	if len(to) == 0 {
+		return errors.New("Email notification without addresses")
+	}
+	if nt.Mail.Server == "" {
+		return errors.New("Email notification without an SMTP server")
+	}
+	var auth smtp.Auth
+	if nt.Mail.Username != "" {
+		host, _, _ := net.SplitHostPort(nt.Mail.Server)
+		auth = smtp.PlainAuth("", nt.Mail.Username, nt.Mail.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", nt.Mail.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: [Screwdriver] %s %s #%d %s\r\n", s.Pipeline, s.Job, s.BuildID, s.Status)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(message, "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+	if err := sendMail(nt.Mail.Server, auth, nt.Mail.From, to, msg.Bytes()); err != nil {
+		return fmt.Errorf("Sending the email notification: %v", err)
+	}
+	return nil
+}
+
+// sendMailTimeout is smtp.SendMail giving up when the server doesn't answer within mailTimeout
+func sendMailTimeout(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, mailTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(mailTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		// The CAs given with --ca-cert are trusted by the mail server too
+		config := &tls.Config{}
+		if t, ok := screwdriver.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		config.ServerName = host
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
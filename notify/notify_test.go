@@ -0,0 +1,251 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var testSummary = Summary{
+	Status:     screwdriver.Failure,
+	Message:    "Failure due to non-zero exit code: exit status 2",
+	Pipeline:   "screwdriver-cd/launcher",
+	PipelineID: 1,
+	Job:        "main",
+	BuildID:    42,
+	FailedStep: "test",
+	Duration:   90*time.Second + 300*time.Millisecond,
+	URL:        "https://cd.screwdriver.cd/pipelines/1/builds/42",
+}
+
+func TestEnabled(t *testing.T) {
+	for _, test := range []struct {
+		statuses []screwdriver.BuildStatus
+		status   screwdriver.BuildStatus
+		want     bool
+	}{
+		{nil, screwdriver.Failure, true},
+		{nil, screwdriver.Success, false},
+		{[]screwdriver.BuildStatus{screwdriver.Success, screwdriver.Aborted}, screwdriver.Success, true},
+		{[]screwdriver.BuildStatus{"aborted"}, screwdriver.Aborted, true},
+		{[]screwdriver.BuildStatus{screwdriver.Success}, screwdriver.Failure, false},
+	} {
+		if got := Enabled(screwdriver.Notification{Statuses: test.statuses}, test.status); got != test.want {
+			t.Errorf("Enabled(%v, %s) = %v, want %v", test.statuses, test.status, got, test.want)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	got, err := Message(screwdriver.Notification{}, testSummary)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := "screwdriver-cd/launcher main #42 FAILURE in step test after 1m30s: Failure due to non-zero exit code: exit status 2\n" +
+		"https://cd.screwdriver.cd/pipelines/1/builds/42"
+	if got != want {
+		t.Errorf("Message() = %q, want %q", got, want)
+	}
+
+	got, _ = Message(screwdriver.Notification{Template: "{{.Job}} is {{.Status}}"}, testSummary)
+	if got != "main is FAILURE" {
+		t.Errorf("Message() with a template = %q", got)
+	}
+	if _, err := Message(screwdriver.Notification{Type: "slack", Template: "{{.Nope}}"}, testSummary); err == nil || !strings.Contains(err.Error(), "template of the slack notification") {
+		t.Errorf("Message() error = %v, want the template failing", err)
+	}
+}
+
+func TestSendPost(t *testing.T) {
+	var bodies []map[string]interface{}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		json.Unmarshal(data, &body)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	tpl := screwdriver.Notification{Template: "{{.Job}} {{.Status}}"}
+	slack, webhook := tpl, tpl
+	slack.Type, slack.URL = screwdriver.NotifySlack, server.URL
+	webhook.Type, webhook.URL = screwdriver.NotifyWebhook, server.URL
+	for _, n := range []screwdriver.Notification{slack, webhook} {
+		if err := (Notifier{}).Send(n, testSummary); err != nil {
+			t.Errorf("Send(%s) error: %v", n.Type, err)
+		}
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("Posted %d notifications, want 2", len(bodies))
+	}
+	if want := map[string]interface{}{"text": "main FAILURE"}; !reflect.DeepEqual(bodies[0], want) {
+		t.Errorf("Posted %v to Slack, want %v", bodies[0], want)
+	}
+	build, _ := bodies[1]["build"].(map[string]interface{})
+	if bodies[1]["text"] != "main FAILURE" || build["failedStep"] != "test" || bodies[1]["durationSeconds"] != float64(90) {
+		t.Errorf("Posted %v to the webhook", bodies[1])
+	}
+
+	status = http.StatusNotFound
+	if err := (Notifier{}).Send(slack, testSummary); err == nil || !strings.Contains(err.Error(), "404 returned") {
+		t.Errorf("Send() error = %v, want the 404", err)
+	}
+	if err := (Notifier{}).Send(screwdriver.Notification{Type: "pager"}, testSummary); err == nil {
+		t.Errorf("Send() sent a notification of an unknown type")
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	oldSendMail := sendMail
+	defer func() { sendMail = oldSendMail }()
+	var server, from string
+	var to []string
+	var msg []byte
+	sendMail = func(addr string, a smtp.Auth, f string, t []string, m []byte) error {
+		server, from, to, msg = addr, f, t, m
+		return nil
+	}
+
+	n := screwdriver.Notification{Type: screwdriver.NotifyEmail, To: []string{"dev@example.com", "ops@example.com"}, Template: "{{.Job}}\n{{.URL}}"}
+	if err := (Notifier{}).Send(n, testSummary); err == nil || !strings.Contains(err.Error(), "without an SMTP server") {
+		t.Errorf("Send() error = %v, want the missing server", err)
+	}
+
+	notifier := Notifier{Mail: Mail{Server: "smtp.example.com:587", From: "sd@example.com", Username: "sd", Password: "secret"}}
+	if err := notifier.Send(n, testSummary); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if server != "smtp.example.com:587" || from != "sd@example.com" || !reflect.DeepEqual(to, n.To) {
+		t.Errorf("Sent by %s from %s to %v", server, from, to)
+	}
+	for _, want := range []string{
+		"To: dev@example.com, ops@example.com\r\n",
+		"Subject: [Screwdriver] screwdriver-cd/launcher main #42 FAILURE\r\n",
+		"\r\n\r\nmain\r\nhttps://cd.screwdriver.cd/pipelines/1/builds/42\r\n",
+	} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("Email %q has no %q", msg, want)
+		}
+	}
+
+	sendMail = func(addr string, a smtp.Auth, f string, t []string, m []byte) error {
+		return errors.New("535 authentication failed")
+	}
+	if err := notifier.Send(n, testSummary); err == nil || !strings.Contains(err.Error(), "535") {
+		t.Errorf("Send() error = %v, want the SMTP failure", err)
+	}
+}
+
+// fakeSMTP answers one SMTP session on l, sending what it was given on received. A silent server
+// accepts the connection but never says anything.
+func fakeSMTP(l net.Listener, silent bool, received chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if silent {
+		ioutil.ReadAll(conn)
+		return
+	}
+	r := bufio.NewReader(conn)
+	var session []string
+	fmt.Fprint(conn, "220 smtp.example.com ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		session = append(session, line)
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			fmt.Fprint(conn, "250 smtp.example.com\r\n")
+		case line == "DATA":
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			for line != "." {
+				line, _ = r.ReadString('\n')
+				line = strings.TrimSpace(line)
+				session = append(session, line)
+			}
+			fmt.Fprint(conn, "250 queued\r\n")
+		case line == "QUIT":
+			fmt.Fprint(conn, "221 bye\r\n")
+			received <- strings.Join(session, "\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	oldTimeout := mailTimeout
+	defer func() { mailTimeout = oldTimeout }()
+	mailTimeout = 100 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go fakeSMTP(l, false, received)
+	if err := sendMailTimeout(l.Addr().String(), nil, "sd@example.com", []string{"dev@example.com"}, []byte("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Unexpected error sending: %v", err)
+	}
+	session := <-received
+	for _, want := range []string{"MAIL FROM:<sd@example.com>", "RCPT TO:<dev@example.com>", "Subject: hi\n\nbody\n."} {
+		if !strings.Contains(session, want) {
+			t.Errorf("Session %q has no %q", session, want)
+		}
+	}
+
+	// A server that never answers doesn't hold the build
+	go fakeSMTP(l, true, nil)
+	start := time.Now()
+	if err := sendMailTimeout(l.Addr().String(), nil, "sd@example.com", []string{"dev@example.com"}, nil); err == nil {
+		t.Errorf("sendMailTimeout() sent to a server that didn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sendMailTimeout() gave up after %v, want %v", elapsed, mailTimeout)
+	}
+}
+
+func TestSendPostTransport(t *testing.T) {
+	oldTransport := screwdriver.Transport
+	defer func() { screwdriver.Transport = oldTransport }()
+	var posted string
+	screwdriver.Transport = roundTripper(func(req *http.Request) (*http.Response, error) {
+		posted = req.URL.String()
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	})
+
+	n := screwdriver.Notification{Type: screwdriver.NotifyWebhook, URL: "https://hooks.example.com/sd"}
+	if err := (Notifier{}).Send(n, testSummary); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if posted != n.URL {
+		t.Errorf("Posted to %q through the launcher transport, want %q", posted, n.URL)
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,103 @@
+// Package packages installs the build toolchains a job declares, as Habitat packages
+package packages
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var execCommand = exec.Command
+
+// Package is a Habitat package, pinned to a version and a release when they are set
+type Package struct {
+	Origin  string
+	Name    string
+	Version string
+	Release string
+}
+
+// Ident is the Habitat identifier of the package, e.g. "core/node/10.16.0"
+func (p Package) Ident() string {
+	parts := []string{p.Origin, p.Name}
+	if p.Version != "" {
+		parts = append(parts, p.Version)
+	}
+	if p.Release != "" {
+		parts = append(parts, p.Release)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Parse reads a comma separated list of Habitat identifiers like "core/node/10.16.0, core/git"
+func Parse(list string) ([]Package, error) {
+	var pkgs []Package
+	for _, ident := range strings.Split(list, ",") {
+		ident = strings.TrimSpace(ident)
+		if ident == "" {
+			continue
+		}
+		parts := strings.Split(ident, "/")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("Invalid package %q: must be origin/name[/version[/release]]", ident)
+		}
+		for _, part := range parts {
+			if part == "" {
+				return nil, fmt.Errorf("Invalid package %q: must be origin/name[/version[/release]]", ident)
+			}
+		}
+
+		p := Package{Origin: parts[0], Name: parts[1]}
+		if len(parts) > 2 {
+			p.Version = parts[2]
+		}
+		if len(parts) > 3 {
+			p.Release = parts[3]
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+// installedPath is where the package is installed, an error when it isn't
+func installedPath(p Package) (string, error) {
+	out, err := execCommand("hab", "pkg", "path", p.Ident()).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Install installs the packages that aren't in the local Habitat store yet, so repeated builds
+// don't download them again, and returns their bin directories in the order of pkgs.
+// The output of Habitat goes to out.
+func Install(pkgs []Package, out io.Writer) ([]string, error) {
+	var binDirs []string
+	for _, p := range pkgs {
+		if p.Version == "" {
+			log.Printf("WARN: Package %s has no version, the latest one is used", p.Ident())
+		}
+
+		dir, err := installedPath(p)
+		if err != nil {
+			log.Printf("Installing package %s", p.Ident())
+			cmd := execCommand("hab", "pkg", "install", p.Ident())
+			cmd.Stdout = out
+			cmd.Stderr = out
+			if err := cmd.Run(); err != nil {
+				return nil, fmt.Errorf("Installing package %s: %v", p.Ident(), err)
+			}
+			if dir, err = installedPath(p); err != nil {
+				return nil, fmt.Errorf("Finding installed package %s: %v", p.Ident(), err)
+			}
+		} else {
+			log.Printf("Using installed package %s from %s", p.Ident(), dir)
+		}
+
+		binDirs = append(binDirs, filepath.Join(dir, "bin"))
+	}
+	return binDirs, nil
+}
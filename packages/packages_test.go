@@ -0,0 +1,136 @@
+package packages
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeHab runs TestHelperProcess instead of hab, keeping the installed packages as files of dir
+func fakeHab(dir string, commands *[]string) func() {
+	oldExecCommand := execCommand
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		*commands = append(*commands, command+" "+strings.Join(args, " "))
+		cs := []string{"-test.run=TestHelperProcess", "--", command}
+		cs = append(cs, args...)
+		cmd := exec.Command(os.Args[0], cs...)
+		cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1", "FAKE_HAB_DIR=" + dir}
+		return cmd
+	}
+	return func() { execCommand = oldExecCommand }
+}
+
+func TestHelperProcess(*testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args[:]
+	for i, val := range os.Args { // Should become something like ["hab", "pkg", "path", "core/git"]
+		args = os.Args[i:]
+		if val == "--" {
+			args = args[1:]
+			break
+		}
+	}
+	if len(args) != 4 || args[0] != "hab" || args[1] != "pkg" {
+		os.Exit(2)
+	}
+
+	ident := args[3]
+	marker := filepath.Join(os.Getenv("FAKE_HAB_DIR"), strings.Replace(ident, "/", "-", -1))
+	switch args[2] {
+	case "install":
+		if strings.HasPrefix(ident, "missing/") {
+			fmt.Println("Package not found")
+			os.Exit(1)
+		}
+		ioutil.WriteFile(marker, nil, 0644)
+	case "path":
+		if _, err := os.Stat(marker); err != nil {
+			os.Exit(1)
+		}
+		fmt.Println("/hab/pkgs/" + ident + "/20190101000000")
+	}
+	os.Exit(0)
+}
+
+func TestParse(t *testing.T) {
+	pkgs, err := Parse("core/node/10.16.0, core/git,, core/jdk8/8.192.0/20190115162852")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing packages: %v", err)
+	}
+	want := []Package{
+		{Origin: "core", Name: "node", Version: "10.16.0"},
+		{Origin: "core", Name: "git"},
+		{Origin: "core", Name: "jdk8", Version: "8.192.0", Release: "20190115162852"},
+	}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("Parse() = %+v, want %+v", pkgs, want)
+	}
+	if got := want[2].Ident(); got != "core/jdk8/8.192.0/20190115162852" {
+		t.Errorf("Ident() = %q", got)
+	}
+
+	for _, list := range []string{"node", "core/node/1/2/3", "core//1.0"} {
+		if _, err := Parse(list); err == nil {
+			t.Errorf("Parse(%q) should have failed", list)
+		}
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hab")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "core-git"), nil, 0644)
+
+	var commands []string
+	defer fakeHab(dir, &commands)()
+
+	pkgs := []Package{{Origin: "core", Name: "node", Version: "10.16.0"}, {Origin: "core", Name: "git"}}
+	binDirs, err := Install(pkgs, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Unexpected error installing packages: %v", err)
+	}
+
+	wantDirs := []string{"/hab/pkgs/core/node/10.16.0/20190101000000/bin", "/hab/pkgs/core/git/20190101000000/bin"}
+	if !reflect.DeepEqual(binDirs, wantDirs) {
+		t.Errorf("Bin directories = %q, want %q", binDirs, wantDirs)
+	}
+	wantCommands := []string{
+		"hab pkg path core/node/10.16.0",
+		"hab pkg install core/node/10.16.0",
+		"hab pkg path core/node/10.16.0",
+		"hab pkg path core/git",
+	}
+	if !reflect.DeepEqual(commands, wantCommands) {
+		t.Errorf("Commands = %q, want %q", commands, wantCommands)
+	}
+
+	// The second build finds everything installed
+	commands = nil
+	if _, err := Install(pkgs, ioutil.Discard); err != nil {
+		t.Fatalf("Unexpected error installing packages: %v", err)
+	}
+	if want := []string{"hab pkg path core/node/10.16.0", "hab pkg path core/git"}; !reflect.DeepEqual(commands, want) {
+		t.Errorf("Commands = %q, want only lookups %q", commands, want)
+	}
+}
+
+func TestInstallError(t *testing.T) {
+	var commands []string
+	defer fakeHab(os.TempDir(), &commands)()
+
+	_, err := Install([]Package{{Origin: "missing", Name: "tool", Version: "1.0"}}, ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "Installing package missing/tool/1.0") {
+		t.Errorf("Install() error = %v, want the failed install", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var unsafeParamChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// eventParameters reads the parameters given when the event was started, kept in its meta as
+// {"parameters": {"name": {"value": "..."}}}
+func eventParameters(meta map[string]interface{}) (map[string]string, error) {
+	raw, ok := meta["parameters"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	given := map[string]string{}
+	for name, v := range raw {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = m["value"]
+		}
+		switch value := v.(type) {
+		case string:
+			given[name] = value
+		case float64, bool:
+			given[name] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("Parameter %q must be a single value, got %v", name, v)
+		}
+	}
+	return given, nil
+}
+
+// resolveParameters checks the given parameters against the ones the job declares and fills in
+// the defaults of the others
+func resolveParameters(jobName string, declared map[string]screwdriver.ParameterDef, given map[string]string) (map[string]string, error) {
+	var unknown []string
+	for name := range given {
+		if _, ok := declared[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("Job %s does not declare the parameters %s", jobName, strings.Join(unknown, ", "))
+	}
+
+	params := map[string]string{}
+	for name, def := range declared {
+		value, ok := given[name]
+		if !ok {
+			value = def.Value
+		}
+		if len(def.Choices) > 0 && !contains(def.Choices, value) {
+			return nil, fmt.Errorf("Parameter %s is %q, must be one of %s", name, value, strings.Join(def.Choices, ", "))
+		}
+		params[name] = value
+	}
+	return params, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parameterEnv names the parameters SD_PARAM_<NAME> for the steps, e.g. SD_PARAM_DEPLOY_ENV
+// for "deploy-env"
+func parameterEnv(params map[string]string) map[string]string {
+	env := map[string]string{}
+	for name, value := range params {
+		env["SD_PARAM_"+unsafeParamChars.ReplaceAllString(strings.ToUpper(name), "_")] = value
+	}
+	return env
+}
+
+// parameterMeta is how the parameters appear in the build meta, the way the UI shows them
+func parameterMeta(params map[string]string) map[string]interface{} {
+	values := map[string]interface{}{}
+	for name, value := range params {
+		values[name] = map[string]interface{}{"value": value}
+	}
+	return map[string]interface{}{"parameters": values}
+}
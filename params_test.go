@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var testParameterDefs = map[string]screwdriver.ParameterDef{
+	"deploy-env": {Value: "staging", Choices: []string{"staging", "production"}},
+	"dry_run":    {Value: "true"},
+	"version":    {Value: ""},
+}
+
+func TestEventParameters(t *testing.T) {
+	meta := map[string]interface{}{
+		"parameters": map[string]interface{}{
+			"deploy-env": map[string]interface{}{"value": "production"},
+			"dry_run":    false,
+			"version":    "1.2.3",
+		},
+	}
+	given, err := eventParameters(meta)
+	if err != nil {
+		t.Fatalf("Unexpected error reading the parameters: %v", err)
+	}
+	want := map[string]string{"deploy-env": "production", "dry_run": "false", "version": "1.2.3"}
+	if !reflect.DeepEqual(given, want) {
+		t.Errorf("eventParameters() = %v, want %v", given, want)
+	}
+
+	if given, err := eventParameters(map[string]interface{}{"foo": "bar"}); err != nil || len(given) != 0 {
+		t.Errorf("eventParameters() = %v, %v, want no parameters", given, err)
+	}
+	list := map[string]interface{}{"parameters": map[string]interface{}{"env": []interface{}{"a", "b"}}}
+	if _, err := eventParameters(list); err == nil {
+		t.Errorf("Expected an error for a list of values")
+	}
+}
+
+func TestResolveParameters(t *testing.T) {
+	params, err := resolveParameters("main", testParameterDefs, map[string]string{"version": "1.2.3"})
+	if err != nil {
+		t.Fatalf("Unexpected error resolving the parameters: %v", err)
+	}
+	want := map[string]string{"deploy-env": "staging", "dry_run": "true", "version": "1.2.3"}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("resolveParameters() = %v, want %v", params, want)
+	}
+
+	tests := map[string]map[string]string{
+		"Job main does not declare the parameters color, size":             {"color": "red", "size": "XL"},
+		`Parameter deploy-env is "qa", must be one of staging, production`: {"deploy-env": "qa"},
+	}
+	for want, given := range tests {
+		if _, err := resolveParameters("main", testParameterDefs, given); err == nil || err.Error() != want {
+			t.Errorf("resolveParameters(%v) error = %v, want %q", given, err, want)
+		}
+	}
+}
+
+func TestParameterEnvAndMeta(t *testing.T) {
+	params := map[string]string{"deploy-env": "staging", "dry_run": "true"}
+
+	env := parameterEnv(params)
+	if want := map[string]string{"SD_PARAM_DEPLOY_ENV": "staging", "SD_PARAM_DRY_RUN": "true"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("parameterEnv() = %v, want %v", env, want)
+	}
+
+	meta := parameterMeta(params)
+	want := map[string]interface{}{"parameters": map[string]interface{}{
+		"deploy-env": map[string]interface{}{"value": "staging"},
+		"dry_run":    map[string]interface{}{"value": "true"},
+	}}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("parameterMeta() = %v, want %v", meta, want)
+	}
+}
+
+func TestLaunchParameters(t *testing.T) {
+	oldExecutorRun, oldWriteFile := executorRun, writeFile
+	defer func() { executorRun, writeFile = oldExecutorRun, oldWriteFile }()
+
+	var meta map[string]interface{}
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if strings.HasSuffix(path, "/meta.json") {
+			json.Unmarshal(data, &meta)
+		}
+		return nil
+	}
+	var env []string
+	executorRun = func(path string, e []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		env = e
+		return nil
+	}
+
+	api := mockAPI(t, TestBuildID, TestJobID, 0, "RUNNING")
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) {
+		return screwdriver.Job{ID: TestJobID, Name: "main", Permutations: []screwdriver.JobPermutation{{Parameters: testParameterDefs}}}, nil
+	}
+	api.eventFromID = func(eventID int) (screwdriver.Event, error) {
+		return screwdriver.Event{ID: TestEventID, Meta: map[string]interface{}{
+			"parameters": map[string]interface{}{"deploy-env": map[string]interface{}{"value": "production"}},
+		}}, nil
+	}
+
+	if err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+
+	for _, want := range []string{"SD_PARAM_DEPLOY_ENV=production", "SD_PARAM_DRY_RUN=true", "SD_PARAM_VERSION="} {
+		found := false
+		for _, v := range env {
+			found = found || v == want
+		}
+		if !found {
+			t.Errorf("Step environment has no %s", want)
+		}
+	}
+	parameters, _ := meta["parameters"].(map[string]interface{})
+	if got := parameters["deploy-env"]; !reflect.DeepEqual(got, map[string]interface{}{"value": "production"}) {
+		t.Errorf("meta.parameters.deploy-env = %v, want the given value", got)
+	}
+
+	// Parameters the job doesn't declare fail the build before its steps
+	api.jobFromID = func(jobID int) (screwdriver.Job, error) {
+		return screwdriver.Job{ID: TestJobID, Name: "main"}, nil
+	}
+	env = nil
+	err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "")
+	if err == nil || !strings.Contains(err.Error(), "does not declare the parameters deploy-env") {
+		t.Errorf("launch() error = %v, want the undeclared parameter", err)
+	}
+	if env != nil {
+		t.Errorf("Steps ran with undeclared parameters")
+	}
+}
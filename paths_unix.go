@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// Default locations of the build, as laid out by the executors
+const (
+	defaultWorkspace = "/sd/workspace"
+	defaultEmitter   = "/var/run/sd/emitter"
+	defaultMetaSpace = "/sd/meta"
+	defaultEnvFile   = "/tmp/env"
+)
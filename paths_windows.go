@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+// Default locations of the build on Windows agents
+const (
+	defaultWorkspace = `C:\sd\workspace`
+	defaultEmitter   = `C:\sd\emitter`
+	defaultMetaSpace = `C:\sd\meta`
+	defaultEnvFile   = `C:\sd\env`
+)
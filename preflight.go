@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// runPreflight checks the node can run the build before the steps start
+var runPreflight = false
+
+// preflightMinDisk is the fewest free bytes the workspace needs, 0 for no check
+var preflightMinDisk int64 = 1 << 30
+
+// preflightMaxClockSkew is how far the clock of the node can be from the one of the API
+var preflightMaxClockSkew = time.Minute
+
+// preflightTimeout is how long the API and the store get to answer
+var preflightTimeout = 10 * time.Second
+
+var lookPath = exec.LookPath
+var diskFree = freeDiskSpace
+
+// preflightCheck is the outcome of one check, with what to do about it when it failed
+type preflightCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// preflightReport is what the checks found, added to the meta of the build as "preflight"
+type preflightReport struct {
+	Passed bool             `json:"passed"`
+	Checks []preflightCheck `json:"checks"`
+}
+
+// ErrPreflight means the node can't run the build
+type ErrPreflight struct {
+	Failed []preflightCheck
+}
+
+func (e ErrPreflight) Error() string {
+	var messages []string
+	for _, check := range e.Failed {
+		messages = append(messages, check.Message)
+	}
+	return "Preflight checks failed: " + strings.Join(messages, "; ")
+}
+
+// Err is ErrPreflight with the failed checks, nil when they all passed
+func (r preflightReport) Err() error {
+	var failed []preflightCheck
+	for _, check := range r.Checks {
+		if !check.OK {
+			failed = append(failed, check)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return ErrPreflight{Failed: failed}
+}
+
+func (r *preflightReport) add(name string, err error) {
+	check := preflightCheck{Name: name, OK: err == nil}
+	if err != nil {
+		check.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+	r.Passed = r.Passed && check.OK
+}
+
+// preflight checks the binaries the build needs are installed, the API and the store can be
+// reached, the clock of the node is right and the workspace can be written with enough room
+func preflight(binaries []string, apiURL, storeURL, rootDir string) preflightReport {
+	report := preflightReport{Passed: true}
+	for _, binary := range binaries {
+		report.add("binary:"+binary, checkBinary(binary))
+	}
+	client := &http.Client{Timeout: preflightTimeout, Transport: screwdriver.Transport}
+	date, err := checkReachable(client, "API", apiURL, "SD_API_URL")
+	report.add("api", err)
+	if err == nil {
+		report.add("clock", checkClockSkew(date))
+	}
+	if storeURL != "" {
+		_, err := checkReachable(client, "Store", storeURL, "SD_STORE_URL")
+		report.add("store", err)
+	}
+	report.add("workspace", checkWritable(rootDir))
+	if preflightMinDisk > 0 {
+		report.add("disk", checkDiskSpace(rootDir, preflightMinDisk))
+	}
+	return report
+}
+
+func checkBinary(binary string) error {
+	if _, err := lookPath(binary); err != nil {
+		return fmt.Errorf("%s not found in PATH: install it in the build image", binary)
+	}
+	return nil
+}
+
+// checkReachable requests url, any answer will do. It returns the date the server gave.
+func checkReachable(client *http.Client, name, url, setting string) (time.Time, error) {
+	if url == "" {
+		return time.Time{}, fmt.Errorf("%s URL is empty: set %s", name, setting)
+	}
+	res, err := client.Get(url)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s at %s can't be reached: %v: check the network of the node and %s", name, url, err, setting)
+	}
+	res.Body.Close()
+	date, _ := http.ParseTime(res.Header.Get("Date"))
+	return date, nil
+}
+
+func checkClockSkew(date time.Time) error {
+	if date.IsZero() {
+		return nil
+	}
+	skew := timeNow().Sub(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > preflightMaxClockSkew {
+		return fmt.Errorf("Clock is %v off from the one of the API: sync the clock of the node with NTP", skew.Round(time.Second))
+	}
+	return nil
+}
+
+func checkWritable(dir string) error {
+	if err := mkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("Workspace %s can't be created: %v: check the volume is mounted read-write", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".preflight")
+	if err != nil {
+		return fmt.Errorf("Workspace %s is not writable: %v: check the volume is mounted read-write", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkDiskSpace(dir string, min int64) error {
+	free, err := diskFree(dir)
+	if err != nil {
+		return fmt.Errorf("Free space of %s unknown: %v", dir, err)
+	}
+	if free < min {
+		return fmt.Errorf("Only %d bytes free in %s, the build needs %d: free some space on the node or lower --preflight-min-disk", free, dir, min)
+	}
+	return nil
+}
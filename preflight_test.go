@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func stubPreflight(missing string, free int64) func() {
+	oldLookPath, oldDiskFree, oldTimeNow := lookPath, diskFree, timeNow
+	oldMinDisk, oldMaxSkew := preflightMinDisk, preflightMaxClockSkew
+	lookPath = func(file string) (string, error) {
+		if file == missing {
+			return "", errors.New("executable file not found in $PATH")
+		}
+		return "/usr/bin/" + file, nil
+	}
+	diskFree = func(string) (int64, error) { return free, nil }
+	timeNow = func() time.Time { return preflightNow }
+	preflightMinDisk, preflightMaxClockSkew = 1<<30, time.Minute
+	return func() {
+		lookPath, diskFree, timeNow = oldLookPath, oldDiskFree, oldTimeNow
+		preflightMinDisk, preflightMaxClockSkew = oldMinDisk, oldMaxSkew
+	}
+}
+
+var preflightNow = time.Date(2020, time.March, 2, 10, 0, 0, 0, time.UTC)
+
+// dateServer answers with the date of a clock off by skew
+func dateServer(skew time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", preflightNow.Add(skew).Format(http.TimeFormat))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+}
+
+func TestPreflight(t *testing.T) {
+	defer stubPreflight("", 10<<30)()
+	api, store := dateServer(0), dateServer(0)
+	defer api.Close()
+	defer store.Close()
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	report := preflight([]string{"git", "tar", "/bin/sh"}, api.URL, store.URL, dir)
+	if !report.Passed || report.Err() != nil {
+		t.Fatalf("preflight() failed: %v", report.Err())
+	}
+	var names []string
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+	}
+	if got, want := strings.Join(names, ","), "binary:git,binary:tar,binary:/bin/sh,api,clock,store,workspace,disk"; got != want {
+		t.Errorf("Checked %s, want %s", got, want)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("The workspace check left %d files behind", len(entries))
+	}
+}
+
+func TestPreflightFailures(t *testing.T) {
+	defer stubPreflight("tar", 100<<20)()
+	api := dateServer(10 * time.Minute)
+	defer api.Close()
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	report := preflight([]string{"git", "tar"}, api.URL, "http://127.0.0.1:1", dir)
+	if report.Passed {
+		t.Fatalf("preflight() passed, want it to fail")
+	}
+	err = report.Err()
+	failed := map[string]string{}
+	for _, check := range err.(ErrPreflight).Failed {
+		failed[check.Name] = check.Message
+	}
+	for name, want := range map[string]string{
+		"binary:tar": "tar not found in PATH: install it in the build image",
+		"clock":      "Clock is 10m0s off from the one of the API",
+		"store":      "Store at http://127.0.0.1:1 can't be reached",
+		"disk":       "Only 104857600 bytes free in " + dir + ", the build needs 1073741824",
+	} {
+		if !strings.HasPrefix(failed[name], want) {
+			t.Errorf("Check %s failed with %q, want %q", name, failed[name], want)
+		}
+	}
+	if len(failed) != 4 {
+		t.Errorf("Failed checks %v, want 4 of them", failed)
+	}
+	if !strings.HasPrefix(err.Error(), "Preflight checks failed: tar not found in PATH") {
+		t.Errorf("Error() = %q", err)
+	}
+}
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := freeDiskSpace(os.TempDir())
+	if err != nil || free <= 0 {
+		t.Errorf("freeDiskSpace() = %d, %v, want some free bytes", free, err)
+	}
+}
+
+func TestPreflightStatus(t *testing.T) {
+	defer stubPreflight("git", 10<<30)()
+	oldRunPreflight, oldWriteFile := runPreflight, writeFile
+	defer func() { runPreflight, writeFile = oldRunPreflight, oldWriteFile }()
+	runPreflight = true
+	var meta []byte
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if strings.HasSuffix(path, "/meta.json") {
+			meta = data
+		}
+		return nil
+	}
+	server := dateServer(0)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gotStatus screwdriver.BuildStatus
+	var gotMessage string
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "")
+	api.getAPIURL = func() (string, error) { return server.URL + "/v4/", nil }
+	api.updateBuildStatus = func(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
+		gotStatus, gotMessage = status, statusMessage
+		return nil
+	}
+
+	if err := launchAction(screwdriver.API(api), TestBuildID, dir, TestEmitter, TestMetaSpace, server.URL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launchAction: %v", err)
+	}
+	if gotStatus != screwdriver.Failure || gotMessage != "Preflight checks failed: git not found in PATH: install it in the build image" {
+		t.Errorf("Set status %q (%q), want a failure of the preflight checks", gotStatus, gotMessage)
+	}
+	var written struct {
+		Preflight preflightReport `json:"preflight"`
+	}
+	if err := json.Unmarshal(meta, &written); err != nil || written.Preflight.Passed || len(written.Preflight.Checks) == 0 {
+		t.Errorf("Meta %s, want the report of the failed preflight checks", meta)
+	}
+}
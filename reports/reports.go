@@ -0,0 +1,275 @@
+// Package reports finds the test results and coverage reports a build leaves in its checkout,
+// and summarizes them for the build page
+package reports
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/artifacts"
+)
+
+// DefaultTestResults are the JUnit XML files looked for unless Options.TestResults is set
+var DefaultTestResults = []string{"TEST-*.xml", "junit*.xml", "*.junit.xml"}
+
+// DefaultCoverage are the Cobertura XML and lcov files looked for unless Options.Coverage is set
+var DefaultCoverage = []string{"cobertura-coverage.xml", "coverage.xml", "lcov.info", "*.lcov"}
+
+// Directories never searched for reports
+var skippedDirs = map[string]bool{".git": true, "node_modules": true}
+
+// Options controls where reports are looked for, with artifacts.Match patterns
+type Options struct {
+	TestResults []string
+	Coverage    []string
+}
+
+// Summary adds up the reports found
+type Summary struct {
+	Tests    int
+	Failures int
+	Errors   int
+	Skipped  int
+
+	LinesCovered int
+	LinesTotal   int
+
+	// Files are the reports read, relative to the searched directory with forward slashes
+	Files []string
+}
+
+// Passed is how many tests neither failed nor were skipped
+func (s Summary) Passed() int {
+	return s.Tests - s.Failures - s.Errors - s.Skipped
+}
+
+// Meta returns the build meta the build page renders the summary from, with the results as
+// "passed/total" and the coverage as a percentage of the lines. Both are left out without reports.
+func (s Summary) Meta() map[string]interface{} {
+	tests := map[string]interface{}{}
+	if s.Tests > 0 {
+		tests["results"] = fmt.Sprintf("%d/%d", s.Passed(), s.Tests)
+	}
+	if s.LinesTotal > 0 {
+		tests["coverage"] = strconv.FormatFloat(float64(s.LinesCovered)*100/float64(s.LinesTotal), 'f', 1, 64)
+	}
+	if len(tests) == 0 {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{"tests": tests}
+}
+
+// Collect reads the reports found in dir. A report that can't be parsed is skipped with a warning
+// rather than failing the build.
+func Collect(dir string, options Options) (Summary, error) {
+	if len(options.TestResults) == 0 {
+		options.TestResults = DefaultTestResults
+	}
+	if len(options.Coverage) == 0 {
+		options.Coverage = DefaultCoverage
+	}
+
+	var summary Summary
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != dir && skippedDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		var parse func(string, *Summary) error
+		switch {
+		case artifacts.MatchAny(options.TestResults, rel):
+			parse = parseJUnit
+		case artifacts.MatchAny(options.Coverage, rel) && strings.HasSuffix(rel, ".xml"):
+			parse = parseCobertura
+		case artifacts.MatchAny(options.Coverage, rel):
+			parse = parseLcov
+		default:
+			return nil
+		}
+
+		if err := parse(p, &summary); err != nil {
+			log.Printf("WARN: Skipping report %s: %v", rel, err)
+			return nil
+		}
+		summary.Files = append(summary.Files, rel)
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("Looking for reports in %q: %v", dir, err)
+	}
+
+	return summary, nil
+}
+
+// junitSuite is a <testsuite>, or the <testsuites> wrapping them
+type junitSuite struct {
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+	Cases    []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Failures []struct{} `xml:"failure"`
+	Errors   []struct{} `xml:"error"`
+	Skipped  []struct{} `xml:"skipped"`
+}
+
+// add counts the tests of the suite, from its test cases when it doesn't have the totals
+func (suite junitSuite) add(s *Summary) {
+	if len(suite.Suites) > 0 {
+		for _, child := range suite.Suites {
+			child.add(s)
+		}
+		return
+	}
+	if suite.Tests > 0 {
+		s.Tests += suite.Tests
+		s.Failures += suite.Failures
+		s.Errors += suite.Errors
+		s.Skipped += suite.Skipped
+		return
+	}
+	for _, c := range suite.Cases {
+		s.Tests++
+		switch {
+		case len(c.Errors) > 0:
+			s.Errors++
+		case len(c.Failures) > 0:
+			s.Failures++
+		case len(c.Skipped) > 0:
+			s.Skipped++
+		}
+	}
+}
+
+func parseJUnit(p string, s *Summary) error {
+	var suite junitSuite
+	if err := decodeXML(p, &suite); err != nil {
+		return err
+	}
+	suite.add(s)
+	return nil
+}
+
+type coberturaReport struct {
+	XMLName      xml.Name `xml:"coverage"`
+	LinesCovered int      `xml:"lines-covered,attr"`
+	LinesValid   int      `xml:"lines-valid,attr"`
+}
+
+func parseCobertura(p string, s *Summary) error {
+	var report coberturaReport
+	if err := decodeXML(p, &report); err != nil {
+		return err
+	}
+	if report.LinesValid == 0 {
+		return fmt.Errorf("No lines-valid count in the Cobertura report")
+	}
+	s.LinesCovered += report.LinesCovered
+	s.LinesTotal += report.LinesValid
+	return nil
+}
+
+func decodeXML(p string, v interface{}) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := xml.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("Parsing XML: %v", err)
+	}
+	return nil
+}
+
+// parseLcov adds up the LF (lines found) and LH (lines hit) records of an lcov tracefile
+func parseLcov(p string, s *Summary) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var found, hit int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for prefix, count := range map[string]*int{"LF:": &found, "LH:": &hit} {
+			if !strings.HasPrefix(line, prefix) {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(line, prefix))
+			if err != nil {
+				return fmt.Errorf("Invalid lcov record %q", line)
+			}
+			*count += n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if found == 0 {
+		return fmt.Errorf("No LF records in the lcov report")
+	}
+
+	s.LinesCovered += hit
+	s.LinesTotal += found
+	return nil
+}
+
+// Copy copies the files of a summary from dir to dest, keeping their relative paths
+func Copy(dir, dest string, files []string) error {
+	for _, name := range files {
+		if err := copyFile(filepath.Join(dir, filepath.FromSlash(name)), filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("Copying report %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,141 @@
+package reports
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testJUnit = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="api" tests="4" failures="1" errors="0" skipped="1"></testsuite>
+  <testsuite name="ui">
+    <testcase name="renders"></testcase>
+    <testcase name="clicks"><failure message="boom"/></testcase>
+    <testcase name="loads"><error message="timeout"/></testcase>
+  </testsuite>
+</testsuites>
+`
+
+const testSurefire = `<testsuite name="com.example.AppTest" tests="2" failures="0" errors="0" skipped="0"/>`
+
+const testCobertura = `<?xml version="1.0"?>
+<coverage line-rate="0.75" lines-covered="75" lines-valid="100"></coverage>
+`
+
+const testLcov = `TN:
+SF:src/index.js
+LF:40
+LH:30
+end_of_record
+SF:src/util.js
+LF:60
+LH:45
+end_of_record
+`
+
+func writeReports(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "reports")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatalf("Creating %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("Writing %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestCollect(t *testing.T) {
+	dir := writeReports(t, map[string]string{
+		"reports/junit.xml":                        testJUnit,
+		"target/surefire-reports/TEST-AppTest.xml": testSurefire,
+		"coverage/cobertura-coverage.xml":          testCobertura,
+		"node_modules/pkg/junit.xml":               testJUnit,
+		"broken/junit-broken.xml":                  "<testsuite",
+		"src/main.go":                              "package main",
+	})
+	defer os.RemoveAll(dir)
+
+	summary, err := Collect(dir, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error from Collect: %v", err)
+	}
+
+	want := Summary{
+		Tests:        9,
+		Failures:     2,
+		Errors:       1,
+		Skipped:      1,
+		LinesCovered: 75,
+		LinesTotal:   100,
+		Files:        []string{"coverage/cobertura-coverage.xml", "reports/junit.xml", "target/surefire-reports/TEST-AppTest.xml"},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("Summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestCollectOptions(t *testing.T) {
+	dir := writeReports(t, map[string]string{
+		"out/results.xml":   testSurefire,
+		"out/coverage.info": testLcov,
+		"junit.xml":         testJUnit,
+	})
+	defer os.RemoveAll(dir)
+
+	summary, err := Collect(dir, Options{TestResults: []string{"out/*.xml"}, Coverage: []string{"*.info"}})
+	if err != nil {
+		t.Fatalf("Unexpected error from Collect: %v", err)
+	}
+	if summary.Tests != 2 || summary.LinesCovered != 75 || summary.LinesTotal != 100 {
+		t.Errorf("Summary = %+v, want the configured reports only", summary)
+	}
+}
+
+func TestCollectNoReports(t *testing.T) {
+	dir := writeReports(t, map[string]string{"README.md": "# Nothing to see"})
+	defer os.RemoveAll(dir)
+
+	summary, err := Collect(dir, Options{})
+	if err != nil || len(summary.Files) != 0 {
+		t.Errorf("Collect() = %+v, %v, want no reports", summary, err)
+	}
+	if meta := summary.Meta(); len(meta) != 0 {
+		t.Errorf("Meta() = %v, want nothing without reports", meta)
+	}
+}
+
+func TestSummaryMeta(t *testing.T) {
+	summary := Summary{Tests: 10, Failures: 1, Skipped: 1, LinesCovered: 2, LinesTotal: 3}
+	want := map[string]interface{}{
+		"tests": map[string]interface{}{"results": "8/10", "coverage": "66.7"},
+	}
+	if got := summary.Meta(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Meta() = %v, want %v", got, want)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := writeReports(t, map[string]string{"target/TEST-AppTest.xml": testSurefire})
+	defer os.RemoveAll(dir)
+	dest, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatalf("Creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dest)
+
+	if err := Copy(dir, dest, []string{"target/TEST-AppTest.xml"}); err != nil {
+		t.Fatalf("Unexpected error from Copy: %v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dest, "target", "TEST-AppTest.xml")); err != nil || string(got) != testSurefire {
+		t.Errorf("Copied report = %q, %v, want the original", got, err)
+	}
+}
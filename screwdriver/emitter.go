@@ -1,29 +1,42 @@
 package screwdriver
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Emitter is an io.WriteCloser that knows about CommandDef
 type Emitter interface {
 	StartCmd(cmd CommandDef)
+	// StopCmd tells the emitter the step is done, with the exit code it finished with
+	StopCmd(cmd CommandDef, exitCode int)
 	io.WriteCloser
 	Error() error
 }
 
+// EmitStepEvents adds a start and a stop event for every step to the log lines of the emitter
+// file, for the sidecars that follow the build through it
+var EmitStepEvents = false
+
+// The kinds of step events
+const (
+	StepStartEvent = "stepStart"
+	StepStopEvent  = "stepStop"
+)
+
 type emitter struct {
-	file   *os.File
-	cmd    CommandDef
-	buffer *bytes.Buffer
-	reader io.Reader
-	*io.PipeWriter
-	err error
+	file    *os.File
+	encoder *json.Encoder
+	mu      sync.Mutex
+	cmd     CommandDef
+	partial []byte
+	err     error
 }
 
 type logLine struct {
@@ -32,85 +45,97 @@ type logLine struct {
 	Step    string `json:"s"`
 }
 
+// stepEvent shares the time and step keys of logLine, the "e" key tells them apart
+type stepEvent struct {
+	Time     int64  `json:"t"`
+	Event    string `json:"e"`
+	Step     string `json:"s"`
+	ExitCode *int   `json:"c,omitempty"`
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
 // Error gets the latest error from the emitter
 func (e *emitter) Error() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.err
 }
 
+// encode writes one JSON object per line to the emitter file
+func (e *emitter) encode(v interface{}) {
+	if err := e.encoder.Encode(v); err != nil {
+		e.err = fmt.Errorf("Encoding json: %v", err)
+	}
+}
+
 // StartCmd switches the currently running step for the Emitter
 func (e *emitter) StartCmd(cmd CommandDef) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.cmd = cmd
+	if EmitStepEvents {
+		e.encode(stepEvent{Time: nowMillis(), Event: StepStartEvent, Step: cmd.Name})
+	}
 }
 
-// Returns a single line (without the ending \n) from the input buffered reader
-// Pulled from https://stackoverflow.com/a/12206365
-func readln(r *bufio.Reader) (string, error) {
-	var (
-		isPrefix = true
-		err      error
-		line, ln []byte
-	)
-
-	for isPrefix && err == nil {
-		line, isPrefix, err = r.ReadLine()
-		ln = append(ln, line...)
+// StopCmd records the end of the step when step events are on
+func (e *emitter) StopCmd(cmd CommandDef, exitCode int) {
+	if !EmitStepEvents {
+		return
 	}
-
-	return string(ln), err
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.encode(stepEvent{Time: nowMillis(), Event: StepStopEvent, Step: cmd.Name, ExitCode: &exitCode})
 }
 
-func (e *emitter) processPipe() {
-	var line string
-	var readErr error
-
-	reader := bufio.NewReader(e.reader)
-	encoder := json.NewEncoder(e.file)
-
-	line, readErr = readln(reader)
-
-	for readErr == nil {
-		newLine := logLine{
-			Time:    time.Now().UnixNano() / int64(time.Millisecond),
-			Message: line,
-			Step:    e.cmd.Name,
+// Write writes the complete lines of p as log lines of the running step. An incomplete line
+// waits for the next write, so the events always come between the lines of two steps.
+func (e *emitter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.partial = append(e.partial, p...)
+	for {
+		i := bytes.IndexByte(e.partial, '\n')
+		if i == -1 {
+			break
 		}
-		if err := encoder.Encode(newLine); err != nil {
-			e.err = fmt.Errorf("Encoding json: %v", err)
-		}
-
-		line, readErr = readln(reader)
-	}
-
-	if readErr != nil && readErr.Error() != "EOF" {
-		e.err = fmt.Errorf("Piping log line to emitter: %v", readErr)
+		e.encode(logLine{
+			Time:    nowMillis(),
+			Message: strings.TrimSuffix(string(e.partial[:i]), "\r"),
+			Step:    e.cmd.Name,
+		})
+		e.partial = e.partial[i+1:]
 	}
+	return len(p), nil
+}
 
+// Close closes the emitter file, a last line without a newline is dropped
+func (e *emitter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if err := e.file.Close(); err != nil {
 		e.err = err
+		return err
 	}
+	return nil
 }
 
 // NewEmitter returns an emitter object from an emitter destination path
 func NewEmitter(path string) (Emitter, error) {
-	r, w := io.Pipe()
 	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("Failed opening emitter path %q: %v", path, err)
 	}
 
-	cmd := CommandDef{
-		Name: "sd-setup-launcher",
-	}
-
 	e := &emitter{
-		file:       file,
-		buffer:     bytes.NewBuffer([]byte{}),
-		reader:     r,
-		PipeWriter: w,
-		cmd:        cmd,
+		file:    file,
+		encoder: json.NewEncoder(file),
 	}
-
-	go e.processPipe()
+	// The launcher's own setup is the first step
+	e.StartCmd(CommandDef{Name: "sd-setup-launcher"})
 
 	return e, nil
 }
@@ -2,11 +2,13 @@ package screwdriver
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -99,3 +101,69 @@ func TestEmitter(t *testing.T) {
 		t.Errorf("file does not contain correct number lines. Wanted %v. Got %v", len(tests), line)
 	}
 }
+
+func TestEmitterStepEvents(t *testing.T) {
+	EmitStepEvents = true
+	defer func() { EmitStepEvents = false }()
+
+	tmp, err := ioutil.TempDir("", "emitter")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	emitterpath := path.Join(tmp, "socket")
+	if _, err = os.Create(emitterpath); err != nil {
+		t.Fatalf("Error creating test socket: %v", err)
+	}
+
+	emitter, err := NewEmitter(emitterpath)
+	if err != nil {
+		t.Fatalf("Error creating emitter: %v", err)
+	}
+	fmt.Fprintln(emitter, "setting up")
+	emitter.StopCmd(fakeCmd("sd-setup-launcher"), 0)
+	emitter.StartCmd(fakeCmd("test"))
+	fmt.Fprint(emitter, "npm ")
+	fmt.Fprintln(emitter, "test\r")
+	emitter.StopCmd(fakeCmd("test"), 1)
+	if err := emitter.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the emitter: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(emitterpath)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var got []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Line %q is not JSON: %v", scanner.Text(), err)
+		}
+		if _, ok := line["t"].(float64); !ok {
+			t.Errorf("Line %q has no time", scanner.Text())
+		}
+		switch {
+		case line["e"] == StepStopEvent:
+			got = append(got, fmt.Sprintf("%v %v %v", line["e"], line["s"], line["c"]))
+		case line["e"] != nil:
+			got = append(got, fmt.Sprintf("%v %v", line["e"], line["s"]))
+		default:
+			got = append(got, fmt.Sprintf("%v: %v", line["s"], line["m"]))
+		}
+	}
+
+	want := []string{
+		"stepStart sd-setup-launcher",
+		"sd-setup-launcher: setting up",
+		"stepStop sd-setup-launcher 0",
+		"stepStart test",
+		"test: npm test",
+		"stepStop test 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Emitted %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,187 @@
+package screwdriver
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// maxLineBytes splits the lines longer than that, so a step printing without newlines
+// doesn't keep its whole output in memory
+const maxLineBytes = 64 * 1024
+
+// LogLimits cap the log of each step and of the whole build, 0 for no limit. Past a limit,
+// only one line in SampleEvery goes on, and the last TailLines lines of the step are written
+// once it stops.
+type LogLimits struct {
+	StepLines   int64
+	StepBytes   int64
+	BuildLines  int64
+	BuildBytes  int64
+	SampleEvery int64
+	TailLines   int
+}
+
+// Enabled tells whether any limit is set
+func (l LogLimits) Enabled() bool {
+	return l.StepLines > 0 || l.StepBytes > 0 || l.BuildLines > 0 || l.BuildBytes > 0
+}
+
+type limitingEmitter struct {
+	Emitter
+	limits  LogLimits
+	mu      sync.Mutex
+	step    string
+	partial []byte
+
+	stepLines, stepBytes   int64
+	buildLines, buildBytes int64
+	// The step is truncated once it goes over a limit, dropped counts the lines not written
+	truncated bool
+	dropped   int64
+	tail      []string
+}
+
+// NewLimitingEmitter returns an emitter truncating the log written to e once it goes over
+// limits, with a warning in the log of the step
+func NewLimitingEmitter(e Emitter, limits LogLimits) Emitter {
+	return &limitingEmitter{Emitter: e, limits: limits}
+}
+
+// StartCmd starts counting the log of cmd
+func (l *limitingEmitter) StartCmd(cmd CommandDef) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.step = cmd.Name
+	l.stepLines, l.stepBytes = 0, 0
+	l.truncated, l.dropped, l.tail = false, 0, nil
+	l.Emitter.StartCmd(cmd)
+}
+
+// Write sends the complete lines of p to the wrapped emitter, as long as the limits allow
+func (l *limitingEmitter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i == -1 && len(l.partial) < maxLineBytes {
+			break
+		}
+		if i == -1 || i >= maxLineBytes {
+			i = maxLineBytes - 1
+		}
+		if err := l.line(l.partial[:i+1]); err != nil {
+			return 0, err
+		}
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// over names the limit the log is over, if any
+func (l *limitingEmitter) over() string {
+	switch {
+	case l.limits.StepLines > 0 && l.stepLines > l.limits.StepLines:
+		return fmt.Sprintf("step limit of %d lines", l.limits.StepLines)
+	case l.limits.StepBytes > 0 && l.stepBytes > l.limits.StepBytes:
+		return fmt.Sprintf("step limit of %d bytes", l.limits.StepBytes)
+	case l.limits.BuildLines > 0 && l.buildLines > l.limits.BuildLines:
+		return fmt.Sprintf("build limit of %d lines", l.limits.BuildLines)
+	case l.limits.BuildBytes > 0 && l.buildBytes > l.limits.BuildBytes:
+		return fmt.Sprintf("build limit of %d bytes", l.limits.BuildBytes)
+	}
+	return ""
+}
+
+// line writes a line of the step, or samples it and keeps it for the tail once truncated
+func (l *limitingEmitter) line(line []byte) error {
+	l.stepLines++
+	l.buildLines++
+	l.stepBytes += int64(len(line))
+	l.buildBytes += int64(len(line))
+
+	if !l.truncated {
+		limit := l.over()
+		if limit == "" {
+			_, err := l.Emitter.Write(line)
+			return err
+		}
+		l.truncated = true
+		log.Printf("WARN: Truncating the log of step %s, over the %s", l.step, limit)
+		if _, err := fmt.Fprintf(l.Emitter, "\nWARNING: The log of step %s is over the %s. %s\n", l.step, limit, l.policy()); err != nil {
+			return err
+		}
+	}
+
+	l.dropped++
+	if l.limits.TailLines > 0 {
+		l.tail = append(l.tail, string(line))
+		if len(l.tail) > l.limits.TailLines {
+			l.tail = l.tail[1:]
+		}
+	}
+	if l.limits.SampleEvery > 0 && l.dropped%l.limits.SampleEvery == 0 {
+		_, err := l.Emitter.Write(line)
+		return err
+	}
+	return nil
+}
+
+// policy tells what is shown of a truncated log
+func (l *limitingEmitter) policy() string {
+	var shown []string
+	if l.limits.SampleEvery > 0 {
+		shown = append(shown, fmt.Sprintf("1 line in %d is shown", l.limits.SampleEvery))
+	}
+	if l.limits.TailLines > 0 {
+		shown = append(shown, fmt.Sprintf("the last %d lines are shown when the step ends", l.limits.TailLines))
+	}
+	if len(shown) == 0 {
+		return "The rest is not shown."
+	}
+	return "From now on, " + strings.Join(shown, " and ") + "."
+}
+
+// flush ends the step: what is left of its last line goes through the limits, and the tail of
+// a truncated step is written
+func (l *limitingEmitter) flush() {
+	if len(l.partial) > 0 {
+		l.line(l.partial)
+		l.partial = nil
+	}
+	if !l.truncated {
+		return
+	}
+	fmt.Fprintf(l.Emitter, "\nWARNING: %d lines of step %s were truncated", l.dropped, l.step)
+	if len(l.tail) > 0 {
+		fmt.Fprintf(l.Emitter, ", the last %d are:\n", len(l.tail))
+		for _, line := range l.tail {
+			l.Emitter.Write([]byte(line))
+		}
+		if !strings.HasSuffix(l.tail[len(l.tail)-1], "\n") {
+			l.Emitter.Write([]byte("\n"))
+		}
+	} else {
+		l.Emitter.Write([]byte("\n"))
+	}
+	l.truncated, l.dropped, l.tail = false, 0, nil
+}
+
+// StopCmd writes the end of the log of the step before it stops
+func (l *limitingEmitter) StopCmd(cmd CommandDef, exitCode int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flush()
+	l.Emitter.StopCmd(cmd, exitCode)
+}
+
+// Close writes the end of the log and closes the wrapped emitter
+func (l *limitingEmitter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flush()
+	return l.Emitter.Close()
+}
@@ -0,0 +1,83 @@
+package screwdriver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLimitingEmitter(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewLimitingEmitter(inner, LogLimits{StepLines: 3, SampleEvery: 4, TailLines: 2})
+
+	e.StartCmd(fakeCmd("test"))
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(e, "line %d\n", i)
+	}
+	e.StopCmd(fakeCmd("test"), 0)
+
+	want := "line 1\nline 2\nline 3\n" +
+		"\nWARNING: The log of step test is over the step limit of 3 lines. From now on, 1 line in 4 is shown and the last 2 lines are shown when the step ends.\n" +
+		"line 7\n" +
+		"\nWARNING: 7 lines of step test were truncated, the last 2 are:\n" +
+		"line 9\nline 10\n"
+	if inner.String() != want {
+		t.Errorf("Log = %q, want %q", inner.String(), want)
+	}
+
+	// The next step starts over
+	inner.Reset()
+	e.StartCmd(fakeCmd("next"))
+	fmt.Fprint(e, "short\n")
+	e.StopCmd(fakeCmd("next"), 0)
+	if inner.String() != "short\n" {
+		t.Errorf("Log = %q, want the whole log of the next step", inner.String())
+	}
+}
+
+func TestLimitingEmitterBuildBytes(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewLimitingEmitter(inner, LogLimits{BuildBytes: 11})
+
+	e.StartCmd(fakeCmd("one"))
+	fmt.Fprint(e, "12345\n")
+	e.StopCmd(fakeCmd("one"), 0)
+	e.StartCmd(fakeCmd("two"))
+	fmt.Fprint(e, "6789\nover\n")
+	// The end of a step without a newline counts too
+	fmt.Fprint(e, "partial")
+	e.StopCmd(fakeCmd("two"), 0)
+
+	want := "12345\n6789\n" +
+		"\nWARNING: The log of step two is over the build limit of 11 bytes. The rest is not shown.\n" +
+		"\nWARNING: 2 lines of step two were truncated\n"
+	if inner.String() != want {
+		t.Errorf("Log = %q, want %q", inner.String(), want)
+	}
+	if err := e.Close(); err != nil || !inner.closed {
+		t.Errorf("Close() = %v, want the wrapped emitter closed", err)
+	}
+}
+
+func TestLimitingEmitterLongLine(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewLimitingEmitter(inner, LogLimits{StepLines: 1})
+
+	e.StartCmd(fakeCmd("test"))
+	fmt.Fprint(e, strings.Repeat("x", 3*maxLineBytes))
+	if l := e.(*limitingEmitter); len(l.partial) >= maxLineBytes || l.stepLines != 3 {
+		t.Errorf("Kept %d bytes over %d lines, want the long line split", len(l.partial), l.stepLines)
+	}
+	if inner.Len() > maxLineBytes+200 {
+		t.Errorf("Wrote %d bytes, want only the first line and the warning", inner.Len())
+	}
+}
+
+func TestLogLimitsEnabled(t *testing.T) {
+	if (LogLimits{SampleEvery: 100, TailLines: 100}).Enabled() {
+		t.Errorf("Limits without a maximum should be disabled")
+	}
+	if !(LogLimits{BuildLines: 1}).Enabled() {
+		t.Errorf("Limits with a maximum should be enabled")
+	}
+}
@@ -0,0 +1,167 @@
+package screwdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log lines are stored in pages of LogPageSize lines. The page being filled is sent again
+// every LogFlushInterval so the UI shows the output while the step runs.
+var (
+	LogPageSize      = 1000
+	LogFlushInterval = time.Second
+)
+
+// logBufferSize is how many lines can wait for upload before step output gets blocked
+const logBufferSize = 1000
+
+type storeEmitter struct {
+	Emitter
+	cmd     CommandDef
+	partial []byte
+	lines   chan logLine
+	done    chan struct{}
+	closing sync.Once
+	store   api
+	buildID int
+	err     error
+
+	// The page being filled for the running step
+	step    string
+	page    []logLine
+	pageNum int
+	dirty   bool
+}
+
+// NewStoreEmitter returns an emitter that writes to e and streams the log lines
+// to the Screwdriver Store as they come. Close flushes the remaining lines.
+func NewStoreEmitter(e Emitter, storeURL string, tokens TokenSource, buildID int) Emitter {
+	s := &storeEmitter{
+		Emitter: e,
+		cmd:     CommandDef{Name: "sd-setup-launcher"},
+		lines:   make(chan logLine, logBufferSize),
+		done:    make(chan struct{}),
+		store:   api{storeURL, tokens, &http.Client{Timeout: APITimeout, Transport: Transport}, DefaultRetryPolicy},
+		buildID: buildID,
+	}
+
+	go s.upload()
+
+	return s
+}
+
+// StartCmd switches the currently running step for both emitters
+func (s *storeEmitter) StartCmd(cmd CommandDef) {
+	s.cmd = cmd
+	s.Emitter.StartCmd(cmd)
+}
+
+// Write sends p to the wrapped emitter and queues its lines for the store.
+// It blocks while the store is too far behind.
+func (s *storeEmitter) Write(p []byte) (int, error) {
+	n, err := s.Emitter.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	// Lines are tagged with the step running when they are written, an incomplete
+	// line waits for the next write
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i == -1 {
+			break
+		}
+		s.lines <- logLine{
+			Time:    time.Now().UnixNano() / int64(time.Millisecond),
+			Message: strings.TrimSuffix(string(s.partial[:i]), "\r"),
+			Step:    s.cmd.Name,
+		}
+		s.partial = s.partial[i+1:]
+	}
+	return n, nil
+}
+
+// Close waits for the queued lines to be sent, then closes the wrapped emitter
+func (s *storeEmitter) Close() error {
+	s.closing.Do(func() {
+		close(s.lines)
+	})
+	<-s.done
+	return s.Emitter.Close()
+}
+
+// Error gets the latest error from either emitter
+func (s *storeEmitter) Error() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Emitter.Error()
+}
+
+func (s *storeEmitter) upload() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(LogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.flush()
+				return
+			}
+
+			if line.Step != s.step {
+				s.flush()
+				s.step, s.page, s.pageNum = line.Step, nil, 0
+			}
+			s.page = append(s.page, line)
+			s.dirty = true
+
+			if len(s.page) >= LogPageSize {
+				s.flush()
+				s.page = nil
+				s.pageNum++
+			}
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// flush sends the page being filled to the store if it changed since the last upload
+func (s *storeEmitter) flush() {
+	if !s.dirty {
+		return
+	}
+	s.dirty = false
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	for _, line := range s.page {
+		if err := encoder.Encode(line); err != nil {
+			s.err = fmt.Errorf("Encoding json: %v", err)
+			return
+		}
+	}
+
+	u, err := url.Parse(fmt.Sprintf("%s/v1/builds/%d/%s/log.%d", s.store.baseURL, s.buildID, url.PathEscape(s.step), s.pageNum))
+	if err != nil {
+		s.err = fmt.Errorf("Creating url: %v", err)
+		return
+	}
+
+	if _, err := s.store.put(u, "application/x-ndjson", buf); err != nil {
+		log.Printf("WARNING: failed uploading logs of step %s: %v", s.step, err)
+		s.err = fmt.Errorf("Uploading logs of step %s: %v", s.step, err)
+	}
+}
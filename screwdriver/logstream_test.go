@@ -0,0 +1,168 @@
+package screwdriver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEmitter keeps what was written to it
+type fakeEmitter struct {
+	bytes.Buffer
+	steps  []string
+	closed bool
+}
+
+func (e *fakeEmitter) StartCmd(cmd CommandDef) {
+	e.steps = append(e.steps, cmd.Name)
+}
+
+func (e *fakeEmitter) StopCmd(cmd CommandDef, exitCode int) {}
+
+func (e *fakeEmitter) Close() error {
+	e.closed = true
+	return nil
+}
+
+func (e *fakeEmitter) Error() error {
+	return nil
+}
+
+// fakeStore records the messages of the log pages it receives, by path
+func fakeStore(t *testing.T) (*httptest.Server, map[string][]string, *sync.Mutex) {
+	pages := map[string][]string{}
+	mu := &sync.Mutex{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			t.Errorf("Store got a %s request, want PUT", r.Method)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer faketoken" {
+			t.Errorf("Authorization header = %q, want %q", got, "Bearer faketoken")
+		}
+
+		var messages []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var line logLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Errorf("Unparseable log line %q: %v", scanner.Text(), err)
+			}
+			messages = append(messages, line.Step+":"+line.Message)
+		}
+
+		mu.Lock()
+		pages[r.URL.Path] = messages
+		mu.Unlock()
+		fmt.Fprint(w, "{}")
+	}))
+	return server, pages, mu
+}
+
+func TestStoreEmitter(t *testing.T) {
+	oldPageSize, oldFlushInterval := LogPageSize, LogFlushInterval
+	defer func() { LogPageSize, LogFlushInterval = oldPageSize, oldFlushInterval }()
+	LogPageSize = 2
+	LogFlushInterval = time.Hour
+
+	server, pages, _ := fakeStore(t)
+	defer server.Close()
+
+	inner := &fakeEmitter{}
+	e := NewStoreEmitter(inner, server.URL, StaticToken("faketoken"), 1234)
+
+	fmt.Fprintln(e, "setup")
+	e.StartCmd(fakeCmd("install"))
+	fmt.Fprintln(e, "line1")
+	fmt.Fprintln(e, "line2")
+	fmt.Fprintln(e, "line3")
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+	if err := e.Error(); err != nil {
+		t.Errorf("Unexpected emitter error: %v", err)
+	}
+
+	want := map[string][]string{
+		"/v1/builds/1234/sd-setup-launcher/log.0": {"sd-setup-launcher:setup"},
+		"/v1/builds/1234/install/log.0":           {"install:line1", "install:line2"},
+		"/v1/builds/1234/install/log.1":           {"install:line3"},
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("Store pages = %v, want %v", pages, want)
+	}
+
+	if inner.String() != "setup\nline1\nline2\nline3\n" {
+		t.Errorf("Wrapped emitter got %q", inner.String())
+	}
+	if !reflect.DeepEqual(inner.steps, []string{"install"}) {
+		t.Errorf("Wrapped emitter steps = %v, want [install]", inner.steps)
+	}
+	if !inner.closed {
+		t.Errorf("Wrapped emitter was not closed")
+	}
+}
+
+func TestStoreEmitterFlushesWhileRunning(t *testing.T) {
+	oldFlushInterval := LogFlushInterval
+	defer func() { LogFlushInterval = oldFlushInterval }()
+	LogFlushInterval = 10 * time.Millisecond
+
+	server, pages, mu := fakeStore(t)
+	defer server.Close()
+
+	e := NewStoreEmitter(&fakeEmitter{}, server.URL, StaticToken("faketoken"), 1234)
+	defer e.Close()
+
+	e.StartCmd(fakeCmd("test"))
+	fmt.Fprintln(e, "still running")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		got := pages["/v1/builds/1234/test/log.0"]
+		mu.Unlock()
+		if reflect.DeepEqual(got, []string{"test:still running"}) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Log line was not sent before the step ended, pages = %v", pages)
+}
+
+func TestStoreEmitterUploadError(t *testing.T) {
+	oldSleep := sleep
+	defer func() { sleep = oldSleep }()
+	sleep = func(time.Duration) {}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		fmt.Fprint(w, `{"statusCode": 500, "error": "Internal Server Error", "message": "store is down"}`)
+	}))
+	defer server.Close()
+
+	inner := &fakeEmitter{}
+	e := NewStoreEmitter(inner, server.URL, StaticToken("faketoken"), 1234)
+	fmt.Fprintln(e, "lost line")
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+	if e.Error() == nil {
+		t.Errorf("Expected an error when the store rejects the logs")
+	}
+
+	// The local log is still complete
+	if got, _ := ioutil.ReadAll(&inner.Buffer); string(got) != "lost line\n" {
+		t.Errorf("Wrapped emitter got %q", got)
+	}
+}
@@ -0,0 +1,227 @@
+package screwdriver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// SecretMask replaces secret values in the build logs
+const SecretMask = "****"
+
+// minSplit is the shortest start of a secret a line must end with for the secret to be looked
+// for across that line and the next one
+const minSplit = 4
+
+// minMasked is the shortest secret value masked. Shorter ones, like "true" or a "}" line of a
+// JSON secret, would hide every occurrence of common text in the whole log.
+const minMasked = 6
+
+// minEncoded is the shortest part of a base64 encoding masked, shorter ones would hide
+// unrelated text
+const minEncoded = 8
+
+type maskingEmitter struct {
+	Emitter
+	replacer *strings.Replacer
+	// splits are the starts of the values, by the rest of them. A line ending with one of those
+	// is held until the next line tells whether it goes on with the rest.
+	splits map[string][]string
+	// grams are the last minSplit bytes of the starts in splits, most lines can't end with any
+	grams    map[string]bool
+	maxSplit int
+	partial  []byte
+	held     []byte
+}
+
+// NewMaskingEmitter returns an emitter that hides the secret values from the lines written to e.
+// Each line of a multi-line secret, like a private key, is masked on its own. The base64 and URL
+// encodings of the secrets are masked too, even inside the encoding of a longer text like
+// "user:secret", and so are the secrets cut in two by a line break. Values shorter than
+// minMasked are left alone.
+func NewMaskingEmitter(e Emitter, secrets []string) Emitter {
+	seen := map[string]bool{}
+	var values []string
+	add := func(v string) {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	short := 0
+	for _, secret := range secrets {
+		for _, line := range strings.Split(secret, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if len(line) < minMasked {
+				short++
+				continue
+			}
+			for _, v := range encodings(line) {
+				add(v)
+			}
+		}
+	}
+	if short > 0 {
+		log.Printf("WARN: Not masking %d secret values shorter than %d bytes in the logs", short, minMasked)
+	}
+	// Longer values first, so a secret containing another one is fully masked
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	m := &maskingEmitter{
+		Emitter: e,
+		splits:  map[string][]string{},
+		grams:   map[string]bool{},
+	}
+	var oldnew []string
+	for _, v := range values {
+		oldnew = append(oldnew, v, SecretMask)
+		for i := minSplit; i < len(v); i++ {
+			m.splits[v[:i]] = append(m.splits[v[:i]], v[i:])
+			m.grams[v[i-minSplit:i]] = true
+		}
+		if len(v)-1 > m.maxSplit {
+			m.maxSplit = len(v) - 1
+		}
+	}
+	m.replacer = strings.NewReplacer(oldnew...)
+	return m
+}
+
+// encodings are the forms a secret can take in the log: itself, base64 and URL encoded
+func encodings(secret string) []string {
+	forms := []string{secret, url.QueryEscape(secret), url.PathEscape(secret)}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		forms = append(forms, encoding.EncodeToString([]byte(secret)))
+		// The secret starting at any byte of a longer encoded text, its encoding is the part
+		// that doesn't depend on the bytes around it
+		for offset := 0; offset < 3; offset++ {
+			raw := encoding.WithPadding(base64.NoPadding)
+			encoded := raw.EncodeToString(append(make([]byte, offset), secret...))
+			bits := 8 * (offset + len(secret))
+			start, end := (8*offset+5)/6, bits/6
+			if part := encoded[start:end]; len(part) >= minEncoded {
+				forms = append(forms, part)
+			}
+		}
+	}
+	return forms
+}
+
+// Write masks the complete lines of p and sends them to the wrapped emitter.
+// An incomplete line waits for the next write so a secret split across writes is still found.
+func (m *maskingEmitter) Write(p []byte) (int, error) {
+	m.partial = append(m.partial, p...)
+	end := bytes.LastIndexByte(m.partial, '\n') + 1
+	// The lines in between a held one and one ending with the start of a value are masked at once
+	start := 0
+	for pos := 0; pos < end; {
+		next := pos + bytes.IndexByte(m.partial[pos:end], '\n') + 1
+		if m.held != nil || m.endsWithSplit(bytes.TrimRight(m.partial[pos:next], "\r\n")) {
+			if err := m.write(m.partial[start:pos]); err != nil {
+				return 0, err
+			}
+			if err := m.line(m.partial[pos:next]); err != nil {
+				return 0, err
+			}
+			start = next
+		}
+		pos = next
+	}
+	if err := m.write(m.partial[start:end]); err != nil {
+		return 0, err
+	}
+	m.partial = append(m.partial[:0], m.partial[end:]...)
+	return len(p), nil
+}
+
+// line masks a complete line, along with the line before it when it was held
+func (m *maskingEmitter) line(line []byte) error {
+	if m.held != nil {
+		held := m.held
+		m.held = nil
+		text := bytes.TrimRight(held, "\r\n")
+		if n, rest := m.splitAt(text, line); n > 0 {
+			masked := m.replacer.Replace(string(text[:len(text)-n])) + SecretMask + string(held[len(text):])
+			if _, err := m.Emitter.Write([]byte(masked)); err != nil {
+				return err
+			}
+			line = append([]byte(SecretMask), line[rest:]...)
+		} else if err := m.write(held); err != nil {
+			return err
+		}
+	}
+	if m.endsWithSplit(bytes.TrimRight(line, "\r\n")) {
+		m.held = append([]byte(nil), line...)
+		return nil
+	}
+	return m.write(line)
+}
+
+// splitAt finds a value text ends with the start of and line starts with the rest of. It
+// returns the lengths of the start and of the rest, zero when there is none.
+func (m *maskingEmitter) splitAt(text, line []byte) (int, int) {
+	for n := m.maxSplit; n >= minSplit; n-- {
+		if n > len(text) {
+			continue
+		}
+		for _, rest := range m.splits[string(text[len(text)-n:])] {
+			if bytes.HasPrefix(line, []byte(rest)) {
+				return n, len(rest)
+			}
+		}
+	}
+	return 0, 0
+}
+
+// endsWithSplit tells whether text ends with the start of a value
+func (m *maskingEmitter) endsWithSplit(text []byte) bool {
+	if len(text) < minSplit || !m.grams[string(text[len(text)-minSplit:])] {
+		return false
+	}
+	for n := minSplit; n <= m.maxSplit && n <= len(text); n++ {
+		if _, ok := m.splits[string(text[len(text)-n:])]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *maskingEmitter) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	_, err := m.Emitter.Write([]byte(m.replacer.Replace(string(p))))
+	return err
+}
+
+// flush sends the held line and what is left of the last line
+func (m *maskingEmitter) flush() {
+	if m.held != nil {
+		m.write(m.held)
+		m.held = nil
+	}
+	if len(m.partial) > 0 {
+		m.write(m.partial)
+		m.partial = nil
+	}
+}
+
+// StopCmd sends what is left of the last line of the step before it stops
+func (m *maskingEmitter) StopCmd(cmd CommandDef, exitCode int) {
+	m.flush()
+	m.Emitter.StopCmd(cmd, exitCode)
+}
+
+// Close sends what is left of the last line and closes the wrapped emitter
+func (m *maskingEmitter) Close() error {
+	m.flush()
+	return m.Emitter.Close()
+}
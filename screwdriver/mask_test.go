@@ -0,0 +1,220 @@
+package screwdriver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMaskingEmitter(t *testing.T) {
+	inner := &fakeEmitter{}
+	secrets := []string{
+		"hunter2",
+		"hunter2hunter2",
+		"",
+		"-----BEGIN KEY-----\nc2VjcmV0\n-----END KEY-----\n",
+	}
+	e := NewMaskingEmitter(inner, secrets)
+
+	fmt.Fprintln(e, "password is hunter2")
+	fmt.Fprintln(e, "doubled hunter2hunter2!")
+	// A secret split over two writes
+	fmt.Fprint(e, "split hun")
+	fmt.Fprintln(e, "ter2 value")
+	fmt.Fprintln(e, "c2VjcmV0")
+	fmt.Fprintln(e, "nothing to hide")
+	fmt.Fprint(e, "no newline hunter2")
+
+	e.StartCmd(fakeCmd("test"))
+	if err := e.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+
+	want := "password is ****\n" +
+		"doubled ****!\n" +
+		"split **** value\n" +
+		"****\n" +
+		"nothing to hide\n" +
+		"no newline ****"
+	if inner.String() != want {
+		t.Errorf("Masked log = %q, want %q", inner.String(), want)
+	}
+	if len(inner.steps) != 1 || inner.steps[0] != "test" {
+		t.Errorf("Wrapped emitter steps = %v, want [test]", inner.steps)
+	}
+	if !inner.closed {
+		t.Errorf("Wrapped emitter was not closed")
+	}
+}
+
+func TestMaskingEmitterStopCmd(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewMaskingEmitter(inner, []string{"hunter2"})
+
+	fmt.Fprint(e, "progress hunter2")
+	e.StopCmd(fakeCmd("test"), 0)
+	if want := "progress ****"; inner.String() != want {
+		t.Errorf("Masked log = %q at the end of the step, want %q", inner.String(), want)
+	}
+}
+
+func TestMaskingEmitterShortValues(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewMaskingEmitter(inner, []string{"1", "true", "{\n  \"token\": \"s3cr3t-t0ken\"\n}"})
+
+	fmt.Fprintln(e, "step 1 of 2: true")
+	fmt.Fprintln(e, "{ \"token\": \"s3cr3t-t0ken\" }")
+	e.Close()
+
+	want := "step 1 of 2: true\n" +
+		"{ **** }\n"
+	if inner.String() != want {
+		t.Errorf("Masked log = %q, want %q", inner.String(), want)
+	}
+}
+
+func TestMaskingEmitterEncoded(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewMaskingEmitter(inner, []string{"s3cr3t/t0ken+value", "short"})
+
+	secret := []byte("s3cr3t/t0ken+value")
+	fmt.Fprintln(e, "std", base64.StdEncoding.EncodeToString(secret))
+	fmt.Fprintln(e, "url", base64.URLEncoding.EncodeToString(secret))
+	fmt.Fprintln(e, "query", url.QueryEscape(string(secret)))
+	// Basic auth encodes the secret along with the user, at any offset
+	for _, user := range []string{"a:", "ab:", "abc:"} {
+		fmt.Fprintln(e, "Authorization: Basic", base64.StdEncoding.EncodeToString([]byte(user+string(secret))))
+	}
+	// Too short to mask in an encoding without hiding other text
+	fmt.Fprintln(e, "brief", base64.StdEncoding.EncodeToString([]byte("x:short")))
+	e.Close()
+
+	for _, line := range strings.Split(strings.TrimSpace(inner.String()), "\n") {
+		if !strings.Contains(line, SecretMask) && !strings.HasPrefix(line, "brief") {
+			t.Errorf("Line %q was not masked", line)
+		}
+	}
+	if !strings.Contains(inner.String(), "brief eDpzaG9ydA==") {
+		t.Errorf("Masked log = %q, want the encoding of the short secret left alone", inner.String())
+	}
+}
+
+func TestMaskingEmitterSplitLines(t *testing.T) {
+	inner := &fakeEmitter{}
+	e := NewMaskingEmitter(inner, []string{"hunter2hunter2"})
+
+	fmt.Fprint(e, "token: hunter2h\r\n")
+	fmt.Fprint(e, "unter2 and more\n")
+	// Lines ending like a secret go on the same when the next one doesn't finish it
+	fmt.Fprint(e, "hunt\n")
+	fmt.Fprint(e, "over\n")
+	fmt.Fprint(e, "last hunter\n")
+	e.StopCmd(fakeCmd("test"), 0)
+
+	want := "token: ****\r\n" +
+		"**** and more\n" +
+		"hunt\n" +
+		"over\n" +
+		"last hunter\n"
+	if inner.String() != want {
+		t.Errorf("Masked log = %q, want %q", inner.String(), want)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	forms := encodings("a secret/value")
+	for _, want := range []string{"a secret/value", "a+secret%2Fvalue", "a%20secret%2Fvalue", "YSBzZWNyZXQvdmFsdWU=", "YSBzZWNyZXQvdmFsdW"} {
+		found := false
+		for _, form := range forms {
+			found = found || form == want
+		}
+		if !found {
+			t.Errorf("encodings() = %q, want %q among them", forms, want)
+		}
+	}
+}
+
+// discardEmitter drops the log, so benchmarks only measure the emitters wrapping it
+type discardEmitter struct {
+	*fakeEmitter
+}
+
+func (discardEmitter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// exactEmitter only replaces the secrets as they are, the baseline of the masking emitter
+type exactEmitter struct {
+	discardEmitter
+	replacer *strings.Replacer
+}
+
+func (e exactEmitter) Write(p []byte) (int, error) {
+	return e.discardEmitter.Write([]byte(e.replacer.Replace(string(p))))
+}
+
+func newExactEmitter(secrets []string) Emitter {
+	var oldnew []string
+	for _, secret := range secrets {
+		oldnew = append(oldnew, secret, SecretMask)
+	}
+	return exactEmitter{discardEmitter{&fakeEmitter{}}, strings.NewReplacer(oldnew...)}
+}
+
+func benchmarkLog() []byte {
+	var log bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&log, "npm http fetch GET 200 https://registry.npmjs.org/package-%d/-/package-%d-1.0.%d.tgz 15ms (cache hit)\n", i, i, i)
+	}
+	return log.Bytes()
+}
+
+// benchmarkLongLines is a log of minified bundles printed on a single line each
+func benchmarkLongLines() []byte {
+	var log bytes.Buffer
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 2000; j++ {
+			fmt.Fprintf(&log, "var a%d=function(e){return e.ghp_%d&&tok(%d)};", j, j, i*j)
+		}
+		log.WriteString("\n")
+	}
+	return log.Bytes()
+}
+
+func benchmarkSecrets(n int) []string {
+	var secrets []string
+	for i := 0; i < n; i++ {
+		secrets = append(secrets, fmt.Sprintf("ghp_%032d", i*7919))
+	}
+	return secrets
+}
+
+func BenchmarkMaskingEmitter(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		log     []byte
+		secrets []string
+	}{
+		{"npm", benchmarkLog(), benchmarkSecrets(20)},
+		{"long lines many secrets", benchmarkLongLines(), benchmarkSecrets(500)},
+	} {
+		for _, emitter := range []struct {
+			name string
+			e    Emitter
+		}{
+			{"unmasked", discardEmitter{&fakeEmitter{}}},
+			{"exact", newExactEmitter(bench.secrets)},
+			{"masked", NewMaskingEmitter(discardEmitter{&fakeEmitter{}}, bench.secrets)},
+		} {
+			b.Run(bench.name+"/"+emitter.name, func(b *testing.B) {
+				b.SetBytes(int64(len(bench.log)))
+				for i := 0; i < b.N; i++ {
+					emitter.e.Write(bench.log)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package screwdriver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/metrics"
+)
+
+// APIRateLimit paces the calls to the API to that many a second, 0 leaves them unpaced. The
+// API asking to slow down pauses the calls whatever the rate.
+var APIRateLimit float64
+
+// APIMaxThrottled is the longest a call waits for the API to stop answering 429 before it fails
+var APIMaxThrottled = 5 * time.Minute
+
+// defaultThrottle is the pause after a 429 that doesn't say how long to wait
+const defaultThrottle = 2 * time.Second
+
+var (
+	apiThrottled = metrics.NewCounter("sd_launcher_api_throttled_total",
+		"Calls to the Screwdriver API answered with a 429, by method", "method")
+	apiQueueWait = metrics.NewHistogram("sd_launcher_api_queue_wait_seconds",
+		"Time the calls to the Screwdriver API waited to be sent, paced or throttled, by method",
+		[]float64{0.01, 0.1, 0.5, 1, 2, 5, 10, 30, 60, 300}, "method")
+)
+
+// rateLimiter queues the calls to the API: they go one after the other, APIRateLimit a second at
+// most, and none of them before the end of the pause the API asked for
+type rateLimiter struct {
+	// queue is held by the call waiting for its turn, the others wait behind it
+	queue sync.Mutex
+	mu    sync.Mutex
+	next  time.Time
+	pause time.Time
+}
+
+// apiLimiter is shared by the API clients, the API limits the launcher as a whole
+var apiLimiter = &rateLimiter{}
+
+// wait blocks until a call can go, and returns how long that took
+func (l *rateLimiter) wait() time.Duration {
+	l.queue.Lock()
+	defer l.queue.Unlock()
+	start := now()
+	for {
+		l.mu.Lock()
+		at := l.next
+		if l.pause.After(at) {
+			at = l.pause
+		}
+		l.mu.Unlock()
+		// The pause can get longer while waiting
+		d := at.Sub(now())
+		if d <= 0 {
+			break
+		}
+		sleep(d)
+	}
+
+	sent := now()
+	if APIRateLimit > 0 {
+		l.mu.Lock()
+		l.next = sent.Add(time.Duration(float64(time.Second) / APIRateLimit))
+		l.mu.Unlock()
+	}
+	return sent.Sub(start)
+}
+
+// pauseFor holds the calls for d, plus up to a quarter of it so the launchers told to wait as
+// long don't all come back at once
+func (l *rateLimiter) pauseFor(d time.Duration) time.Duration {
+	d += time.Duration(randInt63n(int64(d/4) + 1))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := now().Add(d); until.After(l.pause) {
+		l.pause = until
+	}
+	return d
+}
+
+// retryAfter is how long res asks to wait before the next call, from its Retry-After header or
+// its rate limit headers once no call is left, 0 when it doesn't ask
+func retryAfter(res *http.Response) time.Duration {
+	if v := res.Header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(v); err == nil {
+			return date.Sub(now())
+		}
+	}
+	if res.StatusCode != http.StatusTooManyRequests && res.Header.Get("X-RateLimit-Remaining") != "0" {
+		return 0
+	}
+	reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	// A date in seconds since the epoch, or the seconds left before the reset
+	if reset > 1e9 {
+		return time.Unix(reset, 0).Sub(now())
+	}
+	return time.Duration(reset) * time.Second
+}
+
+// send sends the request newRequest makes once the queue lets it go, and again after the pause
+// the API asks for as long as it answers 429, APIMaxThrottled at most
+func (a api) send(method string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var throttled time.Duration
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		apiQueueWait.Observe(apiLimiter.wait().Seconds(), method)
+		start := time.Now()
+		res, err := a.client.Do(req)
+		observeCall(method, start, res, err)
+		if err != nil {
+			return nil, err
+		}
+
+		pause := retryAfter(res)
+		if res.StatusCode != http.StatusTooManyRequests {
+			if pause > 0 {
+				apiLimiter.pauseFor(pause)
+			}
+			return res, nil
+		}
+		res.Body.Close()
+		apiThrottled.Inc(method)
+		if pause <= 0 {
+			pause = defaultThrottle
+		}
+		if throttled+pause > APIMaxThrottled {
+			return nil, fmt.Errorf("Throttled by the API for %v: 429 returned from %s %s", throttled.Round(time.Second), method, req.URL)
+		}
+		pause = apiLimiter.pauseFor(pause)
+		throttled += pause
+		log.Printf("WARNING: throttled by the API, sending %s %s again in %v", method, req.URL, pause.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,139 @@
+package screwdriver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/metrics"
+)
+
+// fakeClock replaces now and sleep, and the limiter with a new one, until the returned func is called
+func fakeClock() (*time.Time, func()) {
+	oldSleep, oldNow, oldRandInt63n, oldLimiter := sleep, now, randInt63n, apiLimiter
+	clock := time.Unix(1600000000, 0)
+	now = func() time.Time { return clock }
+	sleep = func(d time.Duration) { clock = clock.Add(d) }
+	randInt63n = func(n int64) int64 { return 0 }
+	apiLimiter = &rateLimiter{}
+	return &clock, func() { sleep, now, randInt63n, apiLimiter = oldSleep, oldNow, oldRandInt63n, oldLimiter }
+}
+
+// throttlingAPI answers 429 with header to the first throttled requests
+func throttlingAPI(throttled int, header http.Header) (api, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= throttled {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintln(w, `{"statusCode": 429, "error": "Too Many Requests", "message": "slow down"}`)
+			return
+		}
+		fmt.Fprintln(w, `{"id": 1}`)
+	}))
+	client := &http.Client{Transport: &http.Transport{Proxy: func(req *http.Request) (*url.URL, error) {
+		return url.Parse(server.URL)
+	}}}
+	return api{"http://fakeurl", StaticToken("faketoken"), client, RetryPolicy{MaxAttempts: 1}}, &requests
+}
+
+func TestRetryAfter(t *testing.T) {
+	clock, restore := fakeClock()
+	defer restore()
+
+	for _, test := range []struct {
+		code   int
+		header map[string]string
+		want   time.Duration
+	}{
+		{200, nil, 0},
+		{429, nil, 0},
+		{429, map[string]string{"Retry-After": "3"}, 3 * time.Second},
+		{503, map[string]string{"Retry-After": clock.Add(time.Minute).Format(http.TimeFormat)}, time.Minute},
+		{200, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": fmt.Sprint(clock.Add(10 * time.Second).Unix())}, 10 * time.Second},
+		{200, map[string]string{"X-RateLimit-Remaining": "4", "X-RateLimit-Reset": "10"}, 0},
+		{429, map[string]string{"X-RateLimit-Reset": "5"}, 5 * time.Second},
+	} {
+		res := &http.Response{StatusCode: test.code, Header: http.Header{}}
+		for name, value := range test.header {
+			res.Header.Set(name, value)
+		}
+		if got := retryAfter(res); got != test.want {
+			t.Errorf("retryAfter(%d %v) = %v, want %v", test.code, test.header, got, test.want)
+		}
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	clock, restore := fakeClock()
+	defer restore()
+	start := *clock
+
+	testAPI, requests := throttlingAPI(2, http.Header{"Retry-After": {"2"}})
+	if _, err := testAPI.JobFromID(1); err != nil {
+		t.Fatalf("Unexpected error once the API stopped throttling: %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("Sent %d requests, want 3", *requests)
+	}
+	if waited := clock.Sub(start); waited != 4*time.Second {
+		t.Errorf("Waited %v, want the 4 seconds asked for", waited)
+	}
+
+	buf := new(bytes.Buffer)
+	metrics.Default.WriteTo(buf)
+	if want := `sd_launcher_api_throttled_total{method="GET"} 2`; !strings.Contains(buf.String(), want+"\n") {
+		t.Errorf("Metrics have no %s", want)
+	}
+}
+
+func TestThrottledTooLong(t *testing.T) {
+	_, restore := fakeClock()
+	defer restore()
+	oldMax := APIMaxThrottled
+	defer func() { APIMaxThrottled = oldMax }()
+	APIMaxThrottled = 5 * time.Second
+
+	testAPI, requests := throttlingAPI(100, http.Header{"Retry-After": {"2"}})
+	err := testAPI.UpdateStepStart(1, "install")
+	if err == nil || !strings.Contains(err.Error(), "Throttled by the API for 4s") {
+		t.Errorf("Error = %v, want the call throttled too long", err)
+	}
+	if *requests != 3 {
+		t.Errorf("Sent %d requests, want 3", *requests)
+	}
+}
+
+func TestRateLimiterPacing(t *testing.T) {
+	clock, restore := fakeClock()
+	defer restore()
+	oldRate := APIRateLimit
+	defer func() { APIRateLimit = oldRate }()
+	APIRateLimit = 4
+
+	start := *clock
+	var waits []time.Duration
+	for i := 0; i < 3; i++ {
+		waits = append(waits, apiLimiter.wait())
+	}
+	if waits[0] != 0 || waits[1] != 250*time.Millisecond || waits[2] != 250*time.Millisecond {
+		t.Errorf("Waited %v, want the calls 250ms apart", waits)
+	}
+
+	// A pause the API asks for holds the next call
+	apiLimiter.pauseFor(3 * time.Second)
+	if waited := apiLimiter.wait(); waited != 3*time.Second {
+		t.Errorf("Waited %v after a pause of 3s", waited)
+	}
+	if total := clock.Sub(start); total != 3500*time.Millisecond {
+		t.Errorf("Took %v, want 3.5s", total)
+	}
+}
@@ -0,0 +1,209 @@
+package screwdriver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Redacted replaces the tokens and secret values in the recorded responses
+const Redacted = "REDACTED"
+
+// Responses carrying credentials, which never get recorded as they are
+var (
+	tokenPath   = regexp.MustCompile(`/builds/\d+/(token|checkoutToken)$`)
+	secretsPath = regexp.MustCompile(`/builds/\d+/secrets$`)
+)
+
+// Exchange is a response of the API or the store to a request, as recorded in a fixture
+type Exchange struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is the body of the response when it is text, BinaryBody when it isn't
+	Body       string `json:"body,omitempty"`
+	BinaryBody []byte `json:"binaryBody,omitempty"`
+}
+
+// requestKey is what a request is matched on: its method and its URL without the host, which
+// changes from a cluster to another
+func requestKey(method, url string) string {
+	return method + " " + url
+}
+
+func (e Exchange) key() string {
+	return requestKey(e.Method, e.URL)
+}
+
+type recordingTransport struct {
+	transport http.RoundTripper
+	mu        sync.Mutex
+	file      *os.File
+}
+
+// NewRecordingTransport returns a transport sending the requests through transport and
+// appending the responses to the fixture at path, one JSON exchange per line. The tokens and
+// the secret values in the responses are redacted.
+func NewRecordingTransport(transport http.RoundTripper, path string) (http.RoundTripper, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Creating API fixture: %v", err)
+	}
+	return &recordingTransport{transport: transport, file: f}, nil
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Reading response to record: %v", err)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	e := Exchange{
+		Method: req.Method,
+		URL:    req.URL.RequestURI(),
+		Status: res.StatusCode,
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "" {
+		e.Header = http.Header{"Content-Type": {ct}}
+	}
+	body = redact(req.URL.Path, body)
+	if utf8.Valid(body) {
+		e.Body = string(body)
+	} else {
+		e.BinaryBody = body
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("Marshaling JSON for API fixture: %v", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("Writing API fixture: %v", err)
+	}
+	return res, nil
+}
+
+// redact replaces the credentials in the body of the response to a request of path
+func redact(path string, body []byte) []byte {
+	switch {
+	case tokenPath.MatchString(path):
+		var token map[string]interface{}
+		if json.Unmarshal(body, &token) != nil {
+			return body
+		}
+		if _, ok := token["token"]; ok {
+			token["token"] = Redacted
+		}
+		redacted, _ := json.Marshal(token)
+		return redacted
+	case secretsPath.MatchString(path):
+		var secrets []map[string]interface{}
+		if json.Unmarshal(body, &secrets) != nil {
+			return body
+		}
+		for _, s := range secrets {
+			s["value"] = Redacted
+		}
+		redacted, _ := json.Marshal(secrets)
+		return redacted
+	}
+	return body
+}
+
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges map[string][]Exchange
+}
+
+// NewReplayTransport returns a transport answering the requests with the responses of the
+// fixture at path, as recorded by NewRecordingTransport, without any network. Requests made
+// more than once get the recorded responses in turn, then the last one again. Those never
+// recorded get a 404.
+func NewReplayTransport(path string) (http.RoundTripper, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading API fixture: %v", err)
+	}
+	defer f.Close()
+
+	t := &replayTransport{exchanges: map[string][]Exchange{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("Parsing API fixture %s line %d: %v", path, n, err)
+		}
+		t.exchanges[e.key()] = append(t.exchanges[e.key()], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Reading API fixture: %v", err)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := requestKey(req.Method, req.URL.RequestURI())
+
+	t.mu.Lock()
+	recorded := t.exchanges[key]
+	if len(recorded) > 1 {
+		t.exchanges[key] = recorded[1:]
+	}
+	t.mu.Unlock()
+
+	if len(recorded) == 0 {
+		body, _ := json.Marshal(SDError{
+			StatusCode: http.StatusNotFound,
+			Reason:     "Not Found",
+			Message:    "No recorded response for " + key,
+		})
+		return response(req, http.StatusNotFound, http.Header{"Content-Type": {"application/json"}}, body), nil
+	}
+	e := recorded[0]
+	body := e.BinaryBody
+	if body == nil {
+		body = []byte(e.Body)
+	}
+	return response(req, e.Status, e.Header, body), nil
+}
+
+func response(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,148 @@
+package screwdriver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fixturePath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	return filepath.Join(dir, "api.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(body)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path, cleanup := fixturePath(t)
+	defer cleanup()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/v4/builds/1":
+			w.Header().Set("Content-Type", "application/json")
+			if calls == 1 {
+				w.Write([]byte(`{"id":1,"status":"RUNNING"}`))
+			} else {
+				w.Write([]byte(`{"id":1,"status":"ABORTED"}`))
+			}
+		case "/v4/builds/1/token":
+			w.Write([]byte(`{"token":"secret-jwt"}`))
+		case "/v4/builds/1/secrets":
+			w.Write([]byte(`[{"name":"PASSWORD","value":"hunter2"}]`))
+		case "/v1/caches/main":
+			w.Write([]byte{0x1f, 0x8b, 0xff})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	recording, err := NewRecordingTransport(http.DefaultTransport, path)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewRecordingTransport: %v", err)
+	}
+	client := &http.Client{Transport: recording}
+	if _, body := get(t, client, server.URL+"/v4/builds/1"); body != `{"id":1,"status":"RUNNING"}` {
+		t.Errorf("Recording changed the response to %q", body)
+	}
+	get(t, client, server.URL+"/v4/builds/1")
+	if _, body := get(t, client, server.URL+"/v4/builds/1/token"); body != `{"token":"secret-jwt"}` {
+		t.Errorf("Recording changed the token to %q", body)
+	}
+	get(t, client, server.URL+"/v4/builds/1/secrets")
+	get(t, client, server.URL+"/v1/caches/main")
+	get(t, client, server.URL+"/v4/forbidden?x=1")
+
+	fixture, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(fixture), "secret-jwt") || strings.Contains(string(fixture), "hunter2") {
+		t.Errorf("The fixture has the credentials: %s", fixture)
+	}
+	if strings.Count(string(fixture), "\n") != 6 {
+		t.Errorf("Fixture = %s, want 6 exchanges", fixture)
+	}
+
+	// The server is gone, the fixture answers
+	server.Close()
+	replay, err := NewReplayTransport(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewReplayTransport: %v", err)
+	}
+	client = &http.Client{Transport: replay}
+	for _, want := range []string{`{"id":1,"status":"RUNNING"}`, `{"id":1,"status":"ABORTED"}`, `{"id":1,"status":"ABORTED"}`} {
+		if status, body := get(t, client, "http://other-host/v4/builds/1"); status != 200 || body != want {
+			t.Errorf("Replayed %d %q, want %q", status, body, want)
+		}
+	}
+	if _, body := get(t, client, "http://other-host/v4/builds/1/token"); body != `{"token":"REDACTED"}` {
+		t.Errorf("Replayed token %q, want it redacted", body)
+	}
+	if _, body := get(t, client, "http://other-host/v4/builds/1/secrets"); body != `[{"name":"PASSWORD","value":"REDACTED"}]` {
+		t.Errorf("Replayed secrets %q, want their values redacted", body)
+	}
+	if _, body := get(t, client, "http://other-host/v1/caches/main"); body != "\x1f\x8b\xff" {
+		t.Errorf("Replayed binary body %q", body)
+	}
+	if status, _ := get(t, client, "http://other-host/v4/forbidden?x=1"); status != http.StatusForbidden {
+		t.Errorf("Replayed status %d, want %d", status, http.StatusForbidden)
+	}
+	if status, body := get(t, client, "http://other-host/v4/builds/2"); status != http.StatusNotFound || !strings.Contains(body, "No recorded response for GET /v4/builds/2") {
+		t.Errorf("Unrecorded request got %d %q, want a 404", status, body)
+	}
+}
+
+func TestReplayThroughAPI(t *testing.T) {
+	path, cleanup := fixturePath(t)
+	defer cleanup()
+	ioutil.WriteFile(path, []byte(`{"method":"GET","url":"/v4/jobs/2","status":200,"body":"{\"id\":2,\"name\":\"main\"}"}`+"\n\n"), 0600)
+
+	replay, err := NewReplayTransport(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewReplayTransport: %v", err)
+	}
+	oldTransport := Transport
+	defer func() { Transport = oldTransport }()
+	Transport = replay
+
+	testAPI, err := New("http://fakeurl", "faketoken")
+	if err != nil {
+		t.Fatalf("Unexpected error from New: %v", err)
+	}
+	job, err := testAPI.JobFromID(2)
+	if err != nil || job.Name != "main" {
+		t.Errorf("JobFromID() = %+v, %v, want job main", job, err)
+	}
+	if _, err := testAPI.JobFromID(3); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("JobFromID() error = %v, want the 404 of an unrecorded request", err)
+	}
+}
+
+func TestReplayBadFixture(t *testing.T) {
+	path, cleanup := fixturePath(t)
+	defer cleanup()
+	ioutil.WriteFile(path, []byte("{\"method\":\"GET\"}\nnot json\n"), 0600)
+
+	if _, err := NewReplayTransport(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("NewReplayTransport() error = %v, want the bad line", err)
+	}
+	if _, err := NewReplayTransport(path + ".missing"); err == nil {
+		t.Errorf("Expected an error replaying a missing fixture")
+	}
+}
@@ -7,27 +7,36 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/screwdriver-cd/launcher/metrics"
 )
 
 var sleep = time.Sleep
+var now = time.Now
+var randInt63n = rand.Int63n
 
 // BuildStatus is the status of a Screwdriver build
 type BuildStatus string
 
 // These are the set of valid statuses that a build can be set to
 const (
-	Running BuildStatus = "RUNNING"
-	Success             = "SUCCESS"
-	Failure             = "FAILURE"
-	Aborted             = "ABORTED"
+	Running  BuildStatus = "RUNNING"
+	Success              = "SUCCESS"
+	Failure              = "FAILURE"
+	Aborted              = "ABORTED"
+	Timedout             = "TIMEDOUT"
+	// Skipped builds were told not to run by their commit message
+	Skipped = "SKIPPED"
+	// Frozen builds started during a freeze window of their branch
+	Frozen = "FROZEN"
 )
 
-const maxAttempts = 5
 const defaultBuildTimeoutBuffer = 30 // 30 minutes
 
 func (b BuildStatus) String() string {
@@ -39,14 +48,18 @@ type API interface {
 	BuildFromID(buildID int) (Build, error)
 	EventFromID(eventID int) (Event, error)
 	JobFromID(jobID int) (Job, error)
+	LatestBuild(jobID int, status BuildStatus) (Build, error)
 	PipelineFromID(pipelineID int) (Pipeline, error)
-	UpdateBuildStatus(status BuildStatus, meta map[string]interface{}, buildID int) error
+	UpdateBuildStatus(status BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error
 	UpdateStepStart(buildID int, stepName string) error
 	UpdateStepStop(buildID int, stepName string, exitCode int) error
 	SecretsForBuild(build Build) (Secrets, error)
 	GetAPIURL() (string, error)
 	GetCoverageInfo() (Coverage, error)
 	GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error)
+	GetCheckoutToken(buildID int) (string, error)
+	ReportQueuePosition(buildID int, position int) error
+	StartNextJobs(eventID, jobID int, meta map[string]interface{}) ([]Build, error)
 }
 
 // SDError is an error response from the Screwdriver API
@@ -60,26 +73,61 @@ func (e SDError) Error() string {
 	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Reason, e.Message)
 }
 
+// RetryPolicy controls how API calls are retried after a network error or a 5xx response.
+// Other failures, like a 4xx response, are returned right away.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a call is tried
+	MaxAttempts int
+	// MaxElapsed stops the retries once a call would take longer than that, 0 for no limit
+	MaxElapsed time.Duration
+	// BaseDelay is the wait before the first retry, doubled after each attempt
+	BaseDelay time.Duration
+}
+
+// DefaultRetryPolicy tries calls 5 times, waiting up to 2, 4, 8 and 16 seconds in between
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+}
+
 type api struct {
-	baseURL string
-	token   string
-	client  *http.Client
+	baseURL     string
+	tokens      TokenSource
+	client      *http.Client
+	retryPolicy RetryPolicy
 }
 
 // New returns a new API object
 func New(url, token string) (API, error) {
+	return NewWithRetryPolicy(url, token, DefaultRetryPolicy)
+}
+
+// NewWithRetryPolicy returns a new API object retrying failed calls according to policy
+func NewWithRetryPolicy(url, token string, policy RetryPolicy) (API, error) {
+	return NewWithTokenSource(url, StaticToken(token), policy)
+}
+
+// NewWithTokenSource returns a new API object authenticating with the tokens of tokens,
+// which can renew them while the build runs
+func NewWithTokenSource(url string, tokens TokenSource, policy RetryPolicy) (API, error) {
+	if policy.MaxAttempts < 1 {
+		return nil, fmt.Errorf("Invalid retry policy: calls must be tried at least once, got %d attempts", policy.MaxAttempts)
+	}
+
 	newapi := api{
 		url,
-		token,
-		&http.Client{Timeout: 20 * time.Second},
+		tokens,
+		&http.Client{Timeout: APITimeout, Transport: Transport},
+		policy,
 	}
 	return API(newapi), nil
 }
 
 // BuildStatusPayload is a Screwdriver Build Status payload.
 type BuildStatusPayload struct {
-	Status string                 `json:"status"`
-	Meta   map[string]interface{} `json:"meta"`
+	Status        string                 `json:"status"`
+	Meta          map[string]interface{} `json:"meta"`
+	StatusMessage string                 `json:"statusMessage,omitempty"`
 }
 
 // StepStartPayload is a Screwdriver Step Start payload.
@@ -98,11 +146,183 @@ type BuildTokenPayload struct {
 	BuildTimeout int `json:"buildTimeout"`
 }
 
+// QueuePositionPayload is a Screwdriver Build queue position payload.
+type QueuePositionPayload struct {
+	Stats QueueStats `json:"stats"`
+}
+
+// NextJobsPayload is a Screwdriver payload starting the jobs after a Job in the workflow of an Event.
+type NextJobsPayload struct {
+	JobID int                    `json:"jobId"`
+	Meta  map[string]interface{} `json:"meta"`
+}
+
+// QueueStats holds the position of a Build waiting in the queue.
+type QueueStats struct {
+	QueuePosition int `json:"queuePosition"`
+}
+
 // Pipeline is a Screwdriver Pipeline definition.
 type Pipeline struct {
 	ID      int     `json:"id"`
 	ScmRepo ScmRepo `json:"scmRepo"`
 	ScmURI  string  `json:"scmUri"`
+	// ScmContext names the SCM of the pipeline and its host, e.g. "github:github.com"
+	ScmContext  string           `json:"scmContext"`
+	Settings    PipelineSettings `json:"settings"`
+	Annotations Annotations      `json:"annotations,omitempty"`
+}
+
+// Annotations tune how the builds of a pipeline or a job run, e.g.
+// {"screwdriver.cd/gitSubmodules": false}
+type Annotations map[string]interface{}
+
+// Bool reads the annotation key, set to true or false or to a string of them. The annotation
+// is def when missing.
+func (a Annotations) Bool(key string, def bool) (bool, error) {
+	switch v := a[key].(type) {
+	case nil:
+		return def, nil
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return def, fmt.Errorf("Annotation %s is %q, must be true or false", key, v)
+		}
+		return b, nil
+	default:
+		return def, fmt.Errorf("Annotation %s is %v, must be true or false", key, v)
+	}
+}
+
+// Strings reads the annotation key, set to a list of strings or to a string of them separated
+// by commas. The list is empty when the annotation is missing.
+func (a Annotations) Strings(key string) ([]string, error) {
+	var values []string
+	switch v := a[key].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		values = strings.Split(v, ",")
+	case []string:
+		values = v
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Annotation %s is %v, must be a list of strings", key, a[key])
+			}
+			values = append(values, s)
+		}
+	default:
+		return nil, fmt.Errorf("Annotation %s is %v, must be a list of strings", key, v)
+	}
+
+	var list []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list, nil
+}
+
+// Int reads the annotation key, set to a whole number or to a string of one. The annotation is
+// def when missing.
+func (a Annotations) Int(key string, def int) (int, error) {
+	switch v := a[key].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return v, nil
+	case float64:
+		if v != float64(int(v)) {
+			return def, fmt.Errorf("Annotation %s is %v, must be a whole number", key, v)
+		}
+		return int(v), nil
+	case string:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return def, fmt.Errorf("Annotation %s is %q, must be a whole number", key, v)
+		}
+		return n, nil
+	default:
+		return def, fmt.Errorf("Annotation %s is %v, must be a whole number", key, v)
+	}
+}
+
+// String reads the annotation key, set to a string. The annotation is def when missing or empty.
+func (a Annotations) String(key, def string) (string, error) {
+	switch v := a[key].(type) {
+	case nil:
+		return def, nil
+	case string:
+		if v = strings.TrimSpace(v); v == "" {
+			return def, nil
+		}
+		return v, nil
+	default:
+		return def, fmt.Errorf("Annotation %s is %v, must be a string", key, v)
+	}
+}
+
+// Merge returns the annotations of a with those of b over them, like a job's over its pipeline's
+func (a Annotations) Merge(b Annotations) Annotations {
+	merged := Annotations{}
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// The ways of authenticating the checkout of a private repository
+const (
+	CheckoutAuthDeployKey = "deploy-key"
+	CheckoutAuthOAuth     = "oauth"
+)
+
+// PipelineSettings are the options of a Pipeline set by its admins
+type PipelineSettings struct {
+	// CheckoutAuth is CheckoutAuthDeployKey, CheckoutAuthOAuth or empty for a public repository
+	CheckoutAuth string `json:"checkoutAuth,omitempty"`
+	// FreezeWindows are the times the builds of some branches don't run, e.g. during a release
+	FreezeWindows []FreezeWindow `json:"freezeWindows,omitempty"`
+	// Notifications are sent when the builds of the pipeline are done
+	Notifications []Notification `json:"notifications,omitempty"`
+}
+
+// The kinds of Notification
+const (
+	NotifySlack   = "slack"
+	NotifyWebhook = "webhook"
+	NotifyEmail   = "email"
+)
+
+// Notification tells a Slack channel, a webhook or email addresses about the builds ending with
+// one of Statuses, FAILURE only when there are none
+type Notification struct {
+	// Type is NotifySlack, NotifyWebhook or NotifyEmail
+	Type string `json:"type"`
+	// URL is the incoming webhook of Slack, or the webhook the build is posted to
+	URL string `json:"url,omitempty"`
+	// To are the addresses of the emails
+	To       []string      `json:"to,omitempty"`
+	Statuses []BuildStatus `json:"statuses,omitempty"`
+	// Template is the text/template of the message, given the summary of the build
+	Template string `json:"template,omitempty"`
+}
+
+// FreezeWindow stops the builds of the branches matching one of Branches, like "release/*",
+// or of every branch when there are none, from Start until End
+type FreezeWindow struct {
+	Branches []string  `json:"branches,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Reason   string    `json:"reason,omitempty"`
 }
 
 // ScmRepo contains the full name of the repository for a Pipeline, e.g. "screwdriver-cd/launcher"
@@ -112,16 +332,100 @@ type ScmRepo struct {
 
 // Job is a Screwdriver Job.
 type Job struct {
-	ID            int    `json:"id"`
-	PipelineID    int    `json:"pipelineId"`
-	Name          string `json:"name"`
-	PrParentJobID int    `json:"prParentJobId"`
+	ID            int              `json:"id"`
+	PipelineID    int              `json:"pipelineId"`
+	Name          string           `json:"name"`
+	PrParentJobID int              `json:"prParentJobId"`
+	Permutations  []JobPermutation `json:"permutations,omitempty"`
+}
+
+// JobPermutation is the configuration of a Job from its screwdriver.yaml
+type JobPermutation struct {
+	Parameters  map[string]ParameterDef `json:"parameters,omitempty"`
+	Annotations Annotations             `json:"annotations,omitempty"`
+	Image       string                  `json:"image,omitempty"`
+}
+
+// Annotations are the annotations of the Job, without those of its pipeline
+func (j Job) Annotations() Annotations {
+	if len(j.Permutations) == 0 {
+		return nil
+	}
+	return j.Permutations[0].Annotations
+}
+
+// Image is the container image the Job runs in
+func (j Job) Image() string {
+	if len(j.Permutations) == 0 {
+		return ""
+	}
+	return j.Permutations[0].Image
+}
+
+// Parameters are the parameters the Job declares, with their defaults
+func (j Job) Parameters() map[string]ParameterDef {
+	if len(j.Permutations) == 0 {
+		return nil
+	}
+	return j.Permutations[0].Parameters
+}
+
+// ParameterDef is a parameter declared by a job. A list of values in the screwdriver.yaml
+// restricts the parameter to these Choices, the first one being the default Value.
+type ParameterDef struct {
+	Value       string
+	Choices     []string
+	Description string
+}
+
+// UnmarshalJSON reads the forms a parameter is declared with: "value", ["a", "b"],
+// {"value": "value", "description": "..."} or {"value": ["a", "b"], "description": "..."}
+func (p *ParameterDef) UnmarshalJSON(data []byte) error {
+	var full struct {
+		Value       json.RawMessage `json:"value"`
+		Description string          `json:"description"`
+	}
+	if err := json.Unmarshal(data, &full); err == nil {
+		p.Description = full.Description
+		data = full.Value
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		p.Value = value
+		return nil
+	}
+	var choices []string
+	if err := json.Unmarshal(data, &choices); err != nil || len(choices) == 0 {
+		return fmt.Errorf("Parameter must be a string or a list of strings: %s", data)
+	}
+	p.Value, p.Choices = choices[0], choices
+	return nil
 }
 
 // CommandDef is the definition of a single executable command.
+// Timeout is how many seconds the command may run, 0 for no limit other than the build timeout.
 type CommandDef struct {
-	Name string `json:"name"`
-	Cmd  string `json:"command"`
+	Name        string            `json:"name"`
+	Cmd         string            `json:"command"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"`
+	// Teardown steps run after the others, even when they fail, time out or are aborted
+	Teardown bool `json:"teardown,omitempty"`
+	// Limits cap the resources the step uses, when set
+	Limits *ResourceLimits `json:"limits,omitempty"`
+	// Group runs the step along with the steps next to it in the same group, all at once
+	Group string `json:"group,omitempty"`
+}
+
+// ResourceLimits are the most of each resource a step can use, 0 for no limit
+type ResourceLimits struct {
+	// Memory is in bytes
+	Memory int64 `json:"memory,omitempty"`
+	// CPU is a number of cores, like 0.5
+	CPU float64 `json:"cpu,omitempty"`
+	// Procs is how many processes the step runs at once
+	Procs int `json:"nproc,omitempty"`
 }
 
 // Need a generic interface to take in an int or array of ints
@@ -137,6 +441,7 @@ type Build struct {
 	ParentBuildID IntOrArray             `json:"parentBuildId"`
 	Meta          map[string]interface{} `json:"meta"`
 	EventID       int                    `json:"eventId"`
+	Status        BuildStatus            `json:"status"`
 }
 
 // Coverage is a Coverage object returned when getInfo is called
@@ -149,17 +454,55 @@ type Event struct {
 	ID            int                    `json:"id"`
 	Meta          map[string]interface{} `json:"meta"`
 	ParentEventID int                    `json:"parentEventId"`
+	Commit        EventCommit            `json:"commit"`
+}
+
+// EventCommit is the head commit of the change an Event was started for
+type EventCommit struct {
+	Message string `json:"message"`
 }
 
 // Secret is a Screwdriver build secret.
 type Secret struct {
-	Name  string `json:"name"`
-	Value string `json:"value"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	AllowInPR bool   `json:"allowInPR"`
 }
 
 // Secrets is the collection of secrets for a Screwdriver build
 type Secrets []Secret
 
+// AllowedInPR returns the secrets that pull request builds may use
+func (s Secrets) AllowedInPR() Secrets {
+	allowed := Secrets{}
+	for _, secret := range s {
+		if secret.AllowInPR {
+			allowed = append(allowed, secret)
+		}
+	}
+	return allowed
+}
+
+// Without returns the secrets other than the one named name
+func (s Secrets) Without(name string) Secrets {
+	kept := Secrets{}
+	for _, secret := range s {
+		if secret.Name != name {
+			kept = append(kept, secret)
+		}
+	}
+	return kept
+}
+
+// Values returns the values of the secrets
+func (s Secrets) Values() []string {
+	values := []string{}
+	for _, secret := range s {
+		values = append(values, secret.Value)
+	}
+	return values
+}
+
 // Token is a Screwdriver API token.
 type Token struct {
 	Token string `json:"token"`
@@ -175,6 +518,16 @@ func tokenHeader(token string) string {
 	return fmt.Sprintf("Bearer %s", token)
 }
 
+// authorize sets the Authorization header of req with the current token
+func (a api) authorize(req *http.Request) error {
+	token, err := a.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("Getting token: %v", err)
+	}
+	req.Header.Set("Authorization", tokenHeader(token))
+	return nil
+}
+
 func handleResponse(res *http.Response) ([]byte, error) {
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -192,22 +545,53 @@ func handleResponse(res *http.Response) ([]byte, error) {
 	return body, nil
 }
 
-func retry(attempts int, callback func() error) (err error) {
+// delay is the wait after the given failed attempt: an exponential backoff of which
+// a random half is kept, so builds hitting the same outage don't retry in lockstep
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	backoff := p.BaseDelay << uint(attempt)
+	half := int64(backoff / 2)
+	return time.Duration(half + randInt63n(half+1))
+}
+
+// Retry calls callback until it succeeds, following the policy
+func (p RetryPolicy) Retry(callback func() error) (err error) {
+	start := now()
 	for i := 0; ; i++ {
 		err = callback()
 		if err == nil {
 			return nil
 		}
 
-		if i >= (attempts - 1) {
+		if i >= (p.MaxAttempts - 1) {
 			break
 		}
 
-		//Exponential backoff of 2 seconds
-		duration := time.Duration(math.Pow(2, float64(i+1)))
-		sleep(duration * time.Second)
+		delay := p.delay(i)
+		if elapsed := now().Sub(start); p.MaxElapsed > 0 && elapsed+delay > p.MaxElapsed {
+			return fmt.Errorf("After %d attempts in %v, Last error: %s", i+1, elapsed.Round(time.Millisecond), err)
+		}
+		sleep(delay)
+	}
+	return fmt.Errorf("After %d attempts, Last error: %s", p.MaxAttempts, err)
+}
+
+var (
+	apiCallDuration = metrics.NewHistogram("sd_launcher_api_request_duration_seconds",
+		"Latency of the calls to the Screwdriver API, by method and status code", metrics.RequestBuckets, "method", "code")
+	apiCallErrors = metrics.NewCounter("sd_launcher_api_errors_total",
+		"Calls to the Screwdriver API failing with a network error or a 5xx response, by method", "method")
+)
+
+// observeCall records the latency of an API call, and whether it failed
+func observeCall(method string, start time.Time, res *http.Response, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	apiCallDuration.Since(start, method, code)
+	if err != nil || res.StatusCode/100 == 5 {
+		apiCallErrors.Inc(method)
 	}
-	return fmt.Errorf("After %d attempts, Last error: %s", attempts, err)
 }
 
 func (a api) get(url *url.URL) ([]byte, error) {
@@ -215,14 +599,20 @@ func (a api) get(url *url.URL) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Generating request to Screwdriver: %v", err)
 	}
-	req.Header.Set("Authorization", tokenHeader(a.token))
 
 	res := &http.Response{}
 	attemptNumber := 0
 
-	err = retry(maxAttempts, func() error {
+	maxAttempts := a.retryPolicy.MaxAttempts
+	err = a.retryPolicy.Retry(func() error {
 		attemptNumber++
-		res, err = a.client.Do(req)
+		res, err = a.send("GET", func() (*http.Request, error) {
+			// The header is set on each attempt as retries can outlive the token
+			if err := a.authorize(req); err != nil {
+				return nil, err
+			}
+			return req, nil
+		})
 		if err != nil {
 			log.Printf("WARNING: received error from GET(%s): %v "+
 				"(attempt %d of %d)", url.String(), err, attemptNumber, maxAttempts)
@@ -230,6 +620,7 @@ func (a api) get(url *url.URL) ([]byte, error) {
 		}
 
 		if res.StatusCode/100 == 5 {
+			res.Body.Close()
 			log.Printf("WARNING: received response %d from GET %s "+
 				"(attempt %d of %d)", res.StatusCode, url.String(), attemptNumber, maxAttempts)
 			return fmt.Errorf("GET retries exhausted: %d returned from GET %s",
@@ -253,23 +644,25 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 	p := buf.String()
 
 	res := &http.Response{}
-	req := &http.Request{}
 	attemptNumber := 0
 
-	err := retry(maxAttempts, func() error {
+	maxAttempts := a.retryPolicy.MaxAttempts
+	err := a.retryPolicy.Retry(func() error {
 		attemptNumber++
 		var err error
-		req, err = http.NewRequest(requestType, url.String(), strings.NewReader(p))
-		if err != nil {
-			log.Printf("WARNING: received error generating new request for %s(%s): %v "+
-				"(attempt %v of %v)", requestType, url.String(), err, attemptNumber, maxAttempts)
-			return err
-		}
-
-		req.Header.Set("Authorization", tokenHeader(a.token))
-		req.Header.Set("Content-Type", bodyType)
-
-		res, err = a.client.Do(req)
+		res, err = a.send(requestType, func() (*http.Request, error) {
+			req, err := http.NewRequest(requestType, url.String(), strings.NewReader(p))
+			if err != nil {
+				log.Printf("WARNING: received error generating new request for %s(%s): %v "+
+					"(attempt %v of %v)", requestType, url.String(), err, attemptNumber, maxAttempts)
+				return nil, err
+			}
+			if err := a.authorize(req); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", bodyType)
+			return req, nil
+		})
 		if err != nil {
 			log.Printf("WARNING: received error from %s(%s): %v "+
 				"(attempt %d of %d)", requestType, url.String(), err, attemptNumber, maxAttempts)
@@ -277,6 +670,7 @@ func (a api) write(url *url.URL, requestType string, bodyType string, payload io
 		}
 
 		if res.StatusCode/100 == 5 {
+			res.Body.Close()
 			log.Printf("WARNING: received response %d from %s "+
 				"(attempt %d of %d)", res.StatusCode, url.String(), attemptNumber, maxAttempts)
 			return fmt.Errorf("retries exhausted: %d returned from %s",
@@ -379,6 +773,25 @@ func (a api) JobFromID(jobID int) (job Job, err error) {
 }
 
 // PipelineFromID fetches and returns a Pipeline object from its ID
+// LatestBuild returns the last build of the job that ended with status, or an SDError with the
+// status code 404 when there is none
+func (a api) LatestBuild(jobID int, status BuildStatus) (build Build, err error) {
+	u, err := a.makeURL(fmt.Sprintf("jobs/%d/latestBuild", jobID))
+	if err != nil {
+		return build, fmt.Errorf("Creating url: %v", err)
+	}
+	u.RawQuery = url.Values{"status": {string(status)}}.Encode()
+	body, err := a.get(u)
+	if err != nil {
+		return build, err
+	}
+
+	if err := json.Unmarshal(body, &build); err != nil {
+		return build, fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+	return build, nil
+}
+
 func (a api) PipelineFromID(pipelineID int) (pipeline Pipeline, err error) {
 	u, err := a.makeURL(fmt.Sprintf("pipelines/%d", pipelineID))
 	if err != nil {
@@ -397,12 +810,16 @@ func (a api) PipelineFromID(pipelineID int) (pipeline Pipeline, err error) {
 	return pipeline, nil
 }
 
-func (a api) UpdateBuildStatus(status BuildStatus, meta map[string]interface{}, buildID int) error {
+// UpdateBuildStatus sets the status of a Build, with an optional message explaining it
+func (a api) UpdateBuildStatus(status BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
 	switch status {
 	case Running:
 	case Success:
 	case Failure:
 	case Aborted:
+	case Timedout:
+	case Skipped:
+	case Frozen:
 	default:
 		return fmt.Errorf("Invalid build status: %s", status)
 	}
@@ -413,8 +830,9 @@ func (a api) UpdateBuildStatus(status BuildStatus, meta map[string]interface{},
 	}
 
 	bs := BuildStatusPayload{
-		Status: status.String(),
-		Meta:   meta,
+		Status:        status.String(),
+		Meta:          meta,
+		StatusMessage: statusMessage,
 	}
 	payload, err := json.Marshal(bs)
 	if err != nil {
@@ -430,7 +848,7 @@ func (a api) UpdateBuildStatus(status BuildStatus, meta map[string]interface{},
 }
 
 func (a api) UpdateStepStart(buildID int, stepName string) error {
-	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, url.PathEscape(stepName)))
 	if err != nil {
 		return fmt.Errorf("Creating url: %v", err)
 	}
@@ -452,7 +870,7 @@ func (a api) UpdateStepStart(buildID int, stepName string) error {
 }
 
 func (a api) UpdateStepStop(buildID int, stepName string, exitCode int) error {
-	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, stepName))
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/steps/%s", buildID, url.PathEscape(stepName)))
 	if err != nil {
 		return fmt.Errorf("Creating url: %v", err)
 	}
@@ -498,7 +916,7 @@ func (a api) SecretsForBuild(build Build) (Secrets, error) {
 func (a api) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error) {
 	u, err := a.makeURL(fmt.Sprintf("builds/%d/token", buildID))
 	if err != nil {
-		return a.token, fmt.Errorf("Creating url: %v", err)
+		return "", fmt.Errorf("Creating url: %v", err)
 	}
 
 	bs := BuildTokenPayload{
@@ -506,20 +924,88 @@ func (a api) GetBuildToken(buildID int, buildTimeoutMinutes int) (string, error)
 	}
 	payload, err := json.Marshal(bs)
 	if err != nil {
-		return a.token, fmt.Errorf("Marshaling JSON for Build Token: %v", err)
+		return "", fmt.Errorf("Marshaling JSON for Build Token: %v", err)
 	}
 
 	body, err := a.post(u, "application/json", bytes.NewReader(payload))
 	if err != nil {
-		return a.token, fmt.Errorf("Posting to Build Token: %v", err)
+		return "", fmt.Errorf("Posting to Build Token: %v", err)
 	}
 
 	buildToken := Token{}
 
 	err = json.Unmarshal(body, &buildToken)
 	if err != nil {
-		return a.token, fmt.Errorf("Parsing JSON response %q: %v", body, err)
+		return "", fmt.Errorf("Parsing JSON response %q: %v", body, err)
 	}
 
 	return buildToken.Token, nil
 }
+
+// GetCheckoutToken fetches a short lived SCM token able to clone the repository of a Build
+func (a api) GetCheckoutToken(buildID int) (string, error) {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d/checkoutToken", buildID))
+	if err != nil {
+		return "", fmt.Errorf("Creating url: %v", err)
+	}
+
+	body, err := a.get(u)
+	if err != nil {
+		return "", fmt.Errorf("Getting Checkout Token: %v", err)
+	}
+
+	checkoutToken := Token{}
+	if err := json.Unmarshal(body, &checkoutToken); err != nil {
+		return "", fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+
+	return checkoutToken.Token, nil
+}
+
+// ReportQueuePosition updates the position of a waiting Build in the queue
+func (a api) ReportQueuePosition(buildID int, position int) error {
+	u, err := a.makeURL(fmt.Sprintf("builds/%d", buildID))
+	if err != nil {
+		return fmt.Errorf("Creating url: %v", err)
+	}
+
+	qp := QueuePositionPayload{
+		Stats: QueueStats{QueuePosition: position},
+	}
+	payload, err := json.Marshal(qp)
+	if err != nil {
+		return fmt.Errorf("Marshaling JSON for Queue Position: %v", err)
+	}
+
+	_, err = a.put(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("Posting to Queue Position: %v", err)
+	}
+
+	return nil
+}
+
+// StartNextJobs starts the builds of the jobs following jobID in the workflow of an Event, as
+// when jobID succeeded. They get the meta of the build of jobID.
+func (a api) StartNextJobs(eventID, jobID int, meta map[string]interface{}) ([]Build, error) {
+	u, err := a.makeURL(fmt.Sprintf("events/%d/next", eventID))
+	if err != nil {
+		return nil, fmt.Errorf("Creating url: %v", err)
+	}
+
+	payload, err := json.Marshal(NextJobsPayload{JobID: jobID, Meta: meta})
+	if err != nil {
+		return nil, fmt.Errorf("Marshaling JSON for Next Jobs: %v", err)
+	}
+
+	body, err := a.post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("Posting to Next Jobs: %v", err)
+	}
+
+	var builds []Build
+	if err := json.Unmarshal(body, &builds); err != nil {
+		return nil, fmt.Errorf("Parsing JSON response %q: %v", body, err)
+	}
+	return builds, nil
+}
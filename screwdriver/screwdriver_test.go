@@ -11,8 +11,11 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/screwdriver-cd/launcher/metrics"
 )
 
 func makeFakeHTTPClient(t *testing.T, code int, body string) *http.Client {
@@ -151,7 +154,7 @@ func TestBuildFromID(t *testing.T) {
 		}
 
 		http := makeFakeHTTPClient(t, test.statusCode, string(JSON))
-		testAPI := api{"http://fakeurl", "faketoken", http}
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 		build, err := testAPI.BuildFromID(test.build.ID)
 
@@ -217,7 +220,7 @@ func TestEventFromID(t *testing.T) {
 		}
 
 		http := makeFakeHTTPClient(t, test.statusCode, string(JSON))
-		testAPI := api{"http://fakeurl", "faketoken", http}
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 		event, err := testAPI.EventFromID(test.event.ID)
 
@@ -282,7 +285,7 @@ func TestGetCoverageInfo(t *testing.T) {
 		}
 
 		http := makeFakeHTTPClient(t, test.statusCode, string(JSON))
-		testAPI := api{"http://fakeurl", "faketoken", http}
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 		coverage, err := testAPI.GetCoverageInfo()
 
@@ -345,7 +348,7 @@ func TestJobFromID(t *testing.T) {
 		}
 
 		http := makeFakeHTTPClient(t, test.statusCode, string(JSON))
-		testAPI := api{"http://fakeurl", "faketoken", http}
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 		job, err := testAPI.JobFromID(test.job.ID)
 
@@ -359,6 +362,32 @@ func TestJobFromID(t *testing.T) {
 	}
 }
 
+func TestLatestBuild(t *testing.T) {
+	var path, status string
+	http := makeValidatedFakeHTTPClient(t, 200, `{"id": 41, "sha": "abc123"}`, func(r *http.Request) {
+		path, status = r.URL.Path, r.URL.Query().Get("status")
+	})
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
+
+	build, err := testAPI.LatestBuild(1555, Success)
+	if err != nil {
+		t.Fatalf("Unexpected error from LatestBuild: %v", err)
+	}
+	if path != "/v4/jobs/1555/latestBuild" || status != "SUCCESS" {
+		t.Errorf("Requested %s for the status %q, want the latest successful build of the job", path, status)
+	}
+	if build.ID != 41 || build.SHA != "abc123" {
+		t.Errorf("build == %#v, want the build 41 of abc123", build)
+	}
+
+	notFound := SDError{StatusCode: 404, Reason: "Not Found", Message: "Build does not exist"}
+	JSON, _ := json.Marshal(notFound)
+	testAPI.client = makeFakeHTTPClient(t, 404, string(JSON))
+	if _, err := testAPI.LatestBuild(1555, Success); !reflect.DeepEqual(err, notFound) {
+		t.Errorf("LatestBuild() error = %v, want %v", err, notFound)
+	}
+}
+
 func TestPipelineFromID(t *testing.T) {
 	tests := []struct {
 		pipeline   Pipeline
@@ -410,7 +439,7 @@ func TestPipelineFromID(t *testing.T) {
 		}
 
 		http := makeFakeHTTPClient(t, test.statusCode, string(JSON))
-		testAPI := api{"http://fakeurl", "faketoken", http}
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 		pipeline, err := testAPI.PipelineFromID(test.pipeline.ID)
 
@@ -438,7 +467,10 @@ func TestUpdateBuildStatus(t *testing.T) {
 		{Success, meta, 200, nil},
 		{Failure, meta, 200, nil},
 		{Aborted, meta, 200, nil},
+		{Timedout, meta, 200, nil},
 		{Running, meta, 200, nil},
+		{Skipped, meta, 200, nil},
+		{Frozen, meta, 200, nil},
 		{"NOTASTATUS", meta, 200, errors.New("Invalid build status: NOTASTATUS")},
 		{Success, meta, 500, errors.New("Posting to Build Status: After 5 attempts, " +
 			"Last error: retries exhausted: 500 returned from http://fakeurl/v4/builds/15")},
@@ -446,9 +478,9 @@ func TestUpdateBuildStatus(t *testing.T) {
 
 	for _, test := range tests {
 		http := makeFakeHTTPClient(t, test.statusCode, "{}")
-		testAPI := api{"http://fakeurl", "faketoken", http}
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
-		err := testAPI.UpdateBuildStatus(test.status, test.meta, 15)
+		err := testAPI.UpdateBuildStatus(test.status, test.meta, 15, "")
 
 		if !reflect.DeepEqual(err, test.err) {
 			t.Errorf("Unexpected error from UpdateBuildStatus: %v, want %v", err, test.err)
@@ -456,6 +488,35 @@ func TestUpdateBuildStatus(t *testing.T) {
 	}
 }
 
+func TestUpdateBuildStatusMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"", `{"status":"SUCCESS","meta":{}}`},
+		{"exit 1", `{"status":"FAILURE","meta":{},"statusMessage":"exit 1"}`},
+	}
+
+	for _, test := range tests {
+		http := makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(r.Body)
+			if buf.String() != test.want {
+				t.Errorf("buf.String() = %q, want %q", buf.String(), test.want)
+			}
+		})
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
+
+		status := BuildStatus(Success)
+		if test.message != "" {
+			status = Failure
+		}
+		if err := testAPI.UpdateBuildStatus(status, map[string]interface{}{}, 15, test.message); err != nil {
+			t.Errorf("Unexpected error from UpdateBuildStatus: %v", err)
+		}
+	}
+}
+
 func TestUpdateStepStart(t *testing.T) {
 	http := makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
 		buf := new(bytes.Buffer)
@@ -465,7 +526,7 @@ func TestUpdateStepStart(t *testing.T) {
 			t.Errorf("buf.String() = %q", buf.String())
 		}
 	})
-	testAPI := api{"http://fakeurl", "faketoken", http}
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 	err := testAPI.UpdateStepStart(999, "step1")
 
@@ -483,7 +544,7 @@ func TestUpdateStepStop(t *testing.T) {
 			t.Errorf("buf.String() = %q", buf.String())
 		}
 	})
-	testAPI := api{"http://fakeurl", "faketoken", http}
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 	err := testAPI.UpdateStepStop(999, "step1", 10)
 
@@ -492,6 +553,74 @@ func TestUpdateStepStop(t *testing.T) {
 	}
 }
 
+func TestUpdateStepEscapesName(t *testing.T) {
+	for _, update := range []func(API) error{
+		func(a API) error { return a.UpdateStepStart(999, "test ls/all") },
+		func(a API) error { return a.UpdateStepStop(999, "test ls/all", 0) },
+	} {
+		http := makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+			if want := "/v4/builds/999/steps/test%20ls%2Fall"; r.URL.EscapedPath() != want {
+				t.Errorf("Step URL path = %q, want %q", r.URL.EscapedPath(), want)
+			}
+		})
+		if err := update(api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}); err != nil {
+			t.Errorf("Unexpected error updating the step: %v", err)
+		}
+	}
+}
+
+func TestReportQueuePosition(t *testing.T) {
+	http := makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/builds/999")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Queue position URL=%q, want %q", r.URL, wantURL)
+		}
+		if r.Method != "PUT" {
+			t.Errorf("Queue position method=%q, want PUT", r.Method)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"stats":{"queuePosition":3}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
+
+	err := testAPI.ReportQueuePosition(999, 3)
+
+	if err != nil {
+		t.Errorf("Unexpected error from ReportQueuePosition: %v", err)
+	}
+}
+
+func TestStartNextJobs(t *testing.T) {
+	http := makeValidatedFakeHTTPClient(t, 201, `[{"id":556,"jobId":3},{"id":557,"jobId":4}]`, func(r *http.Request) {
+		wantURL, _ := url.Parse("http://fakeurl/v4/events/77/next")
+		if r.URL.String() != wantURL.String() {
+			t.Errorf("Next jobs URL=%q, want %q", r.URL, wantURL)
+		}
+		if r.Method != "POST" {
+			t.Errorf("Next jobs method=%q, want POST", r.Method)
+		}
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r.Body)
+		want := `{"jobId":2,"meta":{"version":"1.2.3"}}`
+		if buf.String() != want {
+			t.Errorf("buf.String() = %q, want %q", buf.String(), want)
+		}
+	})
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
+
+	builds, err := testAPI.StartNextJobs(77, 2, map[string]interface{}{"version": "1.2.3"})
+	if err != nil {
+		t.Fatalf("Unexpected error from StartNextJobs: %v", err)
+	}
+	if len(builds) != 2 || builds[0].ID != 556 || builds[1].JobID != 4 {
+		t.Errorf("StartNextJobs() = %+v, want builds 556 and 557", builds)
+	}
+}
+
 func TestGetAPIURL(t *testing.T) {
 	http := makeValidatedFakeHTTPClient(t, 200, "{}", func(r *http.Request) {
 		buf := new(bytes.Buffer)
@@ -501,7 +630,7 @@ func TestGetAPIURL(t *testing.T) {
 			t.Errorf("buf.String() = %q", buf.String())
 		}
 	})
-	testAPI := api{"http://fakeurl", "faketoken", http}
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 	url, _ := testAPI.GetAPIURL()
 
 	if !reflect.DeepEqual(url, "http://fakeurl/v4/") {
@@ -516,9 +645,10 @@ func TestSecretsForBuild(t *testing.T) {
 		EventID: 8765,
 		SHA:     "testSHA",
 	}
-	testResponse := `[{"name": "foo", "value": "bar"}]`
+	testResponse := `[{"name": "foo", "value": "bar"}, {"name": "baz", "value": "qux", "allowInPR": true}]`
 	wantSecrets := Secrets{
 		{Name: "foo", Value: "bar"},
+		{Name: "baz", Value: "qux", AllowInPR: true},
 	}
 
 	http := makeValidatedFakeHTTPClient(t, 200, testResponse, func(r *http.Request) {
@@ -527,7 +657,7 @@ func TestSecretsForBuild(t *testing.T) {
 			t.Errorf("Secrets URL=%q, want %q", r.URL, wantURL)
 		}
 	})
-	testAPI := api{"http://fakeurl", "faketoken", http}
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 
 	s, err := testAPI.SecretsForBuild(testBuild)
 	if err != nil {
@@ -535,7 +665,7 @@ func TestSecretsForBuild(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(s, wantSecrets) {
-		t.Errorf("s=%q, want %q", s, wantSecrets)
+		t.Errorf("s=%v, want %v", s, wantSecrets)
 	}
 }
 
@@ -558,7 +688,7 @@ func TestGetBuildToken(t *testing.T) {
 		}
 	})
 
-	testAPI := api{"http://fakeurl", "faketoken", http}
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
 	token, err := testAPI.GetBuildToken(testBuildID, testBuildTimeoutMinutes)
 	if err != nil {
 		t.Fatalf("Unexpected error from GetBuildToken: %v", err)
@@ -568,3 +698,272 @@ func TestGetBuildToken(t *testing.T) {
 		t.Errorf("t=%q, want %q", token, wantToken)
 	}
 }
+
+func TestGetCheckoutToken(t *testing.T) {
+	http := makeValidatedFakeHTTPClient(t, 200, `{"token": "ghs_checkout"}`, func(r *http.Request) {
+		wantURL := "http://fakeurl/v4/builds/1111/checkoutToken"
+		if r.URL.String() != wantURL || r.Method != "GET" {
+			t.Errorf("Checkout Token request = %s %q, want GET %q", r.Method, r.URL, wantURL)
+		}
+	})
+
+	testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, DefaultRetryPolicy}
+	token, err := testAPI.GetCheckoutToken(1111)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetCheckoutToken: %v", err)
+	}
+	if token != "ghs_checkout" {
+		t.Errorf("token=%q, want %q", token, "ghs_checkout")
+	}
+}
+
+func TestJobParameters(t *testing.T) {
+	data := `{
+		"id": 1,
+		"permutations": [{"parameters": {
+			"version": "1.0",
+			"env": ["staging", "production"],
+			"region": {"value": "us-west-1", "description": "Where to deploy"},
+			"size": {"value": ["small", "large"]}
+		}}]
+	}`
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		t.Fatalf("Unexpected error parsing the job: %v", err)
+	}
+
+	want := map[string]ParameterDef{
+		"version": {Value: "1.0"},
+		"env":     {Value: "staging", Choices: []string{"staging", "production"}},
+		"region":  {Value: "us-west-1", Description: "Where to deploy"},
+		"size":    {Value: "small", Choices: []string{"small", "large"}},
+	}
+	if got := job.Parameters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parameters() = %+v, want %+v", got, want)
+	}
+	if params := (Job{}).Parameters(); params != nil {
+		t.Errorf("Parameters() = %v for a job without permutations", params)
+	}
+
+	if err := json.Unmarshal([]byte(`{"permutations": [{"parameters": {"n": 3}}]}`), &job); err == nil {
+		t.Errorf("Expected an error for a number parameter")
+	}
+}
+
+func TestAPITimeout(t *testing.T) {
+	oldTimeout := APITimeout
+	defer func() { APITimeout = oldTimeout }()
+	APITimeout = 3 * time.Second
+
+	a, err := New("http://fakeurl", "faketoken")
+	if err != nil {
+		t.Fatalf("Unexpected error creating the API: %v", err)
+	}
+	if timeout := a.(api).client.Timeout; timeout != APITimeout {
+		t.Errorf("API calls time out after %v, want %v", timeout, APITimeout)
+	}
+}
+
+func TestObserveCall(t *testing.T) {
+	start := time.Now()
+	observeCall("PATCH", start, &http.Response{StatusCode: 200}, nil)
+	observeCall("PATCH", start, &http.Response{StatusCode: 503}, nil)
+	observeCall("PATCH", start, nil, errors.New("connection refused"))
+
+	buf := new(bytes.Buffer)
+	metrics.Default.WriteTo(buf)
+	for _, want := range []string{
+		`sd_launcher_api_request_duration_seconds_count{method="PATCH",code="200"} 1`,
+		`sd_launcher_api_request_duration_seconds_count{method="PATCH",code="503"} 1`,
+		`sd_launcher_api_request_duration_seconds_count{method="PATCH",code="error"} 1`,
+		`sd_launcher_api_errors_total{method="PATCH"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("Metrics have no %s", want)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	var job Job
+	data := `{"permutations": [{"annotations": {"screwdriver.cd/gitLFS": "false", "screwdriver.cd/gitSubmodules": true}}]}`
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		t.Fatalf("Unexpected error parsing the job: %v", err)
+	}
+	pipeline := Pipeline{Annotations: Annotations{"screwdriver.cd/gitLFS": true, "screwdriver.cd/other": 3}}
+	a := pipeline.Annotations.Merge(job.Annotations())
+
+	tests := map[string]bool{"screwdriver.cd/gitLFS": false, "screwdriver.cd/gitSubmodules": true, "screwdriver.cd/missing": true}
+	for key, want := range tests {
+		if got, err := a.Bool(key, true); err != nil || got != want {
+			t.Errorf("Bool(%q) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+	if got, err := a.Bool("screwdriver.cd/other", true); err == nil || !got {
+		t.Errorf("Bool() = %v, %v, want the default and an error for a number", got, err)
+	}
+	if a := (Job{}).Annotations(); a != nil {
+		t.Errorf("Annotations() = %v for a job without permutations", a)
+	}
+}
+
+func TestAnnotationsStrings(t *testing.T) {
+	var a Annotations
+	data := `{"list": ["services/api", " libs "], "csv": "services/api, libs,", "number": 3, "mixed": ["libs", 3]}`
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		t.Fatalf("Unexpected error parsing the annotations: %v", err)
+	}
+
+	want := []string{"services/api", "libs"}
+	for _, key := range []string{"list", "csv"} {
+		if got, err := a.Strings(key); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Strings(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if got, err := a.Strings("missing"); err != nil || got != nil {
+		t.Errorf("Strings() = %q, %v, want nothing for a missing annotation", got, err)
+	}
+	for _, key := range []string{"number", "mixed"} {
+		if _, err := a.Strings(key); err == nil {
+			t.Errorf("Strings(%q) should fail for %v", key, a[key])
+		}
+	}
+}
+
+func TestAnnotationsInt(t *testing.T) {
+	var a Annotations
+	data := `{"number": 30, "string": " 45 ", "float": 1.5, "word": "soon", "list": [1]}`
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		t.Fatalf("Unexpected error parsing the annotations: %v", err)
+	}
+	a["int"] = 15
+
+	for key, want := range map[string]int{"number": 30, "string": 45, "int": 15, "missing": 90} {
+		if got, err := a.Int(key, 90); err != nil || got != want {
+			t.Errorf("Int(%q) = %d, %v, want %d", key, got, err, want)
+		}
+	}
+	for _, key := range []string{"float", "word", "list"} {
+		if got, err := a.Int(key, 90); err == nil || got != 90 {
+			t.Errorf("Int(%q) = %d, %v, want the default and an error", key, got, err)
+		}
+	}
+}
+
+func TestAnnotationsString(t *testing.T) {
+	a := Annotations{"shell": " bash ", "empty": "", "number": 3.0}
+	for key, want := range map[string]string{"shell": "bash", "empty": "sh", "missing": "sh"} {
+		if got, err := a.String(key, "sh"); err != nil || got != want {
+			t.Errorf("String(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if got, err := a.String("number", "sh"); err == nil || got != "sh" {
+		t.Errorf("String() = %q, %v, want the default and an error", got, err)
+	}
+}
+
+func TestSecretsAllowedInPR(t *testing.T) {
+	secrets := Secrets{
+		{Name: "A", Value: "a", AllowInPR: true},
+		{Name: "B", Value: "b"},
+		{Name: "C", Value: "c", AllowInPR: true},
+	}
+
+	want := Secrets{
+		{Name: "A", Value: "a", AllowInPR: true},
+		{Name: "C", Value: "c", AllowInPR: true},
+	}
+	if got := secrets.AllowedInPR(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AllowedInPR() = %v, want %v", got, want)
+	}
+	if got := secrets.Values(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Values() = %v, want [a b c]", got)
+	}
+	if got, want := secrets.Without("B"), (Secrets{secrets[0], secrets[2]}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Without(B) = %v, want %v", got, want)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	oldRandInt63n := randInt63n
+	defer func() { randInt63n = oldRandInt63n }()
+
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 2 * time.Second}
+	for attempt, backoff := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second} {
+		randInt63n = func(n int64) int64 { return 0 }
+		if got := p.delay(attempt); got != backoff/2 {
+			t.Errorf("Shortest delay after attempt %d = %v, want %v", attempt, got, backoff/2)
+		}
+		randInt63n = func(n int64) int64 { return n - 1 }
+		if got := p.delay(attempt); got != backoff {
+			t.Errorf("Longest delay after attempt %d = %v, want %v", attempt, got, backoff)
+		}
+	}
+}
+
+func TestRetryNotOn4xx(t *testing.T) {
+	tests := []struct {
+		code     int
+		attempts int
+	}{
+		{404, 1},
+		{403, 1},
+		{502, 3},
+	}
+
+	for _, test := range tests {
+		attempts := 0
+		http := makeValidatedFakeHTTPClient(t, test.code, `{"statusCode": 1, "error": "error", "message": "message"}`, func(r *http.Request) {
+			attempts++
+		})
+		testAPI := api{"http://fakeurl", StaticToken("faketoken"), http, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second}}
+
+		if _, err := testAPI.JobFromID(1); err == nil {
+			t.Errorf("Expected an error for a %d response", test.code)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%d response was tried %d times, want %d", test.code, attempts, test.attempts)
+		}
+	}
+}
+
+func TestRetryMaxElapsed(t *testing.T) {
+	oldSleep, oldNow, oldRandInt63n := sleep, now, randInt63n
+	defer func() { sleep, now, randInt63n = oldSleep, oldNow, oldRandInt63n }()
+
+	// Always wait for the full backoff
+	randInt63n = func(n int64) int64 { return n - 1 }
+	clock := time.Unix(0, 0)
+	now = func() time.Time { return clock }
+	sleep = func(d time.Duration) { clock = clock.Add(d) }
+
+	attempts := 0
+	p := RetryPolicy{MaxAttempts: 10, MaxElapsed: 10 * time.Second, BaseDelay: 2 * time.Second}
+	err := p.Retry(func() error {
+		attempts++
+		return fmt.Errorf("API is down")
+	})
+	if err == nil {
+		t.Fatalf("Expected an error once the time is up")
+	}
+	// Attempts start at 0s, 2s and 6s, waiting 8s more would go over 10s
+	if attempts != 3 {
+		t.Errorf("Tried %d times in %v, want 3", attempts, p.MaxElapsed)
+	}
+	if !strings.Contains(err.Error(), "API is down") {
+		t.Errorf("Error %q does not contain the last error", err)
+	}
+}
+
+func TestNewWithRetryPolicy(t *testing.T) {
+	if _, err := NewWithRetryPolicy("http://fakeurl", "faketoken", RetryPolicy{MaxAttempts: 0}); err == nil {
+		t.Errorf("Expected an error for a policy without attempts")
+	}
+	a, err := NewWithRetryPolicy("http://fakeurl", "faketoken", RetryPolicy{MaxAttempts: 2, MaxElapsed: time.Minute})
+	if err != nil {
+		t.Fatalf("Unexpected error creating API: %v", err)
+	}
+	if got := a.(api).retryPolicy; got.MaxAttempts != 2 || got.MaxElapsed != time.Minute {
+		t.Errorf("Retry policy = %+v, want 2 attempts in a minute", got)
+	}
+}
@@ -0,0 +1,165 @@
+package screwdriver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are renewed TokenRefreshMargin before they expire. A failed renewal is tried
+// again after TokenRetryInterval.
+var (
+	TokenRefreshMargin = 5 * time.Minute
+	TokenRetryInterval = 30 * time.Second
+)
+
+// TokenSource provides the token sent with each API and store call
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a token that is never renewed
+type StaticToken string
+
+// Token returns the token itself
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// RefreshingToken is a JWT renewed with refresh before it expires
+type RefreshingToken struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	// retryAt holds off the next renewal after a failed one
+	retryAt    time.Time
+	refresh    func() (string, error)
+	refreshing bool
+}
+
+// NewRefreshingToken returns a TokenSource starting with token and renewing it with refresh.
+// Tokens without an expiry are never renewed.
+func NewRefreshingToken(token string, refresh func() (string, error)) *RefreshingToken {
+	return &RefreshingToken{
+		token:   token,
+		expiry:  tokenExpiry(token),
+		refresh: refresh,
+	}
+}
+
+// tokenExpiry reads the expiry of a JWT, without checking its signature. It is zero when
+// the token is not a JWT or has no expiry.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
+
+// refreshAt is when the token should be renewed, zero if it never expires. It is
+// TokenRetryInterval after the last failed renewal at the earliest.
+func (t *RefreshingToken) refreshAt() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.expiry.IsZero() {
+		return time.Time{}
+	}
+	at := t.expiry.Add(-TokenRefreshMargin)
+	if t.retryAt.After(at) {
+		return t.retryAt
+	}
+	return at
+}
+
+// Token returns the current token, renewing it first if it is about to expire. It fails
+// once the token has expired without being renewed.
+func (t *RefreshingToken) Token() (string, error) {
+	if at := t.refreshAt(); !at.IsZero() && !now().Before(at) {
+		if err := t.Refresh(); err != nil {
+			log.Printf("WARNING: renewing the token: %v", err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.expiry.IsZero() && !now().Before(t.expiry) {
+		return "", fmt.Errorf("Token expired at %v and could not be renewed", t.expiry.Format(time.RFC3339))
+	}
+	return t.token, nil
+}
+
+// Refresh renews the token now. Calls made by refresh itself get the current token.
+func (t *RefreshingToken) Refresh() error {
+	t.mu.Lock()
+	if t.refreshing {
+		t.mu.Unlock()
+		return nil
+	}
+	t.refreshing = true
+	// Calls made meanwhile keep the current token rather than renewing it again
+	t.retryAt = now().Add(TokenRetryInterval)
+	t.mu.Unlock()
+
+	token, err := t.refresh()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshing = false
+	if err != nil {
+		t.retryAt = now().Add(TokenRetryInterval)
+		return err
+	}
+	t.token = token
+	t.expiry = tokenExpiry(token)
+	t.retryAt = time.Time{}
+	return nil
+}
+
+// Start renews the token in the background before each expiry, so calls in flight never
+// carry an expired token. Calling the returned function stops it.
+func (t *RefreshingToken) Start() func() {
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			at := t.refreshAt()
+			if at.IsZero() {
+				return
+			}
+
+			timer := time.NewTimer(at.Sub(now()))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			// A failed renewal pushes refreshAt back by TokenRetryInterval
+			if err := t.Refresh(); err != nil {
+				log.Printf("WARNING: renewing the token: %v", err)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
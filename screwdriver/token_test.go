@@ -0,0 +1,178 @@
+package screwdriver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fakeJWT makes an unsigned token expiring at exp
+func fakeJWT(name string, exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":%q,"exp":%d}`, name, exp.Unix())))
+	return "eyJhbGciOiJIUzI1NiJ9." + payload + ".signature"
+}
+
+func pinNow(t time.Time) func() {
+	oldNow := now
+	now = func() time.Time { return t }
+	return func() { now = oldNow }
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := testNow.Add(time.Hour)
+	if got := tokenExpiry(fakeJWT("build", exp)); !got.Equal(exp) {
+		t.Errorf("tokenExpiry() = %v, want %v", got, exp)
+	}
+
+	for _, token := range []string{"faketoken", "a.!!!.c", "a." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".c"} {
+		if got := tokenExpiry(token); !got.IsZero() {
+			t.Errorf("tokenExpiry(%q) = %v, want no expiry", token, got)
+		}
+	}
+}
+
+func TestRefreshingToken(t *testing.T) {
+	defer pinNow(testNow)()
+
+	renewed := fakeJWT("renewed", testNow.Add(2*time.Hour))
+	refreshes := 0
+	tokens := NewRefreshingToken(fakeJWT("first", testNow.Add(time.Hour)), func() (string, error) {
+		refreshes++
+		return renewed, nil
+	})
+
+	if _, err := tokens.Token(); err != nil || refreshes != 0 {
+		t.Errorf("Token() renewed a token an hour away from expiry (err %v)", err)
+	}
+
+	now = func() time.Time { return testNow.Add(time.Hour - time.Minute) }
+	got, err := tokens.Token()
+	if err != nil {
+		t.Fatalf("Unexpected error from Token(): %v", err)
+	}
+	if got != renewed || refreshes != 1 {
+		t.Errorf("Token() = %q after %d refreshes, want the renewed token", got, refreshes)
+	}
+}
+
+func TestRefreshingTokenFailure(t *testing.T) {
+	defer pinNow(testNow)()
+
+	first := fakeJWT("first", testNow.Add(time.Minute))
+	refreshes := 0
+	tokens := NewRefreshingToken(first, func() (string, error) {
+		refreshes++
+		return "", fmt.Errorf("403 Forbidden: Insufficient scope")
+	})
+
+	if got, err := tokens.Token(); err != nil || got != first {
+		t.Errorf("Token() = %q, %v, want to keep using the current token", got, err)
+	}
+	// The following calls don't try again until TokenRetryInterval has passed
+	for i := 0; i < 3; i++ {
+		tokens.Token()
+	}
+	if refreshes != 1 {
+		t.Errorf("Tried renewing the token %d times, want once", refreshes)
+	}
+	now = func() time.Time { return testNow.Add(TokenRetryInterval) }
+	tokens.Token()
+	if refreshes != 2 {
+		t.Errorf("Tried renewing the token %d times after TokenRetryInterval, want twice", refreshes)
+	}
+
+	now = func() time.Time { return testNow.Add(time.Minute) }
+	if got, err := tokens.Token(); err == nil {
+		t.Errorf("Token() = %q once expired, want an error", got)
+	}
+}
+
+func TestRefreshingTokenUsedByRefresh(t *testing.T) {
+	defer pinNow(testNow)()
+
+	first := fakeJWT("first", testNow.Add(time.Minute))
+	var tokens *RefreshingToken
+	tokens = NewRefreshingToken(first, func() (string, error) {
+		// API and store calls made while renewing still go out
+		got, err := tokens.Token()
+		if got != first {
+			t.Errorf("Token() = %q while renewing, want the current token", got)
+		}
+		return fakeJWT("renewed", testNow.Add(time.Hour)), err
+	})
+
+	if err := tokens.Refresh(); err != nil {
+		t.Errorf("Unexpected error from Refresh: %v", err)
+	}
+}
+
+func TestStaticTokenNeverRefreshed(t *testing.T) {
+	tokens := NewRefreshingToken("faketoken", func() (string, error) {
+		t.Errorf("Refreshed a token without expiry")
+		return "", nil
+	})
+
+	stop := tokens.Start()
+	defer stop()
+	if got, _ := tokens.Token(); got != "faketoken" {
+		t.Errorf("Token() = %q, want %q", got, "faketoken")
+	}
+}
+
+func TestRefreshingTokenStart(t *testing.T) {
+	refreshed := make(chan struct{})
+	renewed := fakeJWT("renewed", time.Now().Add(time.Hour))
+	tokens := NewRefreshingToken(fakeJWT("first", time.Now().Add(time.Second)), func() (string, error) {
+		close(refreshed)
+		return renewed, nil
+	})
+
+	stop := tokens.Start()
+	defer stop()
+
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Token was not renewed in the background")
+	}
+	if got, _ := tokens.Token(); got != renewed {
+		t.Errorf("Token() = %q, want the renewed token", got)
+	}
+}
+
+type tokenSequence []string
+
+func (s *tokenSequence) Token() (string, error) {
+	token := (*s)[0]
+	if len(*s) > 1 {
+		*s = (*s)[1:]
+	}
+	return token, nil
+}
+
+func TestRetryUsesCurrentToken(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer second" {
+			t.Errorf("Retried with %q, want the renewed token", got)
+		}
+		fmt.Fprint(w, `{"id": 1234, "steps": [{"name": "install"}]}`)
+	}))
+	defer server.Close()
+
+	tokens := tokenSequence{"first", "second"}
+	testAPI := api{server.URL, &tokens, http.DefaultClient, RetryPolicy{MaxAttempts: 2}}
+	if _, err := testAPI.BuildFromID(1234); err != nil {
+		t.Errorf("Unexpected error from BuildFromID: %v", err)
+	}
+}
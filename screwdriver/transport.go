@@ -0,0 +1,103 @@
+package screwdriver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Transport is used by the API and store clients. It goes through the proxies set with
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, and can be replaced with one from NewTransport.
+var Transport http.RoundTripper = http.DefaultTransport
+
+// APITimeout is the deadline of each API call, from sending the request to reading the response
+var APITimeout = 20 * time.Second
+
+// HTTPOptions tune the connections of the API and store clients
+type HTTPOptions struct {
+	// ConnectTimeout limits the time to open a connection, not counting the TLS handshake
+	ConnectTimeout time.Duration
+	// ReadTimeout limits the wait for the response headers once the request is sent, 0 for no limit
+	ReadTimeout time.Duration
+	// KeepAlive is the period of the TCP keep-alives, negative to turn them off
+	KeepAlive time.Duration
+	// IdleConnTimeout closes the connections left unused that long, 0 for never
+	IdleConnTimeout time.Duration
+	// MaxIdleConns is the number of unused connections kept open for each host
+	MaxIdleConns int
+}
+
+// DefaultHTTPOptions are the connection settings used unless set otherwise
+var DefaultHTTPOptions = HTTPOptions{
+	ConnectTimeout:  30 * time.Second,
+	ReadTimeout:     time.Minute,
+	KeepAlive:       30 * time.Second,
+	IdleConnTimeout: 90 * time.Second,
+	MaxIdleConns:    100,
+}
+
+// Validate checks that the options make sense
+func (o HTTPOptions) Validate() error {
+	if o.ConnectTimeout <= 0 {
+		return fmt.Errorf("Invalid HTTP options: the connect timeout must be positive, got %v", o.ConnectTimeout)
+	}
+	if o.ReadTimeout < 0 || o.IdleConnTimeout < 0 {
+		return fmt.Errorf("Invalid HTTP options: timeouts can't be negative")
+	}
+	if o.MaxIdleConns < 0 {
+		return fmt.Errorf("Invalid HTTP options: the idle connections can't be negative, got %d", o.MaxIdleConns)
+	}
+	return nil
+}
+
+// NewTransport returns a transport going through the proxies of the environment that also
+// trusts the CAs in caCertFile, when set. insecureSkipVerify turns off certificate checks
+// entirely and is only meant for lab environments.
+func NewTransport(caCertFile string, insecureSkipVerify bool) (*http.Transport, error) {
+	return NewTransportWithOptions(caCertFile, insecureSkipVerify, DefaultHTTPOptions)
+}
+
+// NewTransportWithOptions returns a transport like NewTransport with the connection settings
+// of options
+func NewTransportWithOptions(caCertFile string, insecureSkipVerify bool, options HTTPOptions) (*http.Transport, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if caCertFile != "" {
+		pem, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Reading CA certificates: %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM certificates found in %q", caCertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   options.ConnectTimeout,
+			KeepAlive: options.KeepAlive,
+		}).DialContext,
+		TLSClientConfig: tlsConfig,
+		// The launcher only talks to the API and the store, so every idle connection can go to one of them
+		MaxIdleConns:          options.MaxIdleConns,
+		MaxIdleConnsPerHost:   options.MaxIdleConns,
+		IdleConnTimeout:       options.IdleConnTimeout,
+		ResponseHeaderTimeout: options.ReadTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
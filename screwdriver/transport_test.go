@@ -0,0 +1,116 @@
+package screwdriver
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tlsServer(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("Creating CA file: %v", err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	return server, f.Name()
+}
+
+func TestNewTransportCACert(t *testing.T) {
+	server, caFile := tlsServer(t)
+	defer server.Close()
+	defer os.Remove(caFile)
+
+	if _, err := (&http.Client{Transport: http.DefaultTransport}).Get(server.URL); err == nil {
+		t.Fatalf("Expected the test server certificate to be unknown")
+	}
+
+	transport, err := NewTransport(caFile, false)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewTransport: %v", err)
+	}
+	if transport.Proxy == nil {
+		t.Errorf("Transport does not use the proxies of the environment")
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err != nil {
+		t.Errorf("Request with the CA = %v, want success", err)
+	}
+}
+
+func TestNewTransportInsecure(t *testing.T) {
+	server, caFile := tlsServer(t)
+	defer server.Close()
+	defer os.Remove(caFile)
+
+	transport, err := NewTransport("", true)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewTransport: %v", err)
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err != nil {
+		t.Errorf("Request skipping verification = %v, want success", err)
+	}
+}
+
+func TestNewTransportInvalidCA(t *testing.T) {
+	if _, err := NewTransport("/does/not/exist.pem", false); err == nil || !strings.HasPrefix(err.Error(), "Reading CA certificates") {
+		t.Errorf("NewTransport() error = %v, want a read error", err)
+	}
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("Creating CA file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	if _, err := NewTransport(f.Name(), false); err == nil || !strings.HasPrefix(err.Error(), "No PEM certificates found") {
+		t.Errorf("NewTransport() error = %v, want a PEM error", err)
+	}
+}
+
+func TestNewTransportWithOptions(t *testing.T) {
+	options := HTTPOptions{
+		ConnectTimeout:  5 * time.Second,
+		ReadTimeout:     50 * time.Millisecond,
+		KeepAlive:       -1,
+		IdleConnTimeout: time.Minute,
+		MaxIdleConns:    4,
+	}
+	transport, err := NewTransportWithOptions("", false, options)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewTransportWithOptions: %v", err)
+	}
+	if transport.MaxIdleConns != 4 || transport.MaxIdleConnsPerHost != 4 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Transport pools %d connections (%d per host) for %v, want the options", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+
+	// A stalled server fails the call instead of hanging it
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Errorf("Expected a timeout from a server not responding")
+	}
+
+	for _, invalid := range []HTTPOptions{
+		{},
+		{ConnectTimeout: time.Second, ReadTimeout: -time.Second},
+		{ConnectTimeout: time.Second, MaxIdleConns: -1},
+	} {
+		if _, err := NewTransportWithOptions("", false, invalid); err == nil {
+			t.Errorf("Expected an error for the options %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Package store talks to the Screwdriver Store, which keeps the artifacts and the caches of the builds
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// ChecksumHeader carries the hex encoded SHA256 of the body of a request or a response. The store
+// rejects uploads that don't match it, and downloads that don't match it fail.
+const ChecksumHeader = "X-Checksum-Sha256"
+
+// DefaultTimeout is how long a request can take unless Options.Timeout is set
+const DefaultTimeout = 30 * time.Minute
+
+// ErrNotFound is returned for paths the store has nothing at
+var ErrNotFound = errors.New("Not found in the store")
+
+// ErrChecksum is returned when the bytes downloaded don't match the checksum the store sent
+type ErrChecksum struct {
+	Path string
+	Want string
+	Got  string
+}
+
+func (e ErrChecksum) Error() string {
+	return fmt.Sprintf("Checksum of %s is %s, want %s", e.Path, e.Got, e.Want)
+}
+
+// Options controls how a Client talks to the store
+type Options struct {
+	// Timeout is how long a request can take, DefaultTimeout when 0
+	Timeout time.Duration
+	// RetryPolicy controls how requests failing on the network or with a 5xx are retried,
+	// screwdriver.DefaultRetryPolicy when unset
+	RetryPolicy screwdriver.RetryPolicy
+	// PartSize sends the uploads bigger than that many bytes in parts of that size, one request
+	// each with a Content-Range header, 0 to always send them whole
+	PartSize int64
+}
+
+// Client reads and writes the store at paths like "v1/builds/1/ARTIFACTS/report.html"
+type Client struct {
+	storeURL string
+	tokens   screwdriver.TokenSource
+	client   *http.Client
+	options  Options
+}
+
+// New returns a Client of the store at storeURL authenticating with the tokens of tokens
+func New(storeURL string, tokens screwdriver.TokenSource, options Options) Client {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.RetryPolicy.MaxAttempts <= 0 {
+		options.RetryPolicy = screwdriver.DefaultRetryPolicy
+	}
+	return Client{
+		storeURL: strings.TrimSuffix(storeURL, "/"),
+		tokens:   tokens,
+		client:   &http.Client{Timeout: options.Timeout, Transport: screwdriver.Transport},
+		options:  options,
+	}
+}
+
+// WithPartSize returns a copy of c sending the uploads bigger than size bytes in parts
+func (c Client) WithPartSize(size int64) Client {
+	c.options.PartSize = size
+	return c
+}
+
+// url escapes each segment of the slash separated path p
+func (c Client) url(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return c.storeURL + "/" + strings.Join(segments, "/")
+}
+
+// do sends a request to p, retrying on network errors and 5xx responses. body is called for
+// each attempt, nil for requests without one. A response other than a 5xx is returned for the
+// caller to check.
+func (c Client) do(method, p string, header http.Header, body func() (io.Reader, int64, error)) (*http.Response, error) {
+	u := c.url(p)
+	var res *http.Response
+	err := c.options.RetryPolicy.Retry(func() error {
+		var reader io.Reader
+		var size int64
+		if body != nil {
+			var err error
+			if reader, size, err = body(); err != nil {
+				return err
+			}
+			if size == 0 {
+				reader = http.NoBody
+			}
+		}
+		req, err := http.NewRequest(method, u, reader)
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.ContentLength = size
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		token, err := c.tokens.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		res, err = c.client.Do(req)
+		if err != nil {
+			log.Printf("WARNING: received error from %s(%s): %v", method, u, err)
+			return err
+		}
+		if res.StatusCode/100 == 5 {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+			log.Printf("WARNING: received response %d from %s %s", res.StatusCode, method, u)
+			return fmt.Errorf("%d returned from %s %s", res.StatusCode, method, u)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Exists tells whether the store has something at p
+func (c Client) Exists(p string) (bool, error) {
+	res, err := c.do("HEAD", p, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return false, nil
+	case res.StatusCode/100 != 2:
+		return false, fmt.Errorf("%d returned from HEAD %s", res.StatusCode, p)
+	}
+	return true, nil
+}
+
+// Upload stores the size bytes of body at p, in parts when they are more than the part size.
+// Each request carries the checksum of what it sends, and each part is retried on its own.
+func (c Client) Upload(p, contentType string, body io.ReadSeeker, size int64) error {
+	partSize := c.options.PartSize
+	if partSize <= 0 || size <= partSize {
+		return c.put(p, contentType, body, 0, size, "")
+	}
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if offset+n > size {
+			n = size - offset
+		}
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+n-1, size)
+		if err := c.put(p, contentType, body, offset, n, contentRange); err != nil {
+			return fmt.Errorf("%s: %v", contentRange, err)
+		}
+	}
+	return nil
+}
+
+// put sends the n bytes of body from offset, reading them again for every attempt
+func (c Client) put(p, contentType string, body io.ReadSeeker, offset, n int64, contentRange string) error {
+	section := func() (io.Reader, int64, error) {
+		if _, err := body.Seek(offset, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return io.LimitReader(body, n), n, nil
+	}
+	r, _, err := section()
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set(ChecksumHeader, hex.EncodeToString(hash.Sum(nil)))
+	if contentRange != "" {
+		header.Set("Content-Range", contentRange)
+	}
+	res, err := c.do("PUT", p, header, section)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%d returned from PUT %s", res.StatusCode, p)
+	}
+	return nil
+}
+
+// Download writes what the store has at p to w, checking it against the checksum the store
+// sent. A download cut short fails, DownloadFile resumes them.
+func (c Client) Download(p string, w io.Writer) error {
+	res, err := c.do("GET", p, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case res.StatusCode/100 != 2:
+		return fmt.Errorf("%d returned from GET %s", res.StatusCode, p)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), res.Body); err != nil {
+		return fmt.Errorf("Reading %s: %v", p, err)
+	}
+	return checkSum(p, res.Header.Get(ChecksumHeader), hash.Sum(nil))
+}
+
+// DownloadFile saves what the store has at p as dest. The bytes land in dest.part first: a
+// download cut short goes on with a Range request from where it stopped, on the next attempt
+// or the next call. dest only appears once its checksum matched.
+func (c Client) DownloadFile(p, dest string) error {
+	part := dest + ".part"
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Requests failing get retried by do, the outer retries go on with the downloads cut short
+	var want string
+	var permanent error
+	err = c.options.RetryPolicy.Retry(func() error {
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			permanent = err
+			return nil
+		}
+		header := http.Header{}
+		if offset > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		res, err := c.do("GET", p, header, nil)
+		if err != nil {
+			permanent = err
+			return nil
+		}
+		defer res.Body.Close()
+
+		switch {
+		case res.StatusCode == http.StatusNotFound:
+			permanent = ErrNotFound
+			return nil
+		case res.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			// What was kept is not a start of the file anymore
+			f.Truncate(0)
+			return fmt.Errorf("%d returned from GET %s from byte %d", res.StatusCode, p, offset)
+		case res.StatusCode == http.StatusOK && offset > 0:
+			// The store sends the whole file
+			if err := f.Truncate(0); err != nil {
+				permanent = err
+				return nil
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				permanent = err
+				return nil
+			}
+		case res.StatusCode/100 != 2:
+			permanent = fmt.Errorf("%d returned from GET %s", res.StatusCode, p)
+			return nil
+		}
+		if sum := res.Header.Get(ChecksumHeader); sum != "" {
+			want = sum
+		}
+		if _, err := io.Copy(f, res.Body); err != nil {
+			log.Printf("WARNING: download of %s cut short: %v", p, err)
+			return fmt.Errorf("Reading %s: %v", p, err)
+		}
+		return nil
+	})
+	if err == nil {
+		err = permanent
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if want != "" {
+		got, err := fileSum(part)
+		if err != nil {
+			return err
+		}
+		if err := checkSum(p, want, got); err != nil {
+			os.Remove(part)
+			return err
+		}
+	}
+	return os.Rename(part, dest)
+}
+
+func fileSum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// checkSum compares the sum of the bytes of p with the one the store sent, if any
+func checkSum(p, want string, sum []byte) error {
+	if got := hex.EncodeToString(sum); want != "" && !strings.EqualFold(want, got) {
+		return ErrChecksum{Path: p, Want: want, Got: got}
+	}
+	return nil
+}
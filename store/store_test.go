@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+var testOptions = Options{RetryPolicy: screwdriver.RetryPolicy{MaxAttempts: 3}}
+
+func sum(data string) string {
+	s := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(s[:])
+}
+
+// fakeStore keeps the files PUT to it after checking their checksum, and serves them with
+// theirs. It fails the first fail requests with a 503 and cuts the first cut downloads after
+// half of the file.
+type fakeStore struct {
+	sync.Mutex
+	files   map[string]string
+	fail    int
+	cut     int
+	corrupt bool
+	ranges  []string
+}
+
+func (s *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Header.Get("Authorization") != "Bearer faketoken" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if s.fail > 0 {
+		s.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(ChecksumHeader) != sum(string(body)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if rng := r.Header.Get("Content-Range"); rng != "" {
+			s.ranges = append(s.ranges, rng)
+			s.files[r.URL.Path] += string(body)
+			return
+		}
+		s.files[r.URL.Path] = string(body)
+	case "GET", "HEAD":
+		file, ok := s.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(ChecksumHeader, sum(file))
+		if s.corrupt {
+			file = strings.ToUpper(file)
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			s.ranges = append(s.ranges, rng)
+			var start int
+			fmt.Sscanf(rng, "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(file)-1, len(file)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(file[start:]))
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(file)))
+		if s.cut > 0 {
+			s.cut--
+			w.Write([]byte(file[:len(file)/2]))
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(file))
+	}
+}
+
+func newTestClient(fake *fakeStore, options Options) (Client, func()) {
+	server := httptest.NewServer(fake)
+	return New(server.URL+"/", screwdriver.StaticToken("faketoken"), options), server.Close
+}
+
+func TestUploadDownload(t *testing.T) {
+	fake := &fakeStore{files: map[string]string{}, fail: 1}
+	c, stop := newTestClient(fake, testOptions)
+	defer stop()
+
+	if ok, err := c.Exists("v1/builds/1/ARTIFACTS/my report.txt"); ok || err != nil {
+		t.Errorf("Exists() = %v, %v before the upload, want false", ok, err)
+	}
+	if err := c.Upload("v1/builds/1/ARTIFACTS/my report.txt", "text/plain", strings.NewReader("all good"), 8); err != nil {
+		t.Fatalf("Unexpected error from Upload: %v", err)
+	}
+	if got := fake.files["/v1/builds/1/ARTIFACTS/my report.txt"]; got != "all good" {
+		t.Errorf("Stored %q, want %q", got, "all good")
+	}
+	if ok, err := c.Exists("v1/builds/1/ARTIFACTS/my report.txt"); !ok || err != nil {
+		t.Errorf("Exists() = %v, %v after the upload, want true", ok, err)
+	}
+
+	var got bytes.Buffer
+	if err := c.Download("v1/builds/1/ARTIFACTS/my report.txt", &got); err != nil || got.String() != "all good" {
+		t.Errorf("Download() = %q, %v, want %q", got.String(), err, "all good")
+	}
+	if err := c.Download("v1/builds/1/ARTIFACTS/missing", &got); err != ErrNotFound {
+		t.Errorf("Download() of a missing file = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUploadParts(t *testing.T) {
+	fake := &fakeStore{files: map[string]string{}}
+	options := testOptions
+	options.PartSize = 8
+	c, stop := newTestClient(fake, options)
+	defer stop()
+
+	content := "0123456789abcdefghij"
+	if err := c.Upload("v1/caches/big", "application/gzip", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Unexpected error from Upload: %v", err)
+	}
+	if got := fake.files["/v1/caches/big"]; got != content {
+		t.Errorf("Stored %q, want %q", got, content)
+	}
+	if want := "bytes 0-7/20,bytes 8-15/20,bytes 16-19/20"; strings.Join(fake.ranges, ",") != want {
+		t.Errorf("Sent the parts %v, want %s", fake.ranges, want)
+	}
+}
+
+func TestDownloadFileResumes(t *testing.T) {
+	content := strings.Repeat("cache archive ", 1000)
+	fake := &fakeStore{files: map[string]string{"/v1/caches/main.tar.gz": content}, cut: 1}
+	c, stop := newTestClient(fake, testOptions)
+	defer stop()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "main.tar.gz")
+	if err := c.DownloadFile("v1/caches/main.tar.gz", dest); err != nil {
+		t.Fatalf("Unexpected error from DownloadFile: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != content {
+		t.Errorf("Downloaded %d bytes, want the %d of the file", len(got), len(content))
+	}
+	if want := fmt.Sprintf("bytes=%d-", len(content)/2); len(fake.ranges) != 1 || fake.ranges[0] != want {
+		t.Errorf("Asked for the ranges %v, want %s", fake.ranges, want)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Errorf("The partial download was left behind: %v", err)
+	}
+
+	if err := c.DownloadFile("v1/caches/missing.tar.gz", dest); err != ErrNotFound {
+		t.Errorf("DownloadFile() of a missing file = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	fake := &fakeStore{files: map[string]string{"/v1/caches/main.tar.gz": "archive"}, corrupt: true}
+	c, stop := newTestClient(fake, testOptions)
+	defer stop()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "main.tar.gz")
+	err = c.DownloadFile("v1/caches/main.tar.gz", dest)
+	if _, ok := err.(ErrChecksum); !ok {
+		t.Errorf("DownloadFile() = %v, want a checksum error", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("The corrupted download was kept: %v", err)
+	}
+	var got bytes.Buffer
+	if err := c.Download("v1/caches/main.tar.gz", &got); err == nil {
+		t.Errorf("Download() of a corrupted file succeeded")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	fake := &fakeStore{files: map[string]string{}, fail: 1}
+	c, stop := newTestClient(fake, Options{RetryPolicy: screwdriver.RetryPolicy{MaxAttempts: 1}})
+	defer stop()
+
+	if err := c.Upload("v1/caches/main.tar.gz", "application/gzip", strings.NewReader("archive"), 7); err == nil {
+		t.Errorf("Upload() succeeded, want the 503 of the only attempt")
+	}
+	if err := c.Upload("v1/caches/main.tar.gz", "application/gzip", strings.NewReader("archive"), 7); err != nil {
+		t.Errorf("Unexpected error from Upload: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/artifacts"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+	"github.com/screwdriver-cd/launcher/store"
+)
+
+// buildSummaryFile is the summary of the build written at the root of its workspace once the
+// build status is set, for the tools analyzing the builds
+const buildSummaryFile = "build-summary.json"
+
+// uploadBuildSummary adds the summary to the artifacts of the build
+var uploadBuildSummary = false
+
+var uploadSummary = func(storeURL string, tokens screwdriver.TokenSource, buildID int, data []byte) error {
+	client := store.New(storeURL, tokens, store.Options{RetryPolicy: storeRetryPolicy})
+	return client.Upload(fmt.Sprintf("v1/builds/%d/ARTIFACTS/%s", buildID, buildSummaryFile), "application/json", bytes.NewReader(data), int64(len(data)))
+}
+
+// buildSummary is what build-summary.json tells of a build
+type buildSummary struct {
+	BuildID       int                     `json:"buildId"`
+	JobID         int                     `json:"jobId,omitempty"`
+	PipelineID    int                     `json:"pipelineId,omitempty"`
+	Status        screwdriver.BuildStatus `json:"status"`
+	StatusMessage string                  `json:"statusMessage,omitempty"`
+	StartTime     time.Time               `json:"startTime"`
+	EndTime       time.Time               `json:"endTime"`
+	Steps         []stepSummary           `json:"steps"`
+	// CheckoutSeconds is how long the launcher took to check out the source, 0 when a step did it
+	CheckoutSeconds float64 `json:"checkoutSeconds,omitempty"`
+	// Cache is hit, miss or error when the build restores a cache
+	Cache     string            `json:"cache,omitempty"`
+	Artifacts *artifactsSummary `json:"artifacts,omitempty"`
+}
+
+type stepSummary struct {
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	ExitCode  int       `json:"exitCode"`
+}
+
+// artifactsSummary counts the artifacts uploaded once the steps are done
+type artifactsSummary struct {
+	Uploaded int   `json:"uploaded"`
+	Skipped  int   `json:"skipped"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// buildReport is the summary of the build being run, with where it goes
+var buildReport struct {
+	buildSummary
+	// path is where the summary is written, nowhere before the workspace is created
+	path     string
+	storeURL string
+	tokens   screwdriver.TokenSource
+	// started is when the running step started, the build itself for sd-setup-launcher
+	started time.Time
+	// grouped are when the steps of groups actually ran, by name
+	grouped map[string]stepSummary
+}
+
+// startBuildReport starts the summary of the build
+func startBuildReport(buildID int, storeURL string, tokens screwdriver.TokenSource) {
+	buildReport.buildSummary = buildSummary{BuildID: buildID, StartTime: timeNow(), Steps: []stepSummary{}}
+	buildReport.path = ""
+	buildReport.storeURL = storeURL
+	buildReport.tokens = tokens
+	buildReport.started = buildReport.StartTime
+	buildReport.grouped = map[string]stepSummary{}
+}
+
+// timeGroupedStep records when a step of a group ran, the executor only stops it along with
+// the others of the group
+func timeGroupedStep(cmd screwdriver.CommandDef, start, stop time.Time) {
+	buildReport.grouped[cmd.Name] = stepSummary{Name: cmd.Name, StartTime: start, EndTime: stop}
+}
+
+// reportArtifacts adds the artifacts uploaded to the summary
+func reportArtifacts(result artifacts.Result) {
+	summary := &artifactsSummary{Uploaded: len(result.Uploaded), Skipped: len(result.Skipped)}
+	for _, f := range result.Uploaded {
+		summary.Bytes += f.Size
+	}
+	buildReport.Artifacts = summary
+}
+
+// summaryEmitter records when each step starts and stops, and its exit code
+type summaryEmitter struct {
+	screwdriver.Emitter
+}
+
+func (e summaryEmitter) StartCmd(cmd screwdriver.CommandDef) {
+	buildReport.started = timeNow()
+	e.Emitter.StartCmd(cmd)
+}
+
+func (e summaryEmitter) StopCmd(cmd screwdriver.CommandDef, exitCode int) {
+	step, ok := buildReport.grouped[cmd.Name]
+	if !ok {
+		step = stepSummary{Name: cmd.Name, StartTime: buildReport.started, EndTime: timeNow()}
+	}
+	step.ExitCode = exitCode
+	buildReport.Steps = append(buildReport.Steps, step)
+	e.Emitter.StopCmd(cmd, exitCode)
+}
+
+// writeBuildReport writes the summary of the build once it ended with status, and uploads it
+// when asked to. Its failures are logged, they don't change the status.
+func writeBuildReport(status screwdriver.BuildStatus, statusMessage string) {
+	if buildReport.path == "" {
+		return
+	}
+	buildReport.Status = status
+	buildReport.StatusMessage = statusMessage
+	buildReport.EndTime = timeNow()
+	data, err := marshal(buildReport.buildSummary)
+	if err != nil {
+		log.Printf("WARN: Marshaling the build summary: %v", err)
+		return
+	}
+	if err := writeFile(buildReport.path, data, 0666); err != nil {
+		log.Printf("WARN: Writing the build summary: %v", err)
+	}
+	if uploadBuildSummary {
+		if err := uploadSummary(buildReport.storeURL, buildReport.tokens, buildReport.BuildID, data); err != nil {
+			log.Printf("WARN: Uploading the build summary: %v", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/artifacts"
+	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestBuildSummary(t *testing.T) {
+	oldRun, oldWriteFile, oldUpload, oldUploadArtifacts := executorRun, writeFile, uploadSummary, uploadArtifactsDir
+	defer func() {
+		executorRun, writeFile, uploadSummary, uploadArtifactsDir = oldRun, oldWriteFile, oldUpload, oldUploadArtifacts
+		uploadBuildSummary, uploadArtifacts = false, false
+	}()
+	uploadBuildSummary, uploadArtifacts = true, true
+
+	executorRun = func(path string, env []string, out screwdriver.Emitter, build screwdriver.Build, a screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		for _, step := range []struct {
+			name string
+			code int
+		}{{"install", 0}, {"test", 2}} {
+			out.StartCmd(screwdriver.CommandDef{Name: step.name})
+			out.StopCmd(screwdriver.CommandDef{Name: step.name}, step.code)
+		}
+		return executor.ErrStatus{Status: 2}
+	}
+	uploadArtifactsDir = func(storeURL string, tokens screwdriver.TokenSource, buildID int, dir string, options artifacts.Options) (artifacts.Result, error) {
+		return artifacts.Result{
+			Uploaded: []artifacts.File{{Path: "report.html", Size: 300}, {Path: "app.tgz", Size: 700}},
+			Skipped:  []artifacts.File{{Path: "core", Size: 1 << 30}},
+		}, nil
+	}
+	var written, uploaded []byte
+	var writtenTo string
+	writeFile = func(path string, data []byte, perm os.FileMode) error {
+		if filepath.Base(path) == buildSummaryFile {
+			writtenTo, written = path, data
+		}
+		return nil
+	}
+	uploadSummary = func(storeURL string, tokens screwdriver.TokenSource, buildID int, data []byte) error {
+		uploaded = data
+		return nil
+	}
+
+	api := mockAPI(t, TestBuildID, TestJobID, TestPipelineID, "")
+	api.updateBuildStatus = func(status screwdriver.BuildStatus, meta map[string]interface{}, buildID int, statusMessage string) error {
+		return nil
+	}
+	if err := launchAction(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", ""); err != nil {
+		t.Fatalf("Unexpected error from launch: %v", err)
+	}
+
+	if want := filepath.Join(TestWorkspace, buildSummaryFile); writtenTo != want {
+		t.Errorf("Summary written to %q, want %q", writtenTo, want)
+	}
+	if string(uploaded) != string(written) {
+		t.Errorf("Uploaded %s, want the summary written", uploaded)
+	}
+	var summary buildSummary
+	if err := json.Unmarshal(written, &summary); err != nil {
+		t.Fatalf("Summary %s isn't JSON: %v", written, err)
+	}
+	if summary.BuildID != TestBuildID || summary.JobID != TestJobID || summary.Status != screwdriver.Failure || summary.StatusMessage == "" {
+		t.Errorf("Summary of build %d of job %d is %s %q", summary.BuildID, summary.JobID, summary.Status, summary.StatusMessage)
+	}
+	if summary.CheckoutSeconds <= 0 || summary.EndTime.Before(summary.StartTime) {
+		t.Errorf("Summary checked out in %vs, from %v to %v", summary.CheckoutSeconds, summary.StartTime, summary.EndTime)
+	}
+	var steps []string
+	for _, step := range summary.Steps {
+		steps = append(steps, step.Name+"="+strconv.Itoa(step.ExitCode))
+		if step.EndTime.Before(step.StartTime) {
+			t.Errorf("Step %s ended before it started", step.Name)
+		}
+	}
+	if want := []string{"sd-setup-launcher=0", "install=0", "test=2"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("Steps %q, want %q", steps, want)
+	}
+	if want := (&artifactsSummary{Uploaded: 2, Skipped: 1, Bytes: 1000}); !reflect.DeepEqual(summary.Artifacts, want) {
+		t.Errorf("Artifacts %+v, want %+v", summary.Artifacts, want)
+	}
+}
+
+func TestBuildSummaryGroup(t *testing.T) {
+	oldTimeNow := timeNow
+	defer func() { timeNow = oldTimeNow }()
+	start := time.Date(2020, time.March, 3, 10, 0, 0, 0, time.UTC)
+	now := start
+	timeNow = func() time.Time { return now }
+
+	startBuildReport(TestBuildID, TestStoreURL, nil)
+	emitter := summaryEmitter{&MockEmitter{}}
+	lint := screwdriver.CommandDef{Name: "lint", Group: "check"}
+	test := screwdriver.CommandDef{Name: "test", Group: "check"}
+
+	// The executor stops the steps of the group one after the other once they all ran
+	emitter.StartCmd(lint)
+	timeGroupedStep(lint, start.Add(time.Second), start.Add(3*time.Second))
+	timeGroupedStep(test, start.Add(2*time.Second), start.Add(7*time.Second))
+	now = start.Add(8 * time.Second)
+	emitter.StopCmd(lint, 0)
+	emitter.StartCmd(test)
+	emitter.StopCmd(test, 4)
+
+	want := []stepSummary{
+		{Name: "lint", StartTime: start.Add(time.Second), EndTime: start.Add(3 * time.Second), ExitCode: 0},
+		{Name: "test", StartTime: start.Add(2 * time.Second), EndTime: start.Add(7 * time.Second), ExitCode: 4},
+	}
+	if !reflect.DeepEqual(buildReport.Steps, want) {
+		t.Errorf("Steps %+v, want %+v", buildReport.Steps, want)
+	}
+}
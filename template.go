@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/screwdriver-cd/launcher/executor"
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+// Annotations turning on the interpolation of ${VAR} in the step commands, and failing the
+// build on the variables that aren't set when strict
+const (
+	InterpolateEnvAnnotation  = "screwdriver.cd/interpolateEnv"
+	StrictTemplatesAnnotation = "screwdriver.cd/strictTemplates"
+)
+
+var (
+	// builtinPattern matches ${{ name }}, which is never valid shell
+	builtinPattern = regexp.MustCompile(`\$\{\{\s*([a-z_.]+)\s*\}\}`)
+	// envPattern only matches the plain ${VAR}, ${VAR:-default} and the like are the shell's
+	envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	// templatePattern matches both, so the commands are expanded in one pass and a value is
+	// never expanded again
+	templatePattern = regexp.MustCompile(builtinPattern.String() + "|" + envPattern.String())
+	// assignPattern matches the variables a step sets, like FOO=bar, export FOO, set FOO=bar for
+	// cmd and $env:FOO = 'bar' for PowerShell
+	assignPattern = regexp.MustCompile(`(?m)(?:^|[\s;&|({])(?:([A-Za-z_][A-Za-z0-9_]*)\+?=|export\s+([A-Za-z_][A-Za-z0-9_]*))|\$env:([A-Za-z_][A-Za-z0-9_]*)\s*=`)
+)
+
+// templateOptions tell how the step commands are expanded
+type templateOptions struct {
+	// Env expands ${VAR} with the environment of the build, leaving those not set to the shell
+	Env bool
+	// Strict fails on the ${VAR} neither set in the environment of the build nor by the steps, it
+	// implies Env
+	Strict bool
+	// Shell is the shell of the steps, the values are quoted for it
+	Shell string
+}
+
+// builtinValues are the values of ${{name}} in the step commands
+func builtinValues(build screwdriver.Build, job screwdriver.Job, branch, pr string) map[string]string {
+	short := build.SHA
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	return map[string]string{
+		"build.id":      fmt.Sprint(build.ID),
+		"event.id":      fmt.Sprint(build.EventID),
+		"job.id":        fmt.Sprint(job.ID),
+		"job.name":      job.Name,
+		"pipeline.id":   fmt.Sprint(job.PipelineID),
+		"git.sha":       build.SHA,
+		"git.sha_short": short,
+		"git.branch":    branch,
+		"pr.number":     pr,
+	}
+}
+
+// assignedVariables are the names of the variables cmd may set for itself and the next steps
+func assignedVariables(cmd string) map[string]bool {
+	names := map[string]bool{}
+	for _, groups := range assignPattern.FindAllStringSubmatch(cmd, -1) {
+		names[groups[1]+groups[2]+groups[3]] = true
+	}
+	return names
+}
+
+// expandCommand replaces ${{name}} with the built-in values and, with options.Env, ${VAR} with
+// the variables of env. The step environment comes before the one of the build, and the
+// variables of assigned, which the steps set when they run, are left to the shell. Values are
+// quoted for the shell, so whatever they hold, like a branch named "x;rm -rf ~", each one
+// stays a single word of the command. Between quotes, they are escaped for the quotes instead.
+func expandCommand(cmd screwdriver.CommandDef, env []string, assigned map[string]bool, builtins map[string]string, options templateOptions) (string, error) {
+	expandEnv := options.Env || options.Strict
+	vars := map[string]string{}
+	if expandEnv {
+		for _, e := range env {
+			if split := strings.SplitN(e, "=", 2); len(split) == 2 {
+				vars[split[0]] = split[1]
+			}
+		}
+		for k, v := range cmd.Environment {
+			vars[k] = v
+		}
+		for k := range assigned {
+			delete(vars, k)
+		}
+	}
+
+	var unknown []string
+	undefined := map[string]bool{}
+	var quoteErr error
+	quotes := executor.NewQuoteScanner(options.Shell, cmd.Cmd)
+	var expanded strings.Builder
+	last := 0
+	for _, match := range templatePattern.FindAllStringSubmatchIndex(cmd.Cmd, -1) {
+		expanded.WriteString(cmd.Cmd[last:match[0]])
+		last = match[1]
+		var builtin, name string
+		if match[2] >= 0 {
+			builtin = cmd.Cmd[match[2]:match[3]]
+		} else {
+			name = cmd.Cmd[match[4]:match[5]]
+		}
+		value, ok := builtins[builtin]
+		switch {
+		case builtin != "" && !ok:
+			unknown = append(unknown, builtin)
+		case builtin == "" && !expandEnv:
+			expanded.WriteString(cmd.Cmd[match[0]:match[1]])
+			continue
+		case builtin == "":
+			if value, ok = vars[name]; !ok {
+				if !assigned[name] {
+					undefined[name] = true
+				}
+				expanded.WriteString(cmd.Cmd[match[0]:match[1]])
+				continue
+			}
+		}
+		quoted, err := executor.QuoteIn(options.Shell, value, quotes.At(match[0]))
+		if err != nil && quoteErr == nil {
+			quoteErr = err
+		}
+		expanded.WriteString(quoted)
+	}
+	expanded.WriteString(cmd.Cmd[last:])
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("Step %s uses unknown values %s", cmd.Name, strings.Join(unknown, ", "))
+	}
+	if options.Strict && len(undefined) > 0 {
+		names := make([]string, 0, len(undefined))
+		for name := range undefined {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("Step %s uses variables %s, which neither the build environment nor the steps up to it set", cmd.Name, strings.Join(names, ", "))
+	}
+	if quoteErr != nil {
+		return "", fmt.Errorf("Step %s: %v", cmd.Name, quoteErr)
+	}
+	return expanded.String(), nil
+}
+
+// expandCommands gives the build the expanded commands of its steps
+func expandCommands(build *screwdriver.Build, env []string, builtins map[string]string, options templateOptions) error {
+	commands := make([]screwdriver.CommandDef, len(build.Commands))
+	// A variable set by a step is the one the next steps see, whatever the build environment holds
+	assigned := map[string]bool{}
+	for i, cmd := range build.Commands {
+		for name := range assignedVariables(cmd.Cmd) {
+			assigned[name] = true
+		}
+		expanded, err := expandCommand(cmd, env, assigned, builtins, options)
+		if err != nil {
+			return err
+		}
+		cmd.Cmd = expanded
+		commands[i] = cmd
+	}
+	build.Commands = commands
+	return nil
+}
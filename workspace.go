@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cleanWorkspace is when the workspace gets wiped: "pre" before the build, "post" after it,
+// "both" or "" for never
+var cleanWorkspace = ""
+
+// workspaceQuota is the most bytes the workspace can hold during the build, 0 for no limit
+var workspaceQuota int64
+
+// How often the size of the workspace is checked against the quota
+var quotaPollInterval = 30 * time.Second
+
+var workspaceUsage = dirSize
+
+// validCleanWorkspace tells whether a --clean-workspace value is known
+func validCleanWorkspace(when string) bool {
+	switch when {
+	case "", "pre", "post", "both":
+		return true
+	}
+	return false
+}
+
+// wipeWorkspace removes everything in the workspace root but keeps the root itself,
+// which is often a volume mounted by the executor
+func wipeWorkspace(rootDir string) error {
+	entries, err := ioutil.ReadDir(rootDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Cleaning workspace %q: %v", rootDir, err)
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(rootDir, e.Name())); err != nil {
+			return fmt.Errorf("Cleaning workspace %q: %v", rootDir, err)
+		}
+	}
+	return nil
+}
+
+// dirSize is the size of the files under dir. Files removed during the walk are skipped.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// ErrQuotaExceeded means the workspace grew past its quota during the build
+type ErrQuotaExceeded struct {
+	Usage int64
+	Quota int64
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("Workspace uses %d bytes, over its quota of %d bytes", e.Usage, e.Quota)
+}
+
+// watchWorkspaceQuota aborts the build as soon as the workspace grows over quota bytes.
+// Calling the returned function stops watching and tells whether the quota was exceeded.
+func watchWorkspaceQuota(rootDir string, quota int64) func() error {
+	done := make(chan struct{})
+	exceeded := make(chan error, 1)
+	ticker := time.NewTicker(quotaPollInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				usage, err := workspaceUsage(rootDir)
+				if err != nil {
+					log.Printf("WARN: Unable to measure the workspace: %v", err)
+					continue
+				}
+				if usage > quota {
+					err := ErrQuotaExceeded{Usage: usage, Quota: quota}
+					log.Printf("ERROR: %v, aborting the build", err)
+					exceeded <- err
+					executorAbort(err.Error())
+					return
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		close(done)
+		select {
+		case err := <-exceeded:
+			return err
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/screwdriver-cd/launcher/screwdriver"
+)
+
+func TestWipeWorkspace(t *testing.T) {
+	root, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "src", "github.com", "org", "repo"), 0777)
+	ioutil.WriteFile(filepath.Join(root, "src", "github.com", "org", "repo", "main.go"), []byte("package main"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "stale.log"), []byte("old build"), 0644)
+
+	if err := wipeWorkspace(root); err != nil {
+		t.Fatalf("Unexpected error cleaning the workspace: %v", err)
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatalf("The workspace root should be kept: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Workspace still has %d entries", len(entries))
+	}
+
+	if err := wipeWorkspace(filepath.Join(root, "missing")); err != nil {
+		t.Errorf("Cleaning a missing workspace should do nothing, got %v", err)
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "workspace")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0777)
+	ioutil.WriteFile(filepath.Join(root, "a", "one"), make([]byte, 100), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a", "b", "two"), make([]byte, 23), 0644)
+
+	if size, err := dirSize(root); err != nil || size != 123 {
+		t.Errorf("dirSize() = %d, %v, want 123", size, err)
+	}
+}
+
+func TestValidCleanWorkspace(t *testing.T) {
+	for _, when := range []string{"", "pre", "post", "both"} {
+		if !validCleanWorkspace(when) {
+			t.Errorf("%q should be a valid clean-workspace", when)
+		}
+	}
+	if validCleanWorkspace("always") {
+		t.Errorf("always should not be a valid clean-workspace")
+	}
+}
+
+func TestLaunchWorkspaceQuota(t *testing.T) {
+	oldExecutorRun, oldAbort, oldUsage, oldInterval := executorRun, executorAbort, workspaceUsage, quotaPollInterval
+	defer func() {
+		executorRun, executorAbort, workspaceUsage, quotaPollInterval = oldExecutorRun, oldAbort, oldUsage, oldInterval
+		workspaceQuota = 0
+	}()
+
+	workspaceQuota = 1000
+	quotaPollInterval = time.Millisecond
+	workspaceUsage = func(dir string) (int64, error) {
+		if dir != TestWorkspace {
+			t.Errorf("Measured %q, want the workspace %q", dir, TestWorkspace)
+		}
+		return 4096, nil
+	}
+	aborted := make(chan string, 1)
+	executorAbort = func(reason string) { aborted <- reason }
+	executorRun = func(p string, env []string, emitter screwdriver.Emitter, build screwdriver.Build, api screwdriver.API, buildID int, shellBin string, timeout int, envFilepath, sourceDir string) error {
+		select {
+		case <-aborted:
+			return nil
+		case <-time.After(5 * time.Second):
+			t.Errorf("The build was not aborted")
+			return nil
+		}
+	}
+
+	api := mockAPI(t, TestBuildID, TestJobID, 0, "RUNNING")
+	err := launch(screwdriver.API(api), TestBuildID, TestWorkspace, TestEmitter, TestMetaSpace, TestStoreURL, TestUiURL, TestShellBin, TestBuildTimeout, TestBuildToken, "", "", "", "")
+	want := ErrQuotaExceeded{Usage: 4096, Quota: 1000}
+	if err != want {
+		t.Errorf("launch() error = %v, want %v", err, want)
+	}
+}